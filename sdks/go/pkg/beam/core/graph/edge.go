@@ -323,6 +323,12 @@ func newDoFnNode(op Opcode, g *Graph, s *Scope, u *DoFn, in []*Node, typedefs ma
 // by a runner and should set this scope's URN and Payload accordingly.
 const CombinePerKeyScope = "CombinePerKey"
 
+// ReshuffleScope is the Go SDK canonical name for the reshuffle composite
+// scope. Like CombinePerKeyScope, it permits the translation layer to attach
+// the reshuffle URN to the scope, with a GroupByKey-based default
+// representation beneath.
+const ReshuffleScope = "Reshuffle"
+
 // NewCombine inserts a new Combine edge into the graph. Combines cannot have side
 // input.
 func NewCombine(g *Graph, s *Scope, u *CombineFn, in *Node, ac *coder.Coder) (*MultiEdge, error) {
@@ -316,6 +316,9 @@ func (b *CoderMarshaller) Add(c *coder.Coder) string {
 	case coder.Custom:
 		ref, err := encodeCustomCoder(c.Custom)
 		if err != nil {
+			if nc, ok := err.(*noCoderError); ok {
+				panic(nc)
+			}
 			panic(fmt.Sprintf("failed to encode custom coder: %v", err))
 		}
 		data, err := protox.EncodeBase64(ref)
@@ -0,0 +1,47 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphx
+
+import (
+	"fmt"
+
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+var pipelineMutators []func(*pb.Pipeline) error
+
+// RegisterPipelineMutator registers a function that may rewrite the model
+// pipeline after it is marshalled and before the runner translates it into a
+// job, such as to inject monitoring transforms or swap coders. Mutators run
+// in registration order. A mutator error aborts the submission. Register the
+// mutator during init().
+func RegisterPipelineMutator(mutator func(*pb.Pipeline) error) {
+	if mutator == nil {
+		panic("nil pipeline mutator")
+	}
+	pipelineMutators = append(pipelineMutators, mutator)
+}
+
+// MutatePipeline runs the registered pipeline mutators on the model pipeline
+// in registration order and stops at the first error.
+func MutatePipeline(p *pb.Pipeline) error {
+	for i, mutator := range pipelineMutators {
+		if err := mutator(p); err != nil {
+			return fmt.Errorf("pipeline mutator %v failed: %v", i, err)
+		}
+	}
+	return nil
+}
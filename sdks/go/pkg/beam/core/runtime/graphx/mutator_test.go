@@ -0,0 +1,90 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphx_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+// mutations records the calls of the test mutators, which only act on
+// pipelines whose first root transform ID names the test case, so that they
+// are harmless to other tests.
+var mutations []string
+
+func init() {
+	graphx.RegisterPipelineMutator(func(p *pb.Pipeline) error {
+		if len(p.GetRootTransformIds()) > 0 && p.RootTransformIds[0] == "noop" {
+			mutations = append(mutations, "noop")
+		}
+		return nil
+	})
+	graphx.RegisterPipelineMutator(func(p *pb.Pipeline) error {
+		if len(p.GetRootTransformIds()) == 0 {
+			return nil
+		}
+		switch p.RootTransformIds[0] {
+		case "mutate":
+			mutations = append(mutations, "mutate")
+			p.RootTransformIds = append(p.RootTransformIds, "mutated")
+		case "fail":
+			return errors.New("rejected")
+		}
+		return nil
+	})
+	graphx.RegisterPipelineMutator(func(p *pb.Pipeline) error {
+		if len(p.GetRootTransformIds()) > 0 && p.RootTransformIds[0] != "noop" {
+			mutations = append(mutations, "last")
+		}
+		return nil
+	})
+}
+
+func TestMutatePipeline(t *testing.T) {
+	tests := []struct {
+		req       string
+		want      []string
+		mutations []string
+		err       string
+	}{
+		{"noop", []string{"noop"}, []string{"noop"}, ""},
+		{"mutate", []string{"mutate", "mutated"}, []string{"mutate", "last"}, ""},
+		{"fail", []string{"fail"}, nil, "pipeline mutator 1 failed: rejected"},
+	}
+	for _, test := range tests {
+		mutations = nil
+		p := &pb.Pipeline{RootTransformIds: []string{test.req}}
+		err := graphx.MutatePipeline(p)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("MutatePipeline(%v) = %v, want error %q", test.req, err, test.err)
+			}
+		} else if err != nil {
+			t.Errorf("MutatePipeline(%v) failed: %v", test.req, err)
+		}
+		if !reflect.DeepEqual(p.RootTransformIds, test.want) {
+			t.Errorf("MutatePipeline(%v) root transforms = %v, want %v", test.req, p.RootTransformIds, test.want)
+		}
+		if !reflect.DeepEqual(mutations, test.mutations) {
+			t.Errorf("MutatePipeline(%v) ran %v, want %v", test.req, mutations, test.mutations)
+		}
+	}
+}
@@ -122,7 +122,7 @@ func DecodeMultiEdge(edge *v1.MultiEdge) (graph.Opcode, *graph.Fn, *window.Fn, [
 func encodeCustomCoder(c *coder.CustomCoder) (*v1.CustomCoder, error) {
 	t, err := encodeType(c.Type)
 	if err != nil {
-		return nil, fmt.Errorf("bad underlying type: %v", err)
+		return nil, &noCoderError{t: c.Type, err: err}
 	}
 	enc, err := EncodeUserFn(c.Enc)
 	if err != nil {
@@ -142,6 +142,30 @@ func encodeCustomCoder(c *coder.CustomCoder) (*v1.CustomCoder, error) {
 	return ret, nil
 }
 
+// noCoderError reports a custom coder whose underlying user type can't be
+// serialized, which means the worker has no way to reconstruct the coder.
+type noCoderError struct {
+	t   reflect.Type
+	err error
+}
+
+func (e *noCoderError) Error() string {
+	return fmt.Sprintf("no coder registered for type %v; register one with beam.RegisterType or use a JSON-encodable type: %v", qualifiedTypeName(e.t), e.err)
+}
+
+// qualifiedTypeName returns the name of the type qualified by its full
+// package path, such as "github.com/foo/bar.Baz", to disambiguate it.
+func qualifiedTypeName(t reflect.Type) string {
+	switch {
+	case t.Kind() == reflect.Ptr:
+		return "*" + qualifiedTypeName(t.Elem())
+	case t.Name() != "" && t.PkgPath() != "":
+		return t.PkgPath() + "." + t.Name()
+	default:
+		return t.String()
+	}
+}
+
 func decodeCustomCoder(c *v1.CustomCoder) (*coder.CustomCoder, error) {
 	t, err := decodeType(c.Type)
 	if err != nil {
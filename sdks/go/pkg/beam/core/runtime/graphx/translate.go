@@ -17,12 +17,16 @@ package graphx
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/coder"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/window"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx/v1"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/pipelinex"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/util/protox"
 	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
 	"github.com/golang/protobuf/proto"
@@ -38,6 +42,7 @@ const (
 	URNGBK           = "beam:transform:group_by_key:v1"
 	URNCombinePerKey = "beam:transform:combine_per_key:v1"
 	URNWindow        = "beam:transform:window:v1"
+	URNReshuffle     = "beam:transform:reshuffle:v1"
 
 	// URNIterableSideInput = "beam:side_input:iterable:v1"
 	URNMultimapSideInput = "beam:side_input:multimap:v1"
@@ -64,13 +69,164 @@ const (
 type Options struct {
 	// ContainerImageURL is the default environment container image.
 	ContainerImageURL string
+	// ImageRepositoryPrefix, if set, replaces the registry and repository
+	// path of the container image, such as "gcr.io/cloud-dataflow" in
+	// "gcr.io/cloud-dataflow/beam-go:latest". It is intended for mirror
+	// registries.
+	ImageRepositoryPrefix string
+
+	// CoderOverrides optionally replaces the coder of specific PCollections,
+	// keyed by their model pipeline id (such as "n3"). Each override must be
+	// of the underlying element type. Advanced use only.
+	CoderOverrides map[string]*coder.Coder
+
+	// Capabilities are additional capability URNs of the default environment,
+	// merged with DefaultCapabilities. A URN with a leading "-" removes a
+	// default capability instead. Advanced use only, such as for testing
+	// backend support of specific protocol features.
+	Capabilities []string
+
+	// DefaultEnvironmentID is the id of the Go SDK environment of the model
+	// pipeline. If empty, DefaultEnvironmentID is used. It must not collide
+	// with the generated ids of other components. See EnvironmentID.
+	DefaultEnvironmentID string
+
+	// MaxScopeDepth is the maximum nesting depth of composite transforms.
+	// Deeper or cyclic scopes fail to marshal. If zero,
+	// DefaultMaxScopeDepth is used.
+	MaxScopeDepth int
+}
+
+// DefaultEnvironmentID is the default id of the Go SDK environment.
+const DefaultEnvironmentID = "go"
+
+var (
+	// envIDRe matches valid environment ids.
+	envIDRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.:-]*$`)
+	// generatedIDRe matches the ids that Marshal generates for scopes,
+	// transforms, PCollections, coders and windowing strategies, such as
+	// "e3" or "n2_inject0".
+	generatedIDRe = regexp.MustCompile(`^[secnw][0-9]+(_|$)`)
+)
+
+// EnvironmentID returns the id of the Go SDK environment. It fails if the
+// configured id is invalid or may collide with a generated id.
+//
+// External transforms carry no environments in the model pipeline, so the
+// Go SDK environment is the only environment that Marshal adds. Runners that
+// add cross-language environments must use distinct ids.
+func EnvironmentID(opt *Options) (string, error) {
+	id := opt.DefaultEnvironmentID
+	if id == "" {
+		return DefaultEnvironmentID, nil
+	}
+	if !envIDRe.MatchString(id) {
+		return "", fmt.Errorf("invalid environment id %q: must start with a letter and contain only letters, digits, '_', '.', ':' or '-'", id)
+	}
+	if generatedIDRe.MatchString(id) {
+		return "", fmt.Errorf("invalid environment id %q: collides with generated component ids, such as e1 or n1", id)
+	}
+	return id, nil
+}
+
+// DefaultCapabilities are the capability URNs that the Go SDK declares for
+// its environment.
+var DefaultCapabilities = []string{
+	urnBytesCoder,
+	urnVarIntCoder,
+	urnLengthPrefixCoder,
+	urnKVCoder,
+	urnIterableCoder,
+	urnWindowedValueCoder,
+	urnGlobalWindow,
+	urnIntervalWindow,
+	URNMultimapSideInput,
+}
+
+// capabilityRe matches plausible URNs, such as "beam:coder:bytes:v1".
+var capabilityRe = regexp.MustCompile(`^[a-z][a-z0-9_.-]*(:[a-zA-Z0-9_.-]+)+$`)
+
+// Capabilities returns the capability URNs of the default environment: the
+// defaults merged with the options, in order and without duplicates. It
+// fails if an option is not a plausible URN.
+//
+// The model environment has no capabilities field, so runners must declare
+// them separately, such as in the Dataflow job spec.
+func Capabilities(opt *Options) ([]string, error) {
+	removed := make(map[string]bool)
+	var added []string
+	for _, c := range opt.Capabilities {
+		urn := strings.TrimPrefix(c, "-")
+		if !capabilityRe.MatchString(urn) {
+			return nil, fmt.Errorf("invalid capability %q: not a URN, such as beam:coder:bytes:v1", c)
+		}
+		if urn != c {
+			removed[urn] = true
+		} else {
+			added = append(added, urn)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var ret []string
+	for _, urn := range append(append([]string(nil), DefaultCapabilities...), added...) {
+		if removed[urn] || seen[urn] {
+			continue
+		}
+		seen[urn] = true
+		ret = append(ret, urn)
+	}
+	return ret, nil
 }
 
 // Marshal converts a graph to a model pipeline.
-func Marshal(edges []*graph.MultiEdge, opt *Options) (*pb.Pipeline, error) {
-	tree := NewScopeTree(edges)
+func Marshal(edges []*graph.MultiEdge, opt *Options) (ret *pb.Pipeline, err error) {
+	defer func() {
+		// Surface missing coders as errors, because they are a user mistake
+		// rather than an internal inconsistency.
+		if p := recover(); p != nil {
+			nc, ok := p.(*noCoderError)
+			if !ok {
+				panic(p)
+			}
+			ret, err = nil, nc
+		}
+	}()
+
+	if err := validateCoderOverrides(edges, opt.CoderOverrides); err != nil {
+		return nil, err
+	}
+	if _, err := Capabilities(opt); err != nil {
+		return nil, err
+	}
+	envID, err := EnvironmentID(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.ImageRepositoryPrefix != "" {
+		image, err := rewriteImage(opt.ContainerImageURL, opt.ImageRepositoryPrefix)
+		if err != nil {
+			return nil, err
+		}
+		rewritten := *opt
+		rewritten.ContainerImageURL = image
+		opt = &rewritten
+	}
 
-	m := newMarshaller(opt)
+	maxDepth := opt.MaxScopeDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxScopeDepth
+	}
+	if maxDepth < 0 {
+		return nil, fmt.Errorf("invalid max scope depth: %v", maxDepth)
+	}
+	tree, err := buildScopeTree(edges, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newMarshaller(opt, envID)
 	for _, edge := range tree.Edges {
 		m.addMultiEdge(edge)
 	}
@@ -84,8 +240,68 @@ func Marshal(edges []*graph.MultiEdge, opt *Options) (*pb.Pipeline, error) {
 	return pipelinex.Normalize(p)
 }
 
+// imageRe matches well-formed container image references of the form
+// host[:port]/path[:tag|@digest].
+var imageRe = regexp.MustCompile(`^[a-zA-Z0-9]+([.-][a-zA-Z0-9]+)*(:[0-9]+)?(/[a-z0-9]+([._-][a-z0-9]+)*)+(:[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}|@sha256:[a-f0-9]{64})?$`)
+
+// rewriteImage replaces everything before the image name, i.e., the registry
+// and repository path, with the prefix. For example, rewriting
+// "gcr.io/cloud-dataflow/beam-go:latest" with prefix "mirror.internal/beam"
+// yields "mirror.internal/beam/beam-go:latest".
+func rewriteImage(image, prefix string) (string, error) {
+	name := image[strings.LastIndex(image, "/")+1:]
+	if name == "" {
+		return "", fmt.Errorf("invalid container image %q", image)
+	}
+	ret := strings.TrimSuffix(prefix, "/") + "/" + name
+	if !imageRe.MatchString(ret) {
+		return "", fmt.Errorf("invalid container image %q after rewriting %q with repository prefix %q", ret, image, prefix)
+	}
+	return ret, nil
+}
+
+// validateCoderOverrides checks that each override names a PCollection in
+// the graph and that its coder is compatible with the element type.
+func validateCoderOverrides(edges []*graph.MultiEdge, overrides map[string]*coder.Coder) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	nodes := make(map[string]*graph.Node)
+	for _, edge := range edges {
+		for _, in := range edge.Input {
+			nodes[nodeID(in.From)] = in.From
+		}
+		for _, out := range edge.Output {
+			nodes[nodeID(out.To)] = out.To
+		}
+	}
+
+	var ids []string
+	for id := range overrides {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		c := overrides[id]
+		n, ok := nodes[id]
+		if !ok {
+			return fmt.Errorf("coder override for unknown PCollection %v", id)
+		}
+		if c == nil {
+			return fmt.Errorf("coder override for PCollection %v is nil", id)
+		}
+		if !typex.IsEqual(n.Type(), c.T) {
+			return fmt.Errorf("coder override %v for PCollection %v has type %v, incompatible with element type %v", c, id, c.T, n.Type())
+		}
+	}
+	return nil
+}
+
 type marshaller struct {
-	opt *Options
+	opt   *Options
+	envID string
 
 	transforms   map[string]*pb.PTransform
 	pcollections map[string]*pb.PCollection
@@ -97,9 +313,10 @@ type marshaller struct {
 	windowing2id map[string]string
 }
 
-func newMarshaller(opt *Options) *marshaller {
+func newMarshaller(opt *Options, envID string) *marshaller {
 	return &marshaller{
 		opt:          opt,
+		envID:        envID,
 		transforms:   make(map[string]*pb.PTransform),
 		pcollections: make(map[string]*pb.PCollection),
 		windowing:    make(map[string]*pb.WindowingStrategy),
@@ -139,6 +356,7 @@ func (m *marshaller) addScopeTree(s *ScopeTree) string {
 	}
 
 	m.updateIfCombineComposite(s, transform)
+	m.updateIfReshuffleComposite(s, transform)
 
 	m.transforms[id] = transform
 	return id
@@ -175,6 +393,17 @@ func (m *marshaller) updateIfCombineComposite(s *ScopeTree, transform *pb.PTrans
 	transform.Spec = &pb.FunctionSpec{Urn: URNCombinePerKey, Payload: protox.MustEncode(payload)}
 }
 
+// updateIfReshuffleComposite examines the scope tree and sets the PTransform
+// Spec to be a Reshuffle, if it's a reshuffle composite. Runners that don't
+// understand the URN use the GroupByKey-based expansion, which is a fusion
+// break nonetheless.
+func (m *marshaller) updateIfReshuffleComposite(s *ScopeTree, transform *pb.PTransform) {
+	if s.Scope.Name != graph.ReshuffleScope || len(s.Edges) == 0 {
+		return
+	}
+	transform.Spec = &pb.FunctionSpec{Urn: URNReshuffle}
+}
+
 // If the accumulator type is unencodable (eg. contains raw interface{})
 // Try encoding the AccumCoder. If the marshaller doesn't panic, it's
 // encodable.
@@ -230,7 +459,7 @@ func (m *marshaller) addMultiEdge(edge NamedEdge) string {
 				// "", even if the input is already KV.
 
 				out := fmt.Sprintf("%v_keyed%v_%v", nodeID(in.From), edgeID(edge.Edge), i)
-				m.makeNode(out, m.coders.Add(makeBytesKeyedCoder(in.From.Coder)), in.From)
+				m.makeNode(out, m.coders.Add(makeBytesKeyedCoder(m.nodeCoder(in.From))), in.From)
 
 				payload := &pb.ParDoPayload{
 					DoFn: &pb.SdkFunctionSpec{
@@ -463,7 +692,15 @@ func (m *marshaller) addNode(n *graph.Node) string {
 		return id
 	}
 	// TODO(herohde) 11/15/2017: expose UniqueName to user.
-	return m.makeNode(id, m.coders.Add(n.Coder), n)
+	return m.makeNode(id, m.coders.Add(m.nodeCoder(n)), n)
+}
+
+// nodeCoder returns the coder for the given node, honoring any override.
+func (m *marshaller) nodeCoder(n *graph.Node) *coder.Coder {
+	if c, ok := m.opt.CoderOverrides[nodeID(n)]; ok {
+		return c
+	}
+	return n.Coder
 }
 
 func (m *marshaller) makeNode(id, cid string, n *graph.Node) string {
@@ -486,11 +723,10 @@ func boolToBounded(bounded bool) pb.IsBounded_Enum {
 }
 
 func (m *marshaller) addDefaultEnv() string {
-	const id = "go"
-	if _, exists := m.environments[id]; !exists {
-		m.environments[id] = &pb.Environment{Url: m.opt.ContainerImageURL}
+	if _, exists := m.environments[m.envID]; !exists {
+		m.environments[m.envID] = &pb.Environment{Url: m.opt.ContainerImageURL}
 	}
-	return id
+	return m.envID
 }
 
 func (m *marshaller) addWindowingStrategy(w *window.WindowingStrategy) string {
@@ -16,6 +16,9 @@
 package graphx_test
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
@@ -25,6 +28,7 @@ import (
 	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/util/reflectx"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
 	"github.com/golang/protobuf/proto"
 )
 
@@ -41,6 +45,10 @@ func pickFn(a int, small, big func(int)) {
 }
 
 func pick(t *testing.T, g *graph.Graph) *graph.MultiEdge {
+	return pickIn(t, g, g.Root())
+}
+
+func pickIn(t *testing.T, g *graph.Graph, s *graph.Scope) *graph.MultiEdge {
 	dofn, err := graph.NewDoFn(pickFn)
 	if err != nil {
 		t.Fatal(err)
@@ -49,7 +57,7 @@ func pick(t *testing.T, g *graph.Graph) *graph.MultiEdge {
 	in := g.NewNode(intT(), window.DefaultWindowingStrategy(), true)
 	in.Coder = intCoder()
 
-	e, err := graph.NewParDo(g, g.Root(), dofn, []*graph.Node{in}, nil)
+	e, err := graph.NewParDo(g, s, dofn, []*graph.Node{in}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -88,3 +96,271 @@ func TestParDo(t *testing.T) {
 		t.Errorf("bad ParDo translation: %v", proto.MarshalTextString(p))
 	}
 }
+
+// TestCoderOverrides verifies that coder overrides replace the coder of the
+// named PCollection and reject incompatible types.
+func TestCoderOverrides(t *testing.T) {
+	g := graph.New()
+	e := pick(t, g)
+
+	edges, _, err := g.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := fmt.Sprintf("n%v", e.Output[0].To.ID())
+
+	override := custom("override", reflectx.Int)
+	p, err := graphx.Marshal(edges, &graphx.Options{
+		ContainerImageURL: "foo",
+		CoderOverrides:    map[string]*coder.Coder{id: override},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid := p.GetComponents().GetPcollections()[id].GetCoderId()
+	c, err := graphx.NewCoderUnmarshaller(p.GetComponents().GetCoders()).Coder(cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(override) {
+		t.Errorf("coder for %v = %v, want %v", id, c, override)
+	}
+
+	_, err = graphx.Marshal(edges, &graphx.Options{
+		ContainerImageURL: "foo",
+		CoderOverrides:    map[string]*coder.Coder{id: custom("bad", reflectx.String)},
+	})
+	if err == nil || !strings.Contains(err.Error(), "string") {
+		t.Errorf("Marshal with incompatible override = %v, want type error", err)
+	}
+
+	_, err = graphx.Marshal(edges, &graphx.Options{
+		ContainerImageURL: "foo",
+		CoderOverrides:    map[string]*coder.Coder{"missing": override},
+	})
+	if err == nil {
+		t.Error("Marshal with unknown PCollection override succeeded, want error")
+	}
+}
+
+func TestImageRepositoryPrefix(t *testing.T) {
+	tests := []struct {
+		image, prefix string
+		exp           string
+		wantErr       bool
+	}{
+		{"gcr.io/cloud-dataflow/beam-go:latest", "", "gcr.io/cloud-dataflow/beam-go:latest", false},
+		{"gcr.io/cloud-dataflow/beam-go:latest", "mirror.internal", "mirror.internal/beam-go:latest", false},
+		{"gcr.io/cloud-dataflow/beam-go:latest", "mirror.internal:5000/dataflow/", "mirror.internal:5000/dataflow/beam-go:latest", false},
+		{"beam-go", "mirror.internal/beam", "mirror.internal/beam/beam-go", false},
+		{"gcr.io/cloud-dataflow/beam-go:latest", "https://mirror.internal", "", true},
+		{"gcr.io/cloud-dataflow/beam-go:latest", "mirror internal", "", true},
+		{"gcr.io/cloud-dataflow/", "mirror.internal", "", true},
+	}
+
+	for _, test := range tests {
+		g := graph.New()
+		pick(t, g)
+		edges, _, err := g.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := graphx.Marshal(edges, &graphx.Options{ContainerImageURL: test.image, ImageRepositoryPrefix: test.prefix})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Marshal(%v, %v) succeeded, want error", test.image, test.prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Marshal(%v, %v) failed: %v", test.image, test.prefix, err)
+		}
+		if actual := p.GetComponents().GetEnvironments()["go"].GetUrl(); actual != test.exp {
+			t.Errorf("Marshal(%v, %v) image = %v, want %v", test.image, test.prefix, actual, test.exp)
+		}
+	}
+}
+
+func TestDefaultEnvironmentID(t *testing.T) {
+	tests := []struct {
+		id      string
+		exp     string
+		wantErr bool
+	}{
+		{"", "go", false},
+		{"go-sdk", "go-sdk", false},
+		{"beam:env:go", "beam:env:go", false},
+		{"e1", "", true},
+		{"n2_inject0", "", true},
+		{"1go", "", true},
+		{"go sdk", "", true},
+	}
+
+	for _, test := range tests {
+		g := graph.New()
+		pick(t, g)
+		edges, _, err := g.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := graphx.Marshal(edges, &graphx.Options{ContainerImageURL: "foo", DefaultEnvironmentID: test.id})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Marshal(%q) succeeded, want error", test.id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Marshal(%q) failed: %v", test.id, err)
+		}
+		envs := p.GetComponents().GetEnvironments()
+		if _, ok := envs[test.exp]; !ok || len(envs) != 1 {
+			t.Errorf("Marshal(%q) environments = %v, want only %v", test.id, envs, test.exp)
+		}
+		for id, transform := range p.GetComponents().GetTransforms() {
+			if transform.GetSpec().GetUrn() != graphx.URNParDo {
+				continue
+			}
+			var payload pb.ParDoPayload
+			if err := proto.Unmarshal(transform.GetSpec().GetPayload(), &payload); err != nil {
+				t.Fatalf("invalid ParDo payload of %v: %v", id, err)
+			}
+			if env := payload.GetDoFn().GetEnvironmentId(); env != test.exp {
+				t.Errorf("Marshal(%q) transform %v environment = %v, want %v", test.id, id, env, test.exp)
+			}
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		caps    []string
+		exp     []string
+		wantErr bool
+	}{
+		{nil, graphx.DefaultCapabilities, false},
+		{[]string{"beam:protocol:progress_reporting:v0", "beam:coder:bytes:v1"}, append(append([]string(nil), graphx.DefaultCapabilities...), "beam:protocol:progress_reporting:v0"), false},
+		{[]string{"-beam:coder:bytes:v1"}, graphx.DefaultCapabilities[1:], false},
+		{[]string{"progress_reporting"}, nil, true},
+		{[]string{"beam:protocol: progress"}, nil, true},
+		{[]string{"-"}, nil, true},
+	}
+
+	for _, test := range tests {
+		caps, err := graphx.Capabilities(&graphx.Options{Capabilities: test.caps})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Capabilities(%v) succeeded, want error", test.caps)
+			}
+
+			g := graph.New()
+			pick(t, g)
+			edges, _, err := g.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := graphx.Marshal(edges, &graphx.Options{ContainerImageURL: "foo", Capabilities: test.caps}); err == nil {
+				t.Errorf("Marshal(%v) succeeded, want error", test.caps)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Capabilities(%v) failed: %v", test.caps, err)
+		}
+		if !reflect.DeepEqual(caps, test.exp) {
+			t.Errorf("Capabilities(%v) = %v, want %v", test.caps, caps, test.exp)
+		}
+	}
+}
+
+// unencodable is a valid element type, but its private map field can't be
+// serialized as part of the type of a custom coder.
+type unencodable struct {
+	Name   string
+	counts map[string]int
+}
+
+// TestScopeGuards verifies that cyclic and too deeply nested composite
+// transforms are reported as errors with the transform path, rather than
+// overflowing the stack.
+func TestScopeGuards(t *testing.T) {
+	t.Run("cycle", func(t *testing.T) {
+		g := graph.New()
+		a := g.NewScope(g.Root(), "a")
+		b := g.NewScope(a, "b")
+		pick(t, g)
+		pickIn(t, g, b)
+		edges, _, err := g.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Parent = b
+
+		_, err = graphx.Marshal(edges, &graphx.Options{ContainerImageURL: "foo"})
+		if err == nil || !strings.Contains(err.Error(), "cyclic") || !strings.Contains(err.Error(), "b/a/b") {
+			t.Errorf("Marshal with cyclic scopes = %v, want cycle error at b/a/b", err)
+		}
+	})
+
+	nested := func(t *testing.T, depth int) []*graph.MultiEdge {
+		g := graph.New()
+		s := g.Root()
+		for i := 0; i < depth; i++ {
+			s = g.NewScope(s, fmt.Sprintf("s%v", i))
+		}
+		pickIn(t, g, s)
+		edges, _, err := g.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return edges
+	}
+	t.Run("depth", func(t *testing.T) {
+		if _, err := graphx.Marshal(nested(t, 5), &graphx.Options{ContainerImageURL: "foo", MaxScopeDepth: 5}); err != nil {
+			t.Errorf("Marshal with 5 nested scopes and max depth 5 failed: %v", err)
+		}
+		_, err := graphx.Marshal(nested(t, 6), &graphx.Options{ContainerImageURL: "foo", MaxScopeDepth: 5})
+		if err == nil || !strings.Contains(err.Error(), "s4/s5") {
+			t.Errorf("Marshal with 6 nested scopes and max depth 5 = %v, want depth error at s4/s5", err)
+		}
+		_, err = graphx.Marshal(nested(t, graphx.DefaultMaxScopeDepth+1), &graphx.Options{ContainerImageURL: "foo"})
+		if err == nil || !strings.Contains(err.Error(), "nested more than") {
+			t.Errorf("Marshal with %v nested scopes = %v, want depth error", graphx.DefaultMaxScopeDepth+1, err)
+		}
+	})
+}
+
+// TestMissingCoder verifies that a user type without a serializable coder
+// is reported as an actionable error, rather than a panic.
+func TestMissingCoder(t *testing.T) {
+	ut := reflect.TypeOf(unencodable{})
+
+	g := graph.New()
+	var in []*graph.Node
+	for i := 0; i < 2; i++ {
+		n := g.NewNode(typex.New(ut), window.DefaultWindowingStrategy(), true)
+		n.Coder = custom("unencodable", ut)
+		in = append(in, n)
+	}
+	e, err := graph.NewFlatten(g, g.Root(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Output[0].To.Coder = in[0].Coder
+
+	edges, _, err := g.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = graphx.Marshal(edges, &graphx.Options{ContainerImageURL: "foo"})
+	if err == nil {
+		t.Fatal("Marshal with unencodable type succeeded, want error")
+	}
+	want := "no coder registered for type github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx_test.unencodable"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("Marshal with unencodable type = %v, want %q", err, want)
+	}
+}
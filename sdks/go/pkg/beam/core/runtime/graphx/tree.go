@@ -16,6 +16,9 @@
 package graphx
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
 )
 
@@ -45,46 +48,121 @@ type ScopeTree struct {
 	Children []*ScopeTree
 }
 
-// NewScopeTree computes the ScopeTree for a set of edges.
+// NewScopeTree computes the ScopeTree for a set of edges. Edges in
+// malformed scopes, such as scopes with cyclic parents, are left out.
+// Marshal reports them as errors instead.
 func NewScopeTree(edges []*graph.MultiEdge) *ScopeTree {
-	t := newTreeBuilder()
+	tree, _ := buildScopeTree(edges, 0)
+	return tree
+}
+
+// DefaultMaxScopeDepth is the default maximum nesting depth of composite
+// transforms. See Options.MaxScopeDepth.
+const DefaultMaxScopeDepth = 1000
+
+// buildScopeTree computes the ScopeTree for a set of edges. It fails with
+// the transform path, if the scopes have cyclic parents or are nested more
+// than maxDepth levels deep. If maxDepth is zero, the depth is not limited.
+func buildScopeTree(edges []*graph.MultiEdge, maxDepth int) (*ScopeTree, error) {
+	t := newTreeBuilder(maxDepth)
+	var first error
 	for _, edge := range edges {
-		t.addEdge(edge)
+		if err := t.addEdge(edge); err != nil && first == nil {
+			first = err
+		}
+	}
+	if first == nil && t.root == nil && len(edges) > 0 {
+		first = fmt.Errorf("no root scope")
 	}
-	return t.root
+	return t.root, first
 }
 
 // treeBuilder is a builder of a ScopeTree from any set of edges and
 // scopes from the same graph.
 type treeBuilder struct {
-	root    *ScopeTree
-	id2tree map[int]*ScopeTree
+	root     *ScopeTree
+	id2tree  map[int]*ScopeTree
+	id2depth map[int]int
+	maxDepth int
 }
 
-func newTreeBuilder() *treeBuilder {
+func newTreeBuilder(maxDepth int) *treeBuilder {
 	return &treeBuilder{
-		id2tree: make(map[int]*ScopeTree),
+		id2tree:  make(map[int]*ScopeTree),
+		id2depth: make(map[int]int),
+		maxDepth: maxDepth,
 	}
 }
 
-func (t *treeBuilder) addEdge(edge *graph.MultiEdge) {
-	tree := t.addScope(edge.Scope())
+func (t *treeBuilder) addEdge(edge *graph.MultiEdge) error {
+	tree, err := t.addScope(edge.Scope())
+	if err != nil {
+		return fmt.Errorf("invalid scope of %v: %v", edge.Name(), err)
+	}
 	tree.Edges = append(tree.Edges, NamedEdge{Name: edge.Name(), Edge: edge})
+	return nil
 }
 
-func (t *treeBuilder) addScope(s *graph.Scope) *ScopeTree {
-	if tree, exists := t.id2tree[s.ID()]; exists {
-		return tree
+// addScope adds the scope and its missing ancestors. It walks the parents
+// iteratively, so that pathological nesting cannot overflow the stack.
+func (t *treeBuilder) addScope(s *graph.Scope) (*ScopeTree, error) {
+	// Collect the missing scopes, innermost first, up to the first known
+	// ancestor, if any.
+	var chain []*graph.Scope
+	onChain := make(map[int]bool)
+	var parent *ScopeTree
+	depth := 0
+	for cur := s; cur != nil; cur = cur.Parent {
+		if tree, exists := t.id2tree[cur.ID()]; exists {
+			parent, depth = tree, t.id2depth[cur.ID()]
+			break
+		}
+		if onChain[cur.ID()] {
+			return nil, fmt.Errorf("cyclic composite transforms at %v", scopePath(append(chain, cur)))
+		}
+		onChain[cur.ID()] = true
+		chain = append(chain, cur)
+		if t.maxDepth > 0 && len(chain) > t.maxDepth+1 {
+			break
+		}
+	}
+	innermost := len(chain) - 1
+	if parent != nil {
+		innermost = depth + len(chain)
+	}
+	if t.maxDepth > 0 && innermost > t.maxDepth {
+		return nil, fmt.Errorf("composite transforms nested more than %v levels deep at %v", t.maxDepth, scopePath(chain))
 	}
 
-	tree := &ScopeTree{Scope: NamedScope{Name: s.Label, Scope: s}}
-	t.id2tree[s.ID()] = tree
+	for i := len(chain) - 1; i >= 0; i-- {
+		cur := chain[i]
+		tree := &ScopeTree{Scope: NamedScope{Name: cur.Label, Scope: cur}}
+		t.id2tree[cur.ID()] = tree
+		if parent == nil {
+			t.root = tree
+			t.id2depth[cur.ID()] = 0
+		} else {
+			parent.Children = append(parent.Children, tree)
+			depth++
+			t.id2depth[cur.ID()] = depth
+		}
+		parent = tree
+	}
+	return parent, nil
+}
 
-	if s.Parent == nil {
-		t.root = tree
-	} else {
-		parent := t.addScope(s.Parent)
-		parent.Children = append(parent.Children, tree)
+// maxPathScopes is the number of innermost scopes that scopePath shows.
+const maxPathScopes = 10
+
+// scopePath returns the transform path of the scopes, given innermost
+// first, such as "a/b/c". Long paths are elided.
+func scopePath(chain []*graph.Scope) string {
+	var names []string
+	for i := len(chain) - 1; i >= 0; i-- {
+		names = append(names, chain[i].Label)
 	}
-	return tree
+	if len(names) > maxPathScopes {
+		names = append([]string{"..."}, names[len(names)-maxPathScopes:]...)
+	}
+	return strings.Join(names, "/")
 }
@@ -20,9 +20,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/util/hooks"
 	"github.com/apache/beam/sdks/go/pkg/beam/log"
@@ -80,6 +82,13 @@ func Main(ctx context.Context, loggingEndpoint, controlEndpoint string) error {
 		}
 	}()
 
+	// Bound the number of bundles processed concurrently, if requested.
+	var threads chan struct{}
+	if n := harnessThreads(ctx); n > 0 {
+		log.Infof(ctx, "Processing at most %v bundles concurrently", n)
+		threads = make(chan struct{}, n)
+	}
+
 	ctrl := &control{
 		plans:  make(map[string]*exec.Plan),
 		active: make(map[string]*exec.Plan),
@@ -99,6 +108,9 @@ func Main(ctx context.Context, loggingEndpoint, controlEndpoint string) error {
 
 			if err == io.EOF {
 				recordFooter()
+				if err := closeCapture(); err != nil {
+					log.Warnf(ctx, "Failed to close session recording: %v", err)
+				}
 				return nil
 			}
 			return fmt.Errorf("recv failed: %v", err)
@@ -124,13 +136,44 @@ func Main(ctx context.Context, loggingEndpoint, controlEndpoint string) error {
 		if req.GetProcessBundle() != nil {
 			// Only process bundles in a goroutine. We at least need to process instructions for
 			// each plan serially. Perhaps just invoke plan.Execute async?
-			go fn(ctx, req)
+			req := req
+			goLimited(threads, func() { fn(ctx, req) })
 		} else {
 			fn(ctx, req)
 		}
 	}
 }
 
+// goLimited runs fn in a goroutine that first acquires a slot of threads, if
+// not nil, which bounds the number of concurrent calls.
+func goLimited(threads chan struct{}, fn func()) {
+	if threads == nil {
+		go fn()
+		return
+	}
+	go func() {
+		threads <- struct{}{}
+		defer func() { <-threads }()
+		fn()
+	}()
+}
+
+// harnessThreads returns the maximum number of bundles to process
+// concurrently from the "number_of_worker_harness_threads" pipeline option,
+// or zero if unlimited.
+func harnessThreads(ctx context.Context) int {
+	opt := runtime.GlobalOptions.Get("number_of_worker_harness_threads")
+	if opt == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(opt)
+	if err != nil || n < 0 {
+		log.Warnf(ctx, "Ignoring invalid number_of_worker_harness_threads %q", opt)
+		return 0
+	}
+	return n
+}
+
 type control struct {
 	// plans that are candidates for execution.
 	plans map[string]*exec.Plan // protected by mu
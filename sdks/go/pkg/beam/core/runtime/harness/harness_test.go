@@ -0,0 +1,94 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+)
+
+func TestHarnessThreads(t *testing.T) {
+	defer runtime.GlobalOptions.Set("number_of_worker_harness_threads", "")
+
+	tests := []struct {
+		opt string
+		exp int
+	}{
+		{"", 0},
+		{"4", 4},
+		{"0", 0},
+		{"-1", 0},
+		{"many", 0},
+	}
+	for _, test := range tests {
+		runtime.GlobalOptions.Set("number_of_worker_harness_threads", test.opt)
+		if actual := harnessThreads(context.Background()); actual != test.exp {
+			t.Errorf("harnessThreads(%q) = %v, want %v", test.opt, actual, test.exp)
+		}
+	}
+}
+
+func TestGoLimited(t *testing.T) {
+	const limit, calls = 2, 10
+
+	threads := make(chan struct{}, limit)
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	var running, max int32
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		goLimited(threads, func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	// Fill the slots, then let the remaining calls through one at a time.
+	for i := 0; i < calls; i++ {
+		release <- struct{}{}
+	}
+	wg.Wait()
+	if max > limit {
+		t.Errorf("goLimited ran %v calls concurrently, want at most %v", max, limit)
+	}
+
+	// Without a limit, all calls run concurrently.
+	var started sync.WaitGroup
+	unlimited := make(chan struct{})
+	started.Add(calls)
+	wg.Add(calls)
+	for i := 0; i < calls; i++ {
+		goLimited(nil, func() {
+			defer wg.Done()
+			started.Done()
+			<-unlimited
+		})
+	}
+	started.Wait()
+	close(unlimited)
+	wg.Wait()
+}
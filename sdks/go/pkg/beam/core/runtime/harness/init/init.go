@@ -70,6 +70,10 @@ func hook() {
 		}
 		runtime.GlobalOptions.Import(opt.Options)
 	}
+	if err := setWorkerEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set worker environment: %v", err)
+		os.Exit(1)
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -94,3 +98,22 @@ func hook() {
 		time.Sleep(time.Hour)
 	}
 }
+
+// setWorkerEnv sets any runner-supplied environment variables, which are
+// passed as a JSON-encoded map in the "worker_env" pipeline option.
+func setWorkerEnv() error {
+	env := runtime.GlobalOptions.Get("worker_env")
+	if env == "" {
+		return nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal([]byte(env), &m); err != nil {
+		return fmt.Errorf("invalid worker environment '%v': %v", env, err)
+	}
+	for k, v := range m {
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
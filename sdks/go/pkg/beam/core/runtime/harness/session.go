@@ -56,7 +56,7 @@ func isEnabled(option string) bool {
 }
 
 func recordMessage(opcode session.Kind, pb *session.Entry) error {
-	if !isEnabled("session_recording") {
+	if !isEnabled("session_recording") && !isCapturing() {
 		return nil
 	}
 
@@ -100,6 +100,10 @@ func recordMessage(opcode session.Kind, pb *session.Entry) error {
 	sessionLock.Lock()
 	defer sessionLock.Unlock()
 
+	if capture == nil {
+		return nil
+	}
+
 	if _, err := capture.Write(l.Bytes()); err != nil {
 		return fmt.Errorf("Unable to write entry header length: %v", err)
 	}
@@ -112,6 +116,27 @@ func recordMessage(opcode session.Kind, pb *session.Entry) error {
 	return nil
 }
 
+// isCapturing returns true iff a capture hook is recording the session.
+func isCapturing() bool {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	return capture != nil
+}
+
+// closeCapture closes the capture hook, if any, so that it can flush any
+// buffered data. The session is not recorded afterwards.
+func closeCapture() error {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	if capture == nil {
+		return nil
+	}
+	err := capture.Close()
+	capture = nil
+	return err
+}
+
 func recordInstructionRequest(req *pb.InstructionRequest) error {
 	return recordMessage(session.Kind_INSTRUCTION_REQUEST,
 		&session.Entry{
@@ -104,6 +104,16 @@ func ResolveFunction(name string, t reflect.Type) (interface{}, error) {
 	return val, nil
 }
 
+// IsFunctionRegistered returns true iff the function with the given symbol
+// name has been registered or already resolved.
+func IsFunctionRegistered(name string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, exists := cache[name]
+	return exists
+}
+
 type failResolver bool
 
 func (p failResolver) Sym2Addr(name string) (uintptr, error) {
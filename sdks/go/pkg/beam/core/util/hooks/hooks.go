@@ -161,6 +161,12 @@ func EnableHook(name string, args ...string) error {
 	return nil
 }
 
+// DisableHook disables the hook, so that it is not serialized into the
+// pipeline options and not run when the pipeline executes.
+func DisableHook(name string) {
+	delete(enabledHooks, name)
+}
+
 // IsEnabled returns true and the registered options if the hook is
 // already enabled.
 func IsEnabled(name string) (bool, []string) {
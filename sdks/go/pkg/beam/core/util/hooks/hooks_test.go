@@ -17,9 +17,11 @@ package hooks
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"testing"
 
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
 	fnpb "github.com/apache/beam/sdks/go/pkg/beam/model/fnexecution_v1"
 )
 
@@ -63,3 +65,23 @@ func TestRequestContextPropagation(t *testing.T) {
 		t.Errorf("Got %s, wanted %s", actual, expected)
 	}
 }
+
+func TestDisableHook(t *testing.T) {
+	RegisterHook("disable_test", func([]string) Hook { return Hook{} })
+	if err := EnableHook("disable_test", "arg"); err != nil {
+		t.Fatalf("EnableHook failed: %v", err)
+	}
+	DisableHook("disable_test")
+	if ok, _ := IsEnabled("disable_test"); ok {
+		t.Errorf("IsEnabled(disable_test) = true after DisableHook, want false")
+	}
+
+	SerializeHooksToOptions()
+	var serialized map[string][]string
+	if err := json.Unmarshal([]byte(runtime.GlobalOptions.Get("hooks")), &serialized); err != nil {
+		t.Fatalf("bad serialized hooks: %v", err)
+	}
+	if _, ok := serialized["disable_test"]; ok {
+		t.Errorf("serialized hooks = %v, want no disable_test entry", serialized)
+	}
+}
@@ -0,0 +1,101 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// JSON is a Logger that writes each message as a single-line JSON object
+// with its level, time, message and fields, for ingestion by structured
+// logging backends.
+type JSON struct {
+	// Level is the severity cutoff for log messages. By default all
+	// messages are logged.
+	Level Severity
+	// Writer is the destination of the log lines. If nil, os.Stderr is used.
+	Writer io.Writer
+	// Fields are additional fields included in every log line.
+	Fields map[string]string
+
+	mu sync.Mutex
+}
+
+type jsonEntry struct {
+	Level   string            `json:"level"`
+	Time    string            `json:"time"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Log writes the message as a JSON object on its own line. The caller's
+// file and line are included as the "caller" field.
+func (j *JSON) Log(ctx context.Context, sev Severity, calldepth int, msg string) {
+	if sev < j.Level {
+		return
+	}
+
+	entry := jsonEntry{
+		Level:   severityName(sev),
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Message: msg,
+		Fields:  make(map[string]string, len(j.Fields)+1),
+	}
+	for k, v := range j.Fields {
+		entry.Fields[k] = v
+	}
+	if _, file, line, ok := runtime.Caller(calldepth); ok {
+		entry.Fields["caller"] = fmt.Sprintf("%v:%v", filepath.Base(file), line)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(jsonEntry{Level: entry.Level, Time: entry.Time, Message: msg})
+	}
+
+	w := j.Writer
+	if w == nil {
+		w = os.Stderr
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	w.Write(append(data, '\n'))
+}
+
+func severityName(sev Severity) string {
+	switch sev {
+	case SevDebug:
+		return "DEBUG"
+	case SevInfo:
+		return "INFO"
+	case SevWarn:
+		return "WARN"
+	case SevError:
+		return "ERROR"
+	case SevFatal:
+		return "FATAL"
+	default:
+		return "UNSPECIFIED"
+	}
+}
@@ -0,0 +1,53 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := &JSON{Level: SevInfo, Writer: &buf, Fields: map[string]string{"job": "test"}}
+
+	ctx := context.Background()
+	l.Log(ctx, SevDebug, 1, "dropped")
+	l.Log(ctx, SevWarn, 1, "multi\nline \"message\"")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("logged %q, want a single line", buf.String())
+	}
+
+	var entry jsonEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("invalid JSON log line %q: %v", lines[0], err)
+	}
+	if entry.Level != "WARN" || entry.Message != "multi\nline \"message\"" {
+		t.Errorf("logged %+v, want WARN multi-line message", entry)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry.Time); err != nil {
+		t.Errorf("logged time %q: %v", entry.Time, err)
+	}
+	if entry.Fields["job"] != "test" || !strings.HasPrefix(entry.Fields["caller"], "json_test.go:") {
+		t.Errorf("logged fields %v, want job and caller", entry.Fields)
+	}
+}
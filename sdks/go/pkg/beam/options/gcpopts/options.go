@@ -20,6 +20,7 @@ import (
 	"context"
 	"flag"
 
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
 	"github.com/apache/beam/sdks/go/pkg/beam/log"
 )
 
@@ -36,3 +37,24 @@ func GetProject(ctx context.Context) string {
 	}
 	return *Project
 }
+
+// Well-known temp data categories of IOs, for per-category temp prefixes.
+const (
+	TempBigQuery = "bigquery"
+	TempGCS      = "gcs"
+)
+
+// TempPrefixOption returns the pipeline option key of the temp prefix of the
+// given IO category.
+func TempPrefixOption(category string) string {
+	return "temp_prefix_" + category
+}
+
+// GetTempPrefix returns the temp prefix of the given IO category, if
+// overridden by the runner, or the fallback otherwise. Convenience function.
+func GetTempPrefix(category, fallback string) string {
+	if prefix := runtime.GlobalOptions.Get(TempPrefixOption(category)); prefix != "" {
+		return prefix
+	}
+	return fallback
+}
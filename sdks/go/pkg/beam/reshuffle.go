@@ -0,0 +1,56 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package beam
+
+import (
+	"math/rand"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
+)
+
+func init() {
+	RegisterFunction(addRandomKeyFn)
+	RegisterFunction(dropKeyExplodeFn)
+}
+
+// Reshuffle redistributes the elements of a PCollection<A> randomly across
+// workers and returns a PCollection<A> with the same elements. It prevents
+// fusion of the transforms before and after it, which is useful to break up
+// hot spots caused by fusing a high fan-out step with its producer. For
+// example:
+//
+//	files := beam.ParDo(s, expandFn, patterns)
+//	lines := beam.ParDo(s, readFn, beam.Reshuffle(s, files))
+//
+// Element timestamps are not preserved, since the elements are grouped.
+func Reshuffle(s Scope, col PCollection) PCollection {
+	s = s.Scope(graph.ReshuffleScope)
+
+	keyed := ParDo(s, addRandomKeyFn, col)
+	grouped := GroupByKey(s, keyed)
+	return ParDo(s, dropKeyExplodeFn, grouped)
+}
+
+func addRandomKeyFn(elm T) (int, T) {
+	return rand.Int(), elm
+}
+
+func dropKeyExplodeFn(_ int, values func(*T) bool, emit func(T)) {
+	var elm T
+	for values(&elm) {
+		emit(elm)
+	}
+}
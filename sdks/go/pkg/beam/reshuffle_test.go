@@ -0,0 +1,77 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package beam_test
+
+import (
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+)
+
+func TestReshuffle(t *testing.T) {
+	p, s, in, exp := ptest.CreateList2([]int{1, 2, 3, 4, 5}, []int{1, 2, 3, 4, 5})
+	passert.Equals(s, beam.Reshuffle(s, in), exp)
+
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("Reshuffle failed: %v", err)
+	}
+}
+
+// TestReshuffleMarshal verifies that a reshuffle marshals to a reshuffle
+// composite with a GroupByKey, i.e., a fusion break, beneath.
+func TestReshuffleMarshal(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	beam.Reshuffle(s, beam.Create(s, 1, 2, 3))
+
+	edges, _, err := p.Build()
+	if err != nil {
+		t.Fatalf("failed to build pipeline: %v", err)
+	}
+	model, err := graphx.Marshal(edges, &graphx.Options{ContainerImageURL: "foo"})
+	if err != nil {
+		t.Fatalf("failed to marshal pipeline: %v", err)
+	}
+
+	transforms := model.GetComponents().GetTransforms()
+	var found bool
+	for _, transform := range transforms {
+		if transform.GetSpec().GetUrn() != graphx.URNReshuffle {
+			continue
+		}
+		found = true
+
+		var urns []string
+		for _, id := range transform.GetSubtransforms() {
+			urns = append(urns, transforms[id].GetSpec().GetUrn())
+		}
+		exp := []string{graphx.URNParDo, graphx.URNGBK, graphx.URNParDo}
+		if len(urns) != len(exp) {
+			t.Fatalf("reshuffle subtransforms = %v, want %v", urns, exp)
+		}
+		for i := range exp {
+			if urns[i] != exp[i] {
+				t.Errorf("reshuffle subtransforms = %v, want %v", urns, exp)
+				break
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no reshuffle transform in model: %v", transforms)
+	}
+}
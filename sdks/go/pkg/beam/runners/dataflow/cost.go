@@ -0,0 +1,121 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"fmt"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+// machineShape is the number of vCPUs and GB of memory of a machine type.
+type machineShape struct {
+	vCPUs    float64
+	memoryGB float64
+}
+
+// machineShapes are the shapes of common GCE machine types, for cost
+// estimates. Update as needed.
+var machineShapes = map[string]machineShape{
+	"n1-standard-1":  {1, 3.75},
+	"n1-standard-2":  {2, 7.5},
+	"n1-standard-4":  {4, 15},
+	"n1-standard-8":  {8, 30},
+	"n1-standard-16": {16, 60},
+	"n1-highmem-2":   {2, 13},
+	"n1-highmem-4":   {4, 26},
+	"n1-highmem-8":   {8, 52},
+	"n1-highmem-16":  {16, 104},
+	"n1-highcpu-4":   {4, 3.6},
+	"n1-highcpu-8":   {8, 7.2},
+	"n1-highcpu-16":  {16, 14.4},
+	"n2-standard-2":  {2, 8},
+	"n2-standard-4":  {4, 16},
+	"n2-standard-8":  {8, 32},
+	"n2-standard-16": {16, 64},
+	"e2-standard-2":  {2, 8},
+	"e2-standard-4":  {4, 16},
+	"e2-standard-8":  {8, 32},
+}
+
+// dataflowPrice is the price in USD of Dataflow worker resources per hour.
+type dataflowPrice struct {
+	vCPU     float64
+	memoryGB float64
+	diskGB   float64
+}
+
+// batchPrice and streamingPrice are the us-central1 list prices of Dataflow
+// worker resources. Update as needed.
+var (
+	batchPrice     = dataflowPrice{vCPU: 0.056, memoryGB: 0.003557, diskGB: 0.000054}
+	streamingPrice = dataflowPrice{vCPU: 0.069, memoryGB: 0.003557, diskGB: 0.000054}
+)
+
+const (
+	defaultBatchMachineType     = "n1-standard-1"
+	defaultStreamingMachineType = "n1-standard-4"
+	defaultBatchDiskSizeGb      = 250
+	defaultStreamingDiskSizeGb  = 400
+)
+
+// estimateCost returns a crude estimate of the cost in USD of running the job
+// for the given duration, based on its first worker pool. It returns false
+// if the machine type is unknown.
+func estimateCost(job *df.Job, d time.Duration) (float64, bool) {
+	pool := job.Environment.WorkerPools[0]
+	streaming := job.Type == "JOB_TYPE_STREAMING"
+
+	price, machineType, diskSizeGb := batchPrice, defaultBatchMachineType, int64(defaultBatchDiskSizeGb)
+	if streaming {
+		price, machineType, diskSizeGb = streamingPrice, defaultStreamingMachineType, defaultStreamingDiskSizeGb
+	}
+	if pool.MachineType != "" {
+		machineType = pool.MachineType
+	}
+	if pool.DiskSizeGb > 0 {
+		diskSizeGb = pool.DiskSizeGb
+	}
+	shape, ok := machineShapes[machineType]
+	if !ok {
+		return 0, false
+	}
+
+	workers := pool.NumWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	perWorker := shape.vCPUs*price.vCPU + shape.memoryGB*price.memoryGB + float64(diskSizeGb)*price.diskGB
+	return float64(workers) * perWorker * d.Hours(), true
+}
+
+// costEstimate returns a human-readable, non-binding cost estimate of the job.
+// If the duration is zero, the hourly cost is estimated.
+func costEstimate(job *df.Job, d time.Duration) string {
+	hourly := d <= 0
+	if hourly {
+		d = time.Hour
+	}
+	cost, ok := estimateCost(job, d)
+	if !ok {
+		return fmt.Sprintf("No cost estimate: unknown machine type %q", job.Environment.WorkerPools[0].MachineType)
+	}
+	if hourly {
+		return fmt.Sprintf("NON-BINDING cost estimate: ~$%.2f per hour at list prices, excluding shuffle, Streaming Engine and autoscaling. Use --estimated_duration for a total.", cost)
+	}
+	return fmt.Sprintf("NON-BINDING cost estimate: ~$%.2f for %v at list prices, excluding shuffle, Streaming Engine and autoscaling.", cost, d)
+}
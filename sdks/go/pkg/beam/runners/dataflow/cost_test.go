@@ -0,0 +1,65 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+func newCostJob(jobType, machineType string, workers int64) *df.Job {
+	return &df.Job{
+		Type: jobType,
+		Environment: &df.Environment{
+			WorkerPools: []*df.WorkerPool{{MachineType: machineType, NumWorkers: workers}},
+		},
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	batchWorker := 4*batchPrice.vCPU + 15*batchPrice.memoryGB + 250*batchPrice.diskGB
+
+	tests := []struct {
+		name string
+		job  *df.Job
+		d    time.Duration
+		exp  float64
+		ok   bool
+	}{
+		{"batch", newCostJob("JOB_TYPE_BATCH", "n1-standard-4", 10), 2 * time.Hour, 20 * batchWorker, true},
+		{"default-workers", newCostJob("JOB_TYPE_BATCH", "n1-standard-4", 0), time.Hour, batchWorker, true},
+		{"default-machine", newCostJob("JOB_TYPE_BATCH", "", 1), time.Hour, batchPrice.vCPU + 3.75*batchPrice.memoryGB + 250*batchPrice.diskGB, true},
+		{"unknown-machine", newCostJob("JOB_TYPE_BATCH", "custom-6-20480", 1), time.Hour, 0, false},
+	}
+
+	for _, test := range tests {
+		cost, ok := estimateCost(test.job, test.d)
+		if ok != test.ok || math.Abs(cost-test.exp) > 1e-9 {
+			t.Errorf("estimateCost(%v) = (%v, %v), want (%v, %v)", test.name, cost, ok, test.exp, test.ok)
+		}
+	}
+
+	if msg := costEstimate(newCostJob("JOB_TYPE_BATCH", "custom-6-20480", 1), 0); !strings.Contains(msg, "No cost estimate") {
+		t.Errorf("costEstimate() = %q, want no estimate for unknown machine type", msg)
+	}
+	if msg := costEstimate(newCostJob("JOB_TYPE_BATCH", "n1-standard-4", 1), 0); !strings.Contains(msg, "NON-BINDING") {
+		t.Errorf("costEstimate() = %q, want non-binding estimate", msg)
+	}
+}
@@ -24,14 +24,22 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/pipelinex"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/util/hooks"
 	"github.com/apache/beam/sdks/go/pkg/beam/log"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
 	"github.com/apache/beam/sdks/go/pkg/beam/options/gcpopts"
 	"github.com/apache/beam/sdks/go/pkg/beam/options/jobopts"
 	"github.com/apache/beam/sdks/go/pkg/beam/runners/dataflow/dataflowlib"
@@ -44,80 +52,609 @@ import (
 // TODO(herohde) 5/16/2017: the Dataflow flags should match the other SDKs.
 
 var (
-	endpoint        = flag.String("dataflow_endpoint", "", "Dataflow endpoint (optional).")
+	endpoint        = flag.String("dataflow_endpoint", "", "Dataflow endpoint (optional). May be a Secret Manager reference of the form sm://projects/<project>/secrets/<secret>/versions/<version>, resolved at submission.")
+	regionalJobs    = flag.Bool("use_regional_endpoint", true, "Create and look up the job with the regional projects.locations.jobs methods of --region (optional). Set to false only for endpoints that lack them, to use the global projects.jobs methods with --region as location.")
+	oauthScopes     = flag.String("oauth_scopes", "", "Comma-separated list of OAuth scopes to request in addition to cloud-platform when submitting the job (optional).")
+	correlationID   = flag.String("correlation_id", "", "Correlation ID of the submission, which prefixes each runner log line and is stored as the beam-correlation-id job label and in receipts and notifications (optional). If unset, a random ID is generated.")
+	quotaProject    = flag.String("quota_project", "", "Project to bill Dataflow and GCS API usage and quota to, if different from --project (optional).")
+	apiTimeout      = flag.Duration("dataflow_api_timeout", 0, "Timeout for each Dataflow API call (optional). If unset, calls use the client defaults.")
 	stagingLocation = flag.String("staging_location", "", "GCS staging location (required).")
+	gcloudDefaults  = flag.Bool("use_gcloud_defaults", false, "Default --project to the active gcloud project and --staging_location to the gs://<project>-dataflow-staging bucket, which must exist (optional).")
 	image           = flag.String("worker_harness_container_image", "", "Worker harness container image (required).")
+	imagePrefix     = flag.String("image_repository_prefix", "", "Registry and repository path to replace in the default container image, such as a mirror registry (optional).")
+	verifyImage     = flag.Bool("verify_image", false, "Verify that the container image is accessible in its registry before submission (optional).")
+	verifyStaging   = flag.Bool("verify_staging", false, "Verify the size and checksum of each staged artifact before submission (optional).")
+	recordChecksums = flag.Bool("record_checksums", false, "Read back the CRC32C and MD5 checksums of each staged object and record them in the receipt (optional). Costs a request per object.")
+	checksumsFile   = flag.String("checksums_file", "", "Local file to write the checksums of the staged objects to as JSON (optional). Implies --record_checksums.")
+	checkPerms      = flag.Bool("check_permissions", false, "Check that the credentials may submit jobs in the project and write to the staging bucket before submission, and report all missing permissions (optional). Costs extra API calls.")
+	checkBucket     = flag.Bool("check_bucket_region", false, "Warn if the staging bucket is not located in the job region before submission (optional).")
+	strictBucket    = flag.Bool("strict_bucket_region", false, "Fail instead of warn if --check_bucket_region finds a mismatch (optional).")
 	labels          = flag.String("labels", "", "JSON-formatted map[string]string of job labels (optional).")
+	provenanceFile  = flag.String("provenance_file", "", "JSON provenance document of the build, such as SLSA provenance, whose digest and key fields are attached to the job (optional).")
+	critical        = flag.Bool("critical", false, "Mark the job as critical with the beam-critical=true label and a warning, so that it is not cancelled by mistake (optional). Advisory only: Dataflow does not prevent cancellation.")
+	labelsFromEnvs  = flag.String("labels_from_env", "", "Comma-separated list of labelKey=ENV_VAR mappings of job labels to populate from the environment (optional).")
 	numWorkers      = flag.Int64("num_workers", 0, "Number of workers (optional).")
-	zone            = flag.String("zone", "", "GCP zone (optional)")
+	zone            = flag.String("zone", "", "GCP zone to pin workers to (optional). If unset, workers are placed regionally.")
 	region          = flag.String("region", "us-central1", "GCP Region (optional)")
+	fallbackRegions = flag.String("fallback_regions", "", "Comma-separated list of regions to try, if the region is out of capacity (optional). If the staging location contains {region}, the artifacts are restaged for each fallback region.")
 	network         = flag.String("network", "", "GCP network (optional)")
 	tempLocation    = flag.String("temp_location", "", "Temp location (optional)")
+	tempPrefixes    = flag.String("temp_prefix_overrides", "", "JSON-formatted map[string]string of GCS temp locations per IO category, such as bigquery or gcs, that override the temp location for those IOs (optional).")
+	requireTemp     = flag.Bool("require_temp_location", false, "Require --temp_location instead of defaulting to a location under --staging_location (optional).")
+	cleanupTemp     = flag.Bool("cleanup_temp_on_done", false, "Delete the job's temp data under the temp location once it completes successfully (optional).")
 	machineType     = flag.String("worker_machine_type", "", "GCE machine type (optional)")
+	workerCPUs      = flag.Int("worker_cpus", 0, "Number of CPUs of a custom worker machine type, built together with --worker_memory_mb instead of --worker_machine_type (optional).")
+	workerMemoryMB  = flag.Int64("worker_memory_mb", 0, "Memory in MB of a custom worker machine type, built together with --worker_cpus instead of --worker_machine_type (optional). Memory beyond 6.5 GB per CPU selects an extended memory type.")
 	minCPUPlatform  = flag.String("min_cpu_platform", "", "GCE minimum cpu platform (optional)")
+	threadsPerWork  = flag.Int64("num_threads_per_worker", 0, "Deprecated alias of --number_of_worker_harness_threads (optional).")
+	capabilities    = flag.String("capabilities", "", "Comma-separated list of capability URNs to declare for the SDK environment in addition to the defaults, or to remove from them with a leading '-' (optional). Advanced use only.")
+	environmentID   = flag.String("default_environment_id", graphx.DefaultEnvironmentID, "Id of the Go SDK environment in the model pipeline, distinct from cross-language environments (optional). Advanced use only.")
+	harnessThreads  = flag.Int("number_of_worker_harness_threads", 0, "Maximum number of bundles each worker harness processes concurrently (optional). If unset, bundles are not limited.")
+	diskSizeGb      = flag.Int64("disk_size_gb", 0, "Worker persistent disk size in GB (optional).")
+	diskType        = flag.String("worker_disk_type", "", "Worker persistent disk type (optional).")
+	enablePrime     = flag.Bool("enable_prime", false, "Run the job on Dataflow Prime (optional).")
+	utilizationHint = flag.Float64("worker_utilization_hint", 0, "Target CPU utilization of the workers between 0 and 1, such as 0.8, set as the worker_utilization_hint Dataflow service option (optional). Only honored with throughput-based autoscaling, which streaming jobs use by default. Lower values trade cost for latency.")
 
+	startupScript     = flag.String("worker_startup_script_file", "", "Local file with a GCE startup script to run on each worker VM before the harness starts (optional).")
+	workerContentType = flag.String("worker_object_content_type", dataflowlib.DefaultWorkerContentType, "Content type of the staged worker binary (optional).")
+	filesToStage      = flag.String("files_to_stage", "", "Comma-separated list of local files to stage and download to the workers, which must have unique names (optional).")
+	uploadConcurrency = flag.Int("staging_upload_concurrency", dataflowlib.DefaultStagingUploadConcurrency, "Maximum number of --files_to_stage uploaded simultaneously (optional).")
+	storageClass      = flag.String("staging_storage_class", "", "GCS storage class of the staged objects, such as NEARLINE (optional). If unset, the default storage class of the bucket is used.")
+
+	modelFormat        = flag.String("model_format", "binary", "Format of the staged model pipeline: binary, or text or auto, which uses text for small models, for debugging only (optional). The service reads the model as binary, so jobs of text models fail.")
+	modelTextThreshold = flag.Int("model_text_threshold", dataflowlib.DefaultModelTextThreshold, "Largest model size in bytes staged as text with --model_format=auto (optional).")
+	spoolModel         = flag.Bool("spool_model_to_disk", false, "Write the model pipeline to a local temp file before uploading it, to reduce peak memory use (optional).")
+	spoolModelDir      = flag.String("spool_model_dir", "", "Directory of the model spool file with --spool_model_to_disk (optional). If unset, the system temp directory is used.")
+
+	streaming = flag.Bool("streaming", false, "Run as a streaming job, even if the pipeline is bounded (optional). If unset, the job type is inferred from the pipeline.")
+
+	// Streaming only options
+	streamingEngine = flag.Bool("enable_streaming_engine", false, "Use Streaming Engine for streaming state and shuffle (optional, streaming only).")
+
+	update               = flag.Bool("update", false, "Update the active job with the same --job_name (optional).")
+	transformNameMapping = flag.String("transform_name_mapping", "", "JSON-formatted map[string]string from the transform names of the updated job to the renamed transforms (optional, --update only).")
+
+	experimentsFile           = flag.String("experiments_file", "", "Local file with experiments to merge with --experiments, as a JSON list or one experiment per line (optional).")
+	strictExperiments         = flag.Bool("strict_experiments", false, "Fail if an --experiments value is not a known Dataflow experiment, which the service otherwise ignores silently (optional).")
+	allowedExperimentPrefixes = flag.String("allowed_experiment_prefixes", "", "Comma-separated list of experiment name prefixes that --strict_experiments accepts, such as new experiments (optional).")
+
+	allowDuplicateNames = flag.Bool("allow_duplicate_names", false, "Only warn about duplicate transform names, which break job updates, instead of failing (optional).")
+	checkRegistration   = flag.Bool("check_registration", false, "Fail if a user type of the pipeline is not registered with beam.RegisterType, which workers fail to deserialize (optional). Functions are deliberately not checked, as workers resolve them through the symbol table.")
+
+	logAPIRequests = flag.Bool("log_api_requests", false, "Log the method, URL, status and latency of each Dataflow and GCS API request of the runner, with credentials redacted (optional).")
+	jsonLogs       = flag.Bool("json_logs", false, "Write the runner's launch-side logs to stdout as one JSON object per line, instead of text (optional). Worker logs are unaffected.")
+	printOpts      = flag.Bool("print_options", false, "Print the resolved job options before submission, with sensitive values redacted (optional).")
+	redactPatterns = flag.String("redact_key_patterns", strings.Join(dataflowlib.DefaultRedactPatterns, ","), "Comma-separated, case-insensitive patterns of option, label and field names whose values are redacted in printed and written jobs and options (optional).")
+	describeGraph  = flag.Bool("describe", false, "Print a table of the transforms of the pipeline with their URNs, input and output PCollections and output coders, instead of submitting it (optional). Needs no staging location.")
 	dryRun         = flag.Bool("dry_run", false, "Dry run. Just print the job, but don't submit it.")
+	follow         = flag.Bool("follow", false, "Tail the job messages to stderr after submission until the job terminates, and fail if the job fails (optional). An interrupt cancels the job.")
+	skipUnchanged  = flag.String("skip_if_unchanged", "", "Local path or GCS location of a submission receipt (optional). If set, the job is only submitted if the pipeline, options or worker binary changed since the recorded submission.")
+	stageOnly      = flag.String("stage_only", "", "Local path or GCS location to write a receipt with the staged artifacts and job to, instead of submitting the job (optional). See dataflowlib.ExecuteFromStaged.")
+	gcloudTemplate = flag.String("emit_gcloud_template", "", "GCS location to write a flex template spec of the pipeline to, for gcloud dataflow flex-template run, instead of submitting the job (optional). Requires --gcloud_template_image.")
+	templateImage  = flag.String("gcloud_template_image", "", "Launcher container image of the flex template, which runs the pipeline binary (optional, --emit_gcloud_template only).")
+	dryRunOutput   = flag.String("dry_run_output", "", "Local path or GCS location to also write the dry-run job spec to (optional).")
+	diffAgainstJob = flag.String("diff_against_job", "", "ID of a running job to print the update-relevant changes of the dry-run job against, such as worker pool, options and transform changes (optional, --dry_run only).")
+	estDuration    = flag.Duration("estimated_duration", 0, "Expected job duration for the dry-run cost estimate (optional).")
 	teardownPolicy = flag.String("teardown_policy", "", "Job teardown policy (internal only).")
 
+	notifyWebhook       = flag.String("notify_webhook", "", "URL to POST job submission and terminal state notifications to (optional). May be a Secret Manager reference of the form sm://projects/<project>/secrets/<secret>/versions/<version>, resolved at submission.")
+	notifyWebhookSecret = flag.String("notify_webhook_secret", "", "Shared secret sent with webhook notifications (optional). May be a Secret Manager reference of the form sm://projects/<project>/secrets/<secret>/versions/<version>, resolved at submission.")
+
+	openLineageURL = flag.String("openlineage_url", "", "OpenLineage endpoint to emit a START event to on submission and a COMPLETE, FAIL or ABORT event to once the job is done (optional). May be a Secret Manager reference of the form sm://projects/<project>/secrets/<secret>/versions/<version>, resolved at submission.")
+
+	metricsExport = flag.String("metrics_export", "", "Prometheus Pushgateway URL or local textfile path to export the job metrics to once the job is done (optional).")
+
 	// SDK options
 	cpuProfiling     = flag.String("cpu_profiling", "", "Job records CPU profiles to this GCS location (optional)")
-	sessionRecording = flag.String("session_recording", "", "Job records session transcripts")
+	heapProfiling    = flag.String("heap_profiling", "", "Job records heap profiles to this GCS location (optional)")
+	cloudProfiler    = flag.Bool("enable_cloud_profiler", false, "Job profiles workers continuously with Cloud Profiler, using the job name as service name (optional). Requires the Cloud Profiler API in the project.")
+	sessionRecording = flag.String("session_recording", "", "Job records session transcripts to this GCS location (optional)")
+	sessionGzip      = flag.Bool("session_recording_gzip", false, "Gzip the session transcript chunks written with --session_recording (optional).")
+	sessionTemplate  = flag.String("session_recording_chunk_template", DefaultSessionChunkTemplate, "Printf-style name template of the session transcript chunks written with --session_recording, with a single zero-padded chunk number such as %05d, so that names sort in chunk order (optional).")
+
+	executionTracing         = flag.String("execution_tracing", "", "Job periodically records runtime/trace execution traces to this GCS location (optional). Tracing slows down workers while a trace is recorded.")
+	executionTracingInterval = flag.Duration("execution_tracing_interval", 5*time.Minute, "Interval between execution traces with --execution_tracing (optional).")
+	executionTracingDuration = flag.Duration("execution_tracing_duration", 5*time.Second, "Duration of each execution trace with --execution_tracing (optional).")
+
+	disableProfilingHooks = flag.Bool("disable_profiling_hooks", false, "Exclude all profiling hooks from the job, overriding --cpu_profiling, --heap_profiling and --execution_tracing (optional).")
+
+	workerEnv             stringSlice
+	dataflowServiceOption stringSlice
+	machineTypeByEnv      stringSlice
+	extraPackage          stringSlice
 )
 
 func init() {
+	flag.Var(&workerEnv, "worker_env", "Environment variable KEY=VALUE to set for the worker harness (optional, repeatable).")
+	flag.Var(&machineTypeByEnv, "worker_machine_type_by_env", "ENV=TYPE machine type of the worker pool of the model pipeline environment ENV, such as go, instead of --worker_machine_type (optional). The job has a single worker pool, so only one environment can be overridden.")
+	flag.Var(&extraPackage, "extra_package", "Local file or gs:// object, optionally as NAME=LOCATION, to stage and download to the workers as an extra package (optional, repeatable).")
+	flag.Var(&dataflowServiceOption, "dataflow_service_option", "Dataflow service option, such as enable_google_cloud_profiler (optional, repeatable).")
+
 	// Note that we also _ import harness/init to setup the remote execution hook.
 	beam.RegisterRunner("dataflow", Execute)
 
 	perf.RegisterProfCaptureHook("gcs_profile_writer", gcsRecorderHook)
+	perf.RegisterHeapCaptureHook("gcs_heap_profile_writer", gcsRecorderHook)
+}
+
+var jsonLogsOnce sync.Once
+
+// setupLogging switches the launch-side logging to JSON on stdout, if
+// --json_logs is set. The worker harness installs its own logger.
+func setupLogging() {
+	if *jsonLogs {
+		jsonLogsOnce.Do(func() {
+			log.SetLogger(&log.JSON{Writer: os.Stdout})
+		})
+	}
+}
+
+// workerHarnessThreads returns the maximum number of bundles each worker
+// harness processes concurrently, given --number_of_worker_harness_threads
+// and its deprecated alias --num_threads_per_worker. The Go harness only
+// reads its own option, so the alias is mapped to it.
+func workerHarnessThreads(harness, perWorker int64) (int64, error) {
+	if perWorker == 0 {
+		if harness < 0 {
+			return 0, fmt.Errorf("invalid --number_of_worker_harness_threads %v: must not be negative", harness)
+		}
+		return harness, nil
+	}
+	if harness != 0 && harness != perWorker {
+		return 0, fmt.Errorf("--num_threads_per_worker %v conflicts with --number_of_worker_harness_threads %v. Use only the latter", perWorker, harness)
+	}
+	if perWorker < 0 {
+		return 0, fmt.Errorf("invalid --num_threads_per_worker %v: must not be negative", perWorker)
+	}
+	return perWorker, nil
+}
+
+// maxThreadsPerWorker is the number of threads per worker above which a
+// warning is logged.
+const maxThreadsPerWorker = 300
+
+// maxMetadataValueBytes is the GCE size limit of a single metadata value.
+const maxMetadataValueBytes = 256 << 10
+
+var (
+	// unique and stagingClock make the staged object names unique. Tests
+	// may reset the counter and replace the clock.
+	unique       int32
+	stagingClock clock = realClock{}
+)
+
+// clock provides the current time.
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
 }
 
-var unique int32
+// stagingURLs returns unique GCS locations under the staging location for
+// the model pipeline and worker binary, unless overridden by the object
+// names of the options.
+func stagingURLs(staging string, opts *dataflowlib.JobOptions) (modelURL, workerURL string, err error) {
+	id := atomic.AddInt32(&unique, 1)
+	now := stagingClock.Now().UnixNano()
+	modelURL = gcsx.Join(staging, fmt.Sprintf("model-%v-%v", id, now))
+	workerURL = gcsx.Join(staging, fmt.Sprintf("worker-%v-%v", id, now))
+
+	if name := opts.ModelObjectName; name != "" {
+		if err := dataflowlib.CheckObjectName(name); err != nil {
+			return "", "", fmt.Errorf("invalid model object name: %v", err)
+		}
+		modelURL = gcsx.Join(staging, name)
+	}
+	if name := opts.WorkerObjectName; name != "" {
+		if err := dataflowlib.CheckObjectName(name); err != nil {
+			return "", "", fmt.Errorf("invalid worker object name: %v", err)
+		}
+		workerURL = gcsx.Join(staging, name)
+	}
+	if modelURL == workerURL {
+		return "", "", fmt.Errorf("model and worker binary are both staged to %v", modelURL)
+	}
+	return modelURL, workerURL, nil
+}
 
 // Execute runs the given pipeline on Google Cloud Dataflow. It uses the
 // default application credentials to submit the job.
 func Execute(ctx context.Context, p *beam.Pipeline) error {
+	if *describeGraph {
+		model, err := buildModel(ctx, p, marshalOptions(ctx))
+		if err != nil {
+			return err
+		}
+		return describe(os.Stdout, model)
+	}
+
 	// (1) Gather job options
 
+	opts, err := getJobOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	// (2) Build and submit
+
+	model, err := buildModel(ctx, p, marshalOptions(ctx))
+	if err != nil {
+		return err
+	}
+	_, err = submit(ctx, model, opts, *stagingLocation)
+	return err
+}
+
+// ValidateAll builds, marshals and translates each pipeline concurrently,
+// without submitting any, and returns the errors by pipeline. An error is
+// nil, if the pipeline is valid. The job options are not populated from
+// flags, so that no hooks are enabled. Nothing is staged and no Google Cloud
+// APIs are called, so a batch of pipelines can be checked before launching
+// any.
+func ValidateAll(ctx context.Context, ps []*beam.Pipeline, opts dataflowlib.JobOptions) []error {
+	errs := make([]error, len(ps))
+	gopts := marshalOptions(ctx)
+
+	var wg sync.WaitGroup
+	for i, p := range ps {
+		wg.Add(1)
+		go func(i int, p *beam.Pipeline) {
+			defer wg.Done()
+			errs[i] = validate(ctx, p, &opts, gopts)
+		}(i, p)
+	}
+	wg.Wait()
+	return errs
+}
+
+// validate builds, marshals and translates the pipeline.
+func validate(ctx context.Context, p *beam.Pipeline, opts *dataflowlib.JobOptions, gopts *graphx.Options) error {
+	model, err := buildModel(ctx, p, gopts)
+	if err != nil {
+		return err
+	}
+	fixed, err := dataflowlib.Fixup(model)
+	if err != nil {
+		return fmt.Errorf("invalid model pipeline: %v", err)
+	}
+	if _, err := dataflowlib.Translate(fixed, opts, "gs://validate/worker", "gs://validate/model"); err != nil {
+		return fmt.Errorf("failed to translate pipeline: %v", err)
+	}
+	return nil
+}
+
+// buildModel builds the pipeline and marshals it to a model pipeline.
+func buildModel(ctx context.Context, p *beam.Pipeline, gopts *graphx.Options) (*pb.Pipeline, error) {
+	edges, _, err := p.Build()
+	if err != nil {
+		return nil, err
+	}
+	if len(edges) == 0 {
+		return nil, errors.New("empty pipeline")
+	}
+	if dups := findDuplicateNames(edges); len(dups) > 0 {
+		err := fmt.Errorf("duplicate transform names: %v. Use beam.Scope to give the transforms unique names", strings.Join(dups, ", "))
+		if !*allowDuplicateNames {
+			return nil, err
+		}
+		dataflowlib.GetLogger(ctx).Warnf(ctx, "%v", err)
+	}
+	if *checkRegistration {
+		if missing := findUnregistered(edges); len(missing) > 0 {
+			return nil, fmt.Errorf("unregistered %v. Register them in init() with beam.RegisterType", strings.Join(missing, ", "))
+		}
+	}
+	model, err := marshalModel(edges, gopts)
+	if err != nil && isTransientMarshalError(err) {
+		// Registrations may be incomplete due to init ordering in large
+		// binaries. Re-run the init hooks and retry once. If the retry
+		// fails too, the original error is returned.
+		dataflowlib.GetLogger(ctx).Warnf(ctx, "Retrying model generation after re-running init hooks: %v", err)
+		rerunInitHooks()
+		if retried, rerr := marshalModel(edges, gopts); rerr == nil {
+			model, err = retried, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate model pipeline: %v", err)
+	}
+	if err := graphx.MutatePipeline(model); err != nil {
+		return nil, fmt.Errorf("failed to mutate model pipeline: %v", err)
+	}
+	return model, nil
+}
+
+// marshalModel and rerunInitHooks generate the model pipeline and re-run the
+// init hooks before retrying a transient failure. Tests replace them.
+var (
+	marshalModel   = graphx.Marshal
+	rerunInitHooks = runtime.Init
+)
+
+// transientMarshalErrors are known error messages of model generation that
+// may be caused by registrations that have not happened yet.
+var transientMarshalErrors = []string{
+	"no coder registered for type",
+	"recv type must be registered",
+}
+
+// isTransientMarshalError returns true iff the model generation error
+// matches a known transient pattern.
+func isTransientMarshalError(err error) bool {
+	for _, msg := range transientMarshalErrors {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalOptions returns the model marshalling options from flags.
+func marshalOptions(ctx context.Context) *graphx.Options {
+	img, explicit := containerImage(ctx)
+	gopts := &graphx.Options{
+		ContainerImageURL:    img,
+		Capabilities:         splitList(*capabilities),
+		DefaultEnvironmentID: *environmentID,
+	}
+	if !explicit {
+		gopts.ImageRepositoryPrefix = *imagePrefix
+	}
+	return gopts
+}
+
+// ExecuteModel submits a pre-built model pipeline to Google Cloud Dataflow,
+// bypassing pipeline construction and marshalling. The staging location,
+// endpoint and dry-run behavior are taken from flags as for Execute, but the
+// job options are not. The returned result is nil for dry runs, stage-only
+// runs and --describe.
+func ExecuteModel(ctx context.Context, model *pb.Pipeline, opts dataflowlib.JobOptions) (*dataflowlib.Result, error) {
+	if err := validateModel(model); err != nil {
+		return nil, fmt.Errorf("invalid model pipeline: %v", err)
+	}
+	if *describeGraph {
+		return nil, describe(os.Stdout, model)
+	}
+	if *stagingLocation == "" {
+		return nil, errors.New("no GCS staging location specified. Use --staging_location=gs://<bucket>/<path>")
+	}
+	switch *modelFormat {
+	case "binary", "text", "auto":
+	default:
+		return nil, fmt.Errorf("invalid --model_format %q: must be binary, text or auto", *modelFormat)
+	}
+	return submit(ctx, model, &opts, *stagingLocation)
+}
+
+// containerImage returns the worker container image and whether it was
+// explicitly specified, as opposed to defaulted.
+func containerImage(ctx context.Context) (string, bool) {
+	if *image != "" {
+		return *image, true
+	}
+	explicit := *jobopts.ContainerImage != ""
+	return jobopts.GetContainerImage(ctx), explicit
+}
+
+// validateModel checks that the model pipeline has root transforms and that
+// they are all defined in its components.
+func validateModel(model *pb.Pipeline) error {
+	if model == nil {
+		return errors.New("no model pipeline")
+	}
+	roots := model.GetRootTransformIds()
+	if len(roots) == 0 {
+		return errors.New("no root transforms")
+	}
+	transforms := model.GetComponents().GetTransforms()
+	for _, id := range roots {
+		if _, ok := transforms[id]; !ok {
+			return fmt.Errorf("root transform %v not found in components", id)
+		}
+	}
+	return nil
+}
+
+// getJobOptions populates the Dataflow job options from flags.
+func getJobOptions(ctx context.Context) (*dataflowlib.JobOptions, error) {
+	setupLogging()
+	if *gcloudDefaults {
+		if err := applyGcloudDefaults(ctx, gcpopts.Project, stagingLocation); err != nil {
+			return nil, err
+		}
+	}
 	project := *gcpopts.Project
 	if project == "" {
-		return errors.New("no Google Cloud project specified. Use --project=<project>")
+		return nil, errors.New("no Google Cloud project specified. Use --project=<project>")
 	}
 	if *stagingLocation == "" {
-		return errors.New("no GCS staging location specified. Use --staging_location=gs://<bucket>/<path>")
+		return nil, errors.New("no GCS staging location specified. Use --staging_location=gs://<bucket>/<path>")
+	}
+	jobCorrelationID := *correlationID
+	if jobCorrelationID == "" {
+		jobCorrelationID = newCorrelationID()
+	} else if !labelValueRe.MatchString(jobCorrelationID) {
+		return nil, fmt.Errorf("invalid --correlation_id %q: must be a valid label value of lowercase letters, digits, - or _", jobCorrelationID)
+	}
+	if *diffAgainstJob != "" && !*dryRun {
+		return nil, errors.New("--diff_against_job requires --dry_run")
+	}
+	if *quotaProject != "" && !projectIDRe.MatchString(*quotaProject) {
+		return nil, fmt.Errorf("invalid --quota_project %q: not a project ID", *quotaProject)
+	}
+	if *skipUnchanged != "" && *jobopts.JobName == "" {
+		return nil, errors.New("no job name specified, which --skip_if_unchanged requires to be stable. Use --job_name=<name>")
 	}
-	if *image == "" {
-		*image = jobopts.GetContainerImage(ctx)
+	if *update && *jobopts.JobName == "" {
+		return nil, errors.New("no job name to update specified. Use --job_name=<name> of the active job")
 	}
+	var provenance *dataflowlib.Provenance
+	if *provenanceFile != "" {
+		var err error
+		if provenance, err = dataflowlib.ReadProvenance(*provenanceFile); err != nil {
+			return nil, err
+		}
+	}
+	var nameMapping map[string]string
+	if *transformNameMapping != "" {
+		if !*update {
+			return nil, errors.New("--transform_name_mapping requires --update")
+		}
+		if err := json.Unmarshal([]byte(*transformNameMapping), &nameMapping); err != nil {
+			return nil, fmt.Errorf("error reading --transform_name_mapping flag as JSON: %v", err)
+		}
+	}
+	name := jobopts.GetJobName()
 	var jobLabels map[string]string
 	if *labels != "" {
 		if err := json.Unmarshal([]byte(*labels), &jobLabels); err != nil {
-			return fmt.Errorf("error reading --label flag as JSON: %v", err)
+			return nil, fmt.Errorf("error reading --label flag as JSON: %v", err)
+		}
+	}
+	envLabels, err := labelsFromEnv(ctx, *labelsFromEnvs)
+	if err != nil {
+		return nil, err
+	}
+	jobLabels = mergeLabels(envLabels, jobLabels)
+
+	jobWorkerEnv, err := parseKeyValues("worker_env", workerEnv)
+	if err != nil {
+		return nil, err
+	}
+	envMachineTypes, err := parseKeyValues("worker_machine_type_by_env", machineTypeByEnv)
+	if err != nil {
+		return nil, err
+	}
+	workerMachineType, err := customMachineType(*machineType, *workerCPUs, *workerMemoryMB)
+	if err != nil {
+		return nil, err
+	}
+	stagingStorageClass := strings.ToUpper(*storageClass)
+	if err := dataflowlib.CheckStorageClass(stagingStorageClass); err != nil {
+		return nil, fmt.Errorf("invalid --staging_storage_class: %v", err)
+	}
+	var extraPackages []dataflowlib.Package
+	for _, pkg := range extraPackage {
+		if i := strings.Index(pkg, "="); i > 0 && !strings.HasPrefix(pkg, "gs://") {
+			extraPackages = append(extraPackages, dataflowlib.Package{Name: pkg[:i], Location: pkg[i+1:]})
+		} else {
+			extraPackages = append(extraPackages, dataflowlib.Package{Location: pkg})
+		}
+	}
+	var jobTempPrefixes map[string]string
+	if *tempPrefixes != "" {
+		if err := json.Unmarshal([]byte(*tempPrefixes), &jobTempPrefixes); err != nil {
+			return nil, fmt.Errorf("error reading --temp_prefix_overrides flag as JSON: %v", err)
+		}
+		if err := dataflowlib.CheckTempPrefixes(jobTempPrefixes); err != nil {
+			return nil, fmt.Errorf("invalid --temp_prefix_overrides: %v", err)
+		}
+	}
+
+	threads, err := workerHarnessThreads(int64(*harnessThreads), *threadsPerWork)
+	if err != nil {
+		return nil, err
+	}
+	if threads > maxThreadsPerWorker {
+		dataflowlib.GetLogger(ctx).Warnf(ctx, "%v worker harness threads exceeds %v, which risks running workers out of memory", threads, maxThreadsPerWorker)
+	}
+	if *uploadConcurrency < 1 {
+		return nil, fmt.Errorf("invalid --staging_upload_concurrency %v: must be at least 1", *uploadConcurrency)
+	}
+	if *diskSizeGb < 0 {
+		return nil, fmt.Errorf("invalid --disk_size_gb %v: must not be negative", *diskSizeGb)
+	}
+
+	var script string
+	if *startupScript != "" {
+		data, err := ioutil.ReadFile(*startupScript)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --worker_startup_script_file: %v", err)
+		}
+		if len(data) > maxMetadataValueBytes {
+			dataflowlib.GetLogger(ctx).Warnf(ctx, "Worker startup script %v is %v bytes, which exceeds the GCE metadata value limit of %v bytes", *startupScript, len(data), maxMetadataValueBytes)
 		}
+		script = string(data)
 	}
 
-	if *cpuProfiling != "" {
-		perf.EnableProfCaptureHook("gcs_profile_writer", *cpuProfiling)
+	if *disableProfilingHooks {
+		perf.DisableCaptureHooks()
+	} else {
+		if *cpuProfiling != "" {
+			perf.EnableProfCaptureHook("gcs_profile_writer", *cpuProfiling)
+		}
+		if *heapProfiling != "" {
+			perf.EnableHeapCaptureHook("gcs_heap_profile_writer", *heapProfiling)
+		}
+		if *executionTracing != "" {
+			if err := enableExecutionTracing(*executionTracing, *executionTracingInterval, *executionTracingDuration); err != nil {
+				return nil, err
+			}
+		}
+		if *cloudProfiler {
+			if err := enableCloudProfiler(name, project); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	if *sessionRecording != "" {
-		// TODO(wcn): BEAM-4017
-		// It's a bit inconvenient for GCS because the whole object is written in
-		// one pass, whereas the session logs are constantly appended. We wouldn't
-		// want to hold all the logs in memory to flush at the end of the pipeline
-		// as we'd blow out memory on the worker. The implementation of the
-		// CaptureHook should create an internal buffer and write chunks out to GCS
-		// once they get to an appropriate size (50M or so?)
+		if err := enableSessionRecording(*sessionRecording, *sessionTemplate, *sessionGzip); err != nil {
+			return nil, err
+		}
 	}
 
 	hooks.SerializeHooksToOptions()
 
-	experiments := jobopts.GetExperiments()
+	var fileExperiments []string
+	if *experimentsFile != "" {
+		var err error
+		if fileExperiments, err = readExperimentsFile(*experimentsFile); err != nil {
+			return nil, err
+		}
+	}
+	experiments, err := mergeExperiments(fileExperiments, jobopts.GetExperiments())
+	if err != nil {
+		return nil, err
+	}
+	if *strictExperiments {
+		if err := checkExperiments(experiments, splitList(*allowedExperimentPrefixes)); err != nil {
+			return nil, err
+		}
+	}
 	if *minCPUPlatform != "" {
 		experiments = append(experiments, fmt.Sprintf("min_cpu_platform=%v", *minCPUPlatform))
 	}
 
+	var caps []string
+	if *capabilities != "" {
+		var err error
+		if caps, err = graphx.Capabilities(&graphx.Options{Capabilities: splitList(*capabilities)}); err != nil {
+			return nil, fmt.Errorf("invalid --capabilities: %v", err)
+		}
+	}
+
+	serviceOptions := append([]string(nil), dataflowServiceOption...)
+	if *enablePrime {
+		serviceOptions = append(serviceOptions, "enable_prime")
+	}
+	if *cloudProfiler && !*disableProfilingHooks {
+		serviceOptions = append(serviceOptions, "enable_google_cloud_profiler")
+	}
+	if *utilizationHint != 0 {
+		opt, err := utilizationHintOption(*utilizationHint)
+		if err != nil {
+			return nil, err
+		}
+		serviceOptions = append(serviceOptions, opt)
+	}
+
 	opts := &dataflowlib.JobOptions{
-		Name:           jobopts.GetJobName(),
+		Name:           name,
 		Experiments:    experiments,
 		Options:        beam.PipelineOptions.Export(),
 		Project:        project,
@@ -125,45 +662,308 @@ func Execute(ctx context.Context, p *beam.Pipeline) error {
 		Zone:           *zone,
 		Network:        *network,
 		NumWorkers:     *numWorkers,
-		MachineType:    *machineType,
+		MachineType:    workerMachineType,
 		Labels:         jobLabels,
+		Critical:       *critical,
+		Provenance:     provenance,
+		WorkerEnv:      jobWorkerEnv,
+		HarnessThreads: int(threads),
 		TempLocation:   *tempLocation,
+		TempPrefixes:   jobTempPrefixes,
+		APITimeout:     *apiTimeout,
+		QuotaProject:   *quotaProject,
+		GlobalJobsPath: !*regionalJobs,
+		CorrelationID:  jobCorrelationID,
+		RedactPatterns: splitList(*redactPatterns),
+		Scopes:         splitList(*oauthScopes),
 		Worker:         *jobopts.WorkerBinary,
 		TeardownPolicy: *teardownPolicy,
+
+		WorkerContentType: *workerContentType,
+		StartupScript:     script,
+
+		FilesToStage:             splitList(*filesToStage),
+		ExtraPackages:            extraPackages,
+		StagingUploadConcurrency: *uploadConcurrency,
+		StagingStorageClass:      stagingStorageClass,
+
+		ModelFormat:        *modelFormat,
+		ModelTextThreshold: *modelTextThreshold,
+		SpoolModel:         *spoolModel,
+		SpoolModelDir:      *spoolModelDir,
+
+		CleanupTempOnDone: *cleanupTemp,
+		FallbackRegions:   splitList(*fallbackRegions),
+
+		DiskSizeGb:      *diskSizeGb,
+		DiskType:        *diskType,
+		StreamingEngine: *streamingEngine,
+		Streaming:       *streaming,
+
+		MachineTypeByEnv: envMachineTypes,
+		Capabilities:     caps,
+
+		Update:               *update,
+		TransformNameMapping: nameMapping,
+
+		DataflowServiceOptions: serviceOptions,
+
+		NotifyWebhook:       *notifyWebhook,
+		NotifyWebhookSecret: *notifyWebhookSecret,
+
+		MetricsExport: *metricsExport,
+		VerifyStaging: *verifyStaging,
+
+		RecordChecksums: *recordChecksums,
+		ChecksumsFile:   *checksumsFile,
+
+		OpenLineageURL: *openLineageURL,
+	}
+	if *logAPIRequests {
+		opts.Transport = dataflowlib.LoggingTransport(nil)
 	}
 	if opts.TempLocation == "" {
+		if *requireTemp {
+			return nil, errors.New("no GCS temp location specified. Use --temp_location=gs://<bucket>/<path>")
+		}
 		opts.TempLocation = gcsx.Join(*stagingLocation, "tmp")
 	}
+	return opts, nil
+}
 
-	// (1) Build and submit
-
-	edges, _, err := p.Build()
+// customMachineType returns the worker machine type: the custom machine type
+// of the CPUs and memory, if set, or else the given machine type.
+func customMachineType(machineType string, cpus int, memoryMB int64) (string, error) {
+	if cpus == 0 && memoryMB == 0 {
+		return machineType, nil
+	}
+	if machineType != "" {
+		return "", errors.New("--worker_cpus and --worker_memory_mb build a custom machine type and cannot be used with --worker_machine_type")
+	}
+	if cpus == 0 || memoryMB == 0 {
+		return "", errors.New("--worker_cpus and --worker_memory_mb must be set together")
+	}
+	mt, err := dataflowlib.CustomMachineType(cpus, memoryMB)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("invalid custom machine type: %v", err)
+	}
+	return mt, nil
+}
+
+// resolveSecrets returns the job options and Dataflow endpoint with the
+// Secret Manager references of the flags that opt into them resolved. Only
+// the endpoint, webhook and OpenLineage settings may be references, so
+// secrets never appear on the command line. The given options are left
+// unchanged.
+func resolveSecrets(ctx context.Context, opts *dataflowlib.JobOptions, endpoint string) (*dataflowlib.JobOptions, string, error) {
+	ret := *opts
+	for _, s := range []struct {
+		flag  string
+		value *string
+	}{
+		{"dataflow_endpoint", &endpoint},
+		{"notify_webhook", &ret.NotifyWebhook},
+		{"notify_webhook_secret", &ret.NotifyWebhookSecret},
+		{"openlineage_url", &ret.OpenLineageURL},
+	} {
+		if !dataflowlib.IsSecretRef(*s.value) {
+			continue
+		}
+		v, err := resolveSecret(ctx, *s.value)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to resolve --%v: %v", s.flag, err)
+		}
+		*s.value = v
+	}
+	return &ret, endpoint, nil
+}
+
+// checkEndpointRegion checks that the resolved Dataflow endpoint, if
+// regional, is the endpoint of the job region.
+func checkEndpointRegion(endpoint, region string) error {
+	if r, ok := dataflowlib.EndpointRegion(endpoint); ok && r != region {
+		return fmt.Errorf("invalid --dataflow_endpoint: regional endpoint of %v, but the job region is %v. Use --region=%v or a global endpoint", r, region, r)
 	}
-	model, err := graphx.Marshal(edges, &graphx.Options{ContainerImageURL: *image})
+	return nil
+}
+
+// resolveSecret is a var so that tests can resolve references without
+// Secret Manager.
+var resolveSecret = dataflowlib.ResolveSecret
+
+// submit stages the model pipeline and worker binary under the staging
+// location and submits the job, unless a dry run or stage-only run.
+func submit(ctx context.Context, model *pb.Pipeline, opts *dataflowlib.JobOptions, staging string) (*dataflowlib.Result, error) {
+	setupLogging()
+	ctx = dataflowlib.WithJobOptions(ctx, opts)
+
+	opts, dfEndpoint, err := resolveSecrets(ctx, opts, *endpoint)
 	if err != nil {
-		return fmt.Errorf("failed to generate model pipeline: %v", err)
+		return nil, err
 	}
+	if err := checkEndpointRegion(dfEndpoint, opts.Region); err != nil {
+		return nil, err
+	}
+	staging = regionStaging(staging, opts)
 
-	id := atomic.AddInt32(&unique, 1)
-	modelURL := gcsx.Join(*stagingLocation, fmt.Sprintf("model-%v-%v", id, time.Now().UnixNano()))
-	workerURL := gcsx.Join(*stagingLocation, fmt.Sprintf("worker-%v-%v", id, time.Now().UnixNano()))
+	if !*dryRun {
+		if err := checkWorkerBinary(opts.Worker); err != nil {
+			return nil, err
+		}
+		if err := dataflowlib.CheckCredentials(ctx); err != nil {
+			return nil, err
+		}
+		if *verifyImage {
+			for _, img := range pipelinex.ContainerImages(model) {
+				if err := dataflowlib.VerifyImage(ctx, img); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if *checkPerms {
+			if err := dataflowlib.CheckPermissions(ctx, opts.StorageClient, opts.Project, staging); err != nil {
+				return nil, err
+			}
+		}
+		if *checkBucket {
+			if err := dataflowlib.CheckBucketRegion(ctx, opts.StorageClient, staging, opts.Region); err != nil {
+				if *strictBucket {
+					return nil, err
+				}
+				dataflowlib.GetLogger(ctx).Warnf(ctx, "Staging bucket check: %v", err)
+			}
+		}
+	}
+
+	if *printOpts {
+		dataflowlib.LogOptions(ctx, opts)
+	}
+	if opts.Streaming && pipelinex.Bounded(model) {
+		dataflowlib.GetLogger(ctx).Warnf(ctx, "Forcing a streaming job for a bounded pipeline")
+	}
+
+	var hash string
+	if *skipUnchanged != "" && !*dryRun {
+		var err error
+		if hash, err = dataflowlib.SubmissionHash(ctx, model, opts); err != nil {
+			return nil, err
+		}
+		last, err := dataflowlib.ReadReceipt(ctx, *skipUnchanged)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil && last.Hash == hash {
+			dataflowlib.GetLogger(ctx).Infof(ctx, "Skipping submission: unchanged since job %v submitted at %v", last.JobID, last.Time)
+			return nil, dataflowlib.ErrUnchanged
+		}
+	}
+
+	modelURL, workerURL, err := stagingURLs(staging, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	if *dryRun {
-		log.Info(ctx, "Dry-run: not submitting job!")
+		dataflowlib.GetLogger(ctx).Infof(ctx, "Dry-run: not submitting job!")
 
-		log.Info(ctx, proto.MarshalTextString(model))
+		dataflowlib.GetLogger(ctx).Infof(ctx, "%s", proto.MarshalTextString(model))
 		job, err := dataflowlib.Translate(model, opts, workerURL, modelURL)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		dataflowlib.PrintJob(ctx, job)
-		return nil
+		dataflowlib.GetLogger(ctx).Infof(ctx, "%s", costEstimate(job, *estDuration))
+		if *diffAgainstJob != "" {
+			client, err := dataflowlib.NewClient(ctx, dfEndpoint, opts.Scopes...)
+			if err != nil {
+				return nil, err
+			}
+			running, err := dataflowlib.GetJob(ctx, client, opts.Project, opts.Region, *diffAgainstJob, opts.APITimeout)
+			if err != nil {
+				return nil, err
+			}
+			dataflowlib.PrintDiff(ctx, *diffAgainstJob, dataflowlib.DiffJobs(running, job, opts.TransformNameMapping))
+		}
+		if *dryRunOutput != "" {
+			if err := dataflowlib.WriteJob(ctx, job, *dryRunOutput); err != nil {
+				return nil, fmt.Errorf("failed to write dry-run job to %v: %v", *dryRunOutput, err)
+			}
+			dataflowlib.GetLogger(ctx).Infof(ctx, "Wrote dry-run job to %v", *dryRunOutput)
+		}
+		return nil, nil
 	}
 
-	_, err = dataflowlib.Execute(ctx, model, opts, workerURL, modelURL, *endpoint, false)
-	return err
+	if *gcloudTemplate != "" {
+		spec, err := dataflowlib.FlexTemplateSpec(model, opts, *templateImage)
+		if err != nil {
+			return nil, err
+		}
+		if err := dataflowlib.WriteFlexTemplateSpec(ctx, spec, *gcloudTemplate); err != nil {
+			return nil, fmt.Errorf("failed to write flex template spec to %v: %v", *gcloudTemplate, err)
+		}
+		dataflowlib.GetLogger(ctx).Infof(ctx, "Not submitting job! Wrote flex template spec to %v", *gcloudTemplate)
+		return nil, nil
+	}
+
+	if *stageOnly != "" {
+		receipt, err := dataflowlib.StageOnly(ctx, model, opts, workerURL, modelURL)
+		if err != nil {
+			return nil, err
+		}
+		receipt.Hash = hash
+		if err := dataflowlib.WriteReceipt(ctx, *stageOnly, receipt); err != nil {
+			return nil, fmt.Errorf("failed to write staging receipt %v: %v", *stageOnly, err)
+		}
+		dataflowlib.GetLogger(ctx).Infof(ctx, "Stage-only: not submitting job! Wrote staging receipt to %v", *stageOnly)
+		return nil, nil
+	}
+
+	res, err := dataflowlib.ExecuteResult(ctx, model, opts, workerURL, modelURL, dfEndpoint, *follow)
+	if err == nil && *follow {
+		err = followJob(ctx, res, opts, dfEndpoint)
+	}
+	if err != nil || hash == "" {
+		return res, err
+	}
+	// Only record successful jobs, so that a failed job is submitted again.
+	receipt := &dataflowlib.Receipt{Hash: hash, JobID: res.JobID, Time: time.Now(), Provenance: opts.Provenance, CorrelationID: opts.CorrelationID, Checksums: res.Checksums}
+	if err := dataflowlib.WriteReceipt(ctx, *skipUnchanged, receipt); err != nil {
+		return res, fmt.Errorf("failed to write submission receipt %v: %v", *skipUnchanged, err)
+	}
+	return res, nil
+}
+
+// utilizationHintOption returns the Dataflow service option for the worker
+// utilization hint, which must be in (0, 1]. The service only honors it with
+// throughput-based autoscaling.
+func utilizationHintOption(hint float64) (string, error) {
+	if !(hint > 0 && hint <= 1) {
+		return "", fmt.Errorf("invalid --worker_utilization_hint %v: must be greater than 0 and at most 1", hint)
+	}
+	return "worker_utilization_hint=" + strconv.FormatFloat(hint, 'g', -1, 64), nil
+}
+
+// checkWorkerBinary verifies that the worker binary, if specified, is a
+// readable file. An empty worker binary is fine, because the running binary
+// is then used or a worker binary is built. A gs:// worker binary is checked
+// when it is copied during staging.
+func checkWorkerBinary(worker string) error {
+	if worker == "" || strings.HasPrefix(worker, "gs://") {
+		return nil
+	}
+	fd, err := os.Open(worker)
+	if err == nil {
+		var info os.FileInfo
+		info, err = fd.Stat()
+		fd.Close()
+		if err == nil && info.IsDir() {
+			err = errors.New("is a directory")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("worker binary not specified or not found: %q: %v", worker, err)
+	}
+	return nil
 }
 
 func gcsRecorderHook(opts []string) perf.CaptureHook {
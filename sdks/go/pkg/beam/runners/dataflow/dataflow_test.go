@@ -0,0 +1,461 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/util/hooks"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/apache/beam/sdks/go/pkg/beam/runners/dataflow/dataflowlib"
+)
+
+type fakeClock time.Time
+
+func (c fakeClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestStagingURLs(t *testing.T) {
+	defer func(c clock) { stagingClock = c }(stagingClock)
+	stagingClock = fakeClock(time.Unix(0, 1234))
+	unique = 0
+
+	tests := []struct {
+		model, worker string
+	}{
+		{"gs://bucket/staging/model-1-1234", "gs://bucket/staging/worker-1-1234"},
+		{"gs://bucket/staging/model-2-1234", "gs://bucket/staging/worker-2-1234"},
+	}
+	for _, test := range tests {
+		model, worker, err := stagingURLs("gs://bucket/staging", &dataflowlib.JobOptions{})
+		if err != nil || model != test.model || worker != test.worker {
+			t.Errorf("stagingURLs() = (%v, %v, %v), want (%v, %v)", model, worker, err, test.model, test.worker)
+		}
+	}
+
+	opts := &dataflowlib.JobOptions{ModelObjectName: "models/job.pb", WorkerObjectName: "bin/worker"}
+	model, worker, err := stagingURLs("gs://bucket/staging", opts)
+	if err != nil || model != "gs://bucket/staging/models/job.pb" || worker != "gs://bucket/staging/bin/worker" {
+		t.Errorf("stagingURLs(%+v) = (%v, %v, %v), want overridden names", opts, model, worker, err)
+	}
+	for _, opts := range []*dataflowlib.JobOptions{
+		{ModelObjectName: "model\n"},
+		{WorkerObjectName: "worker*"},
+		{ModelObjectName: "same", WorkerObjectName: "same"},
+	} {
+		if _, _, err := stagingURLs("gs://bucket/staging", opts); err == nil {
+			t.Errorf("stagingURLs(%+v) succeeded, want error", opts)
+		}
+	}
+}
+
+func TestFindDuplicateNames(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.Impulse(s)
+	a := s.Scope("a")
+	beam.AddFixedKey(a, col)
+	beam.AddFixedKey(s.Scope("b"), col)
+	beam.AddFixedKey(a, col)
+
+	edges, _, err := p.Build()
+	if err != nil {
+		t.Fatalf("failed to build pipeline: %v", err)
+	}
+	actual := findDuplicateNames(edges)
+	exp := []string{"a/github.com/apache/beam/sdks/go/pkg/beam.addFixedKeyFn"}
+	if !reflect.DeepEqual(actual, exp) {
+		t.Errorf("findDuplicateNames() = %v, want %v", actual, exp)
+	}
+
+	p, s = beam.NewPipelineWithRoot()
+	beam.AddFixedKey(s.Scope("a"), beam.Impulse(s))
+	beam.AddFixedKey(s.Scope("a"), beam.Impulse(s))
+
+	edges, _, err = p.Build()
+	if err != nil {
+		t.Fatalf("failed to build pipeline: %v", err)
+	}
+	if actual := findDuplicateNames(edges); len(actual) == 0 {
+		t.Errorf("findDuplicateNames() = %v, want duplicate scopes", actual)
+	}
+}
+
+type unregisteredType struct {
+	N int
+}
+
+func unregisteredFn(b []byte) unregisteredType {
+	return unregisteredType{N: len(b)}
+}
+
+func TestFindUnregistered(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	beam.AddFixedKey(s, beam.Impulse(s))
+
+	edges, _, err := p.Build()
+	if err != nil {
+		t.Fatalf("failed to build pipeline: %v", err)
+	}
+	if actual := findUnregistered(edges); len(actual) != 0 {
+		t.Errorf("findUnregistered() = %v, want none", actual)
+	}
+
+	p, s = beam.NewPipelineWithRoot()
+	beam.ParDo(s, unregisteredFn, beam.Impulse(s))
+
+	edges, _, err = p.Build()
+	if err != nil {
+		t.Fatalf("failed to build pipeline: %v", err)
+	}
+	actual := findUnregistered(edges)
+	// Functions resolve through the symbol table, so only the type is
+	// reported.
+	exp := []string{
+		"type github.com/apache/beam/sdks/go/pkg/beam/runners/dataflow.unregisteredType",
+	}
+	if !reflect.DeepEqual(actual, exp) {
+		t.Errorf("findUnregistered() = %v, want %v", actual, exp)
+	}
+}
+
+func TestValidateModel(t *testing.T) {
+	components := &pb.Components{
+		Transforms: map[string]*pb.PTransform{"t": {UniqueName: "t"}},
+	}
+	tests := []struct {
+		model *pb.Pipeline
+		valid bool
+	}{
+		{nil, false},
+		{&pb.Pipeline{Components: components}, false},
+		{&pb.Pipeline{Components: components, RootTransformIds: []string{"missing"}}, false},
+		{&pb.Pipeline{RootTransformIds: []string{"t"}}, false},
+		{&pb.Pipeline{Components: components, RootTransformIds: []string{"t"}}, true},
+	}
+	for i, test := range tests {
+		if err := validateModel(test.model); (err == nil) != test.valid {
+			t.Errorf("validateModel(#%v) = %v, want valid: %v", i, err, test.valid)
+		}
+	}
+}
+
+func TestIsTransientMarshalError(t *testing.T) {
+	tests := []struct {
+		err error
+		exp bool
+	}{
+		{errors.New("bad userfn: recv type must be registered: *main.fn"), true},
+		{errors.New("no coder registered for type main.T; register one with beam.RegisterType"), true},
+		{errors.New("invalid image repository prefix"), false},
+	}
+	for _, test := range tests {
+		if actual := isTransientMarshalError(test.err); actual != test.exp {
+			t.Errorf("isTransientMarshalError(%v) = %v, want %v", test.err, actual, test.exp)
+		}
+	}
+}
+
+func TestBuildModelRetry(t *testing.T) {
+	defer func(m func([]*graph.MultiEdge, *graphx.Options) (*pb.Pipeline, error), r func()) {
+		marshalModel, rerunInitHooks = m, r
+	}(marshalModel, rerunInitHooks)
+
+	transient := errors.New("no coder registered for type main.T")
+	tests := []struct {
+		name  string
+		errs  []error
+		calls int
+		err   error
+	}{
+		{"success", nil, 1, nil},
+		{"retried", []error{transient}, 2, nil},
+		{"retry failed", []error{transient, errors.New("other")}, 2, transient},
+		{"not transient", []error{errors.New("invalid image")}, 1, errors.New("invalid image")},
+	}
+	for _, test := range tests {
+		var calls, inits int
+		marshalModel = func(edges []*graph.MultiEdge, opts *graphx.Options) (*pb.Pipeline, error) {
+			calls++
+			if calls <= len(test.errs) {
+				return nil, test.errs[calls-1]
+			}
+			return &pb.Pipeline{}, nil
+		}
+		rerunInitHooks = func() { inits++ }
+
+		p, s := beam.NewPipelineWithRoot()
+		beam.AddFixedKey(s, beam.Impulse(s))
+		_, err := buildModel(context.Background(), p, &graphx.Options{})
+		if calls != test.calls || inits != test.calls-1 {
+			t.Errorf("buildModel(%v) marshalled %v times with %v init reruns, want %v marshals", test.name, calls, inits, test.calls)
+		}
+		if test.err == nil {
+			if err != nil {
+				t.Errorf("buildModel(%v) failed: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err.Error()) {
+			t.Errorf("buildModel(%v) = %v, want error %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	valid, s := beam.NewPipelineWithRoot()
+	beam.AddFixedKey(s, beam.Impulse(s))
+
+	dups, s := beam.NewPipelineWithRoot()
+	beam.AddFixedKey(s.Scope("a"), beam.Impulse(s))
+	beam.AddFixedKey(s.Scope("a"), beam.Impulse(s))
+
+	opts := dataflowlib.JobOptions{Name: "job", Project: "project", Region: "us-central1"}
+	errs := ValidateAll(context.Background(), []*beam.Pipeline{valid, dups, beam.NewPipeline()}, opts)
+	if len(errs) != 3 {
+		t.Fatalf("ValidateAll() returned %v errors, want 3", len(errs))
+	}
+	if errs[0] != nil {
+		t.Errorf("ValidateAll() failed for a valid pipeline: %v", errs[0])
+	}
+	if errs[1] == nil {
+		t.Error("ValidateAll() succeeded for a pipeline with duplicate names, want error")
+	}
+	if errs[2] == nil {
+		t.Error("ValidateAll() succeeded for an empty pipeline, want error")
+	}
+}
+
+func TestCloudProfilerHookArguments(t *testing.T) {
+	for _, opts := range [][]string{nil, {"service"}, {"service", "project", "extra"}} {
+		if _, err := newCloudProfilerHook(opts).Init(context.Background()); err == nil || !strings.Contains(err.Error(), "want service name and project") {
+			t.Errorf("Init(%q) = %v, want argument error", opts, err)
+		}
+	}
+}
+
+func TestExecutionTraceHookArguments(t *testing.T) {
+	for _, opts := range [][]string{nil, {"gs://foo/traces"}, {"gs://foo/traces", "1m"}} {
+		if _, err := newExecutionTraceHook(opts).Init(context.Background()); err == nil || !strings.Contains(err.Error(), "want GCS location, interval and duration") {
+			t.Errorf("Init(%q) = %v, want argument error", opts, err)
+		}
+	}
+	if _, err := newExecutionTraceHook([]string{"gs://foo/traces", "soon", "5s"}).Init(context.Background()); err == nil {
+		t.Error("Init with an invalid interval succeeded, want error")
+	}
+}
+
+func TestEnableExecutionTracing(t *testing.T) {
+	defer hooks.DisableHook(executionTraceHook)
+
+	if err := enableExecutionTracing("gs://foo/traces", time.Minute, 2*time.Minute); err == nil {
+		t.Error("enableExecutionTracing succeeded with a duration longer than the interval, want error")
+	}
+	if err := enableExecutionTracing("gs://foo/traces", time.Minute, 5*time.Second); err != nil {
+		t.Errorf("enableExecutionTracing failed: %v", err)
+	}
+}
+
+func TestGcloudProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("CLOUDSDK_ACTIVE_CONFIG_NAME", os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME"))
+	os.Unsetenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+
+	if _, err := gcloudProject(dir); err == nil {
+		t.Error("gcloudProject succeeded without configuration, want error")
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "configurations"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	configs := map[string]string{
+		"active_config":                 "work\n",
+		"configurations/config_default": "[core]\nproject = default-project\n",
+		"configurations/config_work":    "[compute]\nproject = wrong\n\n[core]\naccount = me@example.com\nproject = work-project\n",
+	}
+	for name, data := range configs {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if project, err := gcloudProject(dir); err != nil || project != "work-project" {
+		t.Errorf("gcloudProject() = (%v, %v), want (work-project, nil)", project, err)
+	}
+}
+
+func TestProjectIDRe(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"my-project", true},
+		{"billing-123", true},
+		{"example.com:my-project", true},
+		{"short", false},
+		{"My-Project", false},
+		{"1project", false},
+		{"project-", false},
+		{"my_project", false},
+	}
+	for _, test := range tests {
+		if actual := projectIDRe.MatchString(test.id); actual != test.valid {
+			t.Errorf("projectIDRe.MatchString(%q) = %v, want %v", test.id, actual, test.valid)
+		}
+	}
+}
+
+func TestUtilizationHintOption(t *testing.T) {
+	tests := []struct {
+		hint    float64
+		exp     string
+		wantErr bool
+	}{
+		{0.8, "worker_utilization_hint=0.8", false},
+		{1, "worker_utilization_hint=1", false},
+		{0.05, "worker_utilization_hint=0.05", false},
+		{0, "", true},
+		{-0.5, "", true},
+		{1.5, "", true},
+	}
+	for _, test := range tests {
+		actual, err := utilizationHintOption(test.hint)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("utilizationHintOption(%v) succeeded, want error", test.hint)
+			}
+			continue
+		}
+		if err != nil || actual != test.exp {
+			t.Errorf("utilizationHintOption(%v) = (%v, %v), want %v", test.hint, actual, err, test.exp)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		list string
+		exp  []string
+	}{
+		{"", nil},
+		{" ", nil},
+		{"us-central1", []string{"us-central1"}},
+		{"us-central1,europe-west1", []string{"us-central1", "europe-west1"}},
+		{"us-central1, europe-west1 ,asia-east1", []string{"us-central1", "europe-west1", "asia-east1"}},
+	}
+	for _, test := range tests {
+		if actual := splitList(test.list); !reflect.DeepEqual(actual, test.exp) {
+			t.Errorf("splitList(%q) = %q, want %q", test.list, actual, test.exp)
+		}
+	}
+}
+
+func TestWorkerHarnessThreads(t *testing.T) {
+	tests := []struct {
+		harness, perWorker int64
+		exp                int64
+		wantErr            bool
+	}{
+		{0, 0, 0, false},
+		{8, 0, 8, false},
+		{0, 8, 8, false},
+		{8, 8, 8, false},
+		{4, 8, 0, true},
+		{-1, 0, 0, true},
+		{0, -1, 0, true},
+	}
+	for _, test := range tests {
+		actual, err := workerHarnessThreads(test.harness, test.perWorker)
+		if (err != nil) != test.wantErr || actual != test.exp {
+			t.Errorf("workerHarnessThreads(%v, %v) = (%v, %v), want %v, error: %v", test.harness, test.perWorker, actual, err, test.exp, test.wantErr)
+		}
+	}
+}
+
+func TestCheckEndpointRegion(t *testing.T) {
+	tests := []struct {
+		endpoint, region string
+		wantErr          bool
+	}{
+		{"", "us-central1", false},
+		{"https://dataflow.googleapis.com/", "us-central1", false},
+		{"https://us-central1-dataflow.googleapis.com/", "us-central1", false},
+		{"https://dataflow.europe-west1.rep.googleapis.com/", "us-central1", true},
+		// Unresolved references are checked once resolved.
+		{"sm://projects/p/secrets/endpoint/versions/2", "us-central1", false},
+	}
+	for _, test := range tests {
+		if err := checkEndpointRegion(test.endpoint, test.region); (err != nil) != test.wantErr {
+			t.Errorf("checkEndpointRegion(%v, %v) = %v, want error: %v", test.endpoint, test.region, err, test.wantErr)
+		}
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	defer func(old func(context.Context, string) (string, error)) { resolveSecret = old }(resolveSecret)
+	var resolved []string
+	resolveSecret = func(ctx context.Context, ref string) (string, error) {
+		resolved = append(resolved, ref)
+		if ref == "sm://projects/p/secrets/denied/versions/1" {
+			return "", errors.New("access denied")
+		}
+		return "resolved:" + ref, nil
+	}
+
+	opts := &dataflowlib.JobOptions{
+		NotifyWebhook:       "https://hooks.example.com/",
+		NotifyWebhookSecret: "sm://projects/p/secrets/webhook/versions/latest",
+	}
+	got, endpoint, err := resolveSecrets(context.Background(), opts, "sm://projects/p/secrets/endpoint/versions/2")
+	if err != nil {
+		t.Fatalf("resolveSecrets failed: %v", err)
+	}
+	if want := "resolved:sm://projects/p/secrets/endpoint/versions/2"; endpoint != want {
+		t.Errorf("resolveSecrets endpoint = %q, want %q", endpoint, want)
+	}
+	if want := "resolved:sm://projects/p/secrets/webhook/versions/latest"; got.NotifyWebhookSecret != want {
+		t.Errorf("resolveSecrets NotifyWebhookSecret = %q, want %q", got.NotifyWebhookSecret, want)
+	}
+	if got.NotifyWebhook != opts.NotifyWebhook {
+		t.Errorf("resolveSecrets NotifyWebhook = %q, want unchanged %q", got.NotifyWebhook, opts.NotifyWebhook)
+	}
+	if opts.NotifyWebhookSecret != "sm://projects/p/secrets/webhook/versions/latest" {
+		t.Errorf("resolveSecrets modified the given options: %q", opts.NotifyWebhookSecret)
+	}
+	if len(resolved) != 2 {
+		t.Errorf("resolveSecrets resolved %v, want only the 2 references", resolved)
+	}
+
+	opts.OpenLineageURL = "sm://projects/p/secrets/denied/versions/1"
+	if _, _, err := resolveSecrets(context.Background(), opts, ""); err == nil {
+		t.Errorf("resolveSecrets with denied --openlineage_url succeeded, want error")
+	}
+}
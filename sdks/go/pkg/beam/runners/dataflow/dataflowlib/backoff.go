@@ -0,0 +1,101 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// BackoffStrategy determines the delays of retried API calls and job status
+// polls. It must be concurrency safe.
+type BackoffStrategy interface {
+	// NextDelay returns the delay after the given attempt, starting at 1.
+	NextDelay(attempt int) time.Duration
+}
+
+// ExponentialBackoff is a BackoffStrategy that doubles the delay after each
+// attempt, starting at Initial, up to Max. It is the default for retries.
+type ExponentialBackoff struct {
+	Initial, Max time.Duration
+}
+
+// NextDelay returns Initial doubled attempt-1 times, capped at Max.
+func (b ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	d := b.Initial
+	for i := 1; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// ConstantBackoff is a BackoffStrategy with a fixed delay. It is the default
+// for job status polls.
+type ConstantBackoff time.Duration
+
+// NextDelay returns the constant delay.
+func (b ConstantBackoff) NextDelay(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+// JitteredBackoff is a BackoffStrategy that randomizes the delays of another
+// strategy by up to the given fraction in either direction, so that many
+// clients do not retry or poll in lockstep.
+type JitteredBackoff struct {
+	Strategy BackoffStrategy
+	// Fraction is the maximum relative deviation, such as 0.2 for +/-20%.
+	Fraction float64
+}
+
+// NextDelay returns the jittered delay of the underlying strategy.
+func (b JitteredBackoff) NextDelay(attempt int) time.Duration {
+	d := float64(b.Strategy.NextDelay(attempt))
+	return time.Duration(d * (1 + b.Fraction*(2*rand.Float64()-1)))
+}
+
+type backoffKey struct{}
+
+// WithBackoff returns a context under which the runner retries API calls and
+// polls job status with the given strategy. If the strategy is nil, the
+// context is returned unchanged.
+func WithBackoff(ctx context.Context, b BackoffStrategy) context.Context {
+	if b == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, backoffKey{}, b)
+}
+
+// retryStrategy returns the backoff strategy of the context for retries, or
+// the default exponential backoff.
+func retryStrategy(ctx context.Context) BackoffStrategy {
+	if b, ok := ctx.Value(backoffKey{}).(BackoffStrategy); ok {
+		return b
+	}
+	return ExponentialBackoff{Initial: retryBackoff, Max: maxRetryBackoff}
+}
+
+// pollStrategy returns the backoff strategy of the context for job status
+// polls, or the default constant poll interval.
+func pollStrategy(ctx context.Context) BackoffStrategy {
+	if b, ok := ctx.Value(backoffKey{}).(BackoffStrategy); ok {
+		return b
+	}
+	return ConstantBackoff(pollInterval)
+}
@@ -0,0 +1,81 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
+	"google.golang.org/api/storage/v1"
+)
+
+// multiRegions maps GCS multi-region locations to the prefix of the regions
+// they span.
+var multiRegions = map[string]string{
+	"us":   "us-",
+	"eu":   "europe-",
+	"asia": "asia-",
+}
+
+// dualRegions maps predefined GCS dual-region locations to their regions.
+var dualRegions = map[string][]string{
+	"nam4":  {"us-central1", "us-east1"},
+	"eur4":  {"europe-north1", "europe-west4"},
+	"asia1": {"asia-northeast1", "asia-northeast2"},
+}
+
+// CheckBucketRegion returns an error if the bucket of the given GCS location
+// is not located in or spanning the region, such as a staging bucket in
+// another region, which slows down or breaks the job. If the client is nil,
+// a client with default application credentials is used.
+func CheckBucketRegion(ctx context.Context, client *storage.Service, location, region string) error {
+	bucket, _, err := gcsx.ParseObject(location)
+	if err != nil {
+		return fmt.Errorf("invalid GCS location %v: %v", location, err)
+	}
+	client, err = storageClient(ctx, client)
+	if err != nil {
+		return err
+	}
+	b, err := client.Buckets.Get(bucket).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get location of bucket %v: %v", bucket, err)
+	}
+	if !bucketInRegion(b.Location, region) {
+		return fmt.Errorf("bucket %v is located in %v, which does not include the job region %v", bucket, b.Location, region)
+	}
+	return nil
+}
+
+// bucketInRegion returns true iff the GCS bucket location includes the
+// region. Bucket locations are case insensitive.
+func bucketInRegion(location, region string) bool {
+	location, region = strings.ToLower(location), strings.ToLower(region)
+	if location == region {
+		return true
+	}
+	if prefix, ok := multiRegions[location]; ok {
+		return strings.HasPrefix(region, prefix)
+	}
+	for _, r := range dualRegions[location] {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/storage/v1"
+)
+
+func TestBucketInRegion(t *testing.T) {
+	tests := []struct {
+		location, region string
+		exp              bool
+	}{
+		{"US-CENTRAL1", "us-central1", true},
+		{"US-EAST1", "us-central1", false},
+		{"US", "us-west1", true},
+		{"US", "europe-west1", false},
+		{"EU", "europe-west1", true},
+		{"ASIA", "asia-east1", true},
+		{"NAM4", "us-east1", true},
+		{"NAM4", "us-west1", false},
+		{"EUR4", "europe-west4", true},
+	}
+	for _, test := range tests {
+		if actual := bucketInRegion(test.location, test.region); actual != test.exp {
+			t.Errorf("bucketInRegion(%v, %v) = %v, want %v", test.location, test.region, actual, test.exp)
+		}
+	}
+}
+
+func TestCheckBucketRegion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/b/bucket" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&storage.Bucket{Name: "bucket", Location: "EU"})
+	}))
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	ctx := context.Background()
+	if err := CheckBucketRegion(ctx, client, "gs://bucket/staging", "europe-west1"); err != nil {
+		t.Errorf("CheckBucketRegion(europe-west1) failed: %v", err)
+	}
+	if err := CheckBucketRegion(ctx, client, "gs://bucket/staging", "us-central1"); err == nil {
+		t.Error("CheckBucketRegion(us-central1) succeeded, want error")
+	}
+	if err := CheckBucketRegion(ctx, client, "gs://missing/staging", "europe-west1"); err == nil {
+		t.Error("CheckBucketRegion(missing) succeeded, want error")
+	}
+}
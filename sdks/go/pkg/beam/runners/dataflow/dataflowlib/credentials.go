@@ -0,0 +1,58 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+type tokenSourceKey struct{}
+
+// WithTokenSource returns a context under which the Dataflow and GCS clients
+// of the runner authenticate with tokens of the given source, instead of
+// default application credentials, such as for workload identity federation
+// with an external identity provider. Tokens are reused until they expire.
+// If the token source is nil, the context is returned unchanged.
+func WithTokenSource(ctx context.Context, ts oauth2.TokenSource) context.Context {
+	if ts == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tokenSourceKey{}, oauth2.ReuseTokenSource(nil, ts))
+}
+
+// getTokenSource returns the token source of the context, if any.
+func getTokenSource(ctx context.Context) oauth2.TokenSource {
+	ts, _ := ctx.Value(tokenSourceKey{}).(oauth2.TokenSource)
+	return ts
+}
+
+// tokenSource returns the token source of the context, if any, or else the
+// default application credentials with the given scopes. It checks that the
+// token source of the context yields a token.
+func tokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	ts := getTokenSource(ctx)
+	if ts == nil {
+		return google.DefaultTokenSource(ctx, scopes...)
+	}
+	if _, err := ts.Token(); err != nil {
+		return nil, fmt.Errorf("token source yields no token: %v", err)
+	}
+	return ts, nil
+}
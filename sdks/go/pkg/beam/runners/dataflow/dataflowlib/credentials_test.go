@@ -0,0 +1,146 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/storage/v1"
+)
+
+// countingTokenSource yields a fixed token, or fails, and counts the calls.
+type countingTokenSource struct {
+	calls int
+	err   error
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &oauth2.Token{AccessToken: "federated", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func TestTokenSource(t *testing.T) {
+	var auths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/b/") {
+			json.NewEncoder(w).Encode(&storage.Bucket{Name: "bucket"})
+			return
+		}
+		json.NewEncoder(w).Encode(&df.Job{Id: "id"})
+	}))
+	defer srv.Close()
+
+	ts := &countingTokenSource{}
+	ctx := WithTokenSource(context.Background(), ts)
+	if err := CheckCredentials(ctx); err != nil {
+		t.Fatalf("CheckCredentials failed: %v", err)
+	}
+	client, err := NewClient(ctx, srv.URL+"/")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if _, err := GetJob(ctx, client, "project", "region", "id", 0); err != nil {
+		t.Fatalf("GetJob failed: %v", err)
+	}
+	gcs, err := newStorageClient(ctx, storage.DevstorageReadWriteScope)
+	if err != nil {
+		t.Fatalf("newStorageClient failed: %v", err)
+	}
+	gcs.BasePath = srv.URL + "/"
+	if _, err := gcs.Buckets.Get("bucket").Do(); err != nil {
+		t.Fatalf("Buckets.Get failed: %v", err)
+	}
+	for _, auth := range auths {
+		if auth != "Bearer federated" {
+			t.Errorf("request authorization = %q, want the token of the token source", auth)
+		}
+	}
+	if len(auths) != 2 {
+		t.Errorf("got %v requests, want 2", len(auths))
+	}
+	if ts.calls != 1 {
+		t.Errorf("token source called %v times, want the token to be reused", ts.calls)
+	}
+
+	failing := WithTokenSource(context.Background(), &countingTokenSource{err: errors.New("no federated identity")})
+	if err := CheckCredentials(failing); err == nil || !strings.Contains(err.Error(), "token source yields no token: no federated identity") {
+		t.Errorf("CheckCredentials with failing token source = %v, want token error", err)
+	}
+	if _, err := NewClient(failing, srv.URL+"/"); err == nil || !strings.Contains(err.Error(), "token source yields no token") {
+		t.Errorf("NewClient with failing token source = %v, want token error", err)
+	}
+}
+
+func TestCleanupTempTokenSource(t *testing.T) {
+	opts := &JobOptions{
+		Project:           "project",
+		TempLocation:      "gs://foo/tmp",
+		CleanupTempOnDone: true,
+		TokenSource:       &countingTokenSource{err: errors.New("no federated identity")},
+	}
+	job := &df.Job{Environment: &df.Environment{TempStoragePrefix: "gs://foo/tmp/job/1"}}
+	if err := CleanupTemp(context.Background(), opts, job); err == nil || !strings.Contains(err.Error(), "no federated identity") {
+		t.Errorf("CleanupTemp = %v, want the token source error", err)
+	}
+}
+
+func TestResultWaitTokenSource(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Millisecond
+
+	f := &fakeJobServer{states: []string{"JOB_STATE_DONE"}}
+	res, stop := newFakeResult(t, f)
+	defer stop()
+
+	// Wait cleans up the temp data of the done job with the token source
+	// of the options and logs the failure to the options logger.
+	logger := &recordingLogger{}
+	res.opts = &JobOptions{
+		Project:           "project",
+		TempLocation:      "gs://foo/tmp",
+		CleanupTempOnDone: true,
+		TokenSource:       &countingTokenSource{err: errors.New("no federated identity")},
+		Logger:            logger,
+		CorrelationID:     "run-1",
+	}
+	res.tempLocation = "gs://foo/tmp/job/1"
+	if _, err := res.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	var found bool
+	for _, line := range logger.lines {
+		if strings.HasPrefix(line, "WARN: [run-1] Failed to clean up temp data") && strings.Contains(line, "no federated identity") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Wait logged %q, want the correlated token source error of the cleanup", logger.lines)
+	}
+}
@@ -0,0 +1,238 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+// JobChange is a difference between two jobs in a field or transform that
+// is relevant to update compatibility.
+type JobChange struct {
+	// Kind is "added", "removed" or "changed".
+	Kind string
+	// Field is the job field, such as "worker_pool.machine_type", or the
+	// transform, such as "transform main/ParDo".
+	Field string
+	// Old and New are the values of the running and new job, if any.
+	Old, New string
+}
+
+func (c JobChange) String() string {
+	switch c.Kind {
+	case "added":
+		return fmt.Sprintf("+ %v: %v", c.Field, c.New)
+	case "removed":
+		return fmt.Sprintf("- %v: %v", c.Field, c.Old)
+	default:
+		return fmt.Sprintf("~ %v: %v -> %v", c.Field, c.Old, c.New)
+	}
+}
+
+// GetJob returns the job with the given ID, including its steps.
+func GetJob(ctx context.Context, client *df.Service, project, region, jobID string, timeout time.Duration) (*df.Job, error) {
+	var job *df.Job
+	err := retry(ctx, "Job lookup", func() error {
+		cctx, cancel := apiContext(ctx, timeout)
+		defer cancel()
+
+		var err error
+		job, err = getJob(cctx, client, project, region, jobID, "JOB_VIEW_ALL")
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job %v: %v", jobID, err)
+	}
+	return job, nil
+}
+
+// DiffJobs returns the differences between the running job and the new job
+// that replaces it, in the job type, worker pool, experiments, service
+// options, labels, Go pipeline options and transforms. Transforms are
+// matched by name, after renaming the running transforms with the given
+// transform name mapping, if any. Changes are sorted by field.
+func DiffJobs(running, job *df.Job, mapping map[string]string) []JobChange {
+	var ret []JobChange
+	diff := func(field, o, n string) {
+		switch {
+		case o == n:
+		case o == "":
+			ret = append(ret, JobChange{Kind: "added", Field: field, New: n})
+		case n == "":
+			ret = append(ret, JobChange{Kind: "removed", Field: field, Old: o})
+		default:
+			ret = append(ret, JobChange{Kind: "changed", Field: field, Old: o, New: n})
+		}
+	}
+	diffMaps := func(prefix string, o, n map[string]string) {
+		for k, v := range o {
+			diff(prefix+k, v, n[k])
+		}
+		for k, v := range n {
+			if _, ok := o[k]; !ok {
+				diff(prefix+k, "", v)
+			}
+		}
+	}
+
+	diff("type", running.Type, job.Type)
+	oldEnv, newEnv := jobEnvironment(running), jobEnvironment(job)
+	diffMaps("experiment ", stringSet(oldEnv.Experiments), stringSet(newEnv.Experiments))
+	diffMaps("service_option ", stringSet(oldEnv.ServiceOptions), stringSet(newEnv.ServiceOptions))
+	diffMaps("worker_pool.", workerPoolFields(oldEnv), workerPoolFields(newEnv))
+	diffMaps("label ", running.Labels, job.Labels)
+	diffMaps("go_option ", goOptions(oldEnv), goOptions(newEnv))
+
+	oldSteps := stepFields(running.Steps)
+	renamed := make(map[string]map[string]string)
+	for name, fields := range oldSteps {
+		if to, ok := mapping[name]; ok {
+			name = to
+		}
+		renamed[name] = fields
+	}
+	newSteps := stepFields(job.Steps)
+	for name, fields := range renamed {
+		n, ok := newSteps[name]
+		if !ok {
+			diff("transform "+name, fields["kind"], "")
+			continue
+		}
+		for k, v := range fields {
+			diff(fmt.Sprintf("transform %v %v", name, k), v, n[k])
+		}
+	}
+	for name, fields := range newSteps {
+		if _, ok := renamed[name]; !ok {
+			diff("transform "+name, "", fields["kind"])
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Field < ret[j].Field
+	})
+	return ret
+}
+
+// PrintDiff logs the job changes, one per line. Sensitive label and option
+// values are redacted. See WithRedactPatterns.
+func PrintDiff(ctx context.Context, jobID string, changes []JobChange) {
+	if len(changes) == 0 {
+		GetLogger(ctx).Infof(ctx, "No changes against job %v", jobID)
+		return
+	}
+	patterns := getRedactPatterns(ctx)
+	var lines []string
+	for _, c := range changes {
+		if strings.HasPrefix(c.Field, "label ") || strings.HasPrefix(c.Field, "go_option ") {
+			if i := strings.Index(c.Field, " "); isSensitive(c.Field[i+1:], patterns) {
+				c.Old, c.New = redactNonEmpty(c.Old), redactNonEmpty(c.New)
+			}
+		}
+		lines = append(lines, c.String())
+	}
+	GetLogger(ctx).Infof(ctx, "%v changes against job %v:\n%v", len(changes), jobID, strings.Join(lines, "\n"))
+}
+
+func jobEnvironment(job *df.Job) *df.Environment {
+	if job.Environment == nil {
+		return &df.Environment{}
+	}
+	return job.Environment
+}
+
+func stringSet(list []string) map[string]string {
+	ret := make(map[string]string)
+	for _, s := range list {
+		ret[s] = "present"
+	}
+	return ret
+}
+
+// workerPoolFields returns the update-relevant fields of the first worker
+// pool.
+func workerPoolFields(env *df.Environment) map[string]string {
+	if len(env.WorkerPools) == 0 {
+		return nil
+	}
+	wp := env.WorkerPools[0]
+	ret := map[string]string{
+		"machine_type":    wp.MachineType,
+		"container_image": wp.WorkerHarnessContainerImage,
+		"network":         wp.Network,
+		"zone":            wp.Zone,
+		"disk_type":       wp.DiskType,
+	}
+	if wp.NumWorkers > 0 {
+		ret["num_workers"] = fmt.Sprint(wp.NumWorkers)
+	}
+	if wp.DiskSizeGb > 0 {
+		ret["disk_size_gb"] = fmt.Sprint(wp.DiskSizeGb)
+	}
+	return ret
+}
+
+// goOptions returns the Go pipeline options of the job, if any.
+func goOptions(env *df.Environment) map[string]string {
+	if len(env.SdkPipelineOptions) == 0 {
+		return nil
+	}
+	var sdk struct {
+		GoOptions runtime.RawOptions `json:"beam:option:go_options:v1"`
+	}
+	if err := json.Unmarshal(env.SdkPipelineOptions, &sdk); err != nil {
+		return nil
+	}
+	return sdk.GoOptions.Options
+}
+
+// stepFields returns the update-relevant fields of each step by transform
+// name: its kind, output coders and whether its function changed.
+func stepFields(steps []*df.Step) map[string]map[string]string {
+	ret := make(map[string]map[string]string)
+	for _, s := range steps {
+		var props properties
+		if err := json.Unmarshal(s.Properties, &props); err != nil || props.UserName == "" {
+			continue
+		}
+		fields := map[string]string{"kind": s.Kind}
+		for _, out := range props.OutputInfo {
+			if out.Encoding == nil {
+				continue
+			}
+			data, err := json.Marshal(out.Encoding)
+			if err != nil {
+				continue
+			}
+			fields["coder "+out.OutputName] = string(data)
+		}
+		if props.SerializedFn != "" {
+			sum := sha256.Sum256([]byte(props.SerializedFn))
+			fields["fn"] = fmt.Sprintf("sha256:%x", sum[:8])
+		}
+		ret[props.UserName] = fields
+	}
+	return ret
+}
@@ -0,0 +1,69 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+func TestDiffJobs(t *testing.T) {
+	job := func(machineType string, experiments []string, labels map[string]string, steps ...string) *df.Job {
+		ret := &df.Job{
+			Type:   "JOB_TYPE_STREAMING",
+			Labels: labels,
+			Environment: &df.Environment{
+				Experiments: experiments,
+				SdkPipelineOptions: newMsg(pipelineOptions{
+					GoOptions: runtime.RawOptions{Options: map[string]string{"a": "b"}},
+				}),
+				WorkerPools: []*df.WorkerPool{{MachineType: machineType, NumWorkers: 1}},
+			},
+		}
+		for i := 0; i < len(steps); i += 2 {
+			ret.Steps = append(ret.Steps, &df.Step{
+				Kind:       steps[i+1],
+				Name:       "s",
+				Properties: newMsg(properties{UserName: steps[i]}),
+			})
+		}
+		return ret
+	}
+
+	running := job("n1-standard-1", []string{"beam_fn_api", "old"}, map[string]string{"team": "a"}, "read", "ParallelRead", "parse", "ParallelDo", "gone", "ParallelDo")
+	updated := job("n1-standard-2", []string{"beam_fn_api", "new"}, map[string]string{"team": "b"}, "read", "ParallelRead", "parse2", "GroupByKey", "added", "ParallelDo")
+
+	actual := DiffJobs(running, updated, map[string]string{"parse": "parse2"})
+	expected := []JobChange{
+		{Kind: "added", Field: "experiment new", New: "present"},
+		{Kind: "removed", Field: "experiment old", Old: "present"},
+		{Kind: "changed", Field: "label team", Old: "a", New: "b"},
+		{Kind: "added", Field: "transform added", New: "ParallelDo"},
+		{Kind: "removed", Field: "transform gone", Old: "ParallelDo"},
+		{Kind: "changed", Field: "transform parse2 kind", Old: "ParallelDo", New: "GroupByKey"},
+		{Kind: "changed", Field: "worker_pool.machine_type", Old: "n1-standard-1", New: "n1-standard-2"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("DiffJobs = %v, want %v", actual, expected)
+	}
+
+	if actual := DiffJobs(running, running, nil); len(actual) != 0 {
+		t.Errorf("DiffJobs(running, running) = %v, want no changes", actual)
+	}
+}
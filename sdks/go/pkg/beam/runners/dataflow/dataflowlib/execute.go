@@ -18,98 +18,508 @@
 package dataflowlib
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/apache/beam/sdks/go/pkg/beam/core/util/protox"
-	"github.com/apache/beam/sdks/go/pkg/beam/log"
 	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
 	"github.com/apache/beam/sdks/go/pkg/beam/runners/universal/runnerlib"
+	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
 	"github.com/golang/protobuf/proto"
 	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
 )
 
 // Execute submits a pipeline as a Dataflow job.
 func Execute(ctx context.Context, raw *pb.Pipeline, opts *JobOptions, workerURL, modelURL, endpoint string, async bool) (string, error) {
+	res, err := ExecuteResult(ctx, raw, opts, workerURL, modelURL, endpoint, async)
+	if res == nil {
+		return "", err
+	}
+	return res.JobID, err
+}
+
+// ExecuteResult submits a pipeline as a Dataflow job. It is like Execute, but
+// returns a Result with the observed job state history. If async, the
+// result can be used to wait for or cancel the job.
+func ExecuteResult(ctx context.Context, raw *pb.Pipeline, opts *JobOptions, workerURL, modelURL, endpoint string, async bool) (*Result, error) {
+	ctx = WithJobOptions(ctx, opts)
+	opts = withTempSubprefix(opts)
+
+	p, checksums, err := stage(ctx, raw, opts, workerURL, modelURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// (3) Translate to v1b3 and submit
+
+	client, err := NewClient(ctx, endpoint, opts.Scopes...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Update && opts.ReplaceJobID == "" {
+		id, err := activeJobID(ctx, client, opts.Project, opts.Region, opts.Name, opts.APITimeout)
+		if err != nil {
+			return nil, err
+		}
+		GetLogger(ctx).Infof(ctx, "Updating job: %v", id)
+
+		update := *opts
+		update.ReplaceJobID = id
+		opts = &update
+	}
+	job, upd, region, err := submitWithFallback(ctx, client, p, opts, workerURL, modelURL)
+	if err != nil {
+		return nil, err
+	}
+	res, err := started(ctx, client, p, opts, job, upd, region, endpoint, async)
+	if res != nil {
+		res.Checksums = checksums
+		if opts.ReturnJobSpec {
+			res.JobSpec = job
+		}
+	}
+	return res, err
+}
+
+// StageOnly stages the worker binary and model pipeline like ExecuteResult,
+// but does not submit the job. It returns a receipt with the staged
+// locations and the translated job, which ExecuteFromStaged can submit
+// later, possibly from a different system.
+func StageOnly(ctx context.Context, raw *pb.Pipeline, opts *JobOptions, workerURL, modelURL string) (*Receipt, error) {
+	ctx = WithJobOptions(ctx, opts)
+
+	if opts.Update {
+		return nil, errors.New("staged jobs cannot update a job")
+	}
+	opts = withTempSubprefix(opts)
+	p, checksums, err := stage(ctx, raw, opts, workerURL, modelURL)
+	if err != nil {
+		return nil, err
+	}
+	job, err := Translate(p, opts, workerURL, modelURL)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Receipt{
+		Time:       time.Now(),
+		Provenance: opts.Provenance,
+		ModelURL:   modelURL,
+		WorkerURL:  workerURL,
+		Region:     opts.Region,
+		Job:        job,
+		Checksums:  checksums,
+
+		CorrelationID: opts.CorrelationID,
+	}
+	return ret, nil
+}
+
+// ExecuteFromStaged submits the job of a StageOnly receipt, whose artifacts
+// must still be staged. The options only control the submission and, if not
+// async, waiting for the job. They are not applied to the job, except for
+// the worker environment, which WriteReceipt redacts. If nil, the project
+// and region of the receipt are used.
+func ExecuteFromStaged(ctx context.Context, r *Receipt, opts *JobOptions, endpoint string, async bool) (*Result, error) {
+	if r == nil || r.Job == nil {
+		return nil, errors.New("receipt has no staged job")
+	}
+	if opts == nil {
+		opts = &JobOptions{Project: r.Job.ProjectId, Region: r.Region, CorrelationID: r.CorrelationID}
+	}
+	ctx = WithJobOptions(ctx, opts)
+
+	GetLogger(ctx).Infof(ctx, "Submitting job staged at %v: %v", r.Time, r.ModelURL)
+
+	job, err := restoreStagedJob(r.Job, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Retried creates share the client request ID, so that the service does
+	// not create a second job for a create that went through.
+	job.ClientRequestId = newClientRequestID()
+
+	client, err := NewClient(ctx, endpoint, opts.Scopes...)
+	if err != nil {
+		return nil, err
+	}
+	var upd *df.Job
+	err = retry(ctx, "Job submission", func() error {
+		cctx, cancel := apiContext(ctx, opts.APITimeout)
+		defer cancel()
+
+		var err error
+		upd, err = Submit(cctx, client, job.ProjectId, r.Region, job)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return started(ctx, client, nil, opts, job, upd, r.Region, endpoint, async)
+}
+
+// stage uploads the worker binary, the files to stage and the fixed up
+// model pipeline to GCS. It returns the fixed up pipeline and, if recorded,
+// the checksums of the staged objects.
+func stage(ctx context.Context, raw *pb.Pipeline, opts *JobOptions, workerURL, modelURL string) (*pb.Pipeline, map[string]*Checksum, error) {
 	// (1) Upload Go binary to GCS.
 
+	if err := CheckStorageClass(opts.StagingStorageClass); err != nil {
+		return nil, nil, err
+	}
+	ctx = withStorageClass(ctx, opts.StagingStorageClass)
+
 	bin := opts.Worker
 	if bin == "" {
 		if self, ok := runnerlib.IsWorkerCompatibleBinary(); ok {
 			bin = self
-			log.Infof(ctx, "Using running binary as worker binary: '%v'", bin)
+			GetLogger(ctx).Infof(ctx, "Using running binary as worker binary: '%v'", bin)
 		} else {
 			// Cross-compile as last resort.
 
 			worker, err := runnerlib.BuildTempWorkerBinary(ctx)
 			if err != nil {
-				return "", err
+				return nil, nil, err
 			}
 			defer os.Remove(worker)
 
 			bin = worker
 		}
 	} else {
-		log.Infof(ctx, "Using specified worker binary: '%v'", bin)
+		GetLogger(ctx).Infof(ctx, "Using specified worker binary: '%v'", bin)
 	}
 
-	log.Infof(ctx, "Staging worker binary: %v", bin)
+	staged := []string{workerURL, modelURL}
 
-	if err := StageWorker(ctx, opts.Project, workerURL, bin); err != nil {
-		return "", err
+	p, err := Fixup(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if size, err := stagingBytes(p, bin, opts); err == nil {
+		GetLogger(ctx).Debugf(ctx, "Staging an estimated %v bytes", size)
 	}
-	log.Infof(ctx, "Staged worker binary: %v", workerURL)
+	if isGCSWorker(bin) {
+		// The worker binary is already in GCS, so copy it server-side. GCS
+		// validates the checksums of copies.
+		GetLogger(ctx).Infof(ctx, "Copying worker binary: %v", bin)
 
-	// (2) Fixup and upload model to GCS
+		if err := copyWorker(ctx, opts.StorageClient, opts.Project, workerURL, bin); err != nil {
+			return nil, nil, err
+		}
+		GetLogger(ctx).Infof(ctx, "Copied worker binary: %v", workerURL)
+	} else {
+		GetLogger(ctx).Infof(ctx, "Staging worker binary: %v", bin)
 
-	p, err := Fixup(raw)
-	if err != nil {
-		return "", err
+		if err := stageWorker(ctx, opts.StorageClient, opts.Project, workerURL, bin, opts.WorkerContentType); err != nil {
+			return nil, nil, err
+		}
+		GetLogger(ctx).Infof(ctx, "Staged worker binary: %v", workerURL)
+	}
+	if opts.VerifyStaging && !isGCSWorker(bin) {
+		if err := verifyStaged(ctx, opts.StorageClient, workerURL, openFile(bin)); err != nil {
+			return nil, nil, err
+		}
 	}
-	log.Info(ctx, proto.MarshalTextString(p))
 
-	if err := StageModel(ctx, opts.Project, modelURL, protox.MustEncode(p)); err != nil {
-		return "", err
+	if len(opts.FilesToStage) > 0 {
+		files, err := stagedFiles(workerURL, opts.FilesToStage)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := stageFiles(ctx, opts.StorageClient, opts.Project, files, opts.StagingUploadConcurrency); err != nil {
+			return nil, nil, err
+		}
+		GetLogger(ctx).Infof(ctx, "Staged %v files", len(files))
+		for _, file := range opts.FilesToStage {
+			staged = append(staged, files[file])
+		}
+		if opts.VerifyStaging {
+			for _, file := range opts.FilesToStage {
+				if err := verifyStaged(ctx, opts.StorageClient, files[file], openFile(file)); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
 	}
-	log.Infof(ctx, "Staged model pipeline: %v", modelURL)
 
-	// (3) Translate to v1b3 and submit
+	if len(opts.ExtraPackages) > 0 {
+		pkgs, err := stageExtraPackages(ctx, opts.StorageClient, opts, workerURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		GetLogger(ctx).Infof(ctx, "Staged %v extra packages", len(pkgs))
+		staged = append(staged, pkgs...)
+	}
 
-	job, err := Translate(p, opts, workerURL, modelURL)
-	if err != nil {
-		return "", err
+	// (2) Upload fixed up model to GCS
+
+	GetLogger(ctx).Infof(ctx, "%s", proto.MarshalTextString(p))
+
+	var open func() (io.ReadCloser, error)
+	if opts.SpoolModel {
+		spool, err := spoolModel(ctx, p, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer os.Remove(spool)
+		open = func() (io.ReadCloser, error) {
+			return os.Open(spool)
+		}
+	} else {
+		model, err := encodeModel(ctx, p, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		open = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(model)), nil
+		}
+	}
+	if err := upload(ctx, opts.StorageClient, opts.Project, modelURL, "", open); err != nil {
+		return nil, nil, err
+	}
+	GetLogger(ctx).Infof(ctx, "Staged model pipeline: %v", modelURL)
+	if opts.VerifyStaging {
+		if err := verifyStaged(ctx, opts.StorageClient, modelURL, open); err != nil {
+			return nil, nil, err
+		}
 	}
-	PrintJob(ctx, job)
 
-	client, err := NewClient(ctx, endpoint)
-	if err != nil {
-		return "", err
+	if !opts.RecordChecksums && opts.ChecksumsFile == "" {
+		return p, nil, nil
 	}
-	upd, err := Submit(ctx, client, opts.Project, opts.Region, job)
+	checksums, err := stagedChecksums(ctx, opts.StorageClient, staged)
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+	if opts.ChecksumsFile != "" {
+		data, err := json.MarshalIndent(checksums, "", "  ")
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writeFileAtomic(opts.ChecksumsFile, data); err != nil {
+			return nil, nil, fmt.Errorf("failed to write checksums file %v: %v", opts.ChecksumsFile, err)
+		}
+		GetLogger(ctx).Infof(ctx, "Wrote checksums of %v staged objects to %v", len(checksums), opts.ChecksumsFile)
+	}
+	return p, checksums, nil
+}
+
+// started returns the result of the submitted job, given the job spec and the
+// job returned by the service. If not async, it waits for the job to
+// complete. The pipeline, if not nil, is used to derive the lineage of the
+// job.
+func started(ctx context.Context, client *df.Service, p *pb.Pipeline, opts *JobOptions, job, upd *df.Job, region, endpoint string, async bool) (*Result, error) {
+	GetLogger(ctx).Infof(ctx, "Submitted job: %v in region %v", upd.Id, region)
+	notify(ctx, opts, upd.Id, upd.CurrentState)
+
+	res := &Result{JobID: upd.Id, Region: region, CorrelationID: opts.CorrelationID, client: client, opts: opts}
+	if job.Environment != nil {
+		res.tempLocation = job.Environment.TempStoragePrefix
+	}
+	if p != nil {
+		res.inputs, res.outputs = lineageDatasets(p, lineageNamespace(opts))
 	}
-	log.Infof(ctx, "Submitted job: %v", upd.Id)
+	emitLineage(ctx, opts, upd.Id, "", res.inputs, res.outputs)
+	res.record(upd.CurrentState, stateTime(upd.CurrentStateTime))
+
 	if endpoint == "" {
-		log.Infof(ctx, "Console: https://console.cloud.google.com/dataflow/job/%v?project=%v", upd.Id, opts.Project)
+		GetLogger(ctx).Infof(ctx, "Console: https://console.cloud.google.com/dataflow/job/%v?project=%v", upd.Id, opts.Project)
 	}
-	log.Infof(ctx, "Logs: https://console.cloud.google.com/logs/viewer?project=%v&resource=dataflow_step%%2Fjob_id%%2F%v", opts.Project, upd.Id)
+	GetLogger(ctx).Infof(ctx, "Logs: https://console.cloud.google.com/logs/viewer?project=%v&resource=dataflow_step%%2Fjob_id%%2F%v", opts.Project, upd.Id)
 
 	if async {
-		return upd.Id, nil
+		return res, nil
 	}
 
 	// (4) Wait for completion.
 
-	return upd.Id, WaitForCompletion(ctx, client, opts.Project, opts.Region, upd.Id)
+	_, err := res.Wait(ctx)
+	return res, err
+}
+
+// submitWithFallback translates and submits the job in the configured region.
+// If the region is out of capacity, it tries each fallback region in turn,
+// restaging the artifacts for the region, if it has its own staging
+// locations. It returns the translated and submitted jobs and the region
+// that accepted it.
+func submitWithFallback(ctx context.Context, client *df.Service, p *pb.Pipeline, opts *JobOptions, workerURL, modelURL string) (*df.Job, *df.Job, string, error) {
+	regions := append([]string{opts.Region}, opts.FallbackRegions...)
+	if opts.ReplaceJobID != "" {
+		// An update must run in the region of the replaced job.
+		regions = regions[:1]
+	}
+	creator := newJobCreator(client)
+	// All creates of the submission share the client request ID, so that
+	// the service does not create a second job for a retried create that
+	// went through.
+	reqID := newClientRequestID()
+	for i, region := range regions {
+		attempt := *opts
+		attempt.Region = region
+
+		regionWorker, regionModel := workerURL, modelURL
+		if i > 0 && opts.FallbackStagingURLs != nil {
+			var err error
+			if regionModel, regionWorker, err = opts.FallbackStagingURLs(region); err != nil {
+				return nil, nil, "", fmt.Errorf("invalid staging locations for region %v: %v", region, err)
+			}
+			if err := restage(ctx, opts, workerURL, modelURL, regionWorker, regionModel); err != nil {
+				return nil, nil, "", fmt.Errorf("failed to restage artifacts for region %v: %v", region, err)
+			}
+		}
+
+		job, err := Translate(p, &attempt, regionWorker, regionModel)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		job.ClientRequestId = reqID
+		PrintJob(ctx, job)
+
+		var upd *df.Job
+		err = retry(ctx, "Job submission", func() error {
+			cctx, cancel := apiContext(ctx, opts.APITimeout)
+			defer cancel()
+
+			var err error
+			upd, err = creator.Create(cctx, opts.Project, region, job)
+			if err != nil && i < len(regions)-1 && isCapacityError(err) {
+				// Try the next region instead.
+				return permanentError{err}
+			}
+			return err
+		})
+		if err == nil {
+			return job, upd, region, nil
+		}
+		if i == len(regions)-1 || !isCapacityError(err) {
+			return nil, nil, "", err
+		}
+		GetLogger(ctx).Warnf(ctx, "Region %v is out of capacity: %v. Trying region %v", region, err, regions[i+1])
+	}
+	panic("unreachable")
+}
+
+// restage copies the staged model and worker packages server-side from the
+// given staging locations to those of another region. Unchanged locations
+// are not copied.
+func restage(ctx context.Context, opts *JobOptions, workerURL, modelURL, toWorker, toModel string) error {
+	from, err := workerPackages(opts, workerURL)
+	if err != nil {
+		return err
+	}
+	to, err := workerPackages(opts, toWorker)
+	if err != nil {
+		return err
+	}
+	copies := [][2]string{{modelURL, toModel}}
+	for i := range from {
+		copies = append(copies, [2]string{from[i].Location, to[i].Location})
+	}
+	for _, c := range copies {
+		if c[0] == c[1] {
+			continue
+		}
+		if err := copyWorker(ctx, opts.StorageClient, opts.Project, c[1], c[0]); err != nil {
+			return err
+		}
+	}
+	GetLogger(ctx).Infof(ctx, "Restaged %v artifacts to %v", len(copies), toWorker)
+	return nil
+}
+
+// isCapacityError returns true iff the error indicates that the region
+// lacks quota or capacity for the job. A bare 429, such as a per-user rate
+// limit of jobs.create, is not, as it is retried in the same region.
+func isCapacityError(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok {
+		for _, item := range e.Errors {
+			if item.Reason == "quotaExceeded" {
+				return true
+			}
+		}
+	}
+	// The status and details, if any, are part of the message.
+	return strings.Contains(err.Error(), "RESOURCE_EXHAUSTED")
 }
 
-// PrintJob logs the Dataflow job.
+// PrintJob logs the Dataflow job, with sensitive values redacted. See
+// WithRedactPatterns.
 func PrintJob(ctx context.Context, job *df.Job) {
-	str, err := json.MarshalIndent(job, "", "  ")
+	str, err := redactJob(ctx, job)
+	if err != nil {
+		GetLogger(ctx).Infof(ctx, "Failed to print job %v: %v", job.Id, err)
+		return
+	}
+	GetLogger(ctx).Infof(ctx, "%s", string(str))
+}
+
+// WriteJob writes the Dataflow job as JSON to the given local path or GCS
+// location, with sensitive values redacted. Local files are written
+// atomically. See WithRedactPatterns.
+func WriteJob(ctx context.Context, job *df.Job, dest string) error {
+	data, err := redactJob(ctx, job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job %v: %v", job.Name, err)
+	}
+
+	if strings.HasPrefix(dest, "gs://") {
+		bucket, obj, err := gcsx.ParseObject(dest)
+		if err != nil {
+			return fmt.Errorf("invalid output location %v: %v", dest, err)
+		}
+		client, err := newStorageClient(ctx, storage.DevstorageReadWriteScope)
+		if err != nil {
+			return err
+		}
+		return gcsx.WriteObject(client, bucket, obj, bytes.NewReader(data))
+	}
+	return writeFileAtomic(dest, data)
+}
+
+// redactJob returns the indented JSON encoding of the job with the worker
+// environment and sensitive values redacted.
+func redactJob(ctx context.Context, job *df.Job) ([]byte, error) {
+	job, err := RedactJob(job)
+	if err != nil {
+		return nil, err
+	}
+	return redactIndent(ctx, job)
+}
+
+// writeFileAtomic writes the file via a temporary file in the same
+// directory, so that readers never observe a partial write.
+func writeFileAtomic(filename string, data []byte) error {
+	fd, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
 	if err != nil {
-		log.Infof(ctx, "Failed to print job %v: %v", job.Id, err)
+		return err
+	}
+	tmp := fd.Name()
+	if err := fd.Chmod(0644); err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := fd.Write(data); err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
 	}
-	log.Info(ctx, string(str))
+	return nil
 }
@@ -0,0 +1,467 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+// fakeDataflow is a minimal fake of the Dataflow jobs.create and jobs.get
+// endpoints and of GCS bucket creation and uploads, so that the submission path can be tested
+// end-to-end. Created jobs are recorded and then serve the given states in
+// turn. The first createFailures creations fail with a retryable error.
+type fakeDataflow struct {
+	mu             sync.Mutex
+	states         []string
+	createFailures int
+	creates        int
+	gets           int
+	jobs           []*df.Job
+	uploads        int
+}
+
+func (f *fakeDataflow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/b":
+		// Bucket creation.
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+
+	case strings.Contains(r.URL.Path, "/b/") && r.Method == http.MethodPost:
+		f.uploads++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+
+	case strings.HasSuffix(r.URL.Path, "/jobs") && r.Method == http.MethodPost:
+		f.creates++
+		if f.creates <= f.createFailures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var job df.Job
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job.Id = fmt.Sprintf("job-%v", len(f.jobs)+1)
+		job.CurrentState = "JOB_STATE_PENDING"
+		f.jobs = append(f.jobs, &job)
+		json.NewEncoder(w).Encode(&job)
+
+	case strings.Contains(r.URL.Path, "/jobs/") && r.Method == http.MethodGet:
+		state := f.states[len(f.states)-1]
+		if f.gets < len(f.states) {
+			state = f.states[f.gets]
+		}
+		f.gets++
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		json.NewEncoder(w).Encode(&df.Job{Id: id, CurrentState: state})
+
+	default:
+		http.Error(w, "unexpected request", http.StatusNotFound)
+	}
+}
+
+// newFakeDataflow starts the fake and makes Dataflow clients use its HTTP
+// client. The fake is used by passing its URL as the Dataflow endpoint and
+// the options from fakeOptions. The returned function stops the fake.
+func newFakeDataflow(f *fakeDataflow) (*httptest.Server, func()) {
+	srv := httptest.NewServer(f)
+
+	prev := defaultClient
+	defaultClient = func(ctx context.Context, scopes ...string) (*http.Client, error) {
+		return srv.Client(), nil
+	}
+	return srv, func() {
+		defaultClient = prev
+		srv.Close()
+	}
+}
+
+// fakeOptions returns job options that stage a dummy worker binary to the
+// fake. The returned function removes the worker binary.
+func fakeOptions(t *testing.T, srv *httptest.Server) (*JobOptions, func()) {
+	worker, err := ioutil.TempFile("", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.WriteString("worker")
+	worker.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	opts := &JobOptions{
+		Name:          "job",
+		Project:       "project",
+		Region:        "us-central1",
+		Worker:        worker.Name(),
+		StorageClient: client,
+	}
+	return opts, func() { os.Remove(worker.Name()) }
+}
+
+// impulsePipeline returns a model pipeline with a single impulse.
+func impulsePipeline(t *testing.T) *pb.Pipeline {
+	p, s := beam.NewPipelineWithRoot()
+	beam.Impulse(s)
+
+	edges, _, err := p.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	model, err := graphx.Marshal(edges, &graphx.Options{ContainerImageURL: "image"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Impulse does not reference an environment.
+	model.Components.Environments = emptyPipeline().Components.Environments
+	return model
+}
+
+// submittedJob returns the single job spec received by the fake.
+func (f *fakeDataflow) submittedJob(t *testing.T) *df.Job {
+	t.Helper()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.jobs) != 1 {
+		t.Fatalf("fake received %v jobs, want 1", len(f.jobs))
+	}
+	return f.jobs[0]
+}
+
+// assertPackages checks that the worker pool of the job has exactly the
+// given package locations, in order.
+func assertPackages(t *testing.T, job *df.Job, locations ...string) {
+	t.Helper()
+
+	var actual []string
+	for _, p := range job.Environment.WorkerPools[0].Packages {
+		actual = append(actual, p.Location)
+	}
+	if strings.Join(actual, ",") != strings.Join(locations, ",") {
+		t.Errorf("job packages = %v, want %v", actual, locations)
+	}
+}
+
+func TestExecuteFake(t *testing.T) {
+	defer func(b, d time.Duration) { retryBackoff, pollInterval = b, d }(retryBackoff, pollInterval)
+	retryBackoff, pollInterval = time.Millisecond, time.Millisecond
+
+	f := &fakeDataflow{
+		states:         []string{"JOB_STATE_RUNNING", "JOB_STATE_DONE"},
+		createFailures: 1,
+	}
+	srv, stop := newFakeDataflow(f)
+	defer stop()
+	opts, cleanup := fakeOptions(t, srv)
+	defer cleanup()
+
+	res, err := ExecuteResult(context.Background(), impulsePipeline(t), opts, "gs://bucket/worker", "gs://bucket/model", srv.URL+"/", false)
+	if err != nil {
+		t.Fatalf("ExecuteResult failed: %v", err)
+	}
+	if res.JobID != "job-1" || res.State() != "JOB_STATE_DONE" {
+		t.Errorf("ExecuteResult() = (%v, %v), want (job-1, JOB_STATE_DONE)", res.JobID, res.State())
+	}
+	if f.creates != 2 {
+		t.Errorf("fake received %v job creations, want 2 after a retry", f.creates)
+	}
+	if f.gets != 2 {
+		t.Errorf("fake received %v job polls, want 2", f.gets)
+	}
+	if f.uploads != 2 {
+		t.Errorf("fake received %v uploads, want 2 for the worker and model", f.uploads)
+	}
+
+	job := f.submittedJob(t)
+	if job.Name != "job" || job.ProjectId != "project" {
+		t.Errorf("submitted job %v in project %v, want job in project", job.Name, job.ProjectId)
+	}
+	assertPackages(t, job, "gs://bucket/worker")
+}
+
+// fakeJobCreator is a jobCreator that returns the given errors in turn and
+// then creates the job.
+type fakeJobCreator struct {
+	errs    []error
+	regions []string
+	reqIDs  []string
+}
+
+func (f *fakeJobCreator) Create(ctx context.Context, project, region string, job *df.Job) (*df.Job, error) {
+	f.regions = append(f.regions, region)
+	f.reqIDs = append(f.reqIDs, job.ClientRequestId)
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	ret := *job
+	ret.Id = "job-1"
+	return &ret, nil
+}
+
+func TestSubmitWithFallback(t *testing.T) {
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+	defer func(c func(*df.Service) jobCreator) { newJobCreator = c }(newJobCreator)
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "unavailable"}
+	invalid := &googleapi.Error{Code: http.StatusBadRequest, Message: "invalid job"}
+	exhausted := &googleapi.Error{Code: http.StatusTooManyRequests, Message: "RESOURCE_EXHAUSTED"}
+	rateLimited := &googleapi.Error{Code: http.StatusTooManyRequests, Message: "rate limit exceeded"}
+	fallback := []string{"europe-west1"}
+
+	var lastRegion []string
+	var lastErrs []error
+	for i := 0; i < retryAttempts; i++ {
+		lastRegion = append(lastRegion, "europe-west1")
+		lastErrs = append(lastErrs, exhausted)
+	}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		fallbacks []string
+		regions   []string
+		region    string
+		wantErr   error
+	}{
+		{"success", nil, fallback, []string{"us-central1"}, "us-central1", nil},
+		{"retryable", []error{unavailable, unavailable}, fallback, []string{"us-central1", "us-central1", "us-central1"}, "us-central1", nil},
+		{"permanent", []error{invalid}, fallback, []string{"us-central1"}, "", invalid},
+		{"capacity", []error{exhausted}, fallback, []string{"us-central1", "europe-west1"}, "europe-west1", nil},
+		{"exhausted", append([]error{exhausted}, lastErrs...), fallback, append([]string{"us-central1"}, lastRegion...), "", exhausted},
+		{"rate limited", []error{rateLimited}, fallback, []string{"us-central1", "us-central1"}, "us-central1", nil},
+		{"single region rate limited", []error{rateLimited, rateLimited}, nil, []string{"us-central1", "us-central1", "us-central1"}, "us-central1", nil},
+		{"single region capacity", []error{exhausted}, nil, []string{"us-central1", "us-central1"}, "us-central1", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &fakeJobCreator{errs: test.errs}
+			newJobCreator = func(*df.Service) jobCreator { return f }
+
+			opts := &JobOptions{
+				Name:            "job",
+				Project:         "project",
+				Region:          "us-central1",
+				FallbackRegions: test.fallbacks,
+			}
+			job, upd, region, err := submitWithFallback(context.Background(), nil, emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+			if strings.Join(f.regions, ",") != strings.Join(test.regions, ",") {
+				t.Errorf("submitWithFallback created jobs in %v, want %v", f.regions, test.regions)
+			}
+			for _, id := range f.reqIDs {
+				if id == "" || id != f.reqIDs[0] {
+					t.Errorf("submitWithFallback created jobs with client request IDs %v, want one shared ID", f.reqIDs)
+					break
+				}
+			}
+			if test.wantErr != nil {
+				if err != test.wantErr {
+					t.Errorf("submitWithFallback failed with %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("submitWithFallback failed: %v", err)
+			}
+			if upd.Id != "job-1" || job.Name != "job" || region != test.region {
+				t.Errorf("submitWithFallback() = (%v, %v, %v), want (job, job-1, %v)", job.Name, upd.Id, region, test.region)
+			}
+		})
+	}
+}
+
+func TestSubmitWithFallbackRestage(t *testing.T) {
+	defer func(c func(*df.Service) jobCreator) { newJobCreator = c }(newJobCreator)
+	f := &fakeJobCreator{errs: []error{&googleapi.Error{Code: http.StatusTooManyRequests, Message: "RESOURCE_EXHAUSTED"}}}
+	newJobCreator = func(*df.Service) jobCreator { return f }
+
+	var rewrites []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if i := strings.Index(r.URL.Path, "/rewriteTo/"); i >= 0 {
+			rewrites = append(rewrites, r.URL.Path[:i]+" -> "+r.URL.Path[i+len("/rewriteTo"):])
+			w.Write([]byte(`{"done": true}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	opts := &JobOptions{
+		Name:            "job",
+		Project:         "project",
+		Region:          "us-central1",
+		FallbackRegions: []string{"europe-west1"},
+		FilesToStage:    []string{"/tmp/data.txt"},
+		StorageClient:   client,
+		FallbackStagingURLs: func(region string) (string, string, error) {
+			return "gs://staging-" + region + "/model", "gs://staging-" + region + "/worker", nil
+		},
+	}
+	job, _, region, err := submitWithFallback(context.Background(), nil, emptyPipeline(), opts, "gs://staging-us-central1/worker", "gs://staging-us-central1/model")
+	if err != nil {
+		t.Fatalf("submitWithFallback failed: %v", err)
+	}
+	if region != "europe-west1" {
+		t.Errorf("submitWithFallback() region = %v, want europe-west1", region)
+	}
+	expected := []string{
+		"/b/staging-us-central1/o/model -> /b/staging-europe-west1/o/model",
+		"/b/staging-us-central1/o/worker -> /b/staging-europe-west1/o/worker",
+		"/b/staging-us-central1/o/worker-files/data.txt -> /b/staging-europe-west1/o/worker-files/data.txt",
+	}
+	if !reflect.DeepEqual(rewrites, expected) {
+		t.Errorf("submitWithFallback restaged %q, want %q", rewrites, expected)
+	}
+	assertPackages(t, job, "gs://staging-europe-west1/worker", "gs://staging-europe-west1/worker-files/data.txt")
+}
+
+func TestIsCapacityError(t *testing.T) {
+	tests := []struct {
+		err error
+		exp bool
+	}{
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, false},
+		{&googleapi.Error{Code: http.StatusTooManyRequests, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, false},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}, true},
+		{&googleapi.Error{Code: http.StatusTooManyRequests, Body: `{"error": {"status": "RESOURCE_EXHAUSTED"}}`}, true},
+		{&googleapi.Error{Code: http.StatusForbidden, Message: "Quota exceeded: RESOURCE_EXHAUSTED"}, true},
+		{errors.New("rpc error: code = RESOURCE_EXHAUSTED"), true},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, false},
+		{&googleapi.Error{Code: http.StatusBadRequest, Message: "invalid job"}, false},
+	}
+	for _, test := range tests {
+		if actual := isCapacityError(test.err); actual != test.exp {
+			t.Errorf("isCapacityError(%v) = %v, want %v", test.err, actual, test.exp)
+		}
+	}
+}
+
+func TestWriteJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "job.json")
+
+	job := &df.Job{Name: "job", ProjectId: "project", Type: "JOB_TYPE_BATCH"}
+	if err := WriteJob(context.Background(), job, file); err != nil {
+		t.Fatalf("WriteJob failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual df.Job
+	if err := json.Unmarshal(data, &actual); err != nil {
+		t.Fatalf("WriteJob wrote invalid JSON %s: %v", data, err)
+	}
+	if actual.Name != job.Name || actual.ProjectId != job.ProjectId || actual.Type != job.Type {
+		t.Errorf("WriteJob() wrote %+v, want %+v", actual, job)
+	}
+
+	if err := WriteJob(context.Background(), job, "gs://"); err == nil {
+		t.Error("WriteJob(gs://) succeeded, want invalid location error")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "out.json")
+
+	for _, data := range []string{"first, longer content", "second"} {
+		if err := writeFileAtomic(file, []byte(data)); err != nil {
+			t.Fatalf("writeFileAtomic(%q) failed: %v", data, err)
+		}
+		actual, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != data {
+			t.Errorf("writeFileAtomic(%q) wrote %q, want it replaced", data, actual)
+		}
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0644 {
+		t.Errorf("writeFileAtomic() created mode %v, want 0644", perm)
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "out.json"), []byte("x")); err == nil {
+		t.Error("writeFileAtomic succeeded in a missing directory, want error")
+	}
+	// A failed rename onto a directory leaves no temporary file behind.
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "sub"), []byte("x")); err == nil {
+		t.Error("writeFileAtomic succeeded onto a directory, want error")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if exp := []string{"out.json", "sub"}; !reflect.DeepEqual(names, exp) {
+		t.Errorf("writeFileAtomic() left files %v, want %v", names, exp)
+	}
+}
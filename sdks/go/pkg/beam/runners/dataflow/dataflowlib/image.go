@@ -0,0 +1,109 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+// manifestMediaTypes are the accepted container image manifest types.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// VerifyImage checks that the container image manifest exists and is
+// accessible in its registry. Google Container Registry and Artifact
+// Registry are accessed with default application credentials.
+func VerifyImage(ctx context.Context, image string) error {
+	host, repo, ref, err := parseImage(image)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("https://%v/v2/%v/manifests/%v", host, repo, ref), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ","))
+	if isGoogleRegistry(host) {
+		ts, err := tokenSource(ctx, df.CloudPlatformScope)
+		if err != nil {
+			return fmt.Errorf("failed to obtain credentials for %v: %v", host, err)
+		}
+		tok, err := ts.Token()
+		if err != nil {
+			return fmt.Errorf("failed to obtain credentials for %v: %v", host, err)
+		}
+		req.SetBasicAuth("oauth2accesstoken", tok.AccessToken)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to verify container image %v: %v", image, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("container image %v not found", image)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("container image %v not accessible: %v", image, resp.Status)
+	default:
+		return fmt.Errorf("failed to verify container image %v: %v", image, resp.Status)
+	}
+}
+
+// parseImage splits a container image reference into registry host,
+// repository and tag or digest. Docker Hub is the default registry.
+func parseImage(image string) (host, repo, ref string, err error) {
+	name := image
+	ref = "latest"
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref = name[:i], name[i+1:]
+	}
+	if name == "" || ref == "" {
+		return "", "", "", fmt.Errorf("invalid container image: %q", image)
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0], parts[1], ref, nil
+	}
+	if len(parts) == 1 {
+		name = "library/" + name
+	}
+	return "registry-1.docker.io", name, ref, nil
+}
+
+// isGoogleRegistry returns true iff the registry host is Google Container
+// Registry or Artifact Registry.
+func isGoogleRegistry(host string) bool {
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev")
+}
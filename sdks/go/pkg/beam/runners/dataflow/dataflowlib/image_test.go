@@ -0,0 +1,45 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"testing"
+)
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		image           string
+		host, repo, ref string
+	}{
+		{"gcr.io/project/beam/go:v1", "gcr.io", "project/beam/go", "v1"},
+		{"us-docker.pkg.dev/project/repo/go", "us-docker.pkg.dev", "project/repo/go", "latest"},
+		{"localhost:5000/go:dev", "localhost:5000", "go", "dev"},
+		{"gcr.io/project/go@sha256:abc", "gcr.io", "project/go", "sha256:abc"},
+		{"apache/beam_go_sdk:2.9.0", "registry-1.docker.io", "apache/beam_go_sdk", "2.9.0"},
+		{"golang", "registry-1.docker.io", "library/golang", "latest"},
+	}
+
+	for _, test := range tests {
+		host, repo, ref, err := parseImage(test.image)
+		if err != nil {
+			t.Errorf("parseImage(%v) failed: %v", test.image, err)
+			continue
+		}
+		if host != test.host || repo != test.repo || ref != test.ref {
+			t.Errorf("parseImage(%v) = (%v, %v, %v), want (%v, %v, %v)", test.image, host, repo, ref, test.host, test.repo, test.ref)
+		}
+	}
+}
@@ -17,18 +17,31 @@ package dataflowlib
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
 	// Importing to get the side effect of the remote execution hook. See init().
 	_ "github.com/apache/beam/sdks/go/pkg/beam/core/runtime/harness/init"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/pipelinex"
-	"github.com/apache/beam/sdks/go/pkg/beam/log"
 	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/apache/beam/sdks/go/pkg/beam/options/gcpopts"
+	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/storage/v1"
 )
 
 // JobOptions capture the various options for submitting jobs
@@ -40,6 +53,28 @@ type JobOptions struct {
 	Experiments []string
 	// Pipeline options
 	Options runtime.RawOptions
+	// PipelineOptionsMutator, if set, may add, override or remove pipeline
+	// options before the job is constructed. Non-string values are
+	// JSON-encoded and must be serializable. Options are not modified.
+	PipelineOptionsMutator func(map[string]interface{}) error `json:"-"`
+	// Logger, if set, receives all runner logging instead of the Beam log
+	// package.
+	Logger Logger `json:"-"`
+	// StorageClient, if set, is used to stage the job and clean up its temp
+	// data instead of a client with default application credentials.
+	StorageClient *storage.Service `json:"-"`
+	// Backoff, if set, determines the delays of retried API calls and job
+	// status polls instead of the default exponential retry backoff and
+	// constant poll interval.
+	Backoff BackoffStrategy `json:"-"`
+	// Transport, if set, is the base transport of the Dataflow and GCS
+	// clients, beneath their credentials, such as LoggingTransport for
+	// debugging. See WithTransport.
+	Transport http.RoundTripper `json:"-"`
+	// TokenSource, if set, authenticates the Dataflow and GCS clients
+	// instead of default application credentials, such as for workload
+	// identity federation. It must yield a token. See WithTokenSource.
+	TokenSource oauth2.TokenSource `json:"-"`
 
 	Project     string
 	Region      string
@@ -49,16 +84,316 @@ type JobOptions struct {
 	MachineType string
 	Labels      map[string]string
 
+	// MachineTypeByEnv, if set, overrides the machine type of the worker
+	// pool of specific environments, keyed by their model pipeline id (such
+	// as "go"). Other environments use MachineType. The job has a single
+	// worker pool, so at most one environment may be overridden.
+	MachineTypeByEnv map[string]string
+
+	// Annotations are arbitrary job metadata that do not fit the label
+	// constraints. They are stored in the job environment and can be read
+	// back with GetAnnotations.
+	Annotations map[string]string
+	// Provenance, if set, identifies the build of the job. Its digest and
+	// key fields are added as annotations and its short digest as the
+	// ProvenanceLabel label.
+	Provenance *Provenance
+	// CorrelationID, if set, identifies the submission across systems. It
+	// prefixes each runner log line, is stored as the beam-correlation-id
+	// label and is included in receipts and notifications. It must be a
+	// valid label value. It is not part of the submission hash.
+	CorrelationID string `json:"-"`
+
+	// FallbackRegions are tried in order, if the region is out of
+	// capacity at submission. The staged artifacts are shared, unless
+	// FallbackStagingURLs is set.
+	FallbackRegions []string
+	// FallbackStagingURLs, if set, returns the model and worker locations of
+	// a fallback region, such as in a bucket in that region. The staged
+	// model, worker binary and files are then copied there, server-side,
+	// before the job is submitted in the region.
+	FallbackStagingURLs func(region string) (modelURL, workerURL string, err error) `json:"-"`
+
 	TempLocation string
+	// TempStoragePrefix, if set, is the gs:// location where the service
+	// writes its temp data, instead of the one derived from TempLocation.
+	TempStoragePrefix string
+
+	// QuotaProject, if set, is the project that API usage and quota of the
+	// submission are billed to, instead of Project. See WithQuotaProject.
+	QuotaProject string
+
+	// GlobalJobsPath, if set, calls the jobs API, such as to create, poll
+	// and cancel the job, with the global projects.jobs methods and the
+	// region as location, instead of the regional projects.locations.jobs
+	// methods. See WithGlobalJobsPath.
+	GlobalJobsPath bool `json:"-"`
+
+	// Scopes are additional OAuth scopes for the credentials used to
+	// submit the job, besides the cloud-platform scope.
+	Scopes []string
+
+	// APITimeout bounds each individual Dataflow API call. If zero, calls
+	// are only bounded by the context.
+	APITimeout time.Duration
+
+	// DiskSizeGb is the worker persistent disk size. Zero uses the
+	// service default.
+	DiskSizeGb int64
+	// DiskType is the worker persistent disk type, such as
+	// "compute.googleapis.com/projects/<project>/zones/<zone>/diskTypes/pd-ssd".
+	DiskType string
+	// Capabilities, if set, are the capability URNs declared for the SDK
+	// environment in the job spec, such as from graphx.Capabilities.
+	// Otherwise, none are declared.
+	Capabilities []string
+	// DataflowServiceOptions are Dataflow service options, such as
+	// "enable_prime" or "key=value".
+	DataflowServiceOptions []string
+	// Streaming forces a streaming job, even if the pipeline is bounded.
+	// Otherwise, the job type is inferred from the pipeline.
+	Streaming bool
+	// StreamingEngine moves streaming state and shuffle from the worker
+	// disks into the Streaming Engine service. Streaming only.
+	StreamingEngine bool
+	// Critical marks the job as critical with the CriticalLabel label and a
+	// warning in its display data, so that operators and tooling do not
+	// cancel it by mistake. It is advisory only: Dataflow does not prevent
+	// critical jobs from being cancelled.
+	Critical bool
+	// Update replaces the active job with the same name, which is looked up
+	// at submission, unless ReplaceJobID is set.
+	Update bool
+	// ReplaceJobID is the ID of the job to replace, if any.
+	ReplaceJobID string
+	// TransformNameMapping maps the transform names of the replaced job to
+	// the names of this job, for transforms that were renamed. Updates only.
+	TransformNameMapping map[string]string
+	// CleanupTempOnDone deletes the job-specific temp data once the job
+	// completes successfully. The job then uses a subprefix of TempLocation
+	// named after the job and TempSubprefix, so that cleaning up never
+	// touches the temp data of another job with the same name.
+	CleanupTempOnDone bool
+	// TempSubprefix is the subprefix of the job-specific temp data under the
+	// job name, if CleanupTempOnDone is set. If empty, ExecuteResult and
+	// StageOnly use one unique to the submission.
+	TempSubprefix string
 
-	// Worker is the worker binary override.
+	// Worker is the worker binary override. It is a local path or a gs://
+	// object, which is copied server-side instead of uploaded.
 	Worker string
+	// StartupScript is a GCE startup script run on each worker VM before
+	// the harness starts.
+	StartupScript string
+	// WorkerContentType is the content type of the staged worker binary.
+	// If empty, DefaultWorkerContentType is used.
+	WorkerContentType string
+	// ModelFormat is the format of the staged model pipeline: "binary",
+	// "text" or "auto", which stages models of up to ModelTextThreshold
+	// bytes as text and larger ones as binary. If empty, "binary" is used.
+	// The service reads the model as binary, so text is for debugging the
+	// staged model only.
+	ModelFormat string
+	// ModelTextThreshold is the largest binary model size staged as text in
+	// the "auto" format. If zero, DefaultModelTextThreshold is used.
+	ModelTextThreshold int
+	// SpoolModel writes the model to a local temp file, one component at a
+	// time, before it is uploaded, so that the encoded model is never held
+	// in memory in full. This reduces peak memory use for very large models.
+	SpoolModel bool
+	// SpoolModelDir is the directory of the model spool file. If empty,
+	// os.TempDir is used.
+	SpoolModelDir string
+	// ModelObjectName and WorkerObjectName, if set, are the object names of
+	// the staged model pipeline and worker binary relative to the staging
+	// location, instead of unique timestamped names. Each submission
+	// overwrites fixed names. See CheckObjectName.
+	ModelObjectName  string
+	WorkerObjectName string
+	// StagingStorageClass, if set, is the GCS storage class of the staged
+	// objects, such as NEARLINE. By default, objects get the default storage
+	// class of the bucket. See CheckStorageClass.
+	StagingStorageClass string
+	// FilesToStage are local files staged next to the worker binary and
+	// downloaded to the workers as packages named after the files.
+	FilesToStage []string
+	// ExtraPackages are additional local or GCS files, such as jars, that
+	// are staged next to the worker binary and downloaded to the workers
+	// as packages. See Package.
+	ExtraPackages []Package
+	// VerifyStaging checks the size and CRC32C checksum of each staged
+	// object against the local content before the job is submitted.
+	VerifyStaging bool
+	// RecordChecksums reads back the CRC32C and MD5 checksums of each staged
+	// object after upload and records them in the receipt or result. It
+	// costs a metadata request per object, so it is off by default.
+	RecordChecksums bool
+	// ChecksumsFile, if set, is a local file that the checksums of the
+	// staged objects are written to as JSON. It implies RecordChecksums.
+	ChecksumsFile string
+	// StagingUploadConcurrency bounds the number of files staged
+	// simultaneously. If zero, DefaultStagingUploadConcurrency is used.
+	StagingUploadConcurrency int
+	// ReturnJobSpec includes the submitted job spec in the Result of
+	// ExecuteResult. It is not retained by default. See RedactJob.
+	ReturnJobSpec bool
+	// WorkerEnv are additional environment variables set for the worker
+	// harness process.
+	WorkerEnv map[string]string
+	// HarnessThreads, if positive, is the maximum number of bundles that
+	// each worker harness processes concurrently. By default, it is not
+	// limited. Lower values reduce memory pressure and contention for
+	// CPU-bound pipelines.
+	HarnessThreads int
+	// TempPrefixes are GCS temp locations per IO category, such as
+	// gcpopts.TempBigQuery, that override TempLocation for the IOs that
+	// read them. See gcpopts.GetTempPrefix.
+	TempPrefixes map[string]string
+
+	// NotifyWebhook is an optional URL that receives a JSON notification
+	// on submission and on reaching a terminal state.
+	NotifyWebhook string
+	// NotifyWebhookSecret is an optional shared secret sent with each
+	// webhook notification.
+	NotifyWebhookSecret string
+
+	// OpenLineageURL is an optional OpenLineage endpoint, such as
+	// "http://marquez:5000/api/v1/lineage", that receives a START event on
+	// submission and a COMPLETE, FAIL or ABORT event on reaching a terminal
+	// state. Only waited for jobs report terminal events.
+	OpenLineageURL string
+
+	// MetricsExport is an optional Prometheus Pushgateway URL or local
+	// textfile path that the job metrics are exported to once the job
+	// reaches a terminal state. Only waited for jobs are exported.
+	MetricsExport string
+
+	// RedactPatterns are the sensitive key patterns whose values are
+	// redacted when the job or options are printed or written for
+	// inspection. If empty, DefaultRedactPatterns are used. It is not part
+	// of the submission hash. See WithRedactPatterns.
+	RedactPatterns []string `json:"-"`
 
 	// -- Internal use only. Not supported in public Dataflow. --
 
 	TeardownPolicy string
 }
 
+// redacted replaces sensitive option values.
+const redacted = "<redacted>"
+
+// LogOptions logs the job options as indented JSON, with sensitive values,
+// such as secrets and worker environment variable values, redacted. See
+// WithRedactPatterns.
+func LogOptions(ctx context.Context, opts *JobOptions) {
+	data, err := redactIndent(ctx, redactOptions(opts))
+	if err != nil {
+		GetLogger(ctx).Warnf(ctx, "Failed to print job options: %v", err)
+		return
+	}
+	GetLogger(ctx).Infof(ctx, "Job options: %s", data)
+}
+
+// redactOptions returns a copy of the options with sensitive values redacted.
+func redactOptions(opts *JobOptions) *JobOptions {
+	ret := *opts
+	if ret.NotifyWebhookSecret != "" {
+		ret.NotifyWebhookSecret = redacted
+	}
+	if len(ret.WorkerEnv) > 0 {
+		ret.WorkerEnv = make(map[string]string)
+		for k := range opts.WorkerEnv {
+			ret.WorkerEnv[k] = redacted
+		}
+	}
+	return &ret
+}
+
+// RedactJob returns a copy of the job with the values of the worker
+// environment variables and of the given pipeline options redacted, also in
+// the display data, such as before its spec is archived. The job is not
+// modified.
+func RedactJob(job *df.Job, options ...string) (*df.Job, error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode job %v: %v", job.Name, err)
+	}
+	var ret df.Job
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, fmt.Errorf("failed to decode job %v: %v", job.Name, err)
+	}
+	if ret.Environment == nil || len(ret.Environment.SdkPipelineOptions) == 0 {
+		return &ret, nil
+	}
+
+	var sdk map[string]json.RawMessage
+	if err := json.Unmarshal(ret.Environment.SdkPipelineOptions, &sdk); err != nil {
+		return nil, fmt.Errorf("failed to decode pipeline options of job %v: %v", job.Name, err)
+	}
+	const key = "beam:option:go_options:v1"
+	if _, ok := sdk[key]; !ok {
+		return &ret, nil
+	}
+	var goOpts runtime.RawOptions
+	if err := json.Unmarshal(sdk[key], &goOpts); err != nil {
+		return nil, fmt.Errorf("failed to decode Go options of job %v: %v", job.Name, err)
+	}
+	sensitive := make(map[string]bool)
+	for _, k := range append([]string{workerEnvOption}, options...) {
+		sensitive[k] = true
+		if _, ok := goOpts.Options[k]; ok {
+			goOpts.Options[k] = redacted
+		}
+	}
+	sdk[key] = json.RawMessage(newMsg(goOpts))
+
+	if raw, ok := sdk["display_data"]; ok {
+		var dd []*displayData
+		if err := json.Unmarshal(raw, &dd); err != nil {
+			return nil, fmt.Errorf("failed to decode display data of job %v: %v", job.Name, err)
+		}
+		for _, d := range dd {
+			if d.Namespace == "go_options" && sensitive[d.Key] {
+				d.Value = redacted
+			}
+		}
+		sdk["display_data"] = json.RawMessage(newMsg(dd))
+	}
+	ret.Environment.SdkPipelineOptions = newMsg(sdk)
+	return &ret, nil
+}
+
+// workerPackages returns the packages of the worker pool: the worker binary
+// and the staged files.
+func workerPackages(opts *JobOptions, workerURL string) ([]*df.Package, error) {
+	files, err := stagedFiles(workerURL, opts.FilesToStage)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := stagedPackages(workerURL, opts.FilesToStage, opts.ExtraPackages)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*df.Package{{
+		Location: workerURL,
+		Name:     "worker",
+	}}
+	for _, file := range opts.FilesToStage {
+		ret = append(ret, &df.Package{
+			Location: files[file],
+			Name:     filepath.Base(file),
+		})
+	}
+	for _, pkg := range opts.ExtraPackages {
+		name := pkg.packageName()
+		ret = append(ret, &df.Package{
+			Location: extra[name],
+			Name:     name,
+		})
+	}
+	return ret, nil
+}
+
 // Translate translates a pipeline to a Dataflow job.
 func Translate(p *pb.Pipeline, opts *JobOptions, workerURL, modelURL string) (*df.Job, error) {
 	// (1) Translate pipeline to v1b3 speak.
@@ -71,17 +406,45 @@ func Translate(p *pb.Pipeline, opts *JobOptions, workerURL, modelURL string) (*d
 	jobType := "JOB_TYPE_BATCH"
 	apiJobType := "FNAPI_BATCH"
 
-	streaming := !pipelinex.Bounded(p)
+	streaming := opts.Streaming || !pipelinex.Bounded(p)
 	if streaming {
 		jobType = "JOB_TYPE_STREAMING"
 		apiJobType = "FNAPI_STREAMING"
 	}
 
+	goOpts, err := workerOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	images := pipelinex.ContainerImages(p)
 	if len(images) != 1 {
 		return nil, fmt.Errorf("Dataflow supports one container image only: %v", images)
 	}
 
+	annotations, err := encodeAnnotations(jobAnnotations(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	packages, err := workerPackages(opts, workerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	machineType, err := envMachineType(p, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tempPrefix := jobTempLocation(opts)
+	if opts.TempStoragePrefix != "" {
+		if !strings.HasPrefix(opts.TempStoragePrefix, "gs://") {
+			return nil, fmt.Errorf("invalid temp storage prefix %q: not a gs:// URL", opts.TempStoragePrefix)
+		}
+		tempPrefix = opts.TempStoragePrefix
+	}
+
 	job := &df.Job{
 		ProjectId: opts.Project,
 		Name:      opts.Name,
@@ -100,82 +463,411 @@ func Translate(p *pb.Pipeline, opts *JobOptions, workerURL, modelURL string) (*d
 				Options: dataflowOptions{
 					PipelineURL: modelURL,
 					Region:      opts.Region,
+					Annotations: annotations,
 				},
-				GoOptions: opts.Options,
+				GoOptions: goOpts,
 			}),
 			WorkerPools: []*df.WorkerPool{{
-				Kind: "harness",
-				Packages: []*df.Package{{
-					Location: workerURL,
-					Name:     "worker",
-				}},
+				Kind:                        "harness",
+				Packages:                    packages,
 				WorkerHarnessContainerImage: images[0],
 				NumWorkers:                  1,
-				MachineType:                 opts.MachineType,
+				MachineType:                 machineType,
 				Network:                     opts.Network,
-				Zone:                        opts.Zone,
 			}},
-			TempStoragePrefix: opts.TempLocation,
-			Experiments:       append(opts.Experiments, "beam_fn_api"),
+			TempStoragePrefix: tempPrefix,
+			Experiments:       append(append([]string(nil), opts.Experiments...), "beam_fn_api"),
 		},
-		Labels: opts.Labels,
+		Labels: jobLabels(opts),
 		Steps:  steps,
 	}
 
+	if opts.ReplaceJobID != "" {
+		job.ReplaceJobId = opts.ReplaceJobID
+		job.TransformNameMapping = opts.TransformNameMapping
+	} else if len(opts.TransformNameMapping) > 0 {
+		return nil, errors.New("transform name mapping is only valid for job updates")
+	}
+	if opts.Zone != "" {
+		// Pin workers to the zone. Otherwise, the service places them
+		// anywhere in the region.
+		job.Environment.WorkerPools[0].Zone = opts.Zone
+	}
 	if opts.NumWorkers > 0 {
 		job.Environment.WorkerPools[0].NumWorkers = opts.NumWorkers
 	}
 	if opts.TeardownPolicy != "" {
 		job.Environment.WorkerPools[0].TeardownPolicy = opts.TeardownPolicy
 	}
+	if opts.StartupScript != "" {
+		job.Environment.WorkerPools[0].Metadata = map[string]string{
+			"startup-script": opts.StartupScript,
+		}
+	}
+	if opts.DiskSizeGb < 0 {
+		return nil, fmt.Errorf("invalid disk size: %v GB", opts.DiskSizeGb)
+	}
+	if opts.DiskSizeGb > 0 {
+		job.Environment.WorkerPools[0].DiskSizeGb = opts.DiskSizeGb
+	}
+	if opts.DiskType != "" {
+		job.Environment.WorkerPools[0].DiskType = opts.DiskType
+	}
+	if len(opts.Capabilities) > 0 {
+		// The model pipeline has no capabilities field, so declare them
+		// for the Go SDK environment instead.
+		job.Environment.WorkerPools[0].SdkHarnessContainerImages = []*df.SdkHarnessContainerImage{{
+			ContainerImage: job.Environment.WorkerPools[0].WorkerHarnessContainerImage,
+			EnvironmentId:  goEnvironmentID(p),
+			Capabilities:   opts.Capabilities,
+		}}
+	}
+	serviceOptions, err := serviceOptions(opts.DataflowServiceOptions)
+	if err != nil {
+		return nil, err
+	}
+	job.Environment.ServiceOptions = serviceOptions
 	if streaming {
-		// Add separate data disk for streaming jobs
-		job.Environment.WorkerPools[0].DataDisks = []*df.Disk{{}}
+		job.Environment.Experiments = append(job.Environment.Experiments, "streaming")
+		if opts.StreamingEngine {
+			job.Environment.Experiments = append(job.Environment.Experiments, "enable_streaming_engine", "enable_windmill_service")
+		} else {
+			// Add separate data disk for streaming jobs
+			job.Environment.WorkerPools[0].DataDisks = []*df.Disk{{}}
+		}
+	}
+	job.Environment.Experiments = uniqueStrings(job.Environment.Experiments)
+	if err := checkSpecSize(job); err != nil {
+		return nil, err
 	}
 	return job, nil
 }
 
+// maxLabelsAndOptionsBytes is the Dataflow limit on the combined serialized
+// size of the job labels and pipeline options. Update it, if the service
+// limit changes.
+const maxLabelsAndOptionsBytes = 256 << 10
+
+// checkSpecSize returns an error naming the larger contributor, if the job
+// labels and pipeline options exceed maxLabelsAndOptionsBytes. The service
+// otherwise rejects the job with an opaque INVALID_ARGUMENT error.
+func checkSpecSize(job *df.Job) error {
+	labels, err := json.Marshal(job.Labels)
+	if err != nil {
+		return fmt.Errorf("failed to serialize job labels: %v", err)
+	}
+	if len(job.Labels) == 0 {
+		labels = nil
+	}
+	options := len(job.Environment.SdkPipelineOptions)
+
+	total := len(labels) + options
+	if total <= maxLabelsAndOptionsBytes {
+		return nil
+	}
+	larger, size := "pipeline options", options
+	if len(labels) > options {
+		larger, size = "labels", len(labels)
+	}
+	return fmt.Errorf("job labels and pipeline options are %v bytes, which exceeds the Dataflow limit of %v bytes; the %v are the larger contributor with %v bytes", total, maxLabelsAndOptionsBytes, larger, size)
+}
+
+// serviceOptions validates the Dataflow service options and returns them
+// deduplicated and sorted, so that the job spec is deterministic.
+func serviceOptions(list []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, opt := range list {
+		if !serviceOptionRe.MatchString(opt) {
+			return nil, fmt.Errorf("invalid Dataflow service option: %q", opt)
+		}
+		if !seen[opt] {
+			seen[opt] = true
+			ret = append(ret, opt)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// goEnvironmentID returns the id of the Go SDK environment: the single
+// environment of the pipeline, if any, or else the default id.
+func goEnvironmentID(p *pb.Pipeline) string {
+	envs := p.GetComponents().GetEnvironments()
+	if len(envs) == 1 {
+		for id := range envs {
+			return id
+		}
+	}
+	return graphx.DefaultEnvironmentID
+}
+
+// envMachineType returns the machine type of the worker pool of the single
+// environment of the pipeline: its MachineTypeByEnv override, if any, or
+// else the global machine type. Overrides must be valid machine types of
+// environments of the pipeline. The job has a single worker pool, so at most
+// one environment may be overridden.
+func envMachineType(p *pb.Pipeline, opts *JobOptions) (string, error) {
+	envs := p.GetComponents().GetEnvironments()
+	ids := sortedKeys(opts.MachineTypeByEnv)
+	for _, id := range ids {
+		if _, ok := envs[id]; !ok {
+			return "", fmt.Errorf("invalid machine type override for environment %v: no such environment", id)
+		}
+		if mt := opts.MachineTypeByEnv[id]; !machineTypeRe.MatchString(mt) {
+			return "", fmt.Errorf("invalid machine type %q for environment %v", mt, id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return opts.MachineType, nil
+	case 1:
+		return opts.MachineTypeByEnv[ids[0]], nil
+	default:
+		return "", fmt.Errorf("invalid machine type overrides for environments %v: the job has a single worker pool, so only one environment can be overridden", strings.Join(ids, ", "))
+	}
+}
+
+// uniqueStrings returns the strings in order, without duplicates.
+func uniqueStrings(list []string) []string {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// jobTempLocation returns the temp location used by the job. If temp data is
+// cleaned up, it is the subprefix of the temp location of the job.
+func jobTempLocation(opts *JobOptions) string {
+	if !opts.CleanupTempOnDone || opts.TempLocation == "" {
+		return opts.TempLocation
+	}
+	ret := gcsx.Join(opts.TempLocation, opts.Name)
+	if opts.TempSubprefix != "" {
+		ret = gcsx.Join(ret, opts.TempSubprefix)
+	}
+	return ret
+}
+
+// withTempSubprefix returns the options with a temp subprefix unique to the
+// submission, if temp data is cleaned up and no subprefix is set. All
+// attempts of the submission share it.
+func withTempSubprefix(opts *JobOptions) *JobOptions {
+	if !opts.CleanupTempOnDone || opts.TempSubprefix != "" {
+		return opts
+	}
+	ret := *opts
+	ret.TempSubprefix = newTempSubprefix()
+	return &ret
+}
+
+// newTempSubprefix returns a unique temp subprefix of a submission.
+func newTempSubprefix() string {
+	now := time.Now().UTC()
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%v-%x", now.Format("20060102-150405"), now.UnixNano())
+	}
+	return fmt.Sprintf("%v-%x", now.Format("20060102-150405"), b)
+}
+
 // Submit submits a prepared job to Cloud Dataflow.
+//
+// NOTE: unlike templates.launch, jobs.create has no validate-only mode in
+// the v1b3 API, so the service cannot check a job spec without creating the
+// job. Use --dry_run or ValidateAll for local validation instead.
 func Submit(ctx context.Context, client *df.Service, project, region string, job *df.Job) (*df.Job, error) {
-	return client.Projects.Locations.Jobs.Create(project, region, job).Do()
+	return createJob(ctx, client, project, region, job)
+}
+
+// newClientRequestID returns a unique client request ID of a job submission,
+// with which the service deduplicates the creates of the job.
+func newClientRequestID() string {
+	now := time.Now().UTC()
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%v_%x", now.Format("20060102150405"), now.UnixNano())
+	}
+	return fmt.Sprintf("%v_%x", now.Format("20060102150405"), b)
+}
+
+// jobCreator creates Dataflow jobs. It is the seam of the submission path
+// for tests.
+type jobCreator interface {
+	// Create creates the job in the given project and region and returns
+	// the created job.
+	Create(ctx context.Context, project, region string, job *df.Job) (*df.Job, error)
+}
+
+// serviceJobCreator creates jobs with the Dataflow service.
+type serviceJobCreator struct {
+	client *df.Service
+}
+
+func (c serviceJobCreator) Create(ctx context.Context, project, region string, job *df.Job) (*df.Job, error) {
+	return Submit(ctx, c.client, project, region, job)
+}
+
+// newJobCreator returns the job creator of the client. Tests replace it.
+var newJobCreator = func(client *df.Service) jobCreator {
+	return serviceJobCreator{client: client}
+}
+
+// activeJobID returns the ID of the single active job with the given name,
+// such as the job to replace in an update.
+func activeJobID(ctx context.Context, client *df.Service, project, region, name string, timeout time.Duration) (string, error) {
+	var ids []string
+	err := retry(ctx, "Active job listing", func() error {
+		cctx, cancel := apiContext(ctx, timeout)
+		defer cancel()
+
+		ids = nil
+		return listActiveJobs(cctx, client, project, region, func(list *df.ListJobsResponse) error {
+			for _, job := range list.Jobs {
+				if job.Name == name {
+					ids = append(ids, job.Id)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list active jobs: %v", err)
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no active job named %v in region %v to update", name, region)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("multiple active jobs named %v in region %v: %v", name, region, strings.Join(ids, ", "))
+	}
+}
+
+// WithJobOptions returns a context under which the runner uses the logger,
+// quota project, backoff, transport, token source, correlation ID, redact
+// patterns and jobs path of the options. All entry points that call Google
+// Cloud APIs apply it.
+func WithJobOptions(ctx context.Context, opts *JobOptions) context.Context {
+	ctx = WithLogger(ctx, opts.Logger)
+	ctx = WithQuotaProject(ctx, opts.QuotaProject)
+	ctx = WithBackoff(ctx, opts.Backoff)
+	ctx = WithTransport(ctx, opts.Transport)
+	ctx = WithTokenSource(ctx, opts.TokenSource)
+	ctx = WithCorrelationID(ctx, opts.CorrelationID)
+	ctx = WithRedactPatterns(ctx, opts.RedactPatterns)
+	return WithGlobalJobsPath(ctx, opts.GlobalJobsPath)
+}
+
+// apiContext returns a context for a single Dataflow API call. It is bounded
+// by the timeout, if positive, as well as by the parent context.
+func apiContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 // WaitForCompletion monitors the given job until completion. It logs any messages
 // and state changes received.
 func WaitForCompletion(ctx context.Context, client *df.Service, project, region, jobID string) error {
-	for {
-		j, err := client.Projects.Locations.Jobs.Get(project, region, jobID).Do()
+	return waitForCompletion(ctx, client, project, region, jobID, 0, &Result{JobID: jobID})
+}
+
+// pollInterval is the default time between job status polls.
+var pollInterval = 30 * time.Second
+
+// waitForCompletion is WaitForCompletion, but bounds each API call by the
+// given timeout and records the observed state changes in the given result.
+func waitForCompletion(ctx context.Context, client *df.Service, project, region, jobID string, timeout time.Duration, res *Result) error {
+	strategy := pollStrategy(ctx)
+	for poll := 1; ; poll++ {
+		var j *df.Job
+		err := retry(ctx, "Job status poll", func() error {
+			cctx, cancel := apiContext(ctx, timeout)
+			defer cancel()
+
+			var err error
+			j, err = getJob(cctx, client, project, region, jobID, "")
+			return err
+		})
 		if err != nil {
 			return fmt.Errorf("failed to get job: %v", err)
 		}
+		res.record(j.CurrentState, stateTime(j.CurrentStateTime))
 
 		switch j.CurrentState {
 		case "JOB_STATE_DONE":
-			log.Info(ctx, "Job succeeded!")
+			GetLogger(ctx).Infof(ctx, "Job succeeded!")
 			return nil
 
 		case "JOB_STATE_CANCELLED":
-			log.Info(ctx, "Job cancelled")
+			GetLogger(ctx).Infof(ctx, "Job cancelled")
+			return nil
+
+		case "JOB_STATE_UPDATED":
+			GetLogger(ctx).Infof(ctx, "Job updated and replaced by a new job")
+			return nil
+
+		case "JOB_STATE_DRAINED":
+			GetLogger(ctx).Infof(ctx, "Job drained")
 			return nil
 
 		case "JOB_STATE_FAILED":
 			return fmt.Errorf("job %s failed", jobID)
 
 		case "JOB_STATE_RUNNING":
-			log.Info(ctx, "Job still running ...")
+			GetLogger(ctx).Infof(ctx, "Job still running ...")
 
 		default:
-			log.Infof(ctx, "Job state: %v ...", j.CurrentState)
+			GetLogger(ctx).Infof(ctx, "Job state: %v ...", j.CurrentState)
 		}
 
-		time.Sleep(30 * time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(strategy.NextDelay(poll)):
+		}
 	}
 }
 
+// CheckCredentials verifies that default application credentials are
+// available and can produce a token. It returns an actionable error
+// otherwise. If the context has a token source, it is checked instead.
+func CheckCredentials(ctx context.Context) error {
+	if getTokenSource(ctx) != nil {
+		_, err := tokenSource(ctx)
+		return err
+	}
+	ts, err := google.DefaultTokenSource(ctx, df.CloudPlatformScope)
+	if err == nil {
+		_, err = ts.Token()
+	}
+	if err != nil {
+		return fmt.Errorf("no valid Google Cloud credentials found: %v. Run 'gcloud auth application-default login' or set GOOGLE_APPLICATION_CREDENTIALS to a service account key file", err)
+	}
+	return nil
+}
+
+// defaultClient returns an HTTP client with default application credentials.
+// Tests may replace it to talk to a fake service.
+var defaultClient = google.DefaultClient
+
 // NewClient creates a new dataflow client with default application credentials
-// and CloudPlatformScope. The Dataflow endpoint is optionally overridden.
-func NewClient(ctx context.Context, endpoint string) (*df.Service, error) {
-	cl, err := google.DefaultClient(ctx, df.CloudPlatformScope)
+// and CloudPlatformScope, plus any extra scopes. The Dataflow endpoint is
+// optionally overridden. See WithQuotaProject for billing API usage to a
+// different project.
+func NewClient(ctx context.Context, endpoint string, scopes ...string) (*df.Service, error) {
+	all, err := clientScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := newHTTPClient(ctx, all...)
 	if err != nil {
 		return nil, err
 	}
@@ -184,19 +876,262 @@ func NewClient(ctx context.Context, endpoint string) (*df.Service, error) {
 		return nil, err
 	}
 	if endpoint != "" {
-		log.Infof(ctx, "Dataflow endpoint override: %s", endpoint)
+		GetLogger(ctx).Infof(ctx, "Dataflow endpoint override: %s", endpoint)
 		client.BasePath = endpoint
 	}
 	return client, nil
 }
 
+// EndpointRegion returns the region of a regional Dataflow endpoint, such as
+// us-central1 for https://us-central1-dataflow.googleapis.com/ or
+// https://dataflow.us-central1.rep.googleapis.com/. It returns false for
+// global or unrecognized endpoints.
+func EndpointRegion(endpoint string) (string, bool) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false
+	}
+	host := u.Hostname()
+	if region := strings.TrimSuffix(host, "-dataflow.googleapis.com"); region != host && region != "" {
+		return region, true
+	}
+	if strings.HasPrefix(host, "dataflow.") && strings.HasSuffix(host, ".rep.googleapis.com") {
+		region := strings.TrimSuffix(strings.TrimPrefix(host, "dataflow."), ".rep.googleapis.com")
+		if region != "" && !strings.Contains(region, ".") {
+			return region, true
+		}
+	}
+	return "", false
+}
+
+// clientScopes returns CloudPlatformScope merged with the extra scopes, which
+// must be URLs.
+func clientScopes(extra []string) ([]string, error) {
+	ret := []string{df.CloudPlatformScope}
+	for _, scope := range extra {
+		u, err := url.Parse(scope)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid OAuth scope %q: must be an https URL", scope)
+		}
+		if scope != df.CloudPlatformScope {
+			ret = append(ret, scope)
+		}
+	}
+	return ret, nil
+}
+
+// workerEnvOption is the Go pipeline option key under which the worker
+// environment is passed to the harness. See harness/init.
+const workerEnvOption = "worker_env"
+
+// harnessThreadsOption is the Go pipeline option key under which the maximum
+// number of concurrently processed bundles is passed to the harness.
+const harnessThreadsOption = "number_of_worker_harness_threads"
+
+var (
+	envKeyRe = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+	// tempCategoryRe matches IO categories of temp prefixes, such as
+	// "bigquery".
+	tempCategoryRe = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+
+	// serviceOptionRe matches Dataflow service options of the form "name"
+	// or "name=value".
+	serviceOptionRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*(=[^\s,]+)?$`)
+
+	// machineTypeRe matches GCE machine types, such as "n1-standard-4" or
+	// "e2-custom-4-16384".
+	machineTypeRe = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)+$`)
+
+	// reservedEnvKeys are environment variables that the SDK or container
+	// relies on and that must not be overridden.
+	reservedEnvKeys = map[string]bool{
+		"HOME":                           true,
+		"PATH":                           true,
+		"GOOGLE_APPLICATION_CREDENTIALS": true,
+	}
+)
+
+// CheckTempPrefixes returns an error, if an IO category of the temp prefixes
+// is not lowercase or a prefix is not a gs:// location.
+func CheckTempPrefixes(prefixes map[string]string) error {
+	for _, category := range sortedKeys(prefixes) {
+		if !tempCategoryRe.MatchString(category) {
+			return fmt.Errorf("invalid temp prefix category: %q", category)
+		}
+		if _, _, err := gcsx.ParseObject(prefixes[category]); err != nil {
+			return fmt.Errorf("invalid temp prefix for %v: %v", category, err)
+		}
+	}
+	return nil
+}
+
+// workerOptions returns the Go pipeline options sent to the worker, including
+// any worker environment variables and mutations.
+func workerOptions(opts *JobOptions) (runtime.RawOptions, error) {
+	if len(opts.WorkerEnv) == 0 && len(opts.TempPrefixes) == 0 && opts.HarnessThreads == 0 && opts.PipelineOptionsMutator == nil {
+		return opts.Options, nil
+	}
+
+	ret := runtime.RawOptions{Options: make(map[string]string)}
+	for k, v := range opts.Options.Options {
+		ret.Options[k] = v
+	}
+
+	if len(opts.WorkerEnv) > 0 {
+		for k := range opts.WorkerEnv {
+			if !envKeyRe.MatchString(k) {
+				return runtime.RawOptions{}, fmt.Errorf("invalid worker environment variable name: %q", k)
+			}
+			if reservedEnvKeys[k] || strings.HasPrefix(k, "BEAM_") {
+				return runtime.RawOptions{}, fmt.Errorf("worker environment variable %q is reserved by the SDK", k)
+			}
+		}
+		data, err := json.Marshal(opts.WorkerEnv)
+		if err != nil {
+			return runtime.RawOptions{}, err
+		}
+		ret.Options[workerEnvOption] = string(data)
+	}
+
+	if err := CheckTempPrefixes(opts.TempPrefixes); err != nil {
+		return runtime.RawOptions{}, err
+	}
+	for category, prefix := range opts.TempPrefixes {
+		ret.Options[gcpopts.TempPrefixOption(category)] = prefix
+	}
+
+	if opts.HarnessThreads < 0 {
+		return runtime.RawOptions{}, fmt.Errorf("invalid number of worker harness threads: %v", opts.HarnessThreads)
+	}
+	if opts.HarnessThreads > 0 {
+		ret.Options[harnessThreadsOption] = strconv.Itoa(opts.HarnessThreads)
+	}
+
+	if opts.PipelineOptionsMutator != nil {
+		m := make(map[string]interface{})
+		for k, v := range ret.Options {
+			m[k] = v
+		}
+		if err := opts.PipelineOptionsMutator(m); err != nil {
+			return runtime.RawOptions{}, fmt.Errorf("pipeline options mutator failed: %v", err)
+		}
+
+		ret.Options = make(map[string]string)
+		for k, v := range m {
+			if str, ok := v.(string); ok {
+				ret.Options[k] = str
+				continue
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				return runtime.RawOptions{}, fmt.Errorf("pipeline option %v is not JSON-serializable: %v", k, err)
+			}
+			ret.Options[k] = string(data)
+		}
+	}
+	return ret, nil
+}
+
 type dataflowOptions struct {
 	PipelineURL string `json:"pipelineUrl"`
 	Region      string `json:"region"`
+	Annotations string `json:"beam_annotations,omitempty"`
+}
+
+// encodeAnnotations returns the annotations as a JSON-encoded string, or
+// the empty string if there are none.
+func encodeAnnotations(annotations map[string]string) (string, error) {
+	if len(annotations) == 0 {
+		return "", nil
+	}
+	for k := range annotations {
+		if k == "" {
+			return "", errors.New("invalid annotation: empty key")
+		}
+	}
+	data, err := json.Marshal(annotations)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// GetAnnotations returns the annotations stored in the job environment, if
+// any. It is the inverse of setting JobOptions.Annotations. The job must be
+// retrieved with a view that includes the environment.
+func GetAnnotations(job *df.Job) (map[string]string, error) {
+	if job.Environment == nil || len(job.Environment.SdkPipelineOptions) == 0 {
+		return nil, nil
+	}
+	var sdk struct {
+		Options struct {
+			Annotations string `json:"beam_annotations"`
+		} `json:"options"`
+	}
+	if err := json.Unmarshal(job.Environment.SdkPipelineOptions, &sdk); err != nil {
+		return nil, fmt.Errorf("failed to decode pipeline options of job %v: %v", job.Id, err)
+	}
+	if sdk.Options.Annotations == "" {
+		return nil, nil
+	}
+	var ret map[string]string
+	if err := json.Unmarshal([]byte(sdk.Options.Annotations), &ret); err != nil {
+		return nil, fmt.Errorf("failed to decode annotations of job %v: %v", job.Id, err)
+	}
+	return ret, nil
+}
+
+// CriticalLabel is the job label of critical jobs. See JobOptions.Critical.
+const CriticalLabel = "beam-critical"
+
+// CorrelationLabel is the job label holding the correlation ID.
+const CorrelationLabel = "beam-correlation-id"
+
+// criticalWarning is the display data warning of critical jobs.
+const criticalWarning = "CRITICAL JOB: do not cancel or drain without approval of the owners."
+
+// jobLabels returns the job labels, including the critical label, if the job
+// is critical, and the provenance and correlation labels, if any. The options are not
+// modified.
+func jobLabels(opts *JobOptions) map[string]string {
+	if !opts.Critical && opts.Provenance == nil && opts.CorrelationID == "" {
+		return opts.Labels
+	}
+	ret := make(map[string]string)
+	for k, v := range opts.Labels {
+		ret[k] = v
+	}
+	if opts.Critical {
+		ret[CriticalLabel] = "true"
+	}
+	if opts.Provenance != nil {
+		ret[ProvenanceLabel] = opts.Provenance.label()
+	}
+	if opts.CorrelationID != "" {
+		ret[CorrelationLabel] = opts.CorrelationID
+	}
+	return ret
+}
+
+// jobAnnotations returns the job annotations, including the provenance, if
+// any. The options are not modified.
+func jobAnnotations(opts *JobOptions) map[string]string {
+	if opts.Provenance == nil {
+		return opts.Annotations
+	}
+	ret := opts.Provenance.annotations()
+	for k, v := range opts.Annotations {
+		ret[k] = v
+	}
+	return ret
 }
 
 func printOptions(opts *JobOptions, images []string) []*displayData {
 	var ret []*displayData
+	if opts.Critical {
+		ret = append(ret, newDisplayData("critical", "WARNING", "options", criticalWarning))
+	}
 	addIfNonEmpty := func(name string, value string) {
 		if value != "" {
 			ret = append(ret, newDisplayData(name, "", "options", value))
@@ -213,8 +1148,8 @@ func printOptions(opts *JobOptions, images []string) []*displayData {
 	addIfNonEmpty("container_images", strings.Join(images, ","))
 	addIfNonEmpty("temp_location", opts.TempLocation)
 
-	for k, v := range opts.Options.Options {
-		ret = append(ret, newDisplayData(k, "", "go_options", v))
+	for _, k := range sortedKeys(opts.Options.Options) {
+		ret = append(ret, newDisplayData(k, "", "go_options", opts.Options.Options[k]))
 	}
 	return ret
 }
@@ -0,0 +1,867 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/apache/beam/sdks/go/pkg/beam/options/gcpopts"
+	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/googleapi"
+)
+
+// emptyPipeline returns a minimal translatable pipeline.
+func emptyPipeline() *pb.Pipeline {
+	return &pb.Pipeline{
+		Components: &pb.Components{
+			Environments: map[string]*pb.Environment{
+				"go": {Url: "image"},
+			},
+		},
+	}
+}
+
+func TestTranslateZone(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+	}{
+		{"region-only", ""},
+		{"zonal", "us-central1-b"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &JobOptions{
+				Project: "project",
+				Region:  "us-central1",
+				Zone:    test.zone,
+			}
+			job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+			if err != nil {
+				t.Fatalf("Translate failed: %v", err)
+			}
+			if actual := job.Environment.WorkerPools[0].Zone; actual != test.zone {
+				t.Errorf("worker pool zone = %q, want %q", actual, test.zone)
+			}
+		})
+	}
+}
+
+func TestExtraPackages(t *testing.T) {
+	opts := &JobOptions{
+		Project:       "project",
+		Region:        "us-central1",
+		FilesToStage:  []string{"conf/app.yaml"},
+		ExtraPackages: []Package{{Location: "lib/x.jar"}, {Location: "gs://deps/y.zip", Name: "y"}},
+	}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	var actual []string
+	for _, pkg := range job.Environment.WorkerPools[0].Packages {
+		actual = append(actual, pkg.Name+"="+pkg.Location)
+	}
+	exp := []string{
+		"worker=gs://foo/worker",
+		"app.yaml=gs://foo/worker-files/app.yaml",
+		"x.jar=gs://foo/worker-packages/x.jar",
+		"y=gs://foo/worker-packages/y",
+	}
+	if !reflect.DeepEqual(actual, exp) {
+		t.Errorf("worker pool packages = %v, want %v", actual, exp)
+	}
+
+	opts.ExtraPackages = append(opts.ExtraPackages, Package{Location: "other/app.yaml"})
+	if _, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model"); err == nil {
+		t.Error("Translate succeeded for a package with the name of a file to stage, want error")
+	}
+}
+
+func TestWorkerOptions(t *testing.T) {
+	tests := []struct {
+		env map[string]string
+		ok  bool
+	}{
+		{nil, true},
+		{map[string]string{"FEATURE_X": "on"}, true},
+		{map[string]string{"1BAD": "x"}, false},
+		{map[string]string{"BAD-NAME": "x"}, false},
+		{map[string]string{"PATH": "/tmp"}, false},
+		{map[string]string{"BEAM_FOO": "x"}, false},
+	}
+
+	for _, test := range tests {
+		opts := &JobOptions{
+			Options:   runtime.RawOptions{Options: map[string]string{"a": "b"}},
+			WorkerEnv: test.env,
+		}
+		raw, err := workerOptions(opts)
+		if _, ok := opts.Options.Options[workerEnvOption]; ok {
+			t.Errorf("workerOptions(%v) modified the original options", test.env)
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("workerOptions(%v) failed: %v, want ok=%v", test.env, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if raw.Options["a"] != "b" {
+			t.Errorf("workerOptions(%v) dropped option a: %v", test.env, raw.Options)
+		}
+		if _, ok := raw.Options[workerEnvOption]; ok != (len(test.env) > 0) {
+			t.Errorf("workerOptions(%v) = %v, want worker env iff non-empty", test.env, raw.Options)
+		}
+	}
+}
+
+func TestWorkerOptionsTempPrefixes(t *testing.T) {
+	tests := []struct {
+		prefixes map[string]string
+		ok       bool
+	}{
+		{map[string]string{gcpopts.TempBigQuery: "gs://bq-temp/tmp", gcpopts.TempGCS: "gs://gcs-temp"}, true},
+		{map[string]string{"BigQuery": "gs://bq-temp"}, false},
+		{map[string]string{gcpopts.TempGCS: "/tmp"}, false},
+	}
+
+	for _, test := range tests {
+		opts := &JobOptions{TempPrefixes: test.prefixes}
+		raw, err := workerOptions(opts)
+		if (err == nil) != test.ok {
+			t.Errorf("workerOptions(%v) failed: %v, want ok=%v", test.prefixes, err, test.ok)
+			continue
+		}
+		for category, prefix := range test.prefixes {
+			if test.ok && raw.Options[gcpopts.TempPrefixOption(category)] != prefix {
+				t.Errorf("workerOptions(%v) = %v, want temp prefix %v for %v", test.prefixes, raw.Options, prefix, category)
+			}
+		}
+	}
+}
+
+func TestWorkerOptionsHarnessThreads(t *testing.T) {
+	tests := []struct {
+		threads int
+		want    string
+		ok      bool
+	}{
+		{0, "", true},
+		{4, "4", true},
+		{-1, "", false},
+	}
+
+	for _, test := range tests {
+		opts := &JobOptions{HarnessThreads: test.threads}
+		raw, err := workerOptions(opts)
+		if (err == nil) != test.ok {
+			t.Errorf("workerOptions(%v) failed: %v, want ok=%v", test.threads, err, test.ok)
+			continue
+		}
+		if test.ok && raw.Options[harnessThreadsOption] != test.want {
+			t.Errorf("workerOptions(%v) = %v, want %v=%q", test.threads, raw.Options, harnessThreadsOption, test.want)
+		}
+	}
+}
+
+func TestPipelineOptionsMutator(t *testing.T) {
+	opts := &JobOptions{
+		Options: runtime.RawOptions{Options: map[string]string{"a": "b", "c": "d"}},
+		PipelineOptionsMutator: func(m map[string]interface{}) error {
+			m["a"] = "override"
+			m["n"] = 42
+			delete(m, "c")
+			return nil
+		},
+	}
+	raw, err := workerOptions(opts)
+	if err != nil {
+		t.Fatalf("workerOptions failed: %v", err)
+	}
+	expected := map[string]string{"a": "override", "n": "42"}
+	if !reflect.DeepEqual(raw.Options, expected) {
+		t.Errorf("workerOptions = %v, want %v", raw.Options, expected)
+	}
+
+	opts.PipelineOptionsMutator = func(m map[string]interface{}) error {
+		m["bad"] = func() {}
+		return nil
+	}
+	if _, err := workerOptions(opts); err == nil {
+		t.Error("workerOptions with unserializable option succeeded, want error")
+	}
+}
+
+func TestWaitForCompletionAPITimeout(t *testing.T) {
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stall until the client gives up.
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	client, err := df.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waitForCompletion(context.Background(), client, "project", "region", "job", 10*time.Millisecond, &Result{})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("waitForCompletion succeeded, want timeout error")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("waitForCompletion did not time out")
+	}
+}
+
+func TestAnnotationsRoundTrip(t *testing.T) {
+	annotations := map[string]string{
+		"owner":       "Data Platform <dp@example.com>",
+		"description": "a value that is far too long and too rich to be a label, with UPPER case and spaces",
+	}
+	opts := &JobOptions{
+		Project:     "project",
+		Region:      "us-central1",
+		Annotations: annotations,
+	}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	actual, err := GetAnnotations(job)
+	if err != nil {
+		t.Fatalf("GetAnnotations failed: %v", err)
+	}
+	if !reflect.DeepEqual(actual, annotations) {
+		t.Errorf("GetAnnotations() = %v, want %v", actual, annotations)
+	}
+
+	opts.Annotations = nil
+	job, err = Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	if actual, err := GetAnnotations(job); err != nil || actual != nil {
+		t.Errorf("GetAnnotations() = %v, %v, want no annotations", actual, err)
+	}
+}
+
+func TestTranslateServiceOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []string
+		exp     []string
+		wantErr bool
+	}{
+		{"none", nil, nil, false},
+		{"prime", []string{"enable_prime"}, []string{"enable_prime"}, false},
+		{"key-value", []string{"max_workflow_runtime_walltime_seconds=3600", "enable_prime"}, []string{"enable_prime", "max_workflow_runtime_walltime_seconds=3600"}, false},
+		{"duplicates", []string{"enable_prime", "enable_google_cloud_profiler", "enable_prime"}, []string{"enable_google_cloud_profiler", "enable_prime"}, false},
+		{"empty", []string{""}, nil, true},
+		{"whitespace", []string{"enable prime"}, nil, true},
+		{"no-name", []string{"=value"}, nil, true},
+		{"no-value", []string{"key="}, nil, true},
+		{"comma", []string{"a,b"}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &JobOptions{
+				Project:                "project",
+				Region:                 "us-central1",
+				DataflowServiceOptions: test.opts,
+			}
+			job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Translate succeeded, want error for %q", test.opts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Translate failed: %v", err)
+			}
+			if actual := job.Environment.ServiceOptions; !reflect.DeepEqual(actual, test.exp) {
+				t.Errorf("service options = %v, want %v", actual, test.exp)
+			}
+		})
+	}
+}
+
+func TestTranslateStreaming(t *testing.T) {
+	tests := []struct {
+		streaming bool
+		exp       string
+	}{
+		{false, "JOB_TYPE_BATCH"},
+		{true, "JOB_TYPE_STREAMING"},
+	}
+
+	for _, test := range tests {
+		opts := &JobOptions{
+			Project:   "project",
+			Region:    "us-central1",
+			Streaming: test.streaming,
+		}
+		job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+		if err != nil {
+			t.Fatalf("Translate failed: %v", err)
+		}
+		if job.Type != test.exp {
+			t.Errorf("Translate(streaming=%v) job type = %v, want %v", test.streaming, job.Type, test.exp)
+		}
+		if got := hasString(job.Environment.Experiments, "streaming"); got != test.streaming {
+			t.Errorf("Translate(streaming=%v) experiments = %v, want streaming experiment %v", test.streaming, job.Environment.Experiments, test.streaming)
+		}
+	}
+}
+
+func TestTranslateDiskSizeGb(t *testing.T) {
+	tests := []struct {
+		size int64
+		exp  int64
+		ok   bool
+	}{
+		{0, 0, true},
+		{100, 100, true},
+		{-1, 0, false},
+	}
+
+	for _, test := range tests {
+		opts := &JobOptions{
+			Project:    "project",
+			Region:     "us-central1",
+			DiskSizeGb: test.size,
+		}
+		job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+		if (err == nil) != test.ok {
+			t.Errorf("Translate(disk size %v) failed: %v, want ok=%v", test.size, err, test.ok)
+			continue
+		}
+		if test.ok && job.Environment.WorkerPools[0].DiskSizeGb != test.exp {
+			t.Errorf("Translate(disk size %v) = %v GB, want %v GB", test.size, job.Environment.WorkerPools[0].DiskSizeGb, test.exp)
+		}
+	}
+}
+
+func TestTranslateCritical(t *testing.T) {
+	opts := &JobOptions{
+		Project:  "project",
+		Region:   "us-central1",
+		Labels:   map[string]string{"team": "data"},
+		Critical: true,
+	}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	exp := map[string]string{"team": "data", CriticalLabel: "true"}
+	if !reflect.DeepEqual(job.Labels, exp) {
+		t.Errorf("Translate() labels = %v, want %v", job.Labels, exp)
+	}
+	if len(opts.Labels) != 1 {
+		t.Errorf("Translate() modified the option labels: %v", opts.Labels)
+	}
+	if !strings.Contains(string(job.Environment.SdkPipelineOptions), criticalWarning) {
+		t.Errorf("Translate() pipeline options = %s, want critical warning", job.Environment.SdkPipelineOptions)
+	}
+}
+
+func TestTranslateStartupScript(t *testing.T) {
+	opts := &JobOptions{
+		Project:       "project",
+		Region:        "us-central1",
+		StartupScript: "#!/bin/sh\necho hello\n",
+	}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	if actual := job.Environment.WorkerPools[0].Metadata["startup-script"]; actual != opts.StartupScript {
+		t.Errorf("startup-script metadata = %q, want %q", actual, opts.StartupScript)
+	}
+}
+
+func TestTranslateUpdate(t *testing.T) {
+	mapping := map[string]string{"old": "new"}
+	opts := &JobOptions{
+		Project:              "project",
+		Region:               "us-central1",
+		ReplaceJobID:         "job",
+		TransformNameMapping: mapping,
+	}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	if job.ReplaceJobId != "job" || !reflect.DeepEqual(job.TransformNameMapping, mapping) {
+		t.Errorf("Translate() = (%v, %v), want (job, %v)", job.ReplaceJobId, job.TransformNameMapping, mapping)
+	}
+
+	opts.ReplaceJobID = ""
+	if _, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model"); err == nil {
+		t.Error("Translate succeeded with a transform name mapping but no job to replace, want error")
+	}
+}
+
+func TestActiveJobID(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if filter := r.URL.Query().Get("filter"); filter != "ACTIVE" {
+			t.Errorf("listed jobs with filter %q, want ACTIVE", filter)
+		}
+		json.NewEncoder(w).Encode(&df.ListJobsResponse{Jobs: []*df.Job{
+			{Id: "1", Name: "single"},
+			{Id: "2", Name: "double"},
+			{Id: "3", Name: "double"},
+		}})
+	}))
+	defer srv.Close()
+
+	client, err := df.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	ctx := context.Background()
+	if id, err := activeJobID(ctx, client, "project", "region", "single", 0); err != nil || id != "1" {
+		t.Errorf("activeJobID(single) = (%v, %v), want (1, nil)", id, err)
+	}
+	for _, name := range []string{"none", "double"} {
+		if id, err := activeJobID(ctx, client, "project", "region", name, 0); err == nil {
+			t.Errorf("activeJobID(%v) = %v, want error", name, id)
+		}
+	}
+}
+
+func TestClientScopes(t *testing.T) {
+	const bigquery = "https://www.googleapis.com/auth/bigquery"
+
+	tests := []struct {
+		extra   []string
+		exp     []string
+		wantErr bool
+	}{
+		{nil, []string{df.CloudPlatformScope}, false},
+		{[]string{bigquery}, []string{df.CloudPlatformScope, bigquery}, false},
+		{[]string{df.CloudPlatformScope, bigquery}, []string{df.CloudPlatformScope, bigquery}, false},
+		{[]string{"bigquery"}, nil, true},
+		{[]string{"http://www.googleapis.com/auth/bigquery"}, nil, true},
+	}
+
+	for _, test := range tests {
+		actual, err := clientScopes(test.extra)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("clientScopes(%v) succeeded, want error", test.extra)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(actual, test.exp) {
+			t.Errorf("clientScopes(%v) = (%v, %v), want %v", test.extra, actual, err, test.exp)
+		}
+	}
+}
+
+func TestRedactOptions(t *testing.T) {
+	opts := &JobOptions{
+		Name:                   "job",
+		WorkerEnv:              map[string]string{"TOKEN": "s3cr3t"},
+		NotifyWebhookSecret:    "s3cr3t",
+		PipelineOptionsMutator: func(map[string]interface{}) error { return nil },
+	}
+	data, err := json.Marshal(redactOptions(opts))
+	if err != nil {
+		t.Fatalf("failed to marshal redacted options: %v", err)
+	}
+	if str := string(data); strings.Contains(str, "s3cr3t") || !strings.Contains(str, "TOKEN") {
+		t.Errorf("redacted options = %v, want secrets redacted but keys kept", str)
+	}
+	if opts.WorkerEnv["TOKEN"] != "s3cr3t" || opts.NotifyWebhookSecret != "s3cr3t" {
+		t.Errorf("redactOptions modified the options: %+v", opts)
+	}
+}
+
+func TestTranslateTempStoragePrefix(t *testing.T) {
+	opts := &JobOptions{
+		Project:      "project",
+		Region:       "us-central1",
+		TempLocation: "gs://foo/tmp",
+	}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	if actual := job.Environment.TempStoragePrefix; actual != opts.TempLocation {
+		t.Errorf("Translate() temp storage prefix = %v, want %v", actual, opts.TempLocation)
+	}
+
+	opts.TempStoragePrefix = "gs://bar/service-tmp"
+	job, err = Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	if actual := job.Environment.TempStoragePrefix; actual != opts.TempStoragePrefix {
+		t.Errorf("Translate() temp storage prefix = %v, want %v", actual, opts.TempStoragePrefix)
+	}
+
+	opts.TempStoragePrefix = "/tmp/service"
+	if _, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model"); err == nil {
+		t.Error("Translate succeeded with a non-GCS temp storage prefix, want error")
+	}
+}
+
+func TestTranslateCleanupTempLocation(t *testing.T) {
+	opts := &JobOptions{
+		Name:              "job",
+		Project:           "project",
+		Region:            "us-central1",
+		TempLocation:      "gs://foo/tmp",
+		CleanupTempOnDone: true,
+	}
+	tests := []struct {
+		subprefix, exp string
+	}{
+		{"", "gs://foo/tmp/job"},
+		{"20200101-000000-1234", "gs://foo/tmp/job/20200101-000000-1234"},
+	}
+	for _, test := range tests {
+		attempt := *opts
+		attempt.TempSubprefix = test.subprefix
+		for i := 0; i < 2; i++ {
+			job, err := Translate(emptyPipeline(), &attempt, "gs://foo/worker", "gs://foo/model")
+			if err != nil {
+				t.Fatalf("Translate failed: %v", err)
+			}
+			if prefix := job.Environment.TempStoragePrefix; prefix != test.exp {
+				t.Errorf("Translate(subprefix %q) temp storage prefix = %v, want %v", test.subprefix, prefix, test.exp)
+			}
+		}
+	}
+
+	a, b := withTempSubprefix(opts), withTempSubprefix(opts)
+	if a.TempSubprefix == "" || a.TempSubprefix == b.TempSubprefix || opts.TempSubprefix != "" {
+		t.Errorf("withTempSubprefix() = %q, %q, want unique subprefixes and the options unchanged", a.TempSubprefix, b.TempSubprefix)
+	}
+	if fixed := withTempSubprefix(a); fixed.TempSubprefix != a.TempSubprefix {
+		t.Errorf("withTempSubprefix(%q) = %q, want it kept", a.TempSubprefix, fixed.TempSubprefix)
+	}
+
+	// Temp data outside of the job-specific subprefix is never deleted, so
+	// no storage client is needed.
+	for _, location := range []string{"gs://foo/tmp", "gs://foo/tmp/", "gs://foo/tmpx/job", "gs://bar/service-tmp", ""} {
+		job := &df.Job{Environment: &df.Environment{TempStoragePrefix: location}}
+		if err := CleanupTemp(context.Background(), opts, job); err != nil {
+			t.Errorf("CleanupTemp(%q) = %v, want no-op", location, err)
+		}
+	}
+}
+
+func TestCheckSpecSize(t *testing.T) {
+	big := strings.Repeat("x", maxLabelsAndOptionsBytes)
+
+	tests := []struct {
+		labels  map[string]string
+		options string
+		larger  string
+	}{
+		{map[string]string{"a": "b"}, `{"options":{}}`, ""},
+		{map[string]string{"a": big}, `{"options":{}}`, "labels"},
+		{map[string]string{"a": "b"}, `{"options":{"a":"` + big + `"}}`, "pipeline options"},
+	}
+
+	for _, test := range tests {
+		job := &df.Job{
+			Labels:      test.labels,
+			Environment: &df.Environment{SdkPipelineOptions: googleapi.RawMessage(test.options)},
+		}
+		err := checkSpecSize(job)
+		switch {
+		case test.larger == "" && err != nil:
+			t.Errorf("checkSpecSize failed: %v, want ok", err)
+		case test.larger != "" && (err == nil || !strings.Contains(err.Error(), "the "+test.larger+" are the larger")):
+			t.Errorf("checkSpecSize = %v, want error naming the %v", err, test.larger)
+		}
+	}
+}
+
+func TestEndpointRegion(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		region   string
+		ok       bool
+	}{
+		{"https://us-central1-dataflow.googleapis.com/", "us-central1", true},
+		{"https://dataflow.europe-west1.rep.googleapis.com/", "europe-west1", true},
+		{"https://dataflow.googleapis.com/", "", false},
+		{"https://-dataflow.googleapis.com/", "", false},
+		{"http://localhost:8080/", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		region, ok := EndpointRegion(test.endpoint)
+		if region != test.region || ok != test.ok {
+			t.Errorf("EndpointRegion(%q) = (%q, %v), want (%q, %v)", test.endpoint, region, ok, test.region, test.ok)
+		}
+	}
+}
+
+func TestJobsPath(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.Method + " " + r.URL.Path
+		if loc := r.URL.Query().Get("location"); loc != "" {
+			path += "?location=" + loc
+		}
+		paths = append(paths, path)
+		json.NewEncoder(w).Encode(&df.Job{Id: "id"})
+	}))
+	defer srv.Close()
+
+	client, err := df.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	tests := []struct {
+		global bool
+		want   []string
+	}{
+		{false, []string{
+			"POST /v1b3/projects/project/locations/region/jobs",
+			"GET /v1b3/projects/project/locations/region/jobs/id",
+			"GET /v1b3/projects/project/locations/region/jobs",
+			"GET /v1b3/projects/project/locations/region/jobs/id/metrics",
+			"GET /v1b3/projects/project/locations/region/jobs/id/messages",
+			"PUT /v1b3/projects/project/locations/region/jobs/id",
+		}},
+		{true, []string{
+			"POST /v1b3/projects/project/jobs?location=region",
+			"GET /v1b3/projects/project/jobs/id?location=region",
+			"GET /v1b3/projects/project/jobs?location=region",
+			"GET /v1b3/projects/project/jobs/id/metrics?location=region",
+			"GET /v1b3/projects/project/jobs/id/messages?location=region",
+			"PUT /v1b3/projects/project/jobs/id?location=region",
+		}},
+	}
+	for _, test := range tests {
+		paths = nil
+		ctx := WithGlobalJobsPath(context.Background(), test.global)
+		if _, err := Submit(ctx, client, "project", "region", &df.Job{}); err != nil {
+			t.Fatalf("Submit(global=%v) failed: %v", test.global, err)
+		}
+		if _, err := GetJob(ctx, client, "project", "region", "id", 0); err != nil {
+			t.Fatalf("GetJob(global=%v) failed: %v", test.global, err)
+		}
+		if _, err := activeJobID(ctx, client, "project", "region", "job", 0); err == nil {
+			t.Fatalf("activeJobID(global=%v) found a job, want none", test.global)
+		}
+		if _, err := getMetrics(ctx, client, "project", "region", "id", 0); err != nil {
+			t.Fatalf("getMetrics(global=%v) failed: %v", test.global, err)
+		}
+		tailer := &tailer{client: client, project: "project", region: "region", jobID: "id", w: ioutil.Discard}
+		if err := tailer.tail(ctx); err != nil {
+			t.Fatalf("tail(global=%v) failed: %v", test.global, err)
+		}
+		// The result re-applies the jobs path of the options.
+		res := &Result{JobID: "id", Region: "region", client: client, opts: &JobOptions{Project: "project", GlobalJobsPath: test.global}}
+		if err := res.Cancel(context.Background()); err != nil {
+			t.Fatalf("Cancel(global=%v) failed: %v", test.global, err)
+		}
+		if !reflect.DeepEqual(paths, test.want) {
+			t.Errorf("requests(global=%v) = %v, want %v", test.global, paths, test.want)
+		}
+	}
+}
+
+func TestTranslateMachineTypeByEnv(t *testing.T) {
+	tests := []struct {
+		byEnv   map[string]string
+		exp     string
+		wantErr bool
+	}{
+		{nil, "n1-standard-1", false},
+		{map[string]string{"go": "n2-highmem-8"}, "n2-highmem-8", false},
+		{map[string]string{"go": "e2-custom-4-16384"}, "e2-custom-4-16384", false},
+		{map[string]string{"python": "n2-highmem-8"}, "", true},
+		{map[string]string{"go": "N2 highmem"}, "", true},
+	}
+	for _, test := range tests {
+		opts := &JobOptions{Project: "project", Region: "us-central1", MachineType: "n1-standard-1", MachineTypeByEnv: test.byEnv}
+		job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Translate(%v) succeeded, want error", test.byEnv)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Translate(%v) failed: %v", test.byEnv, err)
+		}
+		if actual := job.Environment.WorkerPools[0].MachineType; actual != test.exp {
+			t.Errorf("Translate(%v) machine type = %v, want %v", test.byEnv, actual, test.exp)
+		}
+	}
+
+	p := emptyPipeline()
+	p.Components.Environments["go2"] = p.Components.Environments["go"]
+	opts := &JobOptions{MachineType: "n1-standard-1", MachineTypeByEnv: map[string]string{"go": "n2-highmem-8", "go2": "n2-highmem-8"}}
+	if _, err := envMachineType(p, opts); err == nil {
+		t.Errorf("envMachineType(%v) succeeded with several overrides for a single worker pool, want error", opts.MachineTypeByEnv)
+	}
+	delete(opts.MachineTypeByEnv, "go2")
+	if mt, err := envMachineType(p, opts); err != nil || mt != "n2-highmem-8" {
+		t.Errorf("envMachineType(%v) = (%v, %v), want n2-highmem-8", opts.MachineTypeByEnv, mt, err)
+	}
+}
+
+func TestRedactJob(t *testing.T) {
+	opts := &JobOptions{
+		Project:   "project",
+		Region:    "us-central1",
+		Options:   runtime.RawOptions{Options: map[string]string{"password": "hunter2", "input": "gs://foo/in"}},
+		WorkerEnv: map[string]string{"API_KEY": "s3cr3t"},
+	}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	before := string(job.Environment.SdkPipelineOptions)
+
+	ret, err := RedactJob(job, "password")
+	if err != nil {
+		t.Fatalf("RedactJob failed: %v", err)
+	}
+	actual := string(ret.Environment.SdkPipelineOptions)
+	for _, secret := range []string{"hunter2", "s3cr3t"} {
+		if strings.Contains(actual, secret) {
+			t.Errorf("RedactJob() options = %v, want %v redacted", actual, secret)
+		}
+	}
+	if !strings.Contains(actual, "gs://foo/in") {
+		t.Errorf("RedactJob() options = %v, want input option kept", actual)
+	}
+	if string(job.Environment.SdkPipelineOptions) != before {
+		t.Error("RedactJob() modified the job")
+	}
+}
+
+func TestTranslateCapabilities(t *testing.T) {
+	opts := &JobOptions{Project: "project", Region: "us-central1"}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	if images := job.Environment.WorkerPools[0].SdkHarnessContainerImages; len(images) != 0 {
+		t.Errorf("SDK harness images = %v, want none", images)
+	}
+
+	opts.Capabilities = []string{"beam:coder:bytes:v1", "beam:protocol:progress_reporting:v0"}
+	job, err = Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	images := job.Environment.WorkerPools[0].SdkHarnessContainerImages
+	if len(images) != 1 {
+		t.Fatalf("SDK harness images = %v, want 1", images)
+	}
+	if images[0].EnvironmentId != "go" || !reflect.DeepEqual(images[0].Capabilities, opts.Capabilities) {
+		t.Errorf("SDK harness image = %+v, want environment go with capabilities %v", images[0], opts.Capabilities)
+	}
+	if images[0].ContainerImage != job.Environment.WorkerPools[0].WorkerHarnessContainerImage {
+		t.Errorf("SDK harness image = %v, want %v", images[0].ContainerImage, job.Environment.WorkerPools[0].WorkerHarnessContainerImage)
+	}
+
+	p := emptyPipeline()
+	envs := p.Components.Environments
+	envs["go-sdk"] = envs["go"]
+	delete(envs, "go")
+	job, err = Translate(p, opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	if id := job.Environment.WorkerPools[0].SdkHarnessContainerImages[0].EnvironmentId; id != "go-sdk" {
+		t.Errorf("SDK harness image environment = %v, want go-sdk", id)
+	}
+}
+
+func hasString(list []string, s string) bool {
+	for _, elm := range list {
+		if elm == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWithJobOptions(t *testing.T) {
+	logger := &recordingLogger{}
+	opts := &JobOptions{
+		Logger:         logger,
+		QuotaProject:   "billing",
+		Backoff:        ConstantBackoff(time.Second),
+		Transport:      http.DefaultTransport,
+		TokenSource:    &countingTokenSource{},
+		CorrelationID:  "run-1",
+		RedactPatterns: []string{"token"},
+		GlobalJobsPath: true,
+	}
+	ctx := WithJobOptions(context.Background(), opts)
+
+	if l, ok := GetLogger(ctx).(correlatedLogger); !ok || l.l != logger || l.id != "run-1" {
+		t.Errorf("WithJobOptions() logger = %v, want the correlated options logger", GetLogger(ctx))
+	}
+	if getQuotaProject(ctx) != "billing" {
+		t.Errorf("WithJobOptions() quota project = %q, want billing", getQuotaProject(ctx))
+	}
+	if retryStrategy(ctx) != opts.Backoff {
+		t.Errorf("WithJobOptions() backoff = %v, want %v", retryStrategy(ctx), opts.Backoff)
+	}
+	if getTransport(ctx) != http.DefaultTransport {
+		t.Error("WithJobOptions() did not set the transport")
+	}
+	if getTokenSource(ctx) == nil {
+		t.Error("WithJobOptions() did not set the token source")
+	}
+	if !reflect.DeepEqual(getRedactPatterns(ctx), opts.RedactPatterns) {
+		t.Errorf("WithJobOptions() redact patterns = %v, want %v", getRedactPatterns(ctx), opts.RedactPatterns)
+	}
+	if !useGlobalJobsPath(ctx) {
+		t.Error("WithJobOptions() did not set the global jobs path")
+	}
+}
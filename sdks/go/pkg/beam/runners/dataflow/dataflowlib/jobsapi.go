@@ -0,0 +1,118 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+// The Dataflow jobs API has a regional projects.locations.jobs path and an
+// older global projects.jobs path, selected by the context. All calls of the
+// jobs API go through the functions below, so that they use the same path.
+
+type globalJobsPathKey struct{}
+
+// WithGlobalJobsPath returns a context under which the jobs API is called
+// with the global projects.jobs methods, passing the region as location,
+// instead of the regional projects.locations.jobs methods. The regional
+// methods are the default and should be preferred: the global ones are only
+// for older endpoints that lack them. If global is false, the context is
+// returned unchanged.
+func WithGlobalJobsPath(ctx context.Context, global bool) context.Context {
+	if !global {
+		return ctx
+	}
+	return context.WithValue(ctx, globalJobsPathKey{}, true)
+}
+
+// useGlobalJobsPath returns true iff the context selects the global jobs
+// path.
+func useGlobalJobsPath(ctx context.Context) bool {
+	global, _ := ctx.Value(globalJobsPathKey{}).(bool)
+	return global
+}
+
+// createJob creates the job, using the jobs path of the context.
+func createJob(ctx context.Context, client *df.Service, project, region string, job *df.Job) (*df.Job, error) {
+	if useGlobalJobsPath(ctx) {
+		return client.Projects.Jobs.Create(project, job).Location(region).Context(ctx).Do()
+	}
+	return client.Projects.Locations.Jobs.Create(project, region, job).Context(ctx).Do()
+}
+
+// getJob returns the job with the given ID in the given view, or the default
+// view if empty, using the jobs path of the context.
+func getJob(ctx context.Context, client *df.Service, project, region, jobID, view string) (*df.Job, error) {
+	if useGlobalJobsPath(ctx) {
+		call := client.Projects.Jobs.Get(project, jobID).Location(region)
+		if view != "" {
+			call = call.View(view)
+		}
+		return call.Context(ctx).Do()
+	}
+	call := client.Projects.Locations.Jobs.Get(project, region, jobID)
+	if view != "" {
+		call = call.View(view)
+	}
+	return call.Context(ctx).Do()
+}
+
+// updateJob updates the job with the given ID, such as to request a state
+// change, using the jobs path of the context.
+func updateJob(ctx context.Context, client *df.Service, project, region, jobID string, job *df.Job) (*df.Job, error) {
+	if useGlobalJobsPath(ctx) {
+		return client.Projects.Jobs.Update(project, jobID, job).Location(region).Context(ctx).Do()
+	}
+	return client.Projects.Locations.Jobs.Update(project, region, jobID, job).Context(ctx).Do()
+}
+
+// listActiveJobs calls fn for each page of the active jobs in the region,
+// using the jobs path of the context.
+func listActiveJobs(ctx context.Context, client *df.Service, project, region string, fn func(*df.ListJobsResponse) error) error {
+	if useGlobalJobsPath(ctx) {
+		return client.Projects.Jobs.List(project).Location(region).Filter("ACTIVE").Pages(ctx, fn)
+	}
+	return client.Projects.Locations.Jobs.List(project, region).Filter("ACTIVE").Pages(ctx, fn)
+}
+
+// getJobMetrics returns the current metrics of the job, using the jobs path
+// of the context.
+func getJobMetrics(ctx context.Context, client *df.Service, project, region, jobID string) (*df.JobMetrics, error) {
+	if useGlobalJobsPath(ctx) {
+		return client.Projects.Jobs.GetMetrics(project, jobID).Location(region).Context(ctx).Do()
+	}
+	return client.Projects.Locations.Jobs.GetMetrics(project, region, jobID).Context(ctx).Do()
+}
+
+// listJobMessages calls fn for each page of the messages of the job of at
+// least the given importance, reported at or after the start time, if not
+// empty. It uses the jobs path of the context.
+func listJobMessages(ctx context.Context, client *df.Service, project, region, jobID, importance, start string, fn func(*df.ListJobMessagesResponse) error) error {
+	if useGlobalJobsPath(ctx) {
+		call := client.Projects.Jobs.Messages.List(project, jobID).Location(region).MinimumImportance(importance)
+		if start != "" {
+			call = call.StartTime(start)
+		}
+		return call.Pages(ctx, fn)
+	}
+	call := client.Projects.Locations.Jobs.Messages.List(project, region, jobID).MinimumImportance(importance)
+	if start != "" {
+		call = call.StartTime(start)
+	}
+	return call.Pages(ctx, fn)
+}
@@ -0,0 +1,199 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+const (
+	lineageProducer  = "https://github.com/apache/beam/tree/master/sdks/go"
+	lineageSchemaURL = "https://openlineage.io/spec/1-0-5/OpenLineage.json#/definitions/RunEvent"
+	jobTypeSchemaURL = "https://openlineage.io/spec/facets/2-0-2/JobTypeJobFacet.json#/$defs/JobTypeJobFacet"
+)
+
+// lineageEvent is an OpenLineage run event.
+type lineageEvent struct {
+	EventType string           `json:"eventType"`
+	EventTime string           `json:"eventTime"`
+	Run       lineageRun       `json:"run"`
+	Job       lineageJob       `json:"job"`
+	Inputs    []lineageDataset `json:"inputs"`
+	Outputs   []lineageDataset `json:"outputs"`
+	Producer  string           `json:"producer"`
+	SchemaURL string           `json:"schemaURL"`
+}
+
+type lineageRun struct {
+	RunID string `json:"runId"`
+}
+
+type lineageJob struct {
+	Namespace string           `json:"namespace"`
+	Name      string           `json:"name"`
+	Facets    lineageJobFacets `json:"facets"`
+}
+
+type lineageJobFacets struct {
+	JobType jobTypeFacet `json:"jobType"`
+}
+
+type jobTypeFacet struct {
+	Producer       string `json:"_producer"`
+	SchemaURL      string `json:"_schemaURL"`
+	ProcessingType string `json:"processingType"`
+	Integration    string `json:"integration"`
+	JobType        string `json:"jobType"`
+}
+
+type lineageDataset struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// lineageDatasets derives the input and output datasets of the pipeline
+// from its root transforms, which are named after the IO that they perform
+// in most pipelines. Root transforms that contain an impulse are sources and
+// root transforms that consume, but do not produce, collections are sinks.
+func lineageDatasets(p *pb.Pipeline, namespace string) (inputs, outputs []lineageDataset) {
+	transforms := p.GetComponents().GetTransforms()
+	for _, id := range p.GetRootTransformIds() {
+		t := transforms[id]
+		switch {
+		case containsImpulse(transforms, id):
+			inputs = append(inputs, lineageDataset{Namespace: namespace, Name: t.GetUniqueName()})
+		case len(t.GetInputs()) > 0 && len(t.GetOutputs()) == 0:
+			outputs = append(outputs, lineageDataset{Namespace: namespace, Name: t.GetUniqueName()})
+		}
+	}
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].Name < inputs[j].Name })
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].Name < outputs[j].Name })
+	return inputs, outputs
+}
+
+// containsImpulse returns true iff the transform is or contains an impulse.
+func containsImpulse(transforms map[string]*pb.PTransform, id string) bool {
+	t := transforms[id]
+	if t.GetSpec().GetUrn() == graphx.URNImpulse {
+		return true
+	}
+	for _, sub := range t.GetSubtransforms() {
+		if containsImpulse(transforms, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// lineageEventType returns the OpenLineage event type of the given job
+// state: START for non-terminal states.
+func lineageEventType(state string) string {
+	switch state {
+	case "JOB_STATE_DONE", "JOB_STATE_DRAINED", "JOB_STATE_UPDATED":
+		return "COMPLETE"
+	case "JOB_STATE_CANCELLED":
+		return "ABORT"
+	case "JOB_STATE_FAILED":
+		return "FAIL"
+	default:
+		return "START"
+	}
+}
+
+// emitLineage posts an OpenLineage event for the job state to the configured
+// endpoint, if any. The run ID is the job ID. Failures are logged, but never
+// fail the job.
+func emitLineage(ctx context.Context, opts *JobOptions, jobID, state string, inputs, outputs []lineageDataset) {
+	if opts.OpenLineageURL == "" {
+		return
+	}
+
+	processing := "BATCH"
+	if opts.Streaming {
+		processing = "STREAMING"
+	}
+	event := lineageEvent{
+		EventType: lineageEventType(state),
+		EventTime: time.Now().UTC().Format(time.RFC3339Nano),
+		Run:       lineageRun{RunID: jobID},
+		Job: lineageJob{
+			Namespace: lineageNamespace(opts),
+			Name:      opts.Name,
+			Facets: lineageJobFacets{
+				JobType: jobTypeFacet{
+					Producer:       lineageProducer,
+					SchemaURL:      jobTypeSchemaURL,
+					ProcessingType: processing,
+					Integration:    "DATAFLOW",
+					JobType:        "JOB",
+				},
+			},
+		},
+		Inputs:    nonNilDatasets(inputs),
+		Outputs:   nonNilDatasets(outputs),
+		Producer:  lineageProducer,
+		SchemaURL: lineageSchemaURL,
+	}
+	if err := postLineage(ctx, opts.OpenLineageURL, event); err != nil {
+		GetLogger(ctx).Warnf(ctx, "Failed to emit OpenLineage %v event of job %v to %v: %v", event.EventType, jobID, opts.OpenLineageURL, err)
+	}
+}
+
+// lineageNamespace returns the OpenLineage namespace of the job and its
+// datasets.
+func lineageNamespace(opts *JobOptions) string {
+	return fmt.Sprintf("dataflow://%v/%v", opts.Project, opts.Region)
+}
+
+func nonNilDatasets(list []lineageDataset) []lineageDataset {
+	if list == nil {
+		return []lineageDataset{}
+	}
+	return list
+}
+
+func postLineage(ctx context.Context, url string, event lineageEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+	return nil
+}
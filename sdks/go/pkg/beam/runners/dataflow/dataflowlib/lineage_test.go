@@ -0,0 +1,85 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+func TestLineageDatasets(t *testing.T) {
+	p := emptyPipeline()
+	p.Components.Transforms = map[string]*pb.PTransform{
+		"read":    {UniqueName: "textio.Read", Subtransforms: []string{"impulse"}, Outputs: map[string]string{"o": "c1"}},
+		"impulse": {UniqueName: "textio.Read/Impulse", Spec: &pb.FunctionSpec{Urn: graphx.URNImpulse}, Outputs: map[string]string{"o": "c0"}},
+		"count":   {UniqueName: "stats.Count", Inputs: map[string]string{"i": "c1"}, Outputs: map[string]string{"o": "c2"}},
+		"write":   {UniqueName: "textio.Write", Inputs: map[string]string{"i": "c2"}},
+	}
+	p.RootTransformIds = []string{"read", "count", "write"}
+
+	inputs, outputs := lineageDatasets(p, "ns")
+	if exp := []lineageDataset{{"ns", "textio.Read"}}; !reflect.DeepEqual(inputs, exp) {
+		t.Errorf("lineageDatasets() inputs = %v, want %v", inputs, exp)
+	}
+	if exp := []lineageDataset{{"ns", "textio.Write"}}; !reflect.DeepEqual(outputs, exp) {
+		t.Errorf("lineageDatasets() outputs = %v, want %v", outputs, exp)
+	}
+}
+
+func TestEmitLineage(t *testing.T) {
+	var events []lineageEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event lineageEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events = append(events, event)
+	}))
+	defer srv.Close()
+
+	opts := &JobOptions{Name: "job", Project: "project", Region: "us-central1", OpenLineageURL: srv.URL}
+	inputs := []lineageDataset{{"ns", "textio.Read"}}
+	ctx := context.Background()
+	emitLineage(ctx, opts, "id", "JOB_STATE_PENDING", inputs, nil)
+	emitLineage(ctx, opts, "id", "JOB_STATE_DONE", inputs, nil)
+	emitLineage(ctx, opts, "id", "JOB_STATE_FAILED", inputs, nil)
+
+	var types []string
+	for _, e := range events {
+		types = append(types, e.EventType)
+		if e.Run.RunID != "id" || e.Job.Name != "job" || e.Job.Namespace != "dataflow://project/us-central1" {
+			t.Errorf("event = %+v, want run id of job in project namespace", e)
+		}
+		if !reflect.DeepEqual(e.Inputs, inputs) || e.Outputs == nil {
+			t.Errorf("event datasets = %v -> %v, want %v -> []", e.Inputs, e.Outputs, inputs)
+		}
+	}
+	if exp := []string{"START", "COMPLETE", "FAIL"}; !reflect.DeepEqual(types, exp) {
+		t.Errorf("event types = %v, want %v", types, exp)
+	}
+
+	// Emitting to an unavailable endpoint only logs.
+	opts.OpenLineageURL = srv.URL + "/missing\x00"
+	emitLineage(ctx, opts, "id", "JOB_STATE_DONE", nil, nil)
+}
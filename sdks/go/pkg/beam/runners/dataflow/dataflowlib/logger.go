@@ -0,0 +1,106 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/log"
+)
+
+// Logger is the logging interface used by the runner. By default, the runner
+// logs to the Beam log package.
+type Logger interface {
+	Debugf(ctx context.Context, format string, v ...interface{})
+	Infof(ctx context.Context, format string, v ...interface{})
+	Warnf(ctx context.Context, format string, v ...interface{})
+	Errorf(ctx context.Context, format string, v ...interface{})
+}
+
+// beamLogger is a Logger that logs to the Beam log package.
+type beamLogger struct{}
+
+func (beamLogger) Debugf(ctx context.Context, format string, v ...interface{}) {
+	log.Output(ctx, log.SevDebug, 2, fmt.Sprintf(format, v...))
+}
+
+func (beamLogger) Infof(ctx context.Context, format string, v ...interface{}) {
+	log.Output(ctx, log.SevInfo, 2, fmt.Sprintf(format, v...))
+}
+
+func (beamLogger) Warnf(ctx context.Context, format string, v ...interface{}) {
+	log.Output(ctx, log.SevWarn, 2, fmt.Sprintf(format, v...))
+}
+
+func (beamLogger) Errorf(ctx context.Context, format string, v ...interface{}) {
+	log.Output(ctx, log.SevError, 2, fmt.Sprintf(format, v...))
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context under which the runner logs to the given
+// logger. If the logger is nil, the context is returned unchanged.
+func WithLogger(ctx context.Context, l Logger) context.Context {
+	if l == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// WithCorrelationID returns a context under which each runner log line is
+// prefixed with the given correlation ID. If the ID is empty or already
+// attached, the context is returned unchanged.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	if l, ok := GetLogger(ctx).(correlatedLogger); ok && l.id == id {
+		return ctx
+	}
+	return WithLogger(ctx, correlatedLogger{l: GetLogger(ctx), id: id})
+}
+
+// correlatedLogger is a Logger that prefixes each message with a
+// correlation ID.
+type correlatedLogger struct {
+	l  Logger
+	id string
+}
+
+func (c correlatedLogger) Debugf(ctx context.Context, format string, v ...interface{}) {
+	c.l.Debugf(ctx, "[%v] %v", c.id, fmt.Sprintf(format, v...))
+}
+
+func (c correlatedLogger) Infof(ctx context.Context, format string, v ...interface{}) {
+	c.l.Infof(ctx, "[%v] %v", c.id, fmt.Sprintf(format, v...))
+}
+
+func (c correlatedLogger) Warnf(ctx context.Context, format string, v ...interface{}) {
+	c.l.Warnf(ctx, "[%v] %v", c.id, fmt.Sprintf(format, v...))
+}
+
+func (c correlatedLogger) Errorf(ctx context.Context, format string, v ...interface{}) {
+	c.l.Errorf(ctx, "[%v] %v", c.id, fmt.Sprintf(format, v...))
+}
+
+// GetLogger returns the runner logger of the context, or the default logger.
+func GetLogger(ctx context.Context) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	return beamLogger{}
+}
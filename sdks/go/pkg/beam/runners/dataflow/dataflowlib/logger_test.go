@@ -0,0 +1,105 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) record(sev, format string, v ...interface{}) {
+	l.lines = append(l.lines, sev+": "+fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Debugf(ctx context.Context, format string, v ...interface{}) {
+	l.record("DEBUG", format, v...)
+}
+
+func (l *recordingLogger) Infof(ctx context.Context, format string, v ...interface{}) {
+	l.record("INFO", format, v...)
+}
+
+func (l *recordingLogger) Warnf(ctx context.Context, format string, v ...interface{}) {
+	l.record("WARN", format, v...)
+}
+
+func (l *recordingLogger) Errorf(ctx context.Context, format string, v ...interface{}) {
+	l.record("ERROR", format, v...)
+}
+
+func TestGetLogger(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := GetLogger(ctx).(beamLogger); !ok {
+		t.Errorf("GetLogger(ctx) = %T, want beamLogger", GetLogger(ctx))
+	}
+	if WithLogger(ctx, nil) != ctx {
+		t.Errorf("WithLogger(ctx, nil) changed the context")
+	}
+
+	l := &recordingLogger{}
+	if actual := GetLogger(WithLogger(ctx, l)); actual != l {
+		t.Errorf("GetLogger(WithLogger(ctx, l)) = %v, want %v", actual, l)
+	}
+}
+
+func TestRetryLogger(t *testing.T) {
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	l := &recordingLogger{}
+	ctx := WithLogger(context.Background(), l)
+
+	calls := 0
+	err := retry(ctx, "Test call", func() error {
+		if calls++; calls == 1 {
+			return context.DeadlineExceeded
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if len(l.lines) != 1 || !strings.HasPrefix(l.lines[0], "WARN: Test call failed") {
+		t.Errorf("logged %q, want a single retry warning", l.lines)
+	}
+}
+
+func TestWithCorrelationID(t *testing.T) {
+	l := &recordingLogger{}
+	ctx := WithLogger(context.Background(), l)
+	if WithCorrelationID(ctx, "") != ctx {
+		t.Errorf("WithCorrelationID(ctx, \"\") changed the context")
+	}
+
+	ctx = WithCorrelationID(ctx, "abc")
+	if WithCorrelationID(ctx, "abc") != ctx {
+		t.Errorf("WithCorrelationID attached the same ID twice")
+	}
+	GetLogger(ctx).Infof(ctx, "Submitted job: %v", "job")
+
+	expected := []string{"INFO: [abc] Submitted job: job"}
+	if !reflect.DeepEqual(l.lines, expected) {
+		t.Errorf("logged %q, want %q", l.lines, expected)
+	}
+}
@@ -0,0 +1,69 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"fmt"
+)
+
+// Constraints of N1 custom machine types in GCE. See
+// https://cloud.google.com/compute/docs/instances/creating-instance-with-custom-machine-type.
+const (
+	customMaxCPUs = 96
+	// customMemoryStepMB is the multiple that the memory must be of.
+	customMemoryStepMB = 256
+	// customMinMemoryPerCPUMB10 is the least memory per CPU, 0.9 GB, in
+	// tenths of a MB to stay integral.
+	customMinMemoryPerCPUMB10 = 9216
+	// customMaxMemoryPerCPUMB is the most memory per CPU that does not
+	// require extended memory.
+	customMaxMemoryPerCPUMB = 6656
+	// customMaxExtendedMemoryMB is the most memory of an extended memory
+	// machine type.
+	customMaxExtendedMemoryMB = 624 * 1024
+)
+
+// CustomMachineType returns the N1 custom machine type with the given number
+// of CPUs and memory in MB, such as "custom-4-16384". Memory beyond 6.5 GB
+// per CPU is extended memory, which adds the "-ext" suffix. It returns an
+// error, if GCE does not support the combination: the CPUs must be 1 or an
+// even number up to 96, and the memory a multiple of 256 MB of at least
+// 0.9 GB per CPU.
+func CustomMachineType(cpus int, memoryMB int64) (string, error) {
+	switch {
+	case cpus < 1 || cpus > customMaxCPUs:
+		return "", fmt.Errorf("invalid number of CPUs %v: must be between 1 and %v", cpus, customMaxCPUs)
+	case cpus > 1 && cpus%2 != 0:
+		return "", fmt.Errorf("invalid number of CPUs %v: must be 1 or even", cpus)
+	case memoryMB <= 0 || memoryMB%customMemoryStepMB != 0:
+		return "", fmt.Errorf("invalid memory %v MB: must be a positive multiple of %v MB", memoryMB, customMemoryStepMB)
+	case memoryMB*10 < int64(cpus)*customMinMemoryPerCPUMB10:
+		return "", fmt.Errorf("invalid memory %v MB for %v CPUs: must be at least 0.9 GB per CPU, or %v MB. Use fewer CPUs or more memory", memoryMB, cpus, minCustomMemoryMB(cpus))
+	case memoryMB > customMaxExtendedMemoryMB:
+		return "", fmt.Errorf("invalid memory %v MB: must be at most %v MB", memoryMB, customMaxExtendedMemoryMB)
+	}
+	if memoryMB > int64(cpus)*customMaxMemoryPerCPUMB {
+		return fmt.Sprintf("custom-%v-%v-ext", cpus, memoryMB), nil
+	}
+	return fmt.Sprintf("custom-%v-%v", cpus, memoryMB), nil
+}
+
+// minCustomMemoryMB returns the least valid memory of a custom machine type
+// with the given number of CPUs.
+func minCustomMemoryMB(cpus int) int64 {
+	min := (int64(cpus)*customMinMemoryPerCPUMB10 + 9) / 10
+	return (min + customMemoryStepMB - 1) / customMemoryStepMB * customMemoryStepMB
+}
@@ -0,0 +1,58 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCustomMachineType(t *testing.T) {
+	tests := []struct {
+		cpus     int
+		memoryMB int64
+		want     string
+		err      string
+	}{
+		{4, 16384, "custom-4-16384", ""},
+		{10, 9216, "custom-10-9216", ""},
+		{1, 1024, "custom-1-1024", ""},
+		{2, 13312, "custom-2-13312", ""},
+		{2, 13568, "custom-2-13568-ext", ""},
+		{96, 638976, "custom-96-638976", ""},
+		{8, 638976, "custom-8-638976-ext", ""},
+		{0, 1024, "", "must be between 1 and 96"},
+		{98, 638976, "", "must be between 1 and 96"},
+		{3, 3072, "", "must be 1 or even"},
+		{4, 4000, "", "multiple of 256 MB"},
+		{1, 768, "", "at least 0.9 GB per CPU, or 1024 MB"},
+		{10, 8960, "", "at least 0.9 GB per CPU, or 9216 MB"},
+		{4, 3584, "", "at least 0.9 GB per CPU, or 3840 MB"},
+		{8, 639232, "", "at most 638976 MB"},
+	}
+	for _, test := range tests {
+		got, err := CustomMachineType(test.cpus, test.memoryMB)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("CustomMachineType(%v, %v) = %v, %v, want error %q", test.cpus, test.memoryMB, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("CustomMachineType(%v, %v) = %v, %v, want %v", test.cpus, test.memoryMB, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+// exportMetrics exports the final metrics of the job, if configured.
+// Failures are logged, but never fail the job.
+func exportMetrics(ctx context.Context, client *df.Service, opts *JobOptions, region, jobID string) {
+	if opts.MetricsExport == "" {
+		return
+	}
+
+	metrics, err := getMetrics(ctx, client, opts.Project, region, jobID, opts.APITimeout)
+	if err != nil {
+		GetLogger(ctx).Warnf(ctx, "Failed to get metrics of job %v: %v", jobID, err)
+		return
+	}
+
+	data := formatMetrics(metrics.Metrics, map[string]string{"job_name": opts.Name, "job_id": jobID})
+	if err := writeMetrics(ctx, opts.MetricsExport, opts.Name, data); err != nil {
+		GetLogger(ctx).Warnf(ctx, "Failed to export metrics of job %v to %v: %v", jobID, opts.MetricsExport, err)
+		return
+	}
+	GetLogger(ctx).Infof(ctx, "Exported %v metrics of job %v to %v", len(metrics.Metrics), jobID, opts.MetricsExport)
+}
+
+// getMetrics returns the current metrics of the job.
+func getMetrics(ctx context.Context, client *df.Service, project, region, jobID string, timeout time.Duration) (*df.JobMetrics, error) {
+	var metrics *df.JobMetrics
+	err := retry(ctx, "Job metrics retrieval", func() error {
+		cctx, cancel := apiContext(ctx, timeout)
+		defer cancel()
+
+		var err error
+		metrics, err = getJobMetrics(cctx, client, project, region, jobID)
+		return err
+	})
+	return metrics, err
+}
+
+// WaitForMetric polls the committed metrics of the job until the predicate
+// holds for the value of the named metric, or the context is done. It uses
+// default application credentials. Counters are summed across steps. For
+// distributions, the value is the mean, unless the name has a ".count",
+// ".sum", ".min" or ".max" suffix that selects that statistic instead. Polls
+// are spaced by the backoff strategy of the context. See WithBackoff.
+func WaitForMetric(ctx context.Context, jobID, project, region, metricName string, predicate func(float64) bool) error {
+	client, err := NewClient(ctx, "")
+	if err != nil {
+		return err
+	}
+	return waitForMetric(ctx, client, jobID, project, region, metricName, predicate)
+}
+
+func waitForMetric(ctx context.Context, client *df.Service, jobID, project, region, metricName string, predicate func(float64) bool) error {
+	strategy := pollStrategy(ctx)
+	for poll := 1; ; poll++ {
+		metrics, err := getMetrics(ctx, client, project, region, jobID, 0)
+		if err != nil {
+			return fmt.Errorf("failed to get metrics of job %v: %v", jobID, err)
+		}
+		if v, ok := namedMetricValue(metrics.Metrics, metricName); ok {
+			if predicate(v) {
+				return nil
+			}
+			GetLogger(ctx).Debugf(ctx, "Metric %v of job %v is %v ...", metricName, jobID, v)
+		} else {
+			GetLogger(ctx).Debugf(ctx, "Metric %v of job %v not reported yet ...", metricName, jobID)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(strategy.NextDelay(poll)):
+		}
+	}
+}
+
+// namedMetricValue returns the committed value of the named counter or
+// distribution statistic, aggregated across steps. See WaitForMetric.
+func namedMetricValue(metrics []*df.MetricUpdate, name string) (float64, bool) {
+	stat := "mean"
+	if !hasMetric(metrics, name) {
+		if i := strings.LastIndex(name, "."); i > 0 {
+			switch s := name[i+1:]; s {
+			case "count", "sum", "min", "max":
+				name, stat = name[:i], s
+			}
+		}
+	}
+
+	var scalar, count, sum, min, max float64
+	var isScalar, isDist bool
+	for _, m := range metrics {
+		if m.Name == nil || m.Name.Name != name || m.Name.Context["tentative"] == "true" {
+			continue
+		}
+		switch {
+		case m.Distribution != nil:
+			d, ok := m.Distribution.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			c, _ := metricValue(d["count"])
+			s, _ := metricValue(d["sum"])
+			lo, _ := metricValue(d["min"])
+			hi, _ := metricValue(d["max"])
+			if !isDist || lo < min {
+				min = lo
+			}
+			if !isDist || hi > max {
+				max = hi
+			}
+			count, sum, isDist = count+c, sum+s, true
+		case m.Scalar != nil:
+			if v, ok := metricValue(m.Scalar); ok {
+				scalar, isScalar = scalar+v, true
+			}
+		}
+	}
+
+	switch {
+	case isDist:
+		switch stat {
+		case "count":
+			return count, true
+		case "sum":
+			return sum, true
+		case "min":
+			return min, true
+		case "max":
+			return max, true
+		}
+		if count == 0 {
+			return 0, false
+		}
+		return sum / count, true
+	case isScalar && stat == "mean":
+		return scalar, true
+	default:
+		return 0, false
+	}
+}
+
+func hasMetric(metrics []*df.MetricUpdate, name string) bool {
+	for _, m := range metrics {
+		if m.Name != nil && m.Name.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMetrics pushes the metrics to the Prometheus Pushgateway at the given
+// http(s) URL, or else writes them as a textfile to the given local path.
+func writeMetrics(ctx context.Context, dest, job string, data []byte) error {
+	if !strings.HasPrefix(dest, "http://") && !strings.HasPrefix(dest, "https://") {
+		return writeFileAtomic(dest, data)
+	}
+
+	u := strings.TrimSuffix(dest, "/") + "/metrics/job/" + url.PathEscape(job)
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+	return nil
+}
+
+// promSample is a single Prometheus sample of a metric family.
+type promSample struct {
+	family string
+	name   string
+	labels string
+	value  float64
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var promNameRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// promName returns a valid Prometheus metric or label name.
+func promName(name string) string {
+	name = promNameRe.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// formatMetrics formats the committed job metrics in the Prometheus text
+// format. Sums map to counters, distributions to summaries with separate
+// min and max gauges, and other scalars to gauges. Metric names are prefixed
+// with "beam_". The metric context, such as the step, and the given job
+// labels are added as labels. Tentative metrics are skipped.
+func formatMetrics(metrics []*df.MetricUpdate, jobLabels map[string]string) []byte {
+	types := make(map[string]string)
+	var samples []promSample
+
+	for _, m := range metrics {
+		if m.Name == nil || m.Name.Context["tentative"] == "true" {
+			continue
+		}
+		lbls := make(map[string]string)
+		for k, v := range jobLabels {
+			lbls[k] = v
+		}
+		for k, v := range m.Name.Context {
+			lbls[promName(k)] = v
+		}
+		if m.Name.Origin != "" {
+			lbls["origin"] = m.Name.Origin
+		}
+		labels := formatLabels(lbls)
+		name := "beam_" + promName(m.Name.Name)
+
+		switch {
+		case m.Distribution != nil:
+			d, ok := m.Distribution.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			types[name] = "summary"
+			types[name+"_min"] = "gauge"
+			types[name+"_max"] = "gauge"
+			for _, f := range []string{"count", "sum", "min", "max"} {
+				family := name
+				if f == "min" || f == "max" {
+					family = name + "_" + f
+				}
+				if v, ok := metricValue(d[f]); ok {
+					samples = append(samples, promSample{family, name + "_" + f, labels, v})
+				}
+			}
+		case m.Scalar != nil:
+			v, ok := metricValue(m.Scalar)
+			if !ok {
+				continue
+			}
+			if strings.EqualFold(m.Kind, "Sum") {
+				types[name] = "counter"
+			} else {
+				types[name] = "gauge"
+			}
+			samples = append(samples, promSample{name, name, labels, v})
+		}
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].family != samples[j].family {
+			return samples[i].family < samples[j].family
+		}
+		if samples[i].name != samples[j].name {
+			return samples[i].name < samples[j].name
+		}
+		return samples[i].labels < samples[j].labels
+	})
+
+	var buf bytes.Buffer
+	for i, s := range samples {
+		if i == 0 || samples[i-1].family != s.family {
+			fmt.Fprintf(&buf, "# TYPE %v %v\n", s.family, types[s.family])
+		}
+		fmt.Fprintf(&buf, "%v%v %v\n", s.name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	return buf.Bytes()
+}
+
+// formatLabels formats the labels as a sorted Prometheus label set.
+func formatLabels(lbls map[string]string) string {
+	if len(lbls) == 0 {
+		return ""
+	}
+	var keys []string
+	for k := range lbls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%v=\"%v\"", k, promLabelEscaper.Replace(lbls[k])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// metricValue returns the numeric value of a JSON-decoded metric value.
+// Integers may be encoded as strings.
+func metricValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,142 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+func TestFormatMetrics(t *testing.T) {
+	metrics := []*df.MetricUpdate{
+		{
+			Name:   &df.MetricStructuredName{Name: "elements", Origin: "user", Context: map[string]string{"step": "s1"}},
+			Kind:   "Sum",
+			Scalar: float64(42),
+		},
+		{
+			Name:   &df.MetricStructuredName{Name: "elements", Origin: "user", Context: map[string]string{"step": "s1", "tentative": "true"}},
+			Kind:   "Sum",
+			Scalar: float64(40),
+		},
+		{
+			Name:         &df.MetricStructuredName{Name: "latency-ms", Origin: "user", Context: map[string]string{"step": "s2"}},
+			Kind:         "Distribution",
+			Distribution: map[string]interface{}{"count": float64(3), "sum": float64(12), "min": float64(1), "max": "8"},
+		},
+		{
+			Name:   &df.MetricStructuredName{Name: "size", Context: map[string]string{"step": `s"3`}},
+			Kind:   "Max",
+			Scalar: "7",
+		},
+	}
+
+	actual := string(formatMetrics(metrics, map[string]string{"job_name": "job"}))
+	exp := `# TYPE beam_elements counter
+beam_elements{job_name="job",origin="user",step="s1"} 42
+# TYPE beam_latency_ms summary
+beam_latency_ms_count{job_name="job",origin="user",step="s2"} 3
+beam_latency_ms_sum{job_name="job",origin="user",step="s2"} 12
+# TYPE beam_latency_ms_max gauge
+beam_latency_ms_max{job_name="job",origin="user",step="s2"} 8
+# TYPE beam_latency_ms_min gauge
+beam_latency_ms_min{job_name="job",origin="user",step="s2"} 1
+# TYPE beam_size gauge
+beam_size{job_name="job",step="s\"3"} 7
+`
+	if actual != exp {
+		t.Errorf("formatMetrics() = \n%v\nwant\n%v", actual, exp)
+	}
+}
+
+func TestWriteMetricsPushgateway(t *testing.T) {
+	var path, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer srv.Close()
+
+	if err := writeMetrics(context.Background(), srv.URL+"/", "my-job", []byte("beam_x 1\n")); err != nil {
+		t.Fatalf("writeMetrics failed: %v", err)
+	}
+	if path != "/metrics/job/my-job" {
+		t.Errorf("pushed to %v, want /metrics/job/my-job", path)
+	}
+	if body != "beam_x 1\n" {
+		t.Errorf("pushed %q, want %q", body, "beam_x 1\n")
+	}
+}
+
+func TestNamedMetricValue(t *testing.T) {
+	metrics := []*df.MetricUpdate{
+		{Name: &df.MetricStructuredName{Name: "elements", Context: map[string]string{"step": "s1"}}, Kind: "Sum", Scalar: float64(40)},
+		{Name: &df.MetricStructuredName{Name: "elements", Context: map[string]string{"step": "s2"}}, Kind: "Sum", Scalar: "2"},
+		{Name: &df.MetricStructuredName{Name: "elements", Context: map[string]string{"step": "s2", "tentative": "true"}}, Kind: "Sum", Scalar: float64(100)},
+		{Name: &df.MetricStructuredName{Name: "latency", Context: map[string]string{"step": "s1"}}, Distribution: map[string]interface{}{"count": float64(2), "sum": float64(10), "min": float64(4), "max": float64(6)}},
+		{Name: &df.MetricStructuredName{Name: "latency", Context: map[string]string{"step": "s2"}}, Distribution: map[string]interface{}{"count": float64(2), "sum": float64(2), "min": float64(1), "max": float64(1)}},
+	}
+	tests := []struct {
+		name string
+		v    float64
+		ok   bool
+	}{
+		{"elements", 42, true},
+		{"latency", 3, true},
+		{"latency.count", 4, true},
+		{"latency.sum", 12, true},
+		{"latency.min", 1, true},
+		{"latency.max", 6, true},
+		{"elements.max", 0, false},
+		{"missing", 0, false},
+	}
+	for _, test := range tests {
+		v, ok := namedMetricValue(metrics, test.name)
+		if v != test.v || ok != test.ok {
+			t.Errorf("namedMetricValue(%v) = (%v, %v), want (%v, %v)", test.name, v, ok, test.v, test.ok)
+		}
+	}
+}
+
+func TestWaitForMetric(t *testing.T) {
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"metrics": [{"name": {"name": "elements"}, "kind": "Sum", "scalar": %v}]}`, polls*10)
+	}))
+	defer srv.Close()
+
+	client, err := df.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	ctx := WithBackoff(context.Background(), ConstantBackoff(time.Millisecond))
+	err = waitForMetric(ctx, client, "job", "project", "region", "elements", func(v float64) bool { return v > 25 })
+	if err != nil || polls != 3 {
+		t.Errorf("waitForMetric = %v after %v polls, want success after 3", err, polls)
+	}
+}
@@ -0,0 +1,83 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// notifySecretHeader is the HTTP header carrying the shared webhook secret.
+const notifySecretHeader = "X-Beam-Notify-Secret"
+
+// notification is the JSON body posted to the notification webhook.
+type notification struct {
+	JobID string `json:"job_id"`
+	State string `json:"state"`
+	URL   string `json:"url"`
+
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// notify posts a job notification to the configured webhook, if any. Failures
+// are logged, but never fail the submission.
+func notify(ctx context.Context, opts *JobOptions, jobID, state string) {
+	if opts.NotifyWebhook == "" {
+		return
+	}
+
+	msg := notification{
+		JobID: jobID,
+		State: state,
+		URL:   fmt.Sprintf("https://console.cloud.google.com/dataflow/job/%v?project=%v", jobID, opts.Project),
+
+		CorrelationID: opts.CorrelationID,
+	}
+	if err := postNotification(ctx, opts.NotifyWebhook, opts.NotifyWebhookSecret, msg); err != nil {
+		GetLogger(ctx).Warnf(ctx, "Failed to notify webhook %v of job %v state %v: %v", opts.NotifyWebhook, jobID, state, err)
+	}
+}
+
+func postNotification(ctx context.Context, url, secret string, msg notification) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(notifySecretHeader, secret)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+	return nil
+}
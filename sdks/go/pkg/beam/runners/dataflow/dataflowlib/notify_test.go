@@ -0,0 +1,81 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	var posts []notification
+	var secrets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %v request with content type %q, want JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		var msg notification
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("failed to decode notification: %v", err)
+		}
+		posts = append(posts, msg)
+		secrets = append(secrets, r.Header.Get(notifySecretHeader))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	notify(ctx, &JobOptions{Project: "project"}, "job", "JOB_STATE_RUNNING")
+	if len(posts) != 0 {
+		t.Fatalf("notify() without a webhook posted %v, want none", posts)
+	}
+
+	opts := &JobOptions{Project: "project", CorrelationID: "run-1", NotifyWebhook: srv.URL, NotifyWebhookSecret: "secret"}
+	notify(ctx, opts, "job", "JOB_STATE_DONE")
+	opts.NotifyWebhookSecret = ""
+	notify(ctx, opts, "job", "JOB_STATE_FAILED")
+
+	exp := []notification{
+		{JobID: "job", State: "JOB_STATE_DONE", URL: "https://console.cloud.google.com/dataflow/job/job?project=project", CorrelationID: "run-1"},
+		{JobID: "job", State: "JOB_STATE_FAILED", URL: "https://console.cloud.google.com/dataflow/job/job?project=project", CorrelationID: "run-1"},
+	}
+	if len(posts) != len(exp) {
+		t.Fatalf("notify() posted %v, want %v", posts, exp)
+	}
+	for i := range exp {
+		if posts[i] != exp[i] {
+			t.Errorf("notify() posted %+v, want %+v", posts[i], exp[i])
+		}
+	}
+	if secrets[0] != "secret" || secrets[1] != "" {
+		t.Errorf("notify() sent secrets %q, want the secret only if set", secrets)
+	}
+}
+
+func TestPostNotificationStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	if err := postNotification(context.Background(), srv.URL, "", notification{JobID: "job"}); err == nil {
+		t.Error("postNotification succeeded for a 503 response, want error")
+	}
+	// Failures are only logged.
+	notify(context.Background(), &JobOptions{NotifyWebhook: srv.URL}, "job", "JOB_STATE_DONE")
+}
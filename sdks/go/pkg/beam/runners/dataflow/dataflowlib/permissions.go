@@ -0,0 +1,128 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/storage/v1"
+)
+
+// projectPermissions are the project permissions needed to submit and
+// monitor jobs, such as granted by roles/dataflow.developer.
+var projectPermissions = []string{
+	"dataflow.jobs.create",
+	"dataflow.jobs.get",
+	"dataflow.jobs.list",
+	"dataflow.messages.list",
+}
+
+// bucketPermissions are the staging bucket permissions needed to stage jobs,
+// such as granted by roles/storage.objectAdmin.
+var bucketPermissions = []string{
+	"storage.objects.create",
+	"storage.objects.delete",
+	"storage.objects.get",
+}
+
+// CheckPermissions returns an error listing all missing permissions of the
+// credentials to submit jobs in the project and to stage them in the bucket
+// of the staging location. The permissions are probed with testIamPermissions
+// calls, which do not create any resources. IAM permissions apply to the
+// whole project, so they are not checked per region. If the client is nil, a
+// client with default application credentials is used.
+func CheckPermissions(ctx context.Context, client *storage.Service, project, stagingLocation string) error {
+	client, err := storageClient(ctx, client)
+	if err != nil {
+		return err
+	}
+	hc, err := newHTTPClient(ctx, df.CloudPlatformScope)
+	if err != nil {
+		return err
+	}
+	projects, err := crm.New(hc)
+	if err != nil {
+		return err
+	}
+	return checkPermissions(ctx, projects, client, project, stagingLocation)
+}
+
+func checkPermissions(ctx context.Context, projects *crm.Service, client *storage.Service, project, stagingLocation string) error {
+	bucket, _, err := gcsx.ParseObject(stagingLocation)
+	if err != nil {
+		return fmt.Errorf("invalid staging location %v: %v", stagingLocation, err)
+	}
+
+	var missing []string
+	var granted []string
+	err = retry(ctx, "Permission check of project "+project, func() error {
+		resp, err := projects.Projects.TestIamPermissions(project, &crm.TestIamPermissionsRequest{Permissions: projectPermissions}).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		granted = resp.Permissions
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check permissions in project %v: %v", project, err)
+	}
+	for _, p := range missingPermissions(projectPermissions, granted) {
+		missing = append(missing, fmt.Sprintf("%v on project %v", p, project))
+	}
+
+	err = retry(ctx, "Permission check of bucket "+bucket, func() error {
+		resp, err := client.Buckets.TestIamPermissions(bucket, bucketPermissions).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		granted = resp.Permissions
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check permissions on bucket %v: %v", bucket, err)
+	}
+	for _, p := range missingPermissions(bucketPermissions, granted) {
+		missing = append(missing, fmt.Sprintf("%v on bucket %v", p, bucket))
+	}
+
+	if len(missing) == 0 {
+		GetLogger(ctx).Debugf(ctx, "Credentials have the permissions to submit jobs in project %v and stage to bucket %v", project, bucket)
+		return nil
+	}
+	return fmt.Errorf("missing permissions: %v. Grant roles/dataflow.developer on the project and roles/storage.objectAdmin on the staging bucket", strings.Join(missing, ", "))
+}
+
+// missingPermissions returns the sorted wanted permissions not granted.
+func missingPermissions(want, granted []string) []string {
+	has := make(map[string]bool)
+	for _, p := range granted {
+		has[p] = true
+	}
+	var ret []string
+	for _, p := range want {
+		if !has[p] {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
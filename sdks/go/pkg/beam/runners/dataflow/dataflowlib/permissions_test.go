@@ -0,0 +1,84 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/storage/v1"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	var projectGrants, bucketGrants string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/projects/project:testIamPermissions"):
+			w.Write([]byte(`{"permissions": [` + projectGrants + `]}`))
+		case strings.HasSuffix(r.URL.Path, "/b/bucket/iam/testPermissions"):
+			w.Write([]byte(`{"permissions": [` + bucketGrants + `]}`))
+		default:
+			http.Error(w, "not found: "+r.URL.Path, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	projects, err := crm.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	projects.BasePath = srv.URL + "/"
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	allProject := `"dataflow.jobs.create", "dataflow.jobs.get", "dataflow.jobs.list", "dataflow.messages.list"`
+	allBucket := `"storage.objects.create", "storage.objects.delete", "storage.objects.get"`
+	tests := []struct {
+		project, bucket string
+		missing         []string
+	}{
+		{allProject, allBucket, nil},
+		{`"dataflow.jobs.get"`, allBucket, []string{"dataflow.jobs.create on project project", "dataflow.messages.list on project project"}},
+		{allProject, `"storage.objects.get"`, []string{"storage.objects.create on bucket bucket"}},
+	}
+	for _, test := range tests {
+		projectGrants, bucketGrants = test.project, test.bucket
+		err := checkPermissions(context.Background(), projects, client, "project", "gs://bucket/staging")
+		if len(test.missing) == 0 {
+			if err != nil {
+				t.Errorf("checkPermissions(%v, %v) failed: %v", test.project, test.bucket, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("checkPermissions(%v, %v) succeeded, want missing %v", test.project, test.bucket, test.missing)
+			continue
+		}
+		for _, m := range test.missing {
+			if !strings.Contains(err.Error(), m) {
+				t.Errorf("checkPermissions(%v, %v) = %v, want missing %v", test.project, test.bucket, err, m)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// ProvenanceLabel is the job label with the short digest of the provenance
+// document of the job, if any.
+const ProvenanceLabel = "beam-provenance"
+
+// Provenance identifies the verified build of a job.
+type Provenance struct {
+	// Digest is the SHA-256 digest of the provenance document, of the form
+	// "sha256:<hex>".
+	Digest string `json:"digest"`
+	// BuilderID identifies the builder, if specified.
+	BuilderID string `json:"builder_id,omitempty"`
+	// SourceURI identifies the build source, if specified.
+	SourceURI string `json:"source_uri,omitempty"`
+	// BuildTimestamp is the time the build started, if specified.
+	BuildTimestamp string `json:"build_timestamp,omitempty"`
+}
+
+// provenanceFields are the paths of the key fields in the supported
+// provenance formats: SLSA v0.2 and v1 provenance, both as plain predicates
+// and wrapped in in-toto statements.
+var provenanceFields = map[string][][]string{
+	"builder_id": {
+		{"builder", "id"},
+		{"runDetails", "builder", "id"},
+	},
+	"source_uri": {
+		{"invocation", "configSource", "uri"},
+		{"buildDefinition", "externalParameters", "source", "uri"},
+		{"buildDefinition", "externalParameters", "source"},
+	},
+	"build_timestamp": {
+		{"metadata", "buildStartedOn"},
+		{"runDetails", "metadata", "startedOn"},
+	},
+}
+
+// ReadProvenance reads the JSON provenance document file and returns its
+// digest and key fields.
+func ReadProvenance(file string) (*Provenance, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provenance file %v: %v", file, err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid provenance file %v: %v", file, err)
+	}
+	if predicate, ok := doc["predicate"].(map[string]interface{}); ok {
+		doc = predicate // in-toto statement
+	}
+
+	fields := make(map[string]string)
+	for field, paths := range provenanceFields {
+		for _, path := range paths {
+			if v, ok := lookupString(doc, path); ok {
+				fields[field] = v
+				break
+			}
+		}
+	}
+	return &Provenance{
+		Digest:         fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		BuilderID:      fields["builder_id"],
+		SourceURI:      fields["source_uri"],
+		BuildTimestamp: fields["build_timestamp"],
+	}, nil
+}
+
+// lookupString returns the string value at the path of the JSON document.
+func lookupString(doc map[string]interface{}, path []string) (string, bool) {
+	for i, key := range path {
+		v, ok := doc[key]
+		if !ok {
+			return "", false
+		}
+		if i == len(path)-1 {
+			str, ok := v.(string)
+			return str, ok && str != ""
+		}
+		if doc, ok = v.(map[string]interface{}); !ok {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// annotations returns the provenance as job annotations.
+func (p *Provenance) annotations() map[string]string {
+	ret := map[string]string{"provenance.digest": p.Digest}
+	if p.BuilderID != "" {
+		ret["provenance.builder_id"] = p.BuilderID
+	}
+	if p.SourceURI != "" {
+		ret["provenance.source_uri"] = p.SourceURI
+	}
+	if p.BuildTimestamp != "" {
+		ret["provenance.build_timestamp"] = p.BuildTimestamp
+	}
+	return ret
+}
+
+// label returns the short digest used as job label value, which is limited
+// to 63 characters.
+func (p *Provenance) label() string {
+	const short = 12
+	digest := p.Digest[len("sha256:"):]
+	if len(digest) > short {
+		digest = digest[:short]
+	}
+	return digest
+}
@@ -0,0 +1,90 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, data string) string {
+	fd, err := ioutil.TempFile("", "provenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if _, err := fd.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	return fd.Name()
+}
+
+func TestReadProvenance(t *testing.T) {
+	file := writeTempFile(t, `{
+  "_type": "https://in-toto.io/Statement/v0.1",
+  "predicateType": "https://slsa.dev/provenance/v0.2",
+  "predicate": {
+    "builder": {"id": "https://cloudbuild.googleapis.com/GoogleHostedWorker"},
+    "invocation": {"configSource": {"uri": "git+https://github.com/example/pipelines@refs/heads/main"}},
+    "metadata": {"buildStartedOn": "2020-01-02T03:04:05Z"}
+  }
+}`)
+	defer os.Remove(file)
+
+	p, err := ReadProvenance(file)
+	if err != nil {
+		t.Fatalf("ReadProvenance failed: %v", err)
+	}
+	if !strings.HasPrefix(p.Digest, "sha256:") || len(p.Digest) != len("sha256:")+64 {
+		t.Errorf("ReadProvenance() digest = %v, want sha256 digest", p.Digest)
+	}
+	exp := Provenance{
+		Digest:         p.Digest,
+		BuilderID:      "https://cloudbuild.googleapis.com/GoogleHostedWorker",
+		SourceURI:      "git+https://github.com/example/pipelines@refs/heads/main",
+		BuildTimestamp: "2020-01-02T03:04:05Z",
+	}
+	if *p != exp {
+		t.Errorf("ReadProvenance() = %+v, want %+v", *p, exp)
+	}
+
+	opts := &JobOptions{Project: "project", Region: "us-central1", Provenance: p}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	if actual := job.Labels[ProvenanceLabel]; actual != p.Digest[7:19] {
+		t.Errorf("Translate() provenance label = %v, want %v", actual, p.Digest[7:19])
+	}
+	annotations, err := GetAnnotations(job)
+	if err != nil {
+		t.Fatalf("GetAnnotations failed: %v", err)
+	}
+	if annotations["provenance.digest"] != p.Digest || annotations["provenance.builder_id"] != exp.BuilderID {
+		t.Errorf("Translate() annotations = %v, want provenance", annotations)
+	}
+}
+
+func TestReadProvenanceInvalid(t *testing.T) {
+	file := writeTempFile(t, `{"builder": `)
+	defer os.Remove(file)
+
+	if _, err := ReadProvenance(file); err == nil {
+		t.Error("ReadProvenance succeeded for invalid JSON, want error")
+	}
+}
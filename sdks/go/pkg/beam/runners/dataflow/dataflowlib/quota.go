@@ -0,0 +1,91 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+	ghttp "google.golang.org/api/transport/http"
+)
+
+type quotaProjectKey struct{}
+
+// WithQuotaProject returns a context under which the Dataflow and GCS clients
+// of the runner bill API usage and quota to the given project, instead of
+// the project of the accessed resources. If the project is empty, the
+// context is returned unchanged.
+func WithQuotaProject(ctx context.Context, project string) context.Context {
+	if project == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, quotaProjectKey{}, project)
+}
+
+// getQuotaProject returns the quota project of the context, if any.
+func getQuotaProject(ctx context.Context) string {
+	project, _ := ctx.Value(quotaProjectKey{}).(string)
+	return project
+}
+
+// newHTTPClient returns an HTTP client with default application credentials
+// and the given scopes that uses the quota project, transport and token
+// source of the context, if any.
+func newHTTPClient(ctx context.Context, scopes ...string) (*http.Client, error) {
+	project := getQuotaProject(ctx)
+	rt := getTransport(ctx)
+	ts := getTokenSource(ctx)
+	if project == "" && rt == nil && ts == nil {
+		return defaultClient(ctx, scopes...)
+	}
+	opts := []option.ClientOption{option.WithScopes(scopes...)}
+	if project != "" {
+		opts = append(opts, option.WithQuotaProject(project))
+	}
+	if ts != nil {
+		checked, err := tokenSource(ctx, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithTokenSource(checked))
+	}
+	if rt == nil {
+		cl, _, err := ghttp.NewClient(ctx, opts...)
+		return cl, err
+	}
+	t, err := ghttp.NewTransport(ctx, rt, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// newStorageClient returns a GCS client with default application credentials
+// and the given scope that uses the quota project, transport and token
+// source of the context, if any.
+func newStorageClient(ctx context.Context, scope string) (*storage.Service, error) {
+	if getQuotaProject(ctx) == "" && getTransport(ctx) == nil && getTokenSource(ctx) == nil {
+		return gcsx.NewClient(ctx, scope)
+	}
+	hc, err := newHTTPClient(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	return storage.New(hc)
+}
@@ -0,0 +1,79 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/storage/v1"
+)
+
+func TestWithQuotaProject(t *testing.T) {
+	ctx := context.Background()
+	if WithQuotaProject(ctx, "") != ctx {
+		t.Error("WithQuotaProject(\"\") changed the context, want it unchanged")
+	}
+	if actual := getQuotaProject(WithQuotaProject(ctx, "billing")); actual != "billing" {
+		t.Errorf("getQuotaProject() = %q, want billing", actual)
+	}
+}
+
+func TestQuotaProjectClients(t *testing.T) {
+	var projects []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		projects = append(projects, r.Header.Get("X-Goog-User-Project"))
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/b/") {
+			json.NewEncoder(w).Encode(&storage.Bucket{Name: "bucket"})
+			return
+		}
+		json.NewEncoder(w).Encode(&df.Job{Id: "id"})
+	}))
+	defer srv.Close()
+
+	// The token source stands in for default application credentials.
+	ctx := WithQuotaProject(WithTokenSource(context.Background(), &countingTokenSource{}), "billing")
+	client, err := NewClient(ctx, srv.URL+"/")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if _, err := GetJob(ctx, client, "project", "region", "id", 0); err != nil {
+		t.Fatalf("GetJob failed: %v", err)
+	}
+	gcs, err := newStorageClient(ctx, storage.DevstorageReadWriteScope)
+	if err != nil {
+		t.Fatalf("newStorageClient failed: %v", err)
+	}
+	gcs.BasePath = srv.URL + "/"
+	if _, err := gcs.Buckets.Get("bucket").Do(); err != nil {
+		t.Fatalf("Buckets.Get failed: %v", err)
+	}
+
+	if len(projects) != 2 {
+		t.Fatalf("got %v requests, want 2", len(projects))
+	}
+	for _, project := range projects {
+		if project != "billing" {
+			t.Errorf("request quota project = %q, want billing", project)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
+	"github.com/golang/protobuf/proto"
+	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+// ErrUnchanged is returned instead of submitting a job, if the pipeline and
+// options are unchanged since the last recorded submission.
+var ErrUnchanged = errors.New("pipeline unchanged since the last submission")
+
+// Receipt records a job submission, or the staged artifacts of a job that is
+// not yet submitted.
+type Receipt struct {
+	// Hash is the submission hash of the pipeline and options.
+	Hash string `json:"hash"`
+	// JobID is the ID of the submitted job.
+	JobID string `json:"job_id"`
+	// Time is the submission time.
+	Time time.Time `json:"time"`
+	// Provenance identifies the build of the submitted job, if known.
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// CorrelationID is the correlation ID of the submission, if any.
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// ModelURL and WorkerURL are the staged model pipeline and worker
+	// binary, for staged jobs.
+	ModelURL  string `json:"model_url,omitempty"`
+	WorkerURL string `json:"worker_url,omitempty"`
+	// Region is the region that the staged job is submitted in.
+	Region string `json:"region,omitempty"`
+	// Job is the translated job, for staged jobs. See ExecuteFromStaged.
+	Job *df.Job `json:"job,omitempty"`
+	// Checksums are the checksums of the staged objects, keyed by their
+	// GCS location, if recorded. See JobOptions.RecordChecksums.
+	Checksums map[string]*Checksum `json:"checksums,omitempty"`
+}
+
+// SubmissionHash returns a stable hash of the model pipeline, the job options
+// and the worker binary. If no worker binary is specified, the running binary
+// is hashed instead, because the worker is either the running binary or
+// built from the same source. A worker binary in GCS is identified by its
+// location and CRC32C checksum, which are looked up with the storage client
+// of the options, if any, without downloading it. Jobs must have a fixed name
+// to hash stably.
+func SubmissionHash(ctx context.Context, p *pb.Pipeline, opts *JobOptions) (string, error) {
+	h := sha256.New()
+
+	var buf proto.Buffer
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(p); err != nil {
+		return "", fmt.Errorf("failed to encode model: %v", err)
+	}
+	h.Write(buf.Bytes())
+
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode job options: %v", err)
+	}
+	h.Write(data)
+
+	worker := opts.Worker
+	if isGCSWorker(worker) {
+		sum, err := gcsWorkerChecksum(ctx, opts.StorageClient, worker)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(worker))
+		h.Write([]byte(sum))
+		return fmt.Sprintf("%x", h.Sum(nil)), nil
+	}
+	if worker == "" {
+		if worker, err = os.Executable(); err != nil {
+			return "", fmt.Errorf("failed to find running binary: %v", err)
+		}
+	}
+	fd, err := os.Open(worker)
+	if err != nil {
+		return "", fmt.Errorf("failed to open worker binary %s: %v", worker, err)
+	}
+	defer fd.Close()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", fmt.Errorf("failed to read worker binary %s: %v", worker, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// gcsWorkerChecksum returns the CRC32C checksum of the worker binary in GCS,
+// or its generation, if it has no checksum, so that a replaced binary changes
+// the submission hash.
+func gcsWorkerChecksum(ctx context.Context, client *storage.Service, worker string) (string, error) {
+	bucket, obj, err := gcsx.ParseObject(worker)
+	if err != nil {
+		return "", fmt.Errorf("invalid worker binary location %v: %v", worker, err)
+	}
+	client, err = storageClient(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	var attrs *storage.Object
+	err = retry(ctx, "Worker binary lookup", func() error {
+		var err error
+		attrs, err = client.Objects.Get(bucket, obj).Fields("crc32c", "generation").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to look up worker binary %v: %v", worker, err)
+	}
+	if attrs.Crc32c != "" {
+		return attrs.Crc32c, nil
+	}
+	return fmt.Sprintf("generation %v", attrs.Generation), nil
+}
+
+// redactReceipt returns the indented JSON encoding of the receipt with the
+// worker environment and sensitive values of its job redacted.
+func redactReceipt(ctx context.Context, r *Receipt) ([]byte, error) {
+	if r.Job != nil {
+		job, err := RedactJob(r.Job)
+		if err != nil {
+			return nil, err
+		}
+		cp := *r
+		cp.Job = job
+		r = &cp
+	}
+	return redactIndent(ctx, r)
+}
+
+// restoreStagedJob returns a copy of the staged job to submit, with the
+// worker environment of the options, if any, restored. It fails if the job
+// has other redacted values, which would reach the workers as is.
+func restoreStagedJob(job *df.Job, opts *JobOptions) (*df.Job, error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode staged job %v: %v", job.Name, err)
+	}
+	var ret df.Job
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, fmt.Errorf("failed to decode staged job %v: %v", job.Name, err)
+	}
+	if len(opts.WorkerEnv) > 0 && ret.Environment != nil && len(ret.Environment.SdkPipelineOptions) > 0 {
+		var sdk map[string]json.RawMessage
+		if err := json.Unmarshal(ret.Environment.SdkPipelineOptions, &sdk); err != nil {
+			return nil, fmt.Errorf("failed to decode pipeline options of staged job %v: %v", job.Name, err)
+		}
+		const key = "beam:option:go_options:v1"
+		var goOpts runtime.RawOptions
+		if raw, ok := sdk[key]; ok {
+			if err := json.Unmarshal(raw, &goOpts); err != nil {
+				return nil, fmt.Errorf("failed to decode Go options of staged job %v: %v", job.Name, err)
+			}
+		}
+		if goOpts.Options == nil {
+			goOpts.Options = make(map[string]string)
+		}
+		env, err := json.Marshal(opts.WorkerEnv)
+		if err != nil {
+			return nil, err
+		}
+		goOpts.Options[workerEnvOption] = string(env)
+		sdk[key] = json.RawMessage(newMsg(goOpts))
+		ret.Environment.SdkPipelineOptions = newMsg(sdk)
+	}
+
+	data, err = json.Marshal(&ret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode staged job %v: %v", job.Name, err)
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to decode staged job %v: %v", job.Name, err)
+	}
+	if path := redactedPath(tree, ""); path != "" {
+		if strings.HasSuffix(path, "."+workerEnvOption) {
+			return nil, fmt.Errorf("staged job %v has a redacted worker environment. Pass it with JobOptions.WorkerEnv", job.Name)
+		}
+		return nil, fmt.Errorf("staged job %v has a redacted value at %v and cannot be submitted", job.Name, path)
+	}
+	return &ret, nil
+}
+
+// redactedPath returns the dotted path of the first redacted value in the
+// decoded JSON tree, ignoring display data, or the empty string if none.
+func redactedPath(v interface{}, path string) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if k == "display_data" {
+				continue
+			}
+			if p := redactedPath(v[k], path+"."+k); p != "" {
+				return p
+			}
+		}
+	case []interface{}:
+		for i, elm := range v {
+			if p := redactedPath(elm, fmt.Sprintf("%v[%v]", path, i)); p != "" {
+				return p
+			}
+		}
+	case string:
+		if v == redacted {
+			return strings.TrimPrefix(path, ".")
+		}
+	}
+	return ""
+}
+
+// ReadReceipt reads the receipt at the given local path or GCS location. It
+// returns nil, if there is no receipt.
+func ReadReceipt(ctx context.Context, location string) (*Receipt, error) {
+	var data []byte
+	if strings.HasPrefix(location, "gs://") {
+		bucket, obj, err := gcsx.ParseObject(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid receipt location %v: %v", location, err)
+		}
+		client, err := newStorageClient(ctx, storage.DevstorageReadOnlyScope)
+		if err != nil {
+			return nil, err
+		}
+		data, err = gcsx.ReadObject(client, bucket, obj)
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read receipt %v: %v", location, err)
+		}
+	} else {
+		var err error
+		data, err = ioutil.ReadFile(location)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read receipt %v: %v", location, err)
+		}
+	}
+
+	var r Receipt
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid receipt %v: %v", location, err)
+	}
+	return &r, nil
+}
+
+// WriteReceipt writes the receipt to the given local path or GCS location.
+// Local files are written atomically. The worker environment and sensitive
+// values of the job of a staged receipt are redacted, like in WriteJob, so
+// the worker environment must be passed to ExecuteFromStaged again. See
+// WithRedactPatterns.
+func WriteReceipt(ctx context.Context, location string, r *Receipt) error {
+	data, err := redactReceipt(ctx, r)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(location, "gs://") {
+		bucket, obj, err := gcsx.ParseObject(location)
+		if err != nil {
+			return fmt.Errorf("invalid receipt location %v: %v", location, err)
+		}
+		client, err := newStorageClient(ctx, storage.DevstorageReadWriteScope)
+		if err != nil {
+			return err
+		}
+		return gcsx.WriteObject(client, bucket, obj, bytes.NewReader(data))
+	}
+	return writeFileAtomic(location, data)
+}
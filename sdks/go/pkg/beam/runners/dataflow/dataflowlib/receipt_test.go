@@ -0,0 +1,241 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/storage/v1"
+)
+
+func TestSubmissionHash(t *testing.T) {
+	worker, err := ioutil.TempFile("", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(worker.Name())
+	worker.WriteString("worker")
+	worker.Close()
+
+	ctx := context.Background()
+	opts := &JobOptions{Name: "job", Project: "project", Worker: worker.Name()}
+	hash, err := SubmissionHash(ctx, emptyPipeline(), opts)
+	if err != nil {
+		t.Fatalf("SubmissionHash failed: %v", err)
+	}
+	if again, _ := SubmissionHash(ctx, emptyPipeline(), opts); again != hash {
+		t.Errorf("SubmissionHash() = %v, then %v, want stable hash", hash, again)
+	}
+
+	changed := *opts
+	changed.NumWorkers = 10
+	if other, _ := SubmissionHash(ctx, emptyPipeline(), &changed); other == hash {
+		t.Error("SubmissionHash() unchanged by a job option change")
+	}
+
+	p := emptyPipeline()
+	p.RootTransformIds = []string{"t"}
+	if other, _ := SubmissionHash(ctx, p, opts); other == hash {
+		t.Error("SubmissionHash() unchanged by a model change")
+	}
+
+	if err := ioutil.WriteFile(worker.Name(), []byte("new worker"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := SubmissionHash(ctx, emptyPipeline(), opts); other == hash {
+		t.Error("SubmissionHash() unchanged by a worker binary change")
+	}
+}
+
+func TestSubmissionHashGCSWorker(t *testing.T) {
+	crc32c := "AAAAAA=="
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/b/bucket/o/worker" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&storage.Object{Crc32c: crc32c, Generation: 1})
+	}))
+	defer srv.Close()
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	ctx := context.Background()
+	opts := &JobOptions{Name: "job", Project: "project", Worker: "gs://bucket/worker", StorageClient: client}
+	hash, err := SubmissionHash(ctx, emptyPipeline(), opts)
+	if err != nil {
+		t.Fatalf("SubmissionHash failed: %v", err)
+	}
+	if again, _ := SubmissionHash(ctx, emptyPipeline(), opts); again != hash {
+		t.Errorf("SubmissionHash() = %v, then %v, want stable hash", hash, again)
+	}
+	crc32c = "BBBBBB=="
+	if other, _ := SubmissionHash(ctx, emptyPipeline(), opts); other == hash {
+		t.Error("SubmissionHash() unchanged by a replaced worker binary in GCS")
+	}
+
+	opts.Worker = "gs://bucket/missing"
+	if _, err := SubmissionHash(ctx, emptyPipeline(), opts); err == nil {
+		t.Error("SubmissionHash succeeded for a missing worker binary in GCS, want error")
+	}
+}
+
+func TestReceiptRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	location := filepath.Join(dir, "receipt.json")
+	if r, err := ReadReceipt(ctx, location); err != nil || r != nil {
+		t.Fatalf("ReadReceipt(missing) = (%v, %v), want (nil, nil)", r, err)
+	}
+
+	r := &Receipt{Hash: "abc", JobID: "job", Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	if err := WriteReceipt(ctx, location, r); err != nil {
+		t.Fatalf("WriteReceipt failed: %v", err)
+	}
+	actual, err := ReadReceipt(ctx, location)
+	if err != nil {
+		t.Fatalf("ReadReceipt failed: %v", err)
+	}
+	if !reflect.DeepEqual(actual, r) {
+		t.Errorf("ReadReceipt() = %v, want %v", actual, r)
+	}
+}
+
+func TestStagedReceipt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	location := filepath.Join(dir, "receipt.json")
+	r := &Receipt{
+		Hash:      "abc",
+		ModelURL:  "gs://bucket/model",
+		WorkerURL: "gs://bucket/worker",
+		Region:    "us-central1",
+		Job:       &df.Job{Name: "job", ProjectId: "project"},
+	}
+	if err := WriteReceipt(ctx, location, r); err != nil {
+		t.Fatalf("WriteReceipt failed: %v", err)
+	}
+	actual, err := ReadReceipt(ctx, location)
+	if err != nil {
+		t.Fatalf("ReadReceipt failed: %v", err)
+	}
+	if actual.ModelURL != r.ModelURL || actual.WorkerURL != r.WorkerURL || actual.Region != r.Region {
+		t.Errorf("ReadReceipt() = %+v, want %+v", actual, r)
+	}
+	if actual.Job == nil || actual.Job.Name != "job" || actual.Job.ProjectId != "project" {
+		t.Errorf("ReadReceipt() job = %+v, want %+v", actual.Job, r.Job)
+	}
+
+	if _, err := ExecuteFromStaged(ctx, &Receipt{JobID: "job"}, nil, "", true); err == nil {
+		t.Error("ExecuteFromStaged succeeded without a staged job, want error")
+	}
+	if _, err := StageOnly(ctx, emptyPipeline(), &JobOptions{Update: true}, r.WorkerURL, r.ModelURL); err == nil {
+		t.Error("StageOnly succeeded for an update, want error")
+	}
+}
+
+func TestStageOnlyAndExecuteFromStaged(t *testing.T) {
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	f := &fakeDataflow{states: []string{"JOB_STATE_RUNNING"}, createFailures: 1}
+	srv, stop := newFakeDataflow(f)
+	defer stop()
+	opts, cleanup := fakeOptions(t, srv)
+	defer cleanup()
+	opts.WorkerEnv = map[string]string{"API_TOKEN": "s3cret"}
+
+	ctx := context.Background()
+	r, err := StageOnly(ctx, impulsePipeline(t), opts, "gs://bucket/worker", "gs://bucket/model")
+	if err != nil {
+		t.Fatalf("StageOnly failed: %v", err)
+	}
+	if f.uploads != 2 || f.creates != 0 {
+		t.Errorf("StageOnly made %v uploads and %v job creations, want 2 and 0", f.uploads, f.creates)
+	}
+	if r.Job == nil || r.Job.Name != "job" || r.ModelURL != "gs://bucket/model" || r.WorkerURL != "gs://bucket/worker" || r.Region != "us-central1" {
+		t.Fatalf("StageOnly() = %+v, want the staged job", r)
+	}
+	assertPackages(t, r.Job, "gs://bucket/worker")
+
+	dir, err := ioutil.TempDir("", "receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "receipt.json")
+	if err := WriteReceipt(ctx, location, r); err != nil {
+		t.Fatalf("WriteReceipt failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Errorf("WriteReceipt() wrote the worker environment:\n%s", data)
+	}
+	read, err := ReadReceipt(ctx, location)
+	if err != nil {
+		t.Fatalf("ReadReceipt failed: %v", err)
+	}
+
+	if _, err := ExecuteFromStaged(ctx, read, nil, srv.URL+"/", true); err == nil || !strings.Contains(err.Error(), "redacted worker environment") {
+		t.Errorf("ExecuteFromStaged without the worker environment = %v, want redaction error", err)
+	}
+	submit := &JobOptions{Project: "project", Region: "us-central1", WorkerEnv: opts.WorkerEnv}
+	res, err := ExecuteFromStaged(ctx, read, submit, srv.URL+"/", true)
+	if err != nil {
+		t.Fatalf("ExecuteFromStaged failed: %v", err)
+	}
+	if res.JobID != "job-1" || res.Region != "us-central1" {
+		t.Errorf("ExecuteFromStaged() = (%v, %v), want (job-1, us-central1)", res.JobID, res.Region)
+	}
+	if f.creates != 2 {
+		t.Errorf("fake received %v job creations, want 2 after a retry", f.creates)
+	}
+	job := f.submittedJob(t)
+	if job.ClientRequestId == "" {
+		t.Error("ExecuteFromStaged submitted the job without a client request ID")
+	}
+	if !strings.Contains(string(job.Environment.SdkPipelineOptions), "s3cret") {
+		t.Errorf("ExecuteFromStaged submitted %s, want the restored worker environment", job.Environment.SdkPipelineOptions)
+	}
+	assertPackages(t, job, "gs://bucket/worker")
+}
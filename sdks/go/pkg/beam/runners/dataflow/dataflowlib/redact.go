@@ -0,0 +1,140 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// DefaultRedactPatterns are the default sensitive key patterns. See
+// WithRedactPatterns.
+var DefaultRedactPatterns = []string{"key", "secret", "token", "password"}
+
+type redactKey struct{}
+
+// WithRedactPatterns returns a context under which the values of options,
+// labels, environment variables and other fields, whose names contain any
+// of the given patterns, are redacted wherever the runner prints or writes
+// them for inspection, such as job logs, dry-run output and printed options.
+// Patterns are matched case-insensitively. If no patterns are given, the
+// context is returned unchanged and DefaultRedactPatterns apply.
+func WithRedactPatterns(ctx context.Context, patterns []string) context.Context {
+	if len(patterns) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, redactKey{}, patterns)
+}
+
+// getRedactPatterns returns the sensitive key patterns of the context.
+func getRedactPatterns(ctx context.Context) []string {
+	if patterns, ok := ctx.Value(redactKey{}).([]string); ok {
+		return patterns
+	}
+	return DefaultRedactPatterns
+}
+
+// isSensitive returns true iff the key contains any of the patterns.
+func isSensitive(key string, patterns []string) bool {
+	key = strings.ToLower(key)
+	for _, p := range patterns {
+		if p != "" && strings.Contains(key, strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact returns the JSON encoding of v with the values of sensitive keys
+// under the patterns of the context redacted. Display data and similar
+// key/value entries are redacted by the value of their key field.
+func Redact(ctx context.Context, v interface{}) ([]byte, error) {
+	tree, err := redactJSON(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+// redactIndent is like Redact, but indents the JSON encoding.
+func redactIndent(ctx context.Context, v interface{}) ([]byte, error) {
+	tree, err := redactJSON(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(tree, "", "  ")
+}
+
+// redactJSON returns the decoded JSON encoding of v with sensitive values
+// redacted. Numbers are kept verbatim.
+func redactJSON(ctx context.Context, v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var tree interface{}
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return redactTree(tree, getRedactPatterns(ctx)), nil
+}
+
+func redactTree(v interface{}, patterns []string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if k, ok := v["key"].(string); ok {
+			if _, ok := v["value"]; ok && isSensitive(k, patterns) {
+				v["value"] = redacted
+			}
+		}
+		for k, elm := range v {
+			if k != "key" && isSensitive(k, patterns) && isScalar(elm) {
+				v[k] = redacted
+				continue
+			}
+			v[k] = redactTree(elm, patterns)
+		}
+		return v
+	case []interface{}:
+		for i, elm := range v {
+			v[i] = redactTree(elm, patterns)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, json.Number, bool:
+		return true
+	default:
+		return false
+	}
+}
+
+// redactNonEmpty returns the redacted placeholder, unless the value is empty.
+func redactNonEmpty(v string) string {
+	if v == "" {
+		return ""
+	}
+	return redacted
+}
@@ -0,0 +1,117 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+)
+
+func TestRedact(t *testing.T) {
+	v := map[string]interface{}{
+		"labels": map[string]string{"team": "data", "auth-token": "t0k3n"},
+		"display_data": []map[string]string{
+			{"key": "db_password", "value": "hunter2"},
+			{"key": "input", "value": "gs://foo/in"},
+		},
+		"numWorkers":       12345678901234567,
+		"NotifyWebhookKey": "s3cr3t",
+	}
+
+	data, err := Redact(context.Background(), v)
+	if err != nil {
+		t.Fatalf("Redact failed: %v", err)
+	}
+	actual := string(data)
+	for _, secret := range []string{"t0k3n", "hunter2", "s3cr3t"} {
+		if strings.Contains(actual, secret) {
+			t.Errorf("Redact() = %v, want %v redacted", actual, secret)
+		}
+	}
+	for _, kept := range []string{"gs://foo/in", `"team":"data"`, `"key":"db_password"`, "12345678901234567"} {
+		if !strings.Contains(actual, kept) {
+			t.Errorf("Redact() = %v, want %v kept", actual, kept)
+		}
+	}
+
+	ctx := WithRedactPatterns(context.Background(), []string{"TEAM"})
+	data, err = Redact(ctx, v)
+	if err != nil {
+		t.Fatalf("Redact failed: %v", err)
+	}
+	actual = string(data)
+	if strings.Contains(actual, `"team":"data"`) || !strings.Contains(actual, "hunter2") {
+		t.Errorf("Redact() with patterns [TEAM] = %v, want only team redacted", actual)
+	}
+}
+
+func TestWriteJobRedacted(t *testing.T) {
+	opts := &JobOptions{
+		Project: "project",
+		Region:  "us-central1",
+		Options: runtime.RawOptions{Options: map[string]string{"api_token": "t0k3n"}},
+		Labels:  map[string]string{"secret-label": "hunter2"},
+	}
+	job, err := Translate(emptyPipeline(), opts, "gs://foo/worker", "gs://foo/model")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "job.json")
+	if err := WriteJob(context.Background(), job, file); err != nil {
+		t.Fatalf("WriteJob failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"t0k3n", "hunter2"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("WriteJob() wrote %s, want %v redacted", data, secret)
+		}
+	}
+	if !strings.Contains(string(data), "gs://foo/model") {
+		t.Errorf("WriteJob() wrote %s, want model URL kept", data)
+	}
+}
+
+func TestPrintDiffRedacted(t *testing.T) {
+	logger := &recordingLogger{}
+	ctx := WithLogger(context.Background(), logger)
+	PrintDiff(ctx, "job", []JobChange{
+		{Kind: "changed", Field: "go_option db_password", Old: "hunter1", New: "hunter2"},
+		{Kind: "added", Field: "label team", New: "data"},
+	})
+	actual := strings.Join(logger.lines, "\n")
+	if strings.Contains(actual, "hunter") {
+		t.Errorf("PrintDiff() logged %v, want password redacted", actual)
+	}
+	if !strings.Contains(actual, "+ label team: data") {
+		t.Errorf("PrintDiff() logged %v, want label change kept", actual)
+	}
+}
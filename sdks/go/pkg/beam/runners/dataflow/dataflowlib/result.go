@@ -0,0 +1,175 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+// Result is the outcome of a Dataflow job submission.
+type Result struct {
+	// JobID is the Dataflow job ID.
+	JobID string
+	// Region is the region that accepted the job.
+	Region string
+	// CorrelationID is the correlation ID of the submission, if any.
+	CorrelationID string
+	// Checksums are the checksums of the staged objects, keyed by their
+	// GCS location, if recorded. See JobOptions.RecordChecksums.
+	Checksums map[string]*Checksum
+	// JobSpec is the submitted job spec, if JobOptions.ReturnJobSpec is
+	// set. It may hold sensitive values. See RedactJob.
+	JobSpec *df.Job
+
+	client *df.Service
+	opts   *JobOptions
+	// tempLocation is the temp location of the submitted job.
+	tempLocation string
+
+	// inputs and outputs are the lineage datasets of the job, if known.
+	inputs, outputs []lineageDataset
+
+	// mu serializes Wait.
+	mu   sync.Mutex
+	done bool
+	err  error
+
+	// states are the observed job state changes, which statesMu guards so
+	// that they can be read while Wait polls.
+	states   []StateChange
+	statesMu sync.Mutex
+}
+
+// StateChange is a job state observed at a given time.
+type StateChange struct {
+	State string
+	Time  time.Time
+}
+
+// State returns the last observed job state, if any. It is safe to call
+// while Wait is in progress.
+func (r *Result) State() string {
+	r.statesMu.Lock()
+	defer r.statesMu.Unlock()
+	return r.lastState()
+}
+
+// States returns a copy of the observed job state changes, in order.
+// Consecutive duplicate states are not recorded. It is safe to call while
+// Wait is in progress.
+func (r *Result) States() []StateChange {
+	r.statesMu.Lock()
+	defer r.statesMu.Unlock()
+	return append([]StateChange(nil), r.states...)
+}
+
+// lastState returns the last observed job state. The caller holds statesMu.
+func (r *Result) lastState() string {
+	if len(r.states) == 0 {
+		return ""
+	}
+	return r.states[len(r.states)-1].State
+}
+
+// Wait blocks until the job reaches a terminal state and returns it. It
+// returns an error if the job failed or could not be monitored. Once the job
+// is done, Wait returns the same state and error without further monitoring,
+// so it is safe to call multiple times.
+func (r *Result) Wait(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done {
+		return r.State(), r.err
+	}
+	if r.client == nil {
+		return r.State(), errors.New("job cannot be monitored: no Dataflow client")
+	}
+	ctx = WithJobOptions(ctx, r.opts)
+
+	err := waitForCompletion(ctx, r.client, r.opts.Project, r.Region, r.JobID, r.opts.APITimeout, r)
+	state := r.State()
+	if !isTerminal(state) {
+		// Monitoring was interrupted, such as by the context.
+		return state, err
+	}
+	r.done, r.err = true, err
+
+	notify(ctx, r.opts, r.JobID, state)
+	emitLineage(ctx, r.opts, r.JobID, state, r.inputs, r.outputs)
+	exportMetrics(ctx, r.client, r.opts, r.Region, r.JobID)
+	if state == "JOB_STATE_DONE" {
+		// Only clean up on success, so that failed jobs leave their temp
+		// data behind for debugging.
+		if err := cleanupTemp(ctx, r.opts, r.tempLocation); err != nil {
+			GetLogger(ctx).Warnf(ctx, "Failed to clean up temp data for job %v: %v", r.JobID, err)
+		}
+	}
+	return state, err
+}
+
+// Cancel requests cancellation of the job. It does not wait for the job to
+// be cancelled. Use Wait for that.
+func (r *Result) Cancel(ctx context.Context) error {
+	if r.client == nil {
+		return errors.New("job cannot be cancelled: no Dataflow client")
+	}
+	ctx = WithJobOptions(ctx, r.opts)
+	return retry(ctx, "Job cancellation", func() error {
+		cctx, cancel := apiContext(ctx, r.opts.APITimeout)
+		defer cancel()
+
+		_, err := updateJob(cctx, r.client, r.opts.Project, r.Region, r.JobID, &df.Job{
+			RequestedState: "JOB_STATE_CANCELLED",
+		})
+		return err
+	})
+}
+
+// isTerminal returns true iff the job state is terminal.
+func isTerminal(state string) bool {
+	switch state {
+	case "JOB_STATE_DONE", "JOB_STATE_FAILED", "JOB_STATE_CANCELLED", "JOB_STATE_UPDATED", "JOB_STATE_DRAINED":
+		return true
+	default:
+		return false
+	}
+}
+
+// record adds the state to the history, unless it is the same as the
+// last observed state.
+func (r *Result) record(state string, t time.Time) {
+	r.statesMu.Lock()
+	defer r.statesMu.Unlock()
+
+	if state == "" || state == r.lastState() {
+		return
+	}
+	r.states = append(r.states, StateChange{State: state, Time: t})
+}
+
+// stateTime returns the parsed job state time, or now if unparseable.
+func stateTime(ts string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+		return t
+	}
+	return time.Now()
+}
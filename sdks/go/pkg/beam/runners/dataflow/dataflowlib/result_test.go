@@ -0,0 +1,178 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+func TestResultRecord(t *testing.T) {
+	var res Result
+	now := time.Now()
+	for i, state := range []string{"JOB_STATE_PENDING", "JOB_STATE_PENDING", "", "JOB_STATE_RUNNING", "JOB_STATE_RUNNING", "JOB_STATE_DONE"} {
+		res.record(state, now.Add(time.Duration(i)*time.Second))
+	}
+
+	var actual []string
+	for _, s := range res.States() {
+		actual = append(actual, s.State)
+	}
+	expected := []string{"JOB_STATE_PENDING", "JOB_STATE_RUNNING", "JOB_STATE_DONE"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("recorded states = %v, want %v", actual, expected)
+	}
+	if res.States()[1].Time != now.Add(3*time.Second) {
+		t.Errorf("RUNNING recorded at %v, want first observation at %v", res.States()[1].Time, now.Add(3*time.Second))
+	}
+}
+
+// fakeJobServer serves the given job states in turn and records the
+// requested job states.
+type fakeJobServer struct {
+	mu        sync.Mutex
+	states    []string
+	gets      int
+	requested []string
+}
+
+func (f *fakeJobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		state := f.states[len(f.states)-1]
+		if f.gets < len(f.states) {
+			state = f.states[f.gets]
+		}
+		f.gets++
+		json.NewEncoder(w).Encode(&df.Job{Id: "job", CurrentState: state})
+	case http.MethodPut:
+		var job df.Job
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.requested = append(f.requested, job.RequestedState)
+		json.NewEncoder(w).Encode(&df.Job{Id: "job"})
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+func newFakeResult(t *testing.T, f *fakeJobServer) (*Result, func()) {
+	srv := httptest.NewServer(f)
+	client, err := df.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	res := &Result{JobID: "job", Region: "region", client: client, opts: &JobOptions{Project: "project"}}
+	return res, srv.Close
+}
+
+func TestResultWait(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Millisecond
+
+	f := &fakeJobServer{states: []string{"JOB_STATE_PENDING", "JOB_STATE_RUNNING", "JOB_STATE_DONE"}}
+	res, stop := newFakeResult(t, f)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		state, err := res.Wait(context.Background())
+		if err != nil || state != "JOB_STATE_DONE" {
+			t.Errorf("Wait() #%v = (%v, %v), want (JOB_STATE_DONE, nil)", i, state, err)
+		}
+	}
+	if f.gets != 3 {
+		t.Errorf("Wait() polled %v times, want 3", f.gets)
+	}
+}
+
+func TestResultStateDuringWait(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Millisecond
+
+	f := &fakeJobServer{states: []string{"JOB_STATE_PENDING", "JOB_STATE_RUNNING", "JOB_STATE_RUNNING", "JOB_STATE_RUNNING", "JOB_STATE_DONE"}}
+	res, stop := newFakeResult(t, f)
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res.Wait(context.Background())
+	}()
+	// Run with -race to check that reading the states does not race with
+	// Wait recording them.
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		default:
+			res.State()
+			res.States()
+		}
+	}
+
+	states := res.States()
+	if len(states) != 3 || res.State() != "JOB_STATE_DONE" {
+		t.Errorf("States() = %v, want PENDING, RUNNING and DONE", states)
+	}
+	states[0].State = "modified"
+	if res.States()[0].State != "JOB_STATE_PENDING" {
+		t.Error("States() returned the recorded states, want a copy")
+	}
+}
+
+func TestResultWaitFailed(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Millisecond
+
+	f := &fakeJobServer{states: []string{"JOB_STATE_RUNNING", "JOB_STATE_FAILED"}}
+	res, stop := newFakeResult(t, f)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		state, err := res.Wait(context.Background())
+		if err == nil || state != "JOB_STATE_FAILED" {
+			t.Errorf("Wait() #%v = (%v, %v), want (JOB_STATE_FAILED, error)", i, state, err)
+		}
+	}
+}
+
+func TestResultCancel(t *testing.T) {
+	f := &fakeJobServer{states: []string{"JOB_STATE_RUNNING"}}
+	res, stop := newFakeResult(t, f)
+	defer stop()
+
+	if err := res.Cancel(context.Background()); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	if exp := []string{"JOB_STATE_CANCELLED"}; !reflect.DeepEqual(f.requested, exp) {
+		t.Errorf("requested states = %v, want %v", f.requested, exp)
+	}
+}
@@ -0,0 +1,99 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// retryAttempts is the maximum number of attempts of a retried call.
+	retryAttempts = 5
+	// retryBackoff is the initial default backoff between attempts. It
+	// doubles after each attempt, up to maxRetryBackoff.
+	retryBackoff    = time.Second
+	maxRetryBackoff = 30 * time.Second
+)
+
+// isRetryable returns true iff the error is transient, i.e., the failed call
+// may succeed if retried: rate limiting (429), server errors (5xx), connection
+// resets, unexpected EOFs and timeouts.
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *googleapi.Error:
+		return e.Code == http.StatusTooManyRequests || e.Code >= 500
+	case *url.Error:
+		return isRetryable(e.Err)
+	case *net.OpError:
+		return e.Timeout() || isRetryable(e.Err)
+	case *os.SyscallError:
+		return isRetryable(e.Err)
+	case syscall.Errno:
+		return e == syscall.ECONNRESET || e == syscall.ECONNABORTED || e == syscall.EPIPE
+	case net.Error:
+		return e.Timeout()
+	}
+	if err == io.ErrUnexpectedEOF || err == context.DeadlineExceeded {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection reset by peer")
+}
+
+// permanentError marks an error as not retryable, regardless of its type.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// retry calls fn until it succeeds, fails with an error that is not
+// retryable, the attempts are exhausted or the context is done. It backs off
+// between attempts, exponentially by default, and returns the last error.
+// See WithBackoff.
+func retry(ctx context.Context, name string, fn func() error) error {
+	strategy := retryStrategy(ctx)
+	for i := 1; ; i++ {
+		err := fn()
+		if p, ok := err.(permanentError); ok {
+			return p.err
+		}
+		if !isRetryable(err) || i == retryAttempts || ctx.Err() != nil {
+			return err
+		}
+		backoff := strategy.NextDelay(i)
+		GetLogger(ctx).Warnf(ctx, "%v failed (attempt %v of %v), retrying in %v: %v", name, i, retryAttempts, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
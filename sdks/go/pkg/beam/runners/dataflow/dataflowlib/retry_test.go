@@ -0,0 +1,145 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{"nil", nil, false},
+		{"400", &googleapi.Error{Code: 400, Message: "Bad request"}, false},
+		{"403", &googleapi.Error{Code: 403, Message: "Permission denied"}, false},
+		{"404", &googleapi.Error{Code: 404, Message: "Not found"}, false},
+		{"409", &googleapi.Error{Code: 409, Message: "Already exists"}, false},
+		{"429", &googleapi.Error{Code: 429, Message: "RESOURCE_EXHAUSTED"}, true},
+		{"500", &googleapi.Error{Code: 500, Message: "Internal error"}, true},
+		{"503", &googleapi.Error{Code: 503, Message: "Unavailable"}, true},
+		{"timeout", timeoutError{}, true},
+		{"url-timeout", &url.Error{Op: "Get", URL: "https://dataflow.googleapis.com", Err: timeoutError{}}, true},
+		{"deadline", context.DeadlineExceeded, true},
+		{"canceled", context.Canceled, false},
+		{"reset", &url.Error{Op: "Post", URL: "https://dataflow.googleapis.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, true},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{"eof", io.ErrUnexpectedEOF, true},
+		{"other", errors.New("invalid job"), false},
+	}
+
+	for _, test := range tests {
+		if actual := isRetryable(test.err); actual != test.exp {
+			t.Errorf("isRetryable(%v) = %v, want %v", test.name, actual, test.exp)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	transient := &googleapi.Error{Code: 503}
+	tests := []struct {
+		name     string
+		errs     []error
+		calls    int
+		expError bool
+	}{
+		{"success", []error{nil}, 1, false},
+		{"transient", []error{transient, transient, nil}, 3, false},
+		{"exhausted", []error{transient, transient, transient, transient, transient, transient}, retryAttempts, true},
+		{"permanent", []error{&googleapi.Error{Code: 400}, nil}, 1, true},
+		{"marked-permanent", []error{permanentError{transient}, nil}, 1, true},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		err := retry(context.Background(), test.name, func() error {
+			calls++
+			return test.errs[calls-1]
+		})
+		if calls != test.calls {
+			t.Errorf("retry(%v) made %v calls, want %v", test.name, calls, test.calls)
+		}
+		if (err != nil) != test.expError {
+			t.Errorf("retry(%v) = %v, want error: %v", test.name, err, test.expError)
+		}
+		if _, ok := err.(permanentError); ok {
+			t.Errorf("retry(%v) returned a permanentError, want the underlying error", test.name)
+		}
+	}
+}
+
+func TestBackoffStrategies(t *testing.T) {
+	exp := ExponentialBackoff{Initial: time.Second, Max: 5 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if d := exp.NextDelay(attempt + 1); d != want {
+			t.Errorf("ExponentialBackoff.NextDelay(%v) = %v, want %v", attempt+1, d, want)
+		}
+	}
+
+	jittered := JitteredBackoff{Strategy: ConstantBackoff(time.Second), Fraction: 0.5}
+	for i := 1; i < 100; i++ {
+		if d := jittered.NextDelay(i); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Errorf("JitteredBackoff.NextDelay(%v) = %v, want within 50%% of 1s", i, d)
+		}
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	var attempts []int
+	rec := backoffFunc(func(attempt int) time.Duration {
+		attempts = append(attempts, attempt)
+		return time.Millisecond
+	})
+	ctx := WithBackoff(context.Background(), rec)
+
+	calls := 0
+	err := retry(ctx, "Test call", func() error {
+		if calls++; calls < 3 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if err != nil || len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Errorf("retry with backoff = %v after delays for attempts %v, want success after attempts [1 2]", err, attempts)
+	}
+}
+
+type backoffFunc func(int) time.Duration
+
+func (f backoffFunc) NextDelay(attempt int) time.Duration {
+	return f(attempt)
+}
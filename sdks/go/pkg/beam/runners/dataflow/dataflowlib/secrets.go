@@ -0,0 +1,107 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// SecretPrefix is the scheme of Secret Manager references, such as
+// sm://projects/my-project/secrets/my-secret/versions/latest.
+const SecretPrefix = "sm://"
+
+// secretRefRe matches a Secret Manager reference and captures the resource
+// name of the secret version.
+var secretRefRe = regexp.MustCompile(`^sm://(projects/[^/]+/secrets/[^/]+/versions/[^/]+)$`)
+
+// IsSecretRef returns true iff the value is a Secret Manager reference.
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretPrefix)
+}
+
+// ResolveSecret returns the payload of the Secret Manager secret version the
+// reference names, using the default application credentials. Access is
+// checked by Secret Manager, so the caller needs the Secret Manager Secret
+// Accessor role on the secret.
+func ResolveSecret(ctx context.Context, ref string) (string, error) {
+	if _, err := secretName(ref); err != nil {
+		return "", err
+	}
+	cl, err := newHTTPClient(ctx, secretmanager.CloudPlatformScope)
+	if err != nil {
+		return "", err
+	}
+	client, err := secretmanager.New(cl)
+	if err != nil {
+		return "", err
+	}
+	return resolveSecret(ctx, client, ref)
+}
+
+// resolveSecret returns the payload of the referenced secret version using
+// the given client. The payload is never logged or included in errors.
+func resolveSecret(ctx context.Context, client *secretmanager.Service, ref string) (string, error) {
+	name, err := secretName(ref)
+	if err != nil {
+		return "", err
+	}
+	var resp *secretmanager.AccessSecretVersionResponse
+	err = retry(ctx, fmt.Sprintf("accessing secret %v", name), func() error {
+		r, err := client.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+		if err != nil {
+			if e, ok := err.(*googleapi.Error); ok {
+				switch e.Code {
+				case http.StatusForbidden:
+					return permanentError{fmt.Errorf("access to secret %v denied: grant roles/secretmanager.secretAccessor on it to the submitting credentials: %v", name, err)}
+				case http.StatusNotFound:
+					return permanentError{fmt.Errorf("secret %v not found: %v", name, err)}
+				}
+			}
+			return err
+		}
+		resp = r
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Payload == nil {
+		return "", fmt.Errorf("secret %v has no payload", name)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("invalid payload of secret %v: %v", name, err)
+	}
+	return string(data), nil
+}
+
+// secretName returns the resource name of the secret version of a Secret
+// Manager reference.
+func secretName(ref string) (string, error) {
+	m := secretRefRe.FindStringSubmatch(ref)
+	if m == nil {
+		return "", fmt.Errorf("invalid secret reference %q: must be of the form %vprojects/<project>/secrets/<secret>/versions/<version>", ref, SecretPrefix)
+	}
+	return m[1], nil
+}
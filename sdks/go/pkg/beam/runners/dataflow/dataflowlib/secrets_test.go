@@ -0,0 +1,70 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+func TestResolveSecret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/projects/p/secrets/endpoint/versions/latest:access"):
+			// "https://dataflow.example.com/" base64 encoded.
+			w.Write([]byte(`{"payload": {"data": "aHR0cHM6Ly9kYXRhZmxvdy5leGFtcGxlLmNvbS8="}}`))
+		case strings.HasSuffix(r.URL.Path, "/projects/p/secrets/denied/versions/1:access"):
+			http.Error(w, `{"error": {"code": 403, "message": "permission denied"}}`, http.StatusForbidden)
+		default:
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := secretmanager.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	tests := []struct {
+		ref, want, err string
+	}{
+		{"sm://projects/p/secrets/endpoint/versions/latest", "https://dataflow.example.com/", ""},
+		{"sm://projects/p/secrets/denied/versions/1", "", "access to secret projects/p/secrets/denied/versions/1 denied"},
+		{"sm://projects/p/secrets/missing/versions/1", "", "secret projects/p/secrets/missing/versions/1 not found"},
+		{"sm://projects/p/secrets/endpoint", "", "invalid secret reference"},
+		{"sm://secrets/endpoint/versions/1", "", "invalid secret reference"},
+	}
+	for _, test := range tests {
+		got, err := resolveSecret(context.Background(), client, test.ref)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("resolveSecret(%v) = %q, %v, want error %q", test.ref, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("resolveSecret(%v) = %q, %v, want %q", test.ref, got, err, test.want)
+		}
+	}
+}
@@ -16,41 +16,805 @@
 package dataflowlib
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/apache/beam/sdks/go/pkg/beam/runners/universal/runnerlib"
 	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
+	"github.com/golang/protobuf/proto"
+	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/storage/v1"
 )
 
 // StageModel uploads the pipeline model to GCS as a unique object.
 func StageModel(ctx context.Context, project, modelURL string, model []byte) error {
-	return upload(ctx, project, modelURL, bytes.NewReader(model))
+	return stageModel(ctx, nil, project, modelURL, model)
 }
 
-// StageWorker uploads the worker binary to GCS as a unique object.
-func StageWorker(ctx context.Context, project, workerURL, worker string) error {
+// stageModel is like StageModel, but uses the given client, if not nil.
+func stageModel(ctx context.Context, client *storage.Service, project, modelURL string, model []byte) error {
+	return upload(ctx, client, project, modelURL, "", func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(model)), nil
+	})
+}
+
+// spoolModel writes the model pipeline in the format of the options to a
+// temp file in the spool directory of the options and returns its path, so
+// that the model can be staged from there with less peak memory use. If the
+// directory is empty, os.TempDir is used. The caller must remove the file.
+func spoolModel(ctx context.Context, p *pb.Pipeline, opts *JobOptions) (string, error) {
+	fd, err := ioutil.TempFile(opts.SpoolModelDir, "beam-model")
+	if err != nil {
+		return "", fmt.Errorf("failed to create model spool file: %v", err)
+	}
+	spool := fd.Name()
+
+	w := bufio.NewWriter(fd)
+	err = writeModel(ctx, w, p, opts)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(spool)
+		return "", fmt.Errorf("failed to write model spool file %v: %v", spool, err)
+	}
+	return spool, nil
+}
+
+// DefaultModelTextThreshold is the largest binary model size, in bytes,
+// staged as text in the "auto" model format, which is for debugging only.
+const DefaultModelTextThreshold = 64 << 10
+
+// modelAsText returns true iff the model pipeline is staged as text in the
+// format of the options.
+func modelAsText(ctx context.Context, p *pb.Pipeline, opts *JobOptions) (bool, error) {
+	switch opts.ModelFormat {
+	case "", "binary":
+		return false, nil
+	case "text":
+		GetLogger(ctx).Warnf(ctx, "Staging model as text for debugging: the service reads the model as binary, so the job will fail")
+		return true, nil
+	case "auto":
+		threshold := opts.ModelTextThreshold
+		if threshold == 0 {
+			threshold = DefaultModelTextThreshold
+		}
+		size := proto.Size(p)
+		if size > threshold {
+			GetLogger(ctx).Infof(ctx, "Staging model as binary: %v bytes exceeds the text threshold of %v bytes", size, threshold)
+			return false, nil
+		}
+		GetLogger(ctx).Warnf(ctx, "Staging model as text for debugging: %v bytes is within the text threshold of %v bytes, but the service reads the model as binary, so the job will fail", size, threshold)
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid model format %q: must be binary, text or auto", opts.ModelFormat)
+	}
+}
+
+// encodeModel serializes the model pipeline in the format of the options.
+func encodeModel(ctx context.Context, p *pb.Pipeline, opts *JobOptions) ([]byte, error) {
+	text, err := modelAsText(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	if text {
+		return []byte(proto.MarshalTextString(p)), nil
+	}
+	return proto.Marshal(p)
+}
+
+// writeModel is like encodeModel, but writes the model pipeline to w. The
+// binary encoding is written one component at a time, so it is never held in
+// memory in full: concatenated encodings decode as the merge of their
+// messages, which is the pipeline.
+func writeModel(ctx context.Context, w io.Writer, p *pb.Pipeline, opts *JobOptions) error {
+	text, err := modelAsText(ctx, p, opts)
+	if err != nil {
+		return err
+	}
+	if text {
+		return proto.MarshalText(w, p)
+	}
+
+	write := func(m *pb.Pipeline) error {
+		data, err := proto.Marshal(m)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	if err := write(&pb.Pipeline{RootTransformIds: p.RootTransformIds, DisplayData: p.DisplayData, XXX_unrecognized: p.XXX_unrecognized}); err != nil {
+		return err
+	}
+	c := p.Components
+	if c == nil {
+		return nil
+	}
+	if err := write(&pb.Pipeline{Components: &pb.Components{XXX_unrecognized: c.XXX_unrecognized}}); err != nil {
+		return err
+	}
+	var parts []*pb.Components
+	for _, id := range mapKeys(c.Transforms) {
+		parts = append(parts, &pb.Components{Transforms: map[string]*pb.PTransform{id: c.Transforms[id]}})
+	}
+	for _, id := range mapKeys(c.Pcollections) {
+		parts = append(parts, &pb.Components{Pcollections: map[string]*pb.PCollection{id: c.Pcollections[id]}})
+	}
+	for _, id := range mapKeys(c.WindowingStrategies) {
+		parts = append(parts, &pb.Components{WindowingStrategies: map[string]*pb.WindowingStrategy{id: c.WindowingStrategies[id]}})
+	}
+	for _, id := range mapKeys(c.Coders) {
+		parts = append(parts, &pb.Components{Coders: map[string]*pb.Coder{id: c.Coders[id]}})
+	}
+	for _, id := range mapKeys(c.Environments) {
+		parts = append(parts, &pb.Components{Environments: map[string]*pb.Environment{id: c.Environments[id]}})
+	}
+	for _, part := range parts {
+		if err := write(&pb.Pipeline{Components: part}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapKeys returns the sorted keys of a map with string keys.
+func mapKeys(m interface{}) []string {
+	var ret []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		ret = append(ret, k.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// DefaultWorkerContentType is the content type used for the staged worker
+// binary, if none is given.
+const DefaultWorkerContentType = "application/octet-stream"
+
+// StageWorker uploads the worker binary to GCS as a unique object with the
+// given content type. If the content type is empty, DefaultWorkerContentType
+// is used. The upload is resumable: a retry after a failure mid-upload
+// continues from the last committed offset, as does a later upload of the
+// same binary to the same bucket, such as by a rerun after a crash.
+func StageWorker(ctx context.Context, project, workerURL, worker, contentType string) error {
+	return stageWorker(ctx, nil, project, workerURL, worker, contentType)
+}
+
+// stageWorker is like StageWorker, but uses the given client, if not nil.
+// The upload is then restarted in full on retry, because resumable uploads
+// require the underlying HTTP client.
+func stageWorker(ctx context.Context, client *storage.Service, project, workerURL, worker, contentType string) error {
+	if contentType == "" {
+		contentType = DefaultWorkerContentType
+	}
+	if client != nil {
+		return upload(ctx, client, project, workerURL, contentType, func() (io.ReadCloser, error) {
+			fd, err := os.Open(worker)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open worker binary %s: %v", worker, err)
+			}
+			return fd, nil
+		})
+	}
+
+	bucket, obj, err := gcsx.ParseObject(workerURL)
+	if err != nil {
+		return fmt.Errorf("invalid staging location %v: %v", workerURL, err)
+	}
+	session, err := uploadSessionFile(worker)
+	if err != nil {
+		return err
+	}
+	hc, err := newHTTPClient(ctx, storage.DevstorageReadWriteScope)
+	if err != nil {
+		return err
+	}
+	client, err = storage.New(hc)
+	if err != nil {
+		return err
+	}
+	// Worker objects are unique per run, so an upload interrupted in an
+	// earlier process is resumed to its object, which is then copied.
+	target := resumeTarget(session, bucket, obj)
+	err = retry(ctx, "Upload of "+workerURL, func() error {
+		if err := ensureBucket(client, project, bucket); err != nil {
+			return err
+		}
+		fd, err := os.Open(worker)
+		if err != nil {
+			return permanentError{fmt.Errorf("failed to open worker binary %s: %v", worker, err)}
+		}
+		defer fd.Close()
+
+		info, err := fd.Stat()
+		if err != nil {
+			return permanentError{fmt.Errorf("failed to stat worker binary %s: %v", worker, err)}
+		}
+		attrs := &storage.Object{Bucket: bucket, Name: target, ContentType: contentType, StorageClass: getStorageClass(ctx)}
+		return gcsx.ResumableUploadWithAttrs(ctx, hc, attrs, fd, info.Size(), session)
+	})
+	if err != nil || target == obj {
+		return err
+	}
+	GetLogger(ctx).Infof(ctx, "Resumed upload of worker binary to gs://%v/%v", bucket, target)
+	return copyWorker(ctx, client, project, workerURL, fmt.Sprintf("gs://%v/%v", bucket, target))
+}
+
+// resumeTarget returns the object to upload the worker binary to: the object
+// of the persisted upload session of the binary, if in the same bucket, or
+// else the given object.
+func resumeTarget(session, bucket, obj string) string {
+	if b, o, ok := gcsx.SessionObject(session); ok && b == bucket {
+		return o
+	}
+	return obj
+}
+
+// maxObjectNameBytes is the GCS limit on object name length.
+const maxObjectNameBytes = 1024
+
+// CheckObjectName returns an error, if the name is not a valid GCS object
+// name: it must be non-empty valid UTF-8 of at most 1024 bytes, not "." or
+// "..", and must not contain carriage returns, line feeds or other control
+// characters, nor the wildcard characters #, [, ], * or ?, which break
+// gsutil.
+func CheckObjectName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("empty object name")
+	case len(name) > maxObjectNameBytes:
+		return fmt.Errorf("object name %q is longer than %v bytes", name, maxObjectNameBytes)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("object name %q is not valid UTF-8", name)
+	case name == "." || name == "..":
+		return fmt.Errorf("object name %q is reserved", name)
+	case strings.HasPrefix(name, ".well-known/acme-challenge/"):
+		return fmt.Errorf("object name %q is reserved", name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || strings.ContainsRune("#[]*?", r) {
+			return fmt.Errorf("object name %q contains illegal character %q", name, r)
+		}
+	}
+	return nil
+}
+
+// isGCSWorker returns true iff the worker binary is a GCS object, which is
+// copied server-side instead of uploaded.
+func isGCSWorker(worker string) bool {
+	return strings.HasPrefix(worker, "gs://")
+}
+
+// copyWorker copies a worker binary that is already in GCS to the worker
+// location, without downloading it. It fails if the source does not exist.
+func copyWorker(ctx context.Context, client *storage.Service, project, workerURL, worker string) error {
+	srcBucket, srcObj, err := gcsx.ParseObject(worker)
+	if err != nil {
+		return fmt.Errorf("invalid worker binary %v: %v", worker, err)
+	}
+	bucket, obj, err := gcsx.ParseObject(workerURL)
+	if err != nil {
+		return fmt.Errorf("invalid staging location %v: %v", workerURL, err)
+	}
+	client, err = storageClient(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	return retry(ctx, "Copy of "+worker, func() error {
+		if _, err := client.Objects.Get(srcBucket, srcObj).Context(ctx).Do(); err != nil {
+			if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+				return permanentError{fmt.Errorf("worker binary %v not found", worker)}
+			}
+			return err
+		}
+		if err := ensureBucket(client, project, bucket); err != nil {
+			return err
+		}
+		// Large or cross-location copies may take several rewrite calls.
+		token := ""
+		for {
+			call := client.Objects.Rewrite(srcBucket, srcObj, bucket, obj, &storage.Object{StorageClass: getStorageClass(ctx)}).Context(ctx)
+			if token != "" {
+				call = call.RewriteToken(token)
+			}
+			resp, err := call.Do()
+			if err != nil {
+				return err
+			}
+			if resp.Done {
+				return nil
+			}
+			token = resp.RewriteToken
+		}
+	})
+}
+
+// DefaultStagingUploadConcurrency is the number of files staged
+// simultaneously, if not set.
+const DefaultStagingUploadConcurrency = 4
+
+// stagedFiles returns the GCS locations of the files to stage, keyed by
+// local file. They are placed next to the worker binary and named after the
+// files, which must therefore have unique base names.
+func stagedFiles(workerURL string, files []string) (map[string]string, error) {
+	ret := make(map[string]string)
+	names := make(map[string]string)
+	for _, file := range files {
+		name := filepath.Base(file)
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("files to stage %v and %v have the same name", other, file)
+		}
+		names[name] = file
+		ret[file] = gcsx.Join(workerURL+"-files", name)
+	}
+	return ret, nil
+}
+
+// Package is an extra file that is downloaded to the workers.
+type Package struct {
+	// Location is a local file or a gs:// object.
+	Location string
+	// Name is the name of the package on the workers. If empty, the base
+	// name of the location is used.
+	Name string
+}
+
+func (p Package) packageName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return path.Base(filepath.ToSlash(p.Location))
+}
+
+// stagedPackages returns the GCS locations of the extra packages, keyed by
+// package name. They are placed next to the worker binary. Package names
+// must be unique and distinct from the worker and the files to stage.
+func stagedPackages(workerURL string, files []string, pkgs []Package) (map[string]string, error) {
+	names := map[string]string{"worker": "the worker binary"}
+	for _, file := range files {
+		names[filepath.Base(file)] = file
+	}
+
+	ret := make(map[string]string)
+	for _, pkg := range pkgs {
+		if pkg.Location == "" {
+			return nil, fmt.Errorf("extra package %q has no location", pkg.Name)
+		}
+		if isGCSWorker(pkg.Location) {
+			_, obj, err := gcsx.ParseObject(pkg.Location)
+			if err != nil {
+				return nil, fmt.Errorf("invalid extra package location %v: %v", pkg.Location, err)
+			}
+			if obj == "" {
+				return nil, fmt.Errorf("invalid extra package location %v: no object", pkg.Location)
+			}
+		}
+		name := pkg.packageName()
+		if name == "" || name == "." || name == "/" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid name %q of extra package %v", name, pkg.Location)
+		}
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("extra package %v and %v have the same name %v", pkg.Location, other, name)
+		}
+		names[name] = pkg.Location
+		ret[name] = gcsx.Join(workerURL+"-packages", name)
+	}
+	return ret, nil
+}
+
+// stageExtraPackages stages the extra packages to their GCS locations. GCS
+// packages are copied server-side. All locations are checked to resolve
+// before anything is staged.
+func stageExtraPackages(ctx context.Context, client *storage.Service, opts *JobOptions, workerURL string) ([]string, error) {
+	staged, err := stagedPackages(workerURL, opts.FilesToStage, opts.ExtraPackages)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range opts.ExtraPackages {
+		if isGCSWorker(pkg.Location) {
+			continue
+		}
+		info, err := os.Stat(pkg.Location)
+		if err != nil {
+			return nil, fmt.Errorf("extra package %v not found: %v", pkg.Location, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("extra package %v is not a regular file", pkg.Location)
+		}
+	}
+	client, err = storageClient(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range opts.ExtraPackages {
+		if !isGCSWorker(pkg.Location) {
+			continue
+		}
+		bucket, obj, _ := gcsx.ParseObject(pkg.Location)
+		if _, err := client.Objects.Get(bucket, obj).Context(ctx).Do(); err != nil {
+			return nil, fmt.Errorf("extra package %v not found: %v", pkg.Location, err)
+		}
+	}
+
+	local := make(map[string]string)
+	var ret []string
+	for _, pkg := range opts.ExtraPackages {
+		object := staged[pkg.packageName()]
+		ret = append(ret, object)
+		if !isGCSWorker(pkg.Location) {
+			local[pkg.Location] = object
+			continue
+		}
+		if err := copyWorker(ctx, client, opts.Project, object, pkg.Location); err != nil {
+			return nil, fmt.Errorf("failed to stage extra package %v: %v", pkg.Location, err)
+		}
+	}
+	if err := stageFiles(ctx, client, opts.Project, local, opts.StagingUploadConcurrency); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// stageFiles uploads the local files to their GCS locations with at most
+// concurrency simultaneous uploads. The first failure stops further uploads
+// from starting and is returned.
+func stageFiles(ctx context.Context, client *storage.Service, project string, files map[string]string, concurrency int) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultStagingUploadConcurrency
+	}
+	client, err := storageClient(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for file := range files {
+		keys = append(keys, file)
+	}
+	sort.Strings(keys)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, file := range keys {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(file, object string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := upload(ctx, client, project, object, DefaultWorkerContentType, func() (io.ReadCloser, error) {
+				fd, err := os.Open(file)
+				if err != nil {
+					return nil, fmt.Errorf("failed to open file to stage %v: %v", file, err)
+				}
+				return fd, nil
+			})
+			if err != nil {
+				once.Do(func() {
+					first = fmt.Errorf("failed to stage %v: %v", file, err)
+					cancel()
+				})
+			}
+		}(file, files[file])
+	}
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// openFile returns a function that opens the given local file.
+func openFile(file string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return os.Open(file)
+	}
+}
+
+// verifyStaged checks that the staged object has the size and, if reported
+// by GCS, the CRC32C checksum of the local content.
+func verifyStaged(ctx context.Context, client *storage.Service, object string, open func() (io.ReadCloser, error)) error {
+	bucket, obj, err := gcsx.ParseObject(object)
+	if err != nil {
+		return fmt.Errorf("invalid staging location %v: %v", object, err)
+	}
+	client, err = storageClient(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return fmt.Errorf("failed to read staged content of %v: %v", object, err)
+	}
+
+	var attrs *storage.Object
+	err = retry(ctx, "Verification of "+object, func() error {
+		var err error
+		attrs, err = client.Objects.Get(bucket, obj).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify staged object %v: %v", object, err)
+	}
+	if int64(attrs.Size) != size {
+		return fmt.Errorf("staged object %v has %v bytes, want %v", object, attrs.Size, size)
+	}
+	if want := base64.StdEncoding.EncodeToString(h.Sum(nil)); attrs.Crc32c != "" && attrs.Crc32c != want {
+		return fmt.Errorf("staged object %v has CRC32C %v, want %v", object, attrs.Crc32c, want)
+	}
+	GetLogger(ctx).Debugf(ctx, "Verified staged object %v: %v bytes", object, size)
+	return nil
+}
+
+// Checksum holds the hashes of a staged object, as reported by GCS. Both are
+// base64-encoded. Composite objects have no MD5 hash.
+type Checksum struct {
+	CRC32C string `json:"crc32c"`
+	MD5    string `json:"md5,omitempty"`
+	Size   uint64 `json:"size"`
+}
+
+// stagedChecksums reads back the checksums of the staged objects, keyed by
+// their GCS location.
+func stagedChecksums(ctx context.Context, client *storage.Service, objects []string) (map[string]*Checksum, error) {
+	client, err := storageClient(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]*Checksum)
+	for _, object := range objects {
+		bucket, obj, err := gcsx.ParseObject(object)
+		if err != nil {
+			return nil, fmt.Errorf("invalid staging location %v: %v", object, err)
+		}
+
+		var attrs *storage.Object
+		err = retry(ctx, "Checksum retrieval of "+object, func() error {
+			var err error
+			attrs, err = client.Objects.Get(bucket, obj).Fields("crc32c", "md5Hash", "size").Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get checksums of staged object %v: %v", object, err)
+		}
+		ret[object] = &Checksum{CRC32C: attrs.Crc32c, MD5: attrs.Md5Hash, Size: attrs.Size}
+	}
+	return ret, nil
+}
+
+// uploadSessionFile returns the temp file that holds the resumable upload
+// session of the given binary, keyed by its content hash.
+func uploadSessionFile(worker string) (string, error) {
 	fd, err := os.Open(worker)
 	if err != nil {
-		return fmt.Errorf("failed to open worker binary %s: %v", worker, err)
+		return "", fmt.Errorf("failed to open worker binary %s: %v", worker, err)
 	}
 	defer fd.Close()
 
-	return upload(ctx, project, workerURL, fd)
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", fmt.Errorf("failed to read worker binary %s: %v", worker, err)
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("beam-upload-%x.json", h.Sum(nil))), nil
+}
+
+// ensureBucket creates the bucket, if it does not exist.
+func ensureBucket(client *storage.Service, project, bucket string) error {
+	exists, err := gcsx.BucketExists(client, bucket)
+	if err != nil || exists {
+		return err
+	}
+	return gcsx.CreateBucket(client, project, bucket)
+}
+
+// EstimateStagingBytes returns the number of bytes that submitting the
+// pipeline with these options uploads to GCS, i.e., the size of the fixed up
+// model, the worker binary, the files to stage and the local extra packages.
+// Nothing is uploaded. If no worker binary is specified and the running
+// binary is not worker compatible, the size is not known in advance and an
+// error is returned. Files in GCS are copied server-side and not counted.
+func (opts JobOptions) EstimateStagingBytes(p *beam.Pipeline) (int64, error) {
+	edges, _, err := p.Build()
+	if err != nil {
+		return 0, err
+	}
+	model, err := graphx.Marshal(edges, &graphx.Options{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate model pipeline: %v", err)
+	}
+	fixed, err := Fixup(model)
+	if err != nil {
+		return 0, err
+	}
+	worker := opts.Worker
+	if worker == "" {
+		self, ok := runnerlib.IsWorkerCompatibleBinary()
+		if !ok {
+			return 0, errors.New("worker binary is built at submission, so its size is not known")
+		}
+		worker = self
+	}
+	return stagingBytes(fixed, worker, &opts)
+}
+
+// stagingBytes returns the combined size of the model and the local worker
+// binary, files to stage and extra packages.
+func stagingBytes(p *pb.Pipeline, worker string, opts *JobOptions) (int64, error) {
+	files := append([]string{worker}, opts.FilesToStage...)
+	for _, pkg := range opts.ExtraPackages {
+		files = append(files, pkg.Location)
+	}
+
+	size := int64(proto.Size(p))
+	for _, file := range files {
+		if isGCSWorker(file) {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat staging file %s: %v", file, err)
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// CleanupTemp deletes the job-specific temp data of the submitted job. It is
+// a no-op unless CleanupTempOnDone is set and the job uses a subprefix of
+// TempLocation, which is not the case if TempStoragePrefix is set.
+func CleanupTemp(ctx context.Context, opts *JobOptions, job *df.Job) error {
+	if job == nil || job.Environment == nil {
+		return nil
+	}
+	return cleanupTemp(ctx, opts, job.Environment.TempStoragePrefix)
 }
 
-func upload(ctx context.Context, project, object string, r io.Reader) error {
+// cleanupTemp deletes the temp data under the given job-specific location.
+func cleanupTemp(ctx context.Context, opts *JobOptions, location string) error {
+	if !opts.CleanupTempOnDone || opts.TempLocation == "" {
+		return nil
+	}
+	// Only delete under the job-specific prefix, never siblings or the
+	// temp location itself.
+	base := strings.TrimSuffix(opts.TempLocation, "/") + "/"
+	if !strings.HasPrefix(location, base) || strings.Trim(location[len(base):], "/") == "" {
+		return nil
+	}
+	ctx = WithJobOptions(ctx, opts)
+	bucket, prefix, err := gcsx.ParseObject(location)
+	if err != nil {
+		return fmt.Errorf("invalid temp location %v: %v", location, err)
+	}
+	client, err := storageClient(ctx, opts.StorageClient)
+	if err != nil {
+		return err
+	}
+	return gcsx.DeleteObjects(ctx, client, bucket, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// storageClient returns the given client, if not nil, or a new client with
+// default application credentials.
+func storageClient(ctx context.Context, client *storage.Service) (*storage.Service, error) {
+	if client == nil {
+		return newStorageClient(ctx, storage.DevstorageReadWriteScope)
+	}
+	if client.Buckets == nil || client.Objects == nil {
+		return nil, errors.New("invalid storage client: it must be created with storage.New")
+	}
+	return client, nil
+}
+
+// upload writes the content to GCS, retrying transient failures. The content
+// is reopened for each attempt. If the client is nil, a client with default
+// application credentials is used.
+func upload(ctx context.Context, client *storage.Service, project, object, contentType string, open func() (io.ReadCloser, error)) error {
 	bucket, obj, err := gcsx.ParseObject(object)
 	if err != nil {
 		return fmt.Errorf("invalid staging location %v: %v", object, err)
 	}
-	client, err := gcsx.NewClient(ctx, storage.DevstorageReadWriteScope)
+	client, err = storageClient(ctx, client)
 	if err != nil {
 		return err
 	}
-	_, err = gcsx.Upload(client, project, bucket, obj, r)
-	return err
+	attrs := &storage.Object{Bucket: bucket, Name: obj, ContentType: contentType, StorageClass: getStorageClass(ctx)}
+	return retry(ctx, "Upload of "+object, func() error {
+		if err := ensureBucket(client, project, bucket); err != nil {
+			return err
+		}
+		r, err := open()
+		if err != nil {
+			return permanentError{err}
+		}
+		defer r.Close()
+
+		return gcsx.WriteObjectWithAttrs(client, attrs, r)
+	})
+}
+
+// StorageClasses are the known GCS storage classes.
+var StorageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE", "MULTI_REGIONAL", "REGIONAL", "DURABLE_REDUCED_AVAILABILITY"}
+
+// CheckStorageClass returns an error, if the class is not empty or one of
+// the known GCS storage classes.
+func CheckStorageClass(class string) error {
+	if class == "" {
+		return nil
+	}
+	for _, c := range StorageClasses {
+		if class == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid storage class %q: must be one of %v", class, strings.Join(StorageClasses, ", "))
+}
+
+type storageClassKey struct{}
+
+// withStorageClass returns a context under which staged objects are written
+// with the given storage class. If the class is empty, objects get the
+// default storage class of the bucket.
+func withStorageClass(ctx context.Context, class string) context.Context {
+	if class == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, storageClassKey{}, class)
+}
+
+// getStorageClass returns the storage class of the context, if any.
+func getStorageClass(ctx context.Context) string {
+	class, _ := ctx.Value(storageClassKey{}).(string)
+	return class
 }
@@ -0,0 +1,601 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/api/storage/v1"
+)
+
+func TestEstimateStagingBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	worker := filepath.Join(dir, "worker")
+	file := filepath.Join(dir, "file")
+	pkg := filepath.Join(dir, "pkg.jar")
+	for name, size := range map[string]int{worker: 1000, file: 100, pkg: 10} {
+		if err := ioutil.WriteFile(name, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := beam.NewPipeline()
+	beam.Impulse(p.Root())
+	edges, _, err := p.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	model, err := graphx.Marshal(edges, &graphx.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed, err := Fixup(model)
+	if err != nil {
+		t.Fatalf("Fixup failed: %v", err)
+	}
+
+	opts := JobOptions{
+		Worker:        worker,
+		FilesToStage:  []string{file},
+		ExtraPackages: []Package{{Location: pkg}, {Location: "gs://foo/remote.jar"}},
+	}
+	size, err := opts.EstimateStagingBytes(p)
+	if err != nil {
+		t.Fatalf("EstimateStagingBytes failed: %v", err)
+	}
+	if exp := int64(1110 + proto.Size(fixed)); size != exp {
+		t.Errorf("EstimateStagingBytes() = %v, want %v", size, exp)
+	}
+
+	opts.Worker = "gs://foo/worker"
+	size, err = opts.EstimateStagingBytes(p)
+	if err != nil {
+		t.Fatalf("EstimateStagingBytes(GCS worker) failed: %v", err)
+	}
+	if exp := int64(110 + proto.Size(fixed)); size != exp {
+		t.Errorf("EstimateStagingBytes(GCS worker) = %v, want %v", size, exp)
+	}
+
+	opts.Worker = worker + ".missing"
+	if _, err := opts.EstimateStagingBytes(p); err == nil {
+		t.Error("EstimateStagingBytes succeeded for a missing worker binary, want error")
+	}
+}
+
+func TestEncodeModel(t *testing.T) {
+	p := emptyPipeline()
+	p.Components.Transforms = map[string]*pb.PTransform{
+		"t": {UniqueName: "t"},
+	}
+	p.RootTransformIds = []string{"t"}
+
+	binary, err := proto.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := proto.MarshalTextString(p)
+
+	tests := []struct {
+		format    string
+		threshold int
+		exp       string
+	}{
+		{"binary", 0, string(binary)},
+		{"text", 1, text},
+		{"", 0, string(binary)},
+		{"auto", len(binary), text},
+		{"auto", len(binary) - 1, string(binary)},
+	}
+	for _, test := range tests {
+		opts := &JobOptions{ModelFormat: test.format, ModelTextThreshold: test.threshold}
+		actual, err := encodeModel(context.Background(), p, opts)
+		if err != nil {
+			t.Errorf("encodeModel(%q, %v) failed: %v", test.format, test.threshold, err)
+			continue
+		}
+		if string(actual) != test.exp {
+			t.Errorf("encodeModel(%q, %v) = %q, want %q", test.format, test.threshold, actual, test.exp)
+		}
+	}
+
+	if _, err := encodeModel(context.Background(), p, &JobOptions{ModelFormat: "json"}); err == nil {
+		t.Error("encodeModel(\"json\") succeeded, want error")
+	}
+}
+
+func TestStageModelStorageClient(t *testing.T) {
+	var uploads int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/b/bucket/o") {
+			uploads++
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	ctx := context.Background()
+	if err := stageModel(ctx, client, "project", "gs://bucket/model", []byte("model")); err != nil {
+		t.Fatalf("stageModel failed: %v", err)
+	}
+	if uploads != 1 {
+		t.Errorf("stageModel uploaded %v objects with the given client, want 1", uploads)
+	}
+
+	if err := stageModel(ctx, &storage.Service{}, "project", "gs://bucket/model", []byte("model")); err == nil {
+		t.Error("stageModel succeeded with an invalid client, want error")
+	}
+}
+
+func TestStageSpooledModel(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			body, _ = ioutil.ReadAll(r.Body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := impulsePipeline(t)
+	spool, err := spoolModel(context.Background(), p, &JobOptions{SpoolModelDir: dir})
+	if err != nil {
+		t.Fatalf("spoolModel failed: %v", err)
+	}
+	defer os.Remove(spool)
+	if filepath.Dir(spool) != dir {
+		t.Errorf("spoolModel() = %v, want a file in %v", spool, dir)
+	}
+	data, err := ioutil.ReadFile(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual pb.Pipeline
+	if err := proto.Unmarshal(data, &actual); err != nil {
+		t.Fatalf("spooled model is not a binary pipeline: %v", err)
+	}
+	if !proto.Equal(&actual, p) {
+		t.Errorf("spooled model = %v, want %v", proto.MarshalTextString(&actual), proto.MarshalTextString(p))
+	}
+
+	if err := upload(context.Background(), client, "project", "gs://bucket/model", "", func() (io.ReadCloser, error) {
+		return os.Open(spool)
+	}); err != nil {
+		t.Fatalf("upload of the spooled model failed: %v", err)
+	}
+	if !bytes.Contains(body, data) {
+		t.Errorf("uploaded %q, want the spooled model", body)
+	}
+
+	if _, err := spoolModel(context.Background(), p, &JobOptions{SpoolModelDir: dir, ModelFormat: "json"}); err == nil {
+		t.Error("spoolModel(\"json\") succeeded, want error")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("spool directory has %v files after a failed spool, want only the first", len(files))
+	}
+}
+
+// newStagingServer returns a fake GCS server that accepts all uploads after
+// the given delay and records the peak number of simultaneous uploads.
+func newStagingServer(delay time.Duration) (*httptest.Server, *int32) {
+	var active, peak int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			n := atomic.AddInt32(&active, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(delay)
+			atomic.AddInt32(&active, -1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	return srv, &peak
+}
+
+// writeStagingFiles writes n small files to a new temp directory and returns
+// them keyed by their staged locations.
+func writeStagingFiles(tb testing.TB, n int) (string, map[string]string) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	files := make(map[string]string)
+	for i := 0; i < n; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("file-%v", i))
+		if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		files[file] = fmt.Sprintf("gs://bucket/files/file-%v", i)
+	}
+	return dir, files
+}
+
+func TestStageFiles(t *testing.T) {
+	srv, peak := newStagingServer(10 * time.Millisecond)
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	dir, files := writeStagingFiles(t, 10)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	if err := stageFiles(ctx, client, "project", files, 3); err != nil {
+		t.Fatalf("stageFiles failed: %v", err)
+	}
+	if *peak > 3 {
+		t.Errorf("stageFiles had %v simultaneous uploads, want at most 3", *peak)
+	}
+
+	files[filepath.Join(dir, "missing")] = "gs://bucket/files/missing"
+	if err := stageFiles(ctx, client, "project", files, 3); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("stageFiles with a missing file = %v, want error", err)
+	}
+}
+
+func TestUploadStorageClass(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			data, _ := ioutil.ReadAll(r.Body)
+			body = string(data)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	open := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("data")), nil
+	}
+	ctx := withStorageClass(context.Background(), "NEARLINE")
+	if err := upload(ctx, client, "project", "gs://bucket/object", "", open); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if !strings.Contains(body, `"storageClass":"NEARLINE"`) {
+		t.Errorf("upload wrote object metadata %q, want storage class NEARLINE", body)
+	}
+
+	if err := upload(context.Background(), client, "project", "gs://bucket/object", "", open); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if strings.Contains(body, "storageClass") {
+		t.Errorf("upload wrote object metadata %q, want default storage class", body)
+	}
+}
+
+func TestCheckStorageClass(t *testing.T) {
+	for _, class := range []string{"", "STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"} {
+		if err := CheckStorageClass(class); err != nil {
+			t.Errorf("CheckStorageClass(%q) failed: %v", class, err)
+		}
+	}
+	for _, class := range []string{"nearline", "GLACIER"} {
+		if err := CheckStorageClass(class); err == nil {
+			t.Errorf("CheckStorageClass(%q) succeeded, want error", class)
+		}
+	}
+}
+
+func TestStagedFiles(t *testing.T) {
+	files, err := stagedFiles("gs://bucket/worker-1", []string{"a/x.jar", "b/y.txt"})
+	if err != nil {
+		t.Fatalf("stagedFiles failed: %v", err)
+	}
+	if exp := "gs://bucket/worker-1-files/x.jar"; files["a/x.jar"] != exp {
+		t.Errorf("stagedFiles located a/x.jar at %v, want %v", files["a/x.jar"], exp)
+	}
+	if _, err := stagedFiles("gs://bucket/worker-1", []string{"a/x.jar", "b/x.jar"}); err == nil {
+		t.Error("stagedFiles succeeded for files with the same name, want error")
+	}
+}
+
+func TestStagedPackages(t *testing.T) {
+	pkgs := []Package{
+		{Location: "lib/x.jar"},
+		{Location: "gs://other/deps/y.zip", Name: "deps.zip"},
+	}
+	staged, err := stagedPackages("gs://bucket/worker-1", []string{"a/z.txt"}, pkgs)
+	if err != nil {
+		t.Fatalf("stagedPackages failed: %v", err)
+	}
+	exp := map[string]string{
+		"x.jar":    "gs://bucket/worker-1-packages/x.jar",
+		"deps.zip": "gs://bucket/worker-1-packages/deps.zip",
+	}
+	if !reflect.DeepEqual(staged, exp) {
+		t.Errorf("stagedPackages() = %v, want %v", staged, exp)
+	}
+
+	tests := []struct {
+		name string
+		pkgs []Package
+	}{
+		{"no location", []Package{{Name: "x.jar"}}},
+		{"duplicate", []Package{{Location: "a/x.jar"}, {Location: "gs://b/x.jar"}}},
+		{"worker", []Package{{Location: "a/x.jar", Name: "worker"}}},
+		{"file to stage", []Package{{Location: "b/z.txt"}}},
+		{"path name", []Package{{Location: "a/x.jar", Name: "a/x.jar"}}},
+		{"bad gcs location", []Package{{Location: "gs://bucket"}}},
+	}
+	for _, test := range tests {
+		if _, err := stagedPackages("gs://bucket/worker-1", []string{"a/z.txt"}, test.pkgs); err == nil {
+			t.Errorf("stagedPackages(%v) succeeded, want error", test.name)
+		}
+	}
+}
+
+func TestStageExtraPackagesMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &JobOptions{
+		Project:       "project",
+		ExtraPackages: []Package{{Location: filepath.Join(dir, "missing.jar")}},
+	}
+	_, err = stageExtraPackages(context.Background(), nil, opts, "gs://bucket/worker-1")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("stageExtraPackages with a missing package = %v, want not found error", err)
+	}
+
+	opts.ExtraPackages = []Package{{Location: dir}}
+	_, err = stageExtraPackages(context.Background(), nil, opts, "gs://bucket/worker-1")
+	if err == nil || !strings.Contains(err.Error(), "regular file") {
+		t.Errorf("stageExtraPackages with a directory = %v, want error", err)
+	}
+}
+
+func BenchmarkStageFiles(b *testing.B) {
+	srv, _ := newStagingServer(5 * time.Millisecond)
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		b.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	dir, files := writeStagingFiles(b, 50)
+	defer os.RemoveAll(dir)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%v", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := stageFiles(context.Background(), client, "project", files, concurrency); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyStaged(t *testing.T) {
+	var attrs string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(attrs))
+	}))
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	open := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("hello")), nil
+	}
+	tests := []struct {
+		attrs   string
+		wantErr bool
+	}{
+		{`{"size": "5", "crc32c": "mnG7TA=="}`, false},
+		{`{"size": "5"}`, false},
+		{`{"size": "4", "crc32c": "mnG7TA=="}`, true},
+		{`{"size": "5", "crc32c": "AAAAAA=="}`, true},
+	}
+	for _, test := range tests {
+		attrs = test.attrs
+		err := verifyStaged(context.Background(), client, "gs://bucket/object", open)
+		if (err != nil) != test.wantErr {
+			t.Errorf("verifyStaged(%v) = %v, want error: %v", test.attrs, err, test.wantErr)
+		}
+	}
+}
+
+func TestStagedChecksums(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/o/worker"):
+			w.Write([]byte(`{"size": "5", "crc32c": "mnG7TA==", "md5Hash": "XUFAKrxLKna5cZ2REBfFkg=="}`))
+		case strings.HasSuffix(r.URL.Path, "/o/composite"):
+			w.Write([]byte(`{"size": "3", "crc32c": "AAAAAA=="}`))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	checksums, err := stagedChecksums(context.Background(), client, []string{"gs://bucket/worker", "gs://bucket/composite"})
+	if err != nil {
+		t.Fatalf("stagedChecksums failed: %v", err)
+	}
+	exp := map[string]*Checksum{
+		"gs://bucket/worker":    {CRC32C: "mnG7TA==", MD5: "XUFAKrxLKna5cZ2REBfFkg==", Size: 5},
+		"gs://bucket/composite": {CRC32C: "AAAAAA==", Size: 3},
+	}
+	if !reflect.DeepEqual(checksums, exp) {
+		t.Errorf("stagedChecksums = %v, want %v", checksums, exp)
+	}
+
+	if _, err := stagedChecksums(context.Background(), client, []string{"gs://bucket/missing"}); err == nil {
+		t.Error("stagedChecksums of missing object succeeded, want error")
+	}
+}
+
+func TestResumeTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	session := filepath.Join(dir, "session.json")
+
+	if actual := resumeTarget(session, "bucket", "worker-2"); actual != "worker-2" {
+		t.Errorf("resumeTarget() without a session = %v, want worker-2", actual)
+	}
+	if err := ioutil.WriteFile(session, []byte(`{"bucket": "bucket", "object": "worker-1", "uri": "https://upload"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if actual := resumeTarget(session, "bucket", "worker-2"); actual != "worker-1" {
+		t.Errorf("resumeTarget() with a session of an earlier run = %v, want worker-1", actual)
+	}
+	if actual := resumeTarget(session, "other", "worker-2"); actual != "worker-2" {
+		t.Errorf("resumeTarget() with a session in another bucket = %v, want worker-2", actual)
+	}
+}
+
+func TestCopyWorker(t *testing.T) {
+	var rewrites []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/rewriteTo/"):
+			rewrites = append(rewrites, r.URL.Path+"?"+r.URL.Query().Get("rewriteToken"))
+			if len(rewrites) == 1 {
+				w.Write([]byte(`{"done": false, "rewriteToken": "more"}`))
+				return
+			}
+			w.Write([]byte(`{"done": true}`))
+		case strings.HasSuffix(r.URL.Path, "/missing"):
+			http.Error(w, `{"error": {"code": 404}}`, http.StatusNotFound)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	ctx := context.Background()
+	if err := copyWorker(ctx, client, "project", "gs://staging/worker", "gs://builds/worker"); err != nil {
+		t.Fatalf("copyWorker failed: %v", err)
+	}
+	expected := []string{
+		"/b/builds/o/worker/rewriteTo/b/staging/o/worker?",
+		"/b/builds/o/worker/rewriteTo/b/staging/o/worker?more",
+	}
+	if !reflect.DeepEqual(rewrites, expected) {
+		t.Errorf("copyWorker rewrote %q, want %q", rewrites, expected)
+	}
+
+	err = copyWorker(ctx, client, "project", "gs://staging/worker", "gs://builds/missing")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("copyWorker of a missing worker = %v, want not found", err)
+	}
+}
+
+func TestCheckObjectName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"staging/model.pb", true},
+		{"ünïcode", true},
+		{"", false},
+		{"..", false},
+		{"a\rb", false},
+		{"a[1]", false},
+		{"a#b", false},
+		{string([]byte{0xff}), false},
+		{strings.Repeat("a", 1025), false},
+	}
+	for _, test := range tests {
+		if err := CheckObjectName(test.name); (err == nil) != test.ok {
+			t.Errorf("CheckObjectName(%q) = %v, want ok=%v", test.name, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+// TailImportance is the minimum importance of the job messages that
+// TailMessages writes.
+const TailImportance = "JOB_MESSAGE_BASIC"
+
+// TailMessages writes the messages of the job to w as they are reported,
+// one per line, until the job reaches a terminal state or the context is
+// done. Messages reported before the job terminated are written before
+// TailMessages returns. Polls are spaced by the backoff strategy of the
+// context. See WithBackoff.
+func TailMessages(ctx context.Context, client *df.Service, project, region, jobID string, w io.Writer) error {
+	strategy := pollStrategy(ctx)
+	t := &tailer{client: client, project: project, region: region, jobID: jobID, w: w, seen: make(map[string]bool)}
+	for poll := 1; ; poll++ {
+		var j *df.Job
+		err := retry(ctx, "Job status poll", func() error {
+			var err error
+			j, err = getJob(ctx, client, project, region, jobID, "")
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get job %v: %v", jobID, err)
+		}
+		if err := t.tail(ctx); err != nil {
+			return err
+		}
+		if isTerminal(j.CurrentState) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(strategy.NextDelay(poll)):
+		}
+	}
+}
+
+// tailer writes new job messages.
+type tailer struct {
+	client                 *df.Service
+	project, region, jobID string
+	w                      io.Writer
+
+	start string          // time of the last written message
+	last  time.Time       // parsed start time
+	seen  map[string]bool // ids of the written messages at the start time
+}
+
+// tail writes the messages reported since the last call.
+func (t *tailer) tail(ctx context.Context) error {
+	var msgs []*df.JobMessage
+	err := retry(ctx, "Job message listing", func() error {
+		msgs = nil
+		return listJobMessages(ctx, t.client, t.project, t.region, t.jobID, TailImportance, t.start, func(resp *df.ListJobMessagesResponse) error {
+			msgs = append(msgs, resp.JobMessages...)
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list messages of job %v: %v", t.jobID, err)
+	}
+
+	for _, m := range msgs {
+		ts, _ := time.Parse(time.RFC3339Nano, m.Time)
+		if t.seen[m.Id] || ts.Before(t.last) {
+			continue
+		}
+		if !ts.Equal(t.last) {
+			t.start, t.last = m.Time, ts
+			t.seen = make(map[string]bool)
+		}
+		t.seen[m.Id] = true
+		fmt.Fprintf(t.w, "%v %v: %v\n", m.Time, strings.TrimPrefix(m.MessageImportance, "JOB_MESSAGE_"), m.MessageText)
+	}
+	return nil
+}
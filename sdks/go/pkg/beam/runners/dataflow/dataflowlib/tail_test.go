@@ -0,0 +1,84 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+func TestTailMessages(t *testing.T) {
+	msgs := []*df.JobMessage{
+		{Id: "1", Time: "2020-01-01T00:00:00Z", MessageImportance: "JOB_MESSAGE_BASIC", MessageText: "Starting"},
+		{Id: "2", Time: "2020-01-01T00:00:01.5Z", MessageImportance: "JOB_MESSAGE_WARNING", MessageText: "Slow"},
+		{Id: "3", Time: "2020-01-01T00:00:01.5Z", MessageImportance: "JOB_MESSAGE_BASIC", MessageText: "Stopping"},
+	}
+	var mu sync.Mutex
+	var polls int
+	var starts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/messages") {
+			starts = append(starts, r.URL.Query().Get("startTime"))
+			if imp := r.URL.Query().Get("minimumImportance"); imp != TailImportance {
+				t.Errorf("listed messages with importance %q, want %v", imp, TailImportance)
+			}
+			// Messages are reported over time and include earlier ones.
+			json.NewEncoder(w).Encode(&df.ListJobMessagesResponse{JobMessages: msgs[:polls]})
+			return
+		}
+		polls++
+		state := "JOB_STATE_RUNNING"
+		if polls == len(msgs) {
+			state = "JOB_STATE_DONE"
+		}
+		json.NewEncoder(w).Encode(&df.Job{Id: "job", CurrentState: state})
+	}))
+	defer srv.Close()
+
+	client, err := df.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	var buf bytes.Buffer
+	ctx := WithBackoff(context.Background(), ConstantBackoff(time.Millisecond))
+	if err := TailMessages(ctx, client, "project", "region", "job", &buf); err != nil {
+		t.Fatalf("TailMessages failed: %v", err)
+	}
+	exp := "2020-01-01T00:00:00Z BASIC: Starting\n" +
+		"2020-01-01T00:00:01.5Z WARNING: Slow\n" +
+		"2020-01-01T00:00:01.5Z BASIC: Stopping\n"
+	if buf.String() != exp {
+		t.Errorf("TailMessages wrote %q, want %q", buf.String(), exp)
+	}
+	if starts[0] != "" || starts[2] != "2020-01-01T00:00:01.5Z" {
+		t.Errorf("TailMessages listed messages from %q, want all and then since the last message", starts)
+	}
+}
@@ -0,0 +1,179 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/pipelinex"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/apache/beam/sdks/go/pkg/beam/options/gcpopts"
+	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
+	df "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/storage/v1"
+)
+
+// templateParamRe matches valid flex template parameter names.
+var templateParamRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]*$`)
+
+// FlexTemplateSpec returns a flex template spec for the pipeline, in the
+// format written by "gcloud dataflow flex-template build". The image is the
+// launcher container image, which runs the pipeline binary. The template is
+// named after the job and has the user pipeline options as optional
+// parameters, with the current values as defaults. Options that the runner
+// sets, such as the hooks configuration, are not parameters. Options under
+// the redact patterns of the job options are parameters without a default,
+// so their values are not written with the spec. The default environment is
+// derived from the job options.
+func FlexTemplateSpec(p *pb.Pipeline, opts *JobOptions, image string) (*df.ContainerSpec, error) {
+	streaming := opts.Streaming || !pipelinex.Bounded(p)
+	metadata := &df.TemplateMetadata{
+		Name:        opts.Name,
+		Description: fmt.Sprintf("Go pipeline %v", opts.Name),
+		Streaming:   streaming,
+	}
+	patterns := opts.RedactPatterns
+	if patterns == nil {
+		patterns = DefaultRedactPatterns
+	}
+	var keys []string
+	for k := range opts.Options.Options {
+		if !isRunnerOption(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		param := &df.ParameterMetadata{
+			Name:         k,
+			Label:        k,
+			HelpText:     fmt.Sprintf("Pipeline option --%v.", k),
+			IsOptional:   true,
+			DefaultValue: opts.Options.Options[k],
+		}
+		if isSensitive(k, patterns) {
+			param.DefaultValue = ""
+			param.HelpText = fmt.Sprintf("Pipeline option --%v. Sensitive, so it has no default.", k)
+		}
+		metadata.Parameters = append(metadata.Parameters, param)
+	}
+	if err := ValidateTemplateMetadata(metadata); err != nil {
+		return nil, err
+	}
+	if image == "" {
+		return nil, errors.New("no flex template launcher image specified")
+	}
+	if _, _, _, err := parseImage(image); err != nil {
+		return nil, fmt.Errorf("invalid flex template launcher image: %v", err)
+	}
+
+	env := &df.FlexTemplateRuntimeEnvironment{
+		AdditionalExperiments: opts.Experiments,
+		AdditionalUserLabels:  jobLabels(opts),
+		DiskSizeGb:            opts.DiskSizeGb,
+		EnableStreamingEngine: streaming && opts.StreamingEngine,
+		MachineType:           opts.MachineType,
+		Network:               opts.Network,
+		NumWorkers:            opts.NumWorkers,
+		TempLocation:          opts.TempLocation,
+		WorkerZone:            opts.Zone,
+	}
+	if images := pipelinex.ContainerImages(p); len(images) > 0 {
+		env.SdkContainerImage = images[0]
+	}
+
+	return &df.ContainerSpec{
+		Image:              image,
+		Metadata:           metadata,
+		SdkInfo:            &df.SDKInfo{Language: "GO"},
+		DefaultEnvironment: env,
+	}, nil
+}
+
+// isRunnerOption returns true iff the pipeline option is set by the runner or
+// the SDK, rather than by the user.
+func isRunnerOption(key string) bool {
+	switch {
+	case key == "hooks", key == workerEnvOption, key == harnessThreadsOption:
+		return true
+	case strings.HasPrefix(key, gcpopts.TempPrefixOption("")):
+		return true
+	default:
+		return false
+	}
+}
+
+// ValidateTemplateMetadata checks that the flex template metadata has the
+// fields that the service requires: a name and, for each parameter, a
+// unique valid name, a label and a help text.
+func ValidateTemplateMetadata(metadata *df.TemplateMetadata) error {
+	if metadata == nil || metadata.Name == "" {
+		return errors.New("invalid template metadata: no name")
+	}
+	seen := make(map[string]bool)
+	for _, param := range metadata.Parameters {
+		switch {
+		case !templateParamRe.MatchString(param.Name):
+			return fmt.Errorf("invalid template metadata: invalid parameter name %q", param.Name)
+		case seen[param.Name]:
+			return fmt.Errorf("invalid template metadata: duplicate parameter %v", param.Name)
+		case param.Label == "":
+			return fmt.Errorf("invalid template metadata: parameter %v has no label", param.Name)
+		case param.HelpText == "":
+			return fmt.Errorf("invalid template metadata: parameter %v has no help text", param.Name)
+		}
+		seen[param.Name] = true
+	}
+	return nil
+}
+
+// WriteFlexTemplateSpec writes the flex template spec as JSON to the given
+// GCS location, from which gcloud can run it. Sensitive values, such as of
+// labels, are redacted. See WithRedactPatterns.
+func WriteFlexTemplateSpec(ctx context.Context, spec *df.ContainerSpec, dest string) error {
+	if !strings.HasPrefix(dest, "gs://") {
+		return fmt.Errorf("invalid template location %v: must be a gs:// location", dest)
+	}
+	bucket, obj, err := gcsx.ParseObject(dest)
+	if err != nil {
+		return fmt.Errorf("invalid template location %v: %v", dest, err)
+	}
+	data, err := encodeTemplateSpec(ctx, spec)
+	if err != nil {
+		return err
+	}
+	client, err := newStorageClient(ctx, storage.DevstorageReadWriteScope)
+	if err != nil {
+		return err
+	}
+	return gcsx.WriteObject(client, bucket, obj, bytes.NewReader(data))
+}
+
+// encodeTemplateSpec returns the indented JSON encoding of the flex template
+// spec with sensitive values redacted.
+func encodeTemplateSpec(ctx context.Context, spec *df.ContainerSpec) ([]byte, error) {
+	data, err := redactIndent(ctx, spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode template spec: %v", err)
+	}
+	return data, nil
+}
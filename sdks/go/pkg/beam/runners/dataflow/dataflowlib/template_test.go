@@ -0,0 +1,120 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+func TestFlexTemplateSpec(t *testing.T) {
+	opts := &JobOptions{
+		Name:        "wordcount",
+		Project:     "project",
+		Region:      "us-central1",
+		NumWorkers:  3,
+		MachineType: "n1-standard-4",
+		Options: runtime.RawOptions{Options: map[string]string{
+			"output":        "gs://foo/out",
+			"input":         "gs://foo/in",
+			"api_key":       "s3cret",
+			"hooks":         `{"profiler":["gs://foo/profiles"]}`,
+			workerEnvOption: `{"A":"B"}`,
+		}},
+	}
+	spec, err := FlexTemplateSpec(emptyPipeline(), opts, "gcr.io/project/launcher:v1")
+	if err != nil {
+		t.Fatalf("FlexTemplateSpec failed: %v", err)
+	}
+	if spec.Image != "gcr.io/project/launcher:v1" || spec.SdkInfo.Language != "GO" {
+		t.Errorf("spec = %+v, want launcher image and GO sdk", spec)
+	}
+	if spec.Metadata.Name != "wordcount" || len(spec.Metadata.Parameters) != 3 {
+		t.Fatalf("metadata = %+v, want wordcount with 3 user parameters", spec.Metadata)
+	}
+	if p := spec.Metadata.Parameters[0]; p.Name != "api_key" || !p.IsOptional || p.DefaultValue != "" {
+		t.Errorf("parameter = %+v, want optional api_key without default", p)
+	}
+	if p := spec.Metadata.Parameters[1]; p.Name != "input" || !p.IsOptional || p.DefaultValue != "gs://foo/in" {
+		t.Errorf("parameter = %+v, want optional input with default", p)
+	}
+	if env := spec.DefaultEnvironment; env.NumWorkers != 3 || env.MachineType != "n1-standard-4" || env.SdkContainerImage != "image" {
+		t.Errorf("environment = %+v, want job options", env)
+	}
+
+	for _, image := range []string{"", "gcr.io/project/launcher@"} {
+		if _, err := FlexTemplateSpec(emptyPipeline(), opts, image); err == nil {
+			t.Errorf("FlexTemplateSpec(%q) succeeded, want error", image)
+		}
+	}
+	if _, err := FlexTemplateSpec(emptyPipeline(), &JobOptions{}, "gcr.io/project/launcher:v1"); err == nil {
+		t.Error("FlexTemplateSpec without name succeeded, want error")
+	}
+}
+
+func TestValidateTemplateMetadata(t *testing.T) {
+	tests := []struct {
+		metadata *df.TemplateMetadata
+		wantErr  bool
+	}{
+		{&df.TemplateMetadata{Name: "t"}, false},
+		{&df.TemplateMetadata{Name: "t", Parameters: []*df.ParameterMetadata{{Name: "input", Label: "Input", HelpText: "Input files."}}}, false},
+		{nil, true},
+		{&df.TemplateMetadata{}, true},
+		{&df.TemplateMetadata{Name: "t", Parameters: []*df.ParameterMetadata{{Name: "input", HelpText: "Input files."}}}, true},
+		{&df.TemplateMetadata{Name: "t", Parameters: []*df.ParameterMetadata{{Name: "input", Label: "Input"}}}, true},
+		{&df.TemplateMetadata{Name: "t", Parameters: []*df.ParameterMetadata{{Name: "1input", Label: "Input", HelpText: "Input files."}}}, true},
+		{&df.TemplateMetadata{Name: "t", Parameters: []*df.ParameterMetadata{
+			{Name: "input", Label: "Input", HelpText: "Input files."},
+			{Name: "input", Label: "Input", HelpText: "Input files."},
+		}}, true},
+	}
+	for i, test := range tests {
+		if err := ValidateTemplateMetadata(test.metadata); (err != nil) != test.wantErr {
+			t.Errorf("ValidateTemplateMetadata(#%v) = %v, want error: %v", i, err, test.wantErr)
+		}
+	}
+}
+
+func TestWriteFlexTemplateSpecLocation(t *testing.T) {
+	if err := WriteFlexTemplateSpec(context.Background(), &df.ContainerSpec{}, "/tmp/spec.json"); err == nil {
+		t.Error("WriteFlexTemplateSpec to a local path succeeded, want error")
+	}
+}
+
+func TestEncodeTemplateSpec(t *testing.T) {
+	spec := &df.ContainerSpec{
+		Image: "image",
+		DefaultEnvironment: &df.FlexTemplateRuntimeEnvironment{
+			AdditionalUserLabels: map[string]string{"team": "data", "api_token": "hunter2"},
+		},
+	}
+	data, err := encodeTemplateSpec(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("encodeTemplateSpec failed: %v", err)
+	}
+	var got df.ContainerSpec
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("encodeTemplateSpec = %s, not a spec: %v", data, err)
+	}
+	if labels := got.DefaultEnvironment.AdditionalUserLabels; labels["api_token"] != redacted || labels["team"] != "data" {
+		t.Errorf("encodeTemplateSpec labels = %v, want api_token redacted and team kept", labels)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"sort"
 
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/coder"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/mtime"
@@ -135,8 +136,14 @@ func (x *translator) translateTransform(trunk string, id string) ([]*df.Step, er
 		var steps []*df.Step
 		rem := reflectx.ShallowClone(t.Inputs).(map[string]string)
 
-		prop.NonParallelInputs = make(map[string]*outputReference)
+		var keys []string
 		for key := range payload.SideInputs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		prop.NonParallelInputs = make(map[string]*outputReference)
+		for _, key := range keys {
 			// Side input require an additional conversion step, which must
 			// be before the present one.
 			delete(rem, key)
@@ -201,8 +208,8 @@ func (x *translator) translateTransform(trunk string, id string) ([]*df.Step, er
 		return steps, nil
 
 	case graphx.URNFlatten:
-		for _, in := range t.Inputs {
-			prop.Inputs = append(prop.Inputs, x.pcollections[in])
+		for _, key := range sortedKeys(t.Inputs) {
+			prop.Inputs = append(prop.Inputs, x.pcollections[t.Inputs[key]])
 		}
 		return []*df.Step{x.newStep(id, flattenKind, prop)}, nil
 
@@ -282,7 +289,8 @@ func (x *translator) newStep(id, kind string, prop properties) *df.Step {
 
 func (x *translator) translateOutputs(outputs map[string]string) []output {
 	var ret []output
-	for _, out := range outputs {
+	for _, key := range sortedKeys(outputs) {
+		out := outputs[key]
 		pcol := x.comp.Pcollections[out]
 		ref := x.pcollections[out]
 
@@ -368,6 +376,14 @@ func userName(trunk, name string) string {
 	return fmt.Sprintf("%v%v", trunk, path.Base(name))
 }
 
+// sortedKeys returns the keys of the map in sorted order, so that
+// translation is deterministic.
+func sortedKeys(m map[string]string) []string {
+	keys := stringx.Keys(m)
+	sort.Strings(keys)
+	return keys
+}
+
 func encodeSerializedFn(in proto.Message) string {
 	// The Beam Runner API uses percent-encoding for serialized fn messages.
 	// See: https://en.wikipedia.org/wiki/Percent-encoding
@@ -0,0 +1,74 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+)
+
+// TestTranslateDeterministic verifies that translating identical inputs
+// produces byte-identical job specs.
+func TestTranslateDeterministic(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	a := beam.Impulse(s)
+	b := beam.Impulse(s)
+	c := beam.Impulse(s)
+	beam.Flatten(s, a, b, c)
+
+	edges, _, err := p.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	model, err := graphx.Marshal(edges, &graphx.Options{ContainerImageURL: "image"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Impulse and Flatten do not reference an environment.
+	model.Components.Environments = emptyPipeline().Components.Environments
+
+	opts := &JobOptions{
+		Name:    "test",
+		Project: "project",
+		Region:  "us-central1",
+		Labels:  map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"},
+		Options: runtime.RawOptions{Options: map[string]string{"x": "1", "y": "2", "z": "3"}},
+	}
+
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		job, err := Translate(model, opts, "gs://foo/worker", "gs://foo/model")
+		if err != nil {
+			t.Fatalf("Translate failed: %v", err)
+		}
+		data, err := json.Marshal(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected == nil {
+			expected = data
+			continue
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("Translate not deterministic:\n%s\nvs\n%s", data, expected)
+		}
+	}
+}
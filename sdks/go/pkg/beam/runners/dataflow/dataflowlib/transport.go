@@ -0,0 +1,93 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type transportKey struct{}
+
+// WithTransport returns a context under which the Dataflow and GCS clients
+// of the runner send requests through the given transport. The clients'
+// credentials wrap it, so it sees authenticated requests. If the transport
+// is nil, the context is returned unchanged.
+func WithTransport(ctx context.Context, rt http.RoundTripper) context.Context {
+	if rt == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, transportKey{}, rt)
+}
+
+// getTransport returns the transport of the context, if any.
+func getTransport(ctx context.Context) http.RoundTripper {
+	rt, _ := ctx.Value(transportKey{}).(http.RoundTripper)
+	return rt
+}
+
+// redactedParams are URL query parameters that carry credentials.
+var redactedParams = []string{"access_token", "key"}
+
+// LoggingTransport returns a transport that logs the method, URL, status and
+// latency of each request through the runner logger of the request context.
+// Credentials in the URL are redacted and headers are not logged. If the
+// base transport is nil, http.DefaultTransport is used.
+func LoggingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return loggingTransport{base: base}
+}
+
+type loggingTransport struct {
+	base http.RoundTripper
+}
+
+func (t loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	latency := time.Since(start)
+
+	u := redactURL(req.URL)
+	if err != nil {
+		GetLogger(ctx).Infof(ctx, "API request %v %v failed after %v: %v", req.Method, u, latency, err)
+		return resp, err
+	}
+	GetLogger(ctx).Infof(ctx, "API request %v %v: %v in %v", req.Method, u, resp.Status, latency)
+	return resp, nil
+}
+
+// redactURL returns the URL with credential query parameters redacted.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	redacted := false
+	for _, p := range redactedParams {
+		if q.Get(p) != "" {
+			q.Set(p, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
@@ -0,0 +1,68 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflowlib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoggingTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	l := &recordingLogger{}
+	ctx := WithLogger(context.Background(), l)
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1b3/projects/p/jobs?access_token=secret&view=JOB_VIEW_ALL", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	client := &http.Client{Transport: LoggingTransport(nil)}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(l.lines) != 1 {
+		t.Fatalf("logged %v, want 1 line", l.lines)
+	}
+	line := l.lines[0]
+	if !strings.Contains(line, "GET "+srv.URL+"/v1b3/projects/p/jobs?") || !strings.Contains(line, "403 Forbidden") {
+		t.Errorf("logged %q, want method, URL and status", line)
+	}
+	if strings.Contains(line, "secret") || !strings.Contains(line, "access_token=REDACTED") {
+		t.Errorf("logged %q, want redacted credentials", line)
+	}
+}
+
+func TestWithTransport(t *testing.T) {
+	ctx := context.Background()
+	if WithTransport(ctx, nil) != ctx {
+		t.Error("WithTransport(ctx, nil) changed the context")
+	}
+	rt := LoggingTransport(nil)
+	if actual := getTransport(WithTransport(ctx, rt)); actual != rt {
+		t.Errorf("getTransport(WithTransport(ctx, rt)) = %v, want %v", actual, rt)
+	}
+}
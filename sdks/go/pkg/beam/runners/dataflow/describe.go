@@ -0,0 +1,96 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+)
+
+// describe writes a table of the transforms of the model pipeline, sorted by
+// name, with their URN, input and output PCollections and the coders of the
+// outputs. Composite transforms are included.
+func describe(w io.Writer, model *pb.Pipeline) error {
+	transforms := model.GetComponents().GetTransforms()
+	pcolls := model.GetComponents().GetPcollections()
+	coders := graphx.NewCoderUnmarshaller(model.GetComponents().GetCoders())
+
+	var ids []string
+	for id := range transforms {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := transforms[ids[i]].GetUniqueName(), transforms[ids[j]].GetUniqueName()
+		if a != b {
+			return a < b
+		}
+		return ids[i] < ids[j]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TRANSFORM\tURN\tINPUTS\tOUTPUTS\tCODERS")
+	for _, id := range ids {
+		t := transforms[id]
+		outputs := sortedValues(t.GetOutputs())
+		var outCoders []string
+		for _, pc := range outputs {
+			outCoders = append(outCoders, describeCoder(coders, pcolls[pc].GetCoderId()))
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", t.GetUniqueName(), orDash(t.GetSpec().GetUrn()), orDash(strings.Join(sortedValues(t.GetInputs()), ",")), orDash(strings.Join(outputs, ",")), orDash(strings.Join(outCoders, ",")))
+	}
+	return tw.Flush()
+}
+
+// describeCoder returns the Go representation of the coder, such as
+// KV<int,string>, or its ID if it is not a Go SDK coder.
+func describeCoder(coders *graphx.CoderUnmarshaller, id string) string {
+	if id == "" {
+		return "?"
+	}
+	c, err := coders.Coder(id)
+	if err != nil {
+		return id
+	}
+	return c.String()
+}
+
+// sortedValues returns the values of the map, ordered by key.
+func sortedValues(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var ret []string
+	for _, k := range keys {
+		ret = append(ret, m[k])
+	}
+	return ret
+}
+
+// orDash returns the string, or "-" if empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+)
+
+func TestDescribe(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	beam.AddFixedKey(s.Scope("keyed"), beam.Impulse(s))
+
+	model, err := buildModel(context.Background(), p, marshalOptions(context.Background()))
+	if err != nil {
+		t.Fatalf("buildModel failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := describe(&buf, model); err != nil {
+		t.Fatalf("describe failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(model.GetComponents().GetTransforms())+1 {
+		t.Fatalf("describe() =\n%v\nwant a header and a line per transform", buf.String())
+	}
+	header := lines[0]
+	if !strings.HasPrefix(header, "TRANSFORM") || !strings.Contains(header, "URN") || !strings.HasSuffix(header, "CODERS") {
+		t.Errorf("describe() header = %q, want TRANSFORM, URN, INPUTS, OUTPUTS and CODERS columns", header)
+	}
+	col := strings.Index(header, "URN")
+	var names []string
+	for _, line := range lines[1:] {
+		if len(line) <= col || line[col-1] != ' ' || line[col] == ' ' {
+			t.Errorf("describe() line %q is not aligned with the URN column of %q", line, header)
+		}
+		names = append(names, strings.Fields(line)[0])
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i-1] > names[i] {
+			t.Errorf("describe() transforms %v are not sorted by name", names)
+		}
+	}
+	if !strings.Contains(buf.String(), "beam:transform:impulse:v1") {
+		t.Errorf("describe() =\n%v\nwant the impulse transform", buf.String())
+	}
+
+	var again bytes.Buffer
+	describe(&again, model)
+	if again.String() != buf.String() {
+		t.Errorf("describe() is not deterministic:\n%v\nvs\n%v", buf.String(), again.String())
+	}
+}
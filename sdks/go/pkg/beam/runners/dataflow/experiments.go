@@ -0,0 +1,133 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// knownExperiments are the Dataflow experiments accepted by
+// --strict_experiments, by name without any "=value" suffix. The service
+// adds experiments over time, so update the set as needed. Until then,
+// --allowed_experiment_prefixes lets new experiments through.
+var knownExperiments = map[string]bool{
+	"beam_fn_api":                            true,
+	"disable_runner_v2":                      true,
+	"disable_worker_container_image_prepull": true,
+	"enable_data_sampling":                   true,
+	"enable_execution_details_collection":    true,
+	"enable_google_cloud_heap_sampling":      true,
+	"enable_google_cloud_profiler":           true,
+	"enable_recommendations":                 true,
+	"enable_stackdriver_agent_metrics":       true,
+	"enable_streaming_engine":                true,
+	"enable_windmill_service":                true,
+	"min_cpu_platform":                       true,
+	"no_use_multiple_sdk_containers":         true,
+	"shuffle_mode":                           true,
+	"streaming":                              true,
+	"upload_graph":                           true,
+	"use_monitoring_state_manager":           true,
+	"use_network_tags":                       true,
+	"use_portable_job_submission":            true,
+	"use_runner_v2":                          true,
+	"use_sibling_sdk_workers":                true,
+	"use_unified_worker":                     true,
+	"worker_accelerator":                     true,
+}
+
+// checkExperiments returns an error listing the unknown experiments, if
+// any. Experiments with one of the allowed prefixes are always accepted.
+func checkExperiments(experiments, allowedPrefixes []string) error {
+	var unknown []string
+	for _, exp := range experiments {
+		name := exp
+		if i := strings.Index(exp, "="); i >= 0 {
+			name = exp[:i]
+		}
+		if knownExperiments[name] || hasAnyPrefix(name, allowedPrefixes) {
+			continue
+		}
+		unknown = append(unknown, exp)
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown experiments %v. Check for typos or use --allowed_experiment_prefixes to allow new experiments", unknown)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if p != "" && strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// experimentRe matches experiments of the form "name" or "name=value".
+var experimentRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*(=[^,\n]+)?$`)
+
+// readExperimentsFile reads the experiments of the given file, which holds
+// either a JSON list of strings or one experiment per line. Blank lines and
+// lines starting with "#" are ignored.
+func readExperimentsFile(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read experiments file: %v", err)
+	}
+
+	var ret []string
+	if content := strings.TrimSpace(string(data)); strings.HasPrefix(content, "[") {
+		if err := json.Unmarshal([]byte(content), &ret); err != nil {
+			return nil, fmt.Errorf("invalid experiments file %v: %v", filename, err)
+		}
+		return ret, nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ret = append(ret, line)
+	}
+	return ret, nil
+}
+
+// mergeExperiments returns the experiments of all lists in order, without
+// duplicates. It fails if an experiment is malformed.
+func mergeExperiments(lists ...[]string) ([]string, error) {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, list := range lists {
+		for _, exp := range list {
+			if !experimentRe.MatchString(exp) {
+				return nil, fmt.Errorf("invalid experiment %q: expected name or name=value", exp)
+			}
+			if !seen[exp] {
+				seen[exp] = true
+				ret = append(ret, exp)
+			}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,94 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckExperiments(t *testing.T) {
+	tests := []struct {
+		experiments, prefixes []string
+		unknown               string
+	}{
+		{nil, nil, ""},
+		{[]string{"use_runner_v2", "shuffle_mode=service", "min_cpu_platform=Intel Skylake"}, nil, ""},
+		{[]string{"use_runnerv2"}, nil, "use_runnerv2"},
+		{[]string{"use_runner_v2", "new_experiment=1"}, nil, "new_experiment=1"},
+		{[]string{"new_experiment=1"}, []string{"", "new_"}, ""},
+	}
+	for _, test := range tests {
+		err := checkExperiments(test.experiments, test.prefixes)
+		if (err == nil) != (test.unknown == "") || (err != nil && !strings.Contains(err.Error(), test.unknown)) {
+			t.Errorf("checkExperiments(%v, %v) = %v, want unknown: %q", test.experiments, test.prefixes, err, test.unknown)
+		}
+	}
+}
+
+func TestReadExperimentsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "experiments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		exp     []string
+		wantErr bool
+	}{
+		{"use_runner_v2\n\n# Rollout of 2026-10.\nshuffle_mode=service\n", []string{"use_runner_v2", "shuffle_mode=service"}, false},
+		{`["use_runner_v2", "min_cpu_platform=Intel Skylake"]`, []string{"use_runner_v2", "min_cpu_platform=Intel Skylake"}, false},
+		{`["use_runner_v2",`, nil, true},
+	}
+	for i, test := range tests {
+		filename := filepath.Join(dir, "experiments.txt")
+		if err := ioutil.WriteFile(filename, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := readExperimentsFile(filename)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("readExperimentsFile(#%v) succeeded, want error", i)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(actual, test.exp) {
+			t.Errorf("readExperimentsFile(#%v) = (%v, %v), want %v", i, actual, err, test.exp)
+		}
+	}
+	if _, err := readExperimentsFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("readExperimentsFile(missing) succeeded, want error")
+	}
+}
+
+func TestMergeExperiments(t *testing.T) {
+	actual, err := mergeExperiments([]string{"use_runner_v2", "shuffle_mode=service"}, []string{"shuffle_mode=service", "upload_graph"})
+	exp := []string{"use_runner_v2", "shuffle_mode=service", "upload_graph"}
+	if err != nil || !reflect.DeepEqual(actual, exp) {
+		t.Errorf("mergeExperiments() = (%v, %v), want %v", actual, err, exp)
+	}
+	for _, bad := range []string{"", "=value", "a,b"} {
+		if _, err := mergeExperiments([]string{bad}); err == nil {
+			t.Errorf("mergeExperiments(%q) succeeded, want error", bad)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// projectIDRe matches Google Cloud project IDs, optionally domain-scoped,
+// such as "my-project" or "example.com:my-project".
+var projectIDRe = regexp.MustCompile(`^([a-z][a-z0-9.-]*[a-z0-9]:)?[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+
+// labelValueRe matches Google Cloud label values.
+var labelValueRe = regexp.MustCompile(`^[a-z0-9_-]{1,63}$`)
+
+// newCorrelationID returns a random correlation ID, which is a valid label
+// value.
+func newCorrelationID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// stringSlice is a flag.Value for repeatable string flags.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// splitList splits a comma-separated list, trimming spaces around the
+// entries. It returns nil for the empty string.
+func splitList(list string) []string {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	ret := strings.Split(list, ",")
+	for i, s := range ret {
+		ret[i] = strings.TrimSpace(s)
+	}
+	return ret
+}
+
+// parseKeyValues parses a list of KEY=VALUE pairs into a map. Later
+// duplicate keys override earlier ones.
+func parseKeyValues(name string, list []string) (map[string]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	ret := make(map[string]string)
+	for _, kv := range list {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid --%v value %q: expected KEY=VALUE", name, kv)
+		}
+		ret[kv[:i]] = kv[i+1:]
+	}
+	return ret, nil
+}
@@ -0,0 +1,79 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/runners/dataflow/dataflowlib"
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+// followJob tails the messages of the submitted job to stderr until the job
+// terminates and returns its terminal state error, like a blocking
+// submission. An interrupt requests cancellation of the job, which is
+// followed until it is cancelled. A second interrupt stops following
+// without waiting for the job.
+func followJob(ctx context.Context, res *dataflowlib.Result, opts *dataflowlib.JobOptions, endpoint string) error {
+	client, err := dataflowlib.NewClient(ctx, endpoint, opts.Scopes...)
+	if err != nil {
+		return err
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	return followMessages(ctx, client, res, opts.Project, res.Region, res.JobID, interrupts, os.Stderr)
+}
+
+// followedJob is the submitted job that followMessages waits for and cancels.
+type followedJob interface {
+	Wait(ctx context.Context) (string, error)
+	Cancel(ctx context.Context) error
+}
+
+// followMessages tails the messages of the job to w until it terminates,
+// cancelling it on the first interrupt and giving up on the second.
+func followMessages(ctx context.Context, client *df.Service, job followedJob, project, region, jobID string, interrupts <-chan os.Signal, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-interrupts:
+		case <-ctx.Done():
+			return
+		}
+		dataflowlib.GetLogger(ctx).Warnf(ctx, "Interrupted: cancelling job %v. Interrupt again to stop following it.", jobID)
+		if err := job.Cancel(ctx); err != nil {
+			dataflowlib.GetLogger(ctx).Errorf(ctx, "Failed to cancel job %v: %v", jobID, err)
+		}
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := dataflowlib.TailMessages(ctx, client, project, region, jobID, w); err != nil {
+		return err
+	}
+	_, err := job.Wait(ctx)
+	return err
+}
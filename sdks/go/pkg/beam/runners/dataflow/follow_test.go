@@ -0,0 +1,127 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/runners/dataflow/dataflowlib"
+	df "google.golang.org/api/dataflow/v1b3"
+)
+
+// fakeFollowedJob is a running job whose cancellation the fake Dataflow
+// service of TestFollowMessages reports, if accepted.
+type fakeFollowedJob struct {
+	mu               sync.Mutex
+	accept           bool
+	cancels          int
+	cancelled, waits bool
+}
+
+func (j *fakeFollowedJob) Wait(ctx context.Context) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.waits = true
+	if j.cancelled {
+		return "JOB_STATE_CANCELLED", errors.New("job cancelled")
+	}
+	return "JOB_STATE_DONE", nil
+}
+
+func (j *fakeFollowedJob) Cancel(ctx context.Context) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cancels++
+	j.cancelled = j.accept
+	return nil
+}
+
+func (j *fakeFollowedJob) state() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cancelled {
+		return "JOB_STATE_CANCELLED"
+	}
+	return "JOB_STATE_RUNNING"
+}
+
+func TestFollowMessages(t *testing.T) {
+	tests := []struct {
+		name       string
+		accept     bool
+		interrupts int
+		err        string
+	}{
+		{"cancel", true, 1, "job cancelled"},
+		{"stop following", false, 2, "context canceled"},
+	}
+	for _, test := range tests {
+		job := &fakeFollowedJob{accept: test.accept}
+		interrupts := make(chan os.Signal, test.interrupts)
+		var polls int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if strings.HasSuffix(r.URL.Path, "/messages") {
+				json.NewEncoder(w).Encode(&df.ListJobMessagesResponse{JobMessages: []*df.JobMessage{
+					{Id: "1", Time: "2020-01-01T00:00:00Z", MessageImportance: "JOB_MESSAGE_BASIC", MessageText: "Starting"},
+				}})
+				return
+			}
+			// Interrupt once the first messages are written.
+			if atomic.AddInt32(&polls, 1) == 2 {
+				for i := 0; i < test.interrupts; i++ {
+					interrupts <- os.Interrupt
+				}
+			}
+			json.NewEncoder(w).Encode(&df.Job{Id: "job", CurrentState: job.state()})
+		}))
+
+		client, err := df.New(srv.Client())
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		client.BasePath = srv.URL + "/"
+
+		var buf bytes.Buffer
+		ctx := dataflowlib.WithBackoff(context.Background(), dataflowlib.ConstantBackoff(time.Millisecond))
+		err = followMessages(ctx, client, job, "project", "region", "job", interrupts, &buf)
+		srv.Close()
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("followMessages(%v) = %v, want error %q", test.name, err, test.err)
+		}
+		if job.cancels != 1 {
+			t.Errorf("followMessages(%v) cancelled the job %v times, want once", test.name, job.cancels)
+		}
+		if job.waits != test.accept {
+			t.Errorf("followMessages(%v) waited for the job: %v, want %v", test.name, job.waits, test.accept)
+		}
+		if exp := "2020-01-01T00:00:00Z BASIC: Starting\n"; buf.String() != exp {
+			t.Errorf("followMessages(%v) wrote %q, want %q", test.name, buf.String(), exp)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/runners/dataflow/dataflowlib"
+	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
+	"google.golang.org/api/storage/v1"
+)
+
+// gcloudConfigDir returns the gcloud configuration directory.
+func gcloudConfigDir() (string, error) {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud"), nil
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", errors.New("$HOME is not defined")
+	}
+	return filepath.Join(home, ".config", "gcloud"), nil
+}
+
+// gcloudProject returns the project of the active gcloud configuration in
+// the given configuration directory.
+func gcloudProject(dir string) (string, error) {
+	config := os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	if config == "" {
+		config = "default"
+		if data, err := ioutil.ReadFile(filepath.Join(dir, "active_config")); err == nil {
+			if name := strings.TrimSpace(string(data)); name != "" {
+				config = name
+			}
+		}
+	}
+
+	file := filepath.Join(dir, "configurations", "config_"+config)
+	fd, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read gcloud configuration %v: %v", config, err)
+	}
+	defer fd.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == "core":
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "project" {
+				if project := strings.TrimSpace(kv[1]); project != "" {
+					return project, nil
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read gcloud configuration %v: %v", config, err)
+	}
+	return "", fmt.Errorf("no project set in gcloud configuration %v. Use gcloud config set project <project>", config)
+}
+
+// defaultStagingBucket returns the conventional staging bucket of the
+// project.
+func defaultStagingBucket(project string) string {
+	return project + "-dataflow-staging"
+}
+
+// applyGcloudDefaults sets the project and staging location flags from the
+// active gcloud configuration and the staging bucket naming convention, if
+// they are not set. The staging bucket must exist. It is not created.
+func applyGcloudDefaults(ctx context.Context, project, staging *string) error {
+	if *project == "" {
+		dir, err := gcloudConfigDir()
+		if err != nil {
+			return fmt.Errorf("failed to find gcloud configuration: %v", err)
+		}
+		if *project, err = gcloudProject(dir); err != nil {
+			return err
+		}
+		dataflowlib.GetLogger(ctx).Infof(ctx, "Using project %v from gcloud configuration", *project)
+	}
+	if *staging == "" {
+		bucket := defaultStagingBucket(*project)
+		client, err := gcsx.NewClient(ctx, storage.DevstorageReadOnlyScope)
+		if err != nil {
+			return err
+		}
+		exists, err := gcsx.BucketExists(client, bucket)
+		if err != nil {
+			return fmt.Errorf("failed to check default staging bucket %v: %v", bucket, err)
+		}
+		if !exists {
+			return fmt.Errorf("default staging bucket gs://%v does not exist. Create it or use --staging_location=gs://<bucket>/<path>", bucket)
+		}
+		*staging = gcsx.MakeObject(bucket, "staging")
+		dataflowlib.GetLogger(ctx).Infof(ctx, "Using default staging location %v", *staging)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/runners/dataflow/dataflowlib"
+)
+
+// maxLabelValueLength is the maximum length of a Dataflow label value.
+const maxLabelValueLength = 63
+
+// labelsFromEnv returns job labels from a comma-separated list of
+// labelKey=ENV_VAR mappings. Missing environment variables are skipped. Keys
+// and values are sanitized, but keys must start with a letter.
+func labelsFromEnv(ctx context.Context, mappings string) (map[string]string, error) {
+	ret := make(map[string]string)
+	if mappings == "" {
+		return ret, nil
+	}
+	for _, m := range strings.Split(mappings, ",") {
+		i := strings.Index(m, "=")
+		if i <= 0 || i == len(m)-1 {
+			return nil, fmt.Errorf("invalid --labels_from_env mapping %q: expected labelKey=ENV_VAR", m)
+		}
+		key, env := sanitizeLabelValue(m[:i]), m[i+1:]
+		if key[0] < 'a' || key[0] > 'z' {
+			return nil, fmt.Errorf("invalid --labels_from_env mapping %q: label key must start with a letter", m)
+		}
+
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			dataflowlib.GetLogger(ctx).Debugf(ctx, "Environment variable %v not set. Skipping label %v", env, key)
+			continue
+		}
+		ret[key] = sanitizeLabelValue(value)
+	}
+	return ret, nil
+}
+
+// sanitizeLabelValue converts the value into a valid Dataflow label value or,
+// if it starts with a letter, key:
+// lowercase letters, digits, underscores and dashes of limited length.
+func sanitizeLabelValue(value string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(value) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	ret := b.String()
+	if len(ret) > maxLabelValueLength {
+		ret = ret[:maxLabelValueLength]
+	}
+	return ret
+}
+
+// mergeLabels merges the label maps. Later maps take precedence.
+func mergeLabels(list ...map[string]string) map[string]string {
+	var ret map[string]string
+	for _, m := range list {
+		for k, v := range m {
+			if ret == nil {
+				ret = make(map[string]string)
+			}
+			ret[k] = v
+		}
+	}
+	return ret
+}
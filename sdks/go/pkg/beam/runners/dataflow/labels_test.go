@@ -0,0 +1,91 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLabelsFromEnv(t *testing.T) {
+	os.Setenv("LABELS_TEST_BRANCH", "Feature/Foo-1")
+	os.Setenv("LABELS_TEST_EMPTY", "")
+	os.Unsetenv("LABELS_TEST_MISSING")
+	defer os.Unsetenv("LABELS_TEST_BRANCH")
+	defer os.Unsetenv("LABELS_TEST_EMPTY")
+
+	tests := []struct {
+		mappings string
+		exp      map[string]string
+	}{
+		{"", map[string]string{}},
+		{"branch=LABELS_TEST_BRANCH", map[string]string{"branch": "feature_foo-1"}},
+		{"Git.Branch=LABELS_TEST_BRANCH,empty=LABELS_TEST_EMPTY", map[string]string{"git_branch": "feature_foo-1", "empty": ""}},
+		{"missing=LABELS_TEST_MISSING", map[string]string{}},
+	}
+	for _, test := range tests {
+		actual, err := labelsFromEnv(context.Background(), test.mappings)
+		if err != nil {
+			t.Errorf("labelsFromEnv(%q) failed: %v", test.mappings, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.exp) {
+			t.Errorf("labelsFromEnv(%q) = %v, want %v", test.mappings, actual, test.exp)
+		}
+	}
+
+	for _, mappings := range []string{"branch", "=LABELS_TEST_BRANCH", "branch=", "1branch=LABELS_TEST_BRANCH", "_branch=LABELS_TEST_BRANCH"} {
+		if _, err := labelsFromEnv(context.Background(), mappings); err == nil {
+			t.Errorf("labelsFromEnv(%q) succeeded, want error", mappings)
+		}
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	tests := []struct {
+		value, exp string
+	}{
+		{"", ""},
+		{"abc-123_x", "abc-123_x"},
+		{"Release 1.2/RC", "release_1_2_rc"},
+		{"héllo", "h_llo"},
+		{strings.Repeat("a", 70), strings.Repeat("a", maxLabelValueLength)},
+	}
+	for _, test := range tests {
+		actual := sanitizeLabelValue(test.value)
+		if actual != test.exp {
+			t.Errorf("sanitizeLabelValue(%q) = %q, want %q", test.value, actual, test.exp)
+		}
+		if actual != "" && !labelValueRe.MatchString(actual) {
+			t.Errorf("sanitizeLabelValue(%q) = %q, not a valid label value", test.value, actual)
+		}
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	if actual := mergeLabels(nil, map[string]string{}); actual != nil {
+		t.Errorf("mergeLabels(empty) = %v, want nil", actual)
+	}
+	env := map[string]string{"branch": "env", "commit": "abc"}
+	explicit := map[string]string{"branch": "flag"}
+	exp := map[string]string{"branch": "flag", "commit": "abc"}
+	if actual := mergeLabels(env, explicit); !reflect.DeepEqual(actual, exp) {
+		t.Errorf("mergeLabels(%v, %v) = %v, want %v", env, explicit, actual, exp)
+	}
+}
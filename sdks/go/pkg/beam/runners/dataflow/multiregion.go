@@ -0,0 +1,219 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/apache/beam/sdks/go/pkg/beam/runners/dataflow/dataflowlib"
+	"github.com/apache/beam/sdks/go/pkg/beam/runners/universal/runnerlib"
+	"github.com/golang/protobuf/proto"
+)
+
+// RegionPlaceholder is replaced by the region in the staging and temp
+// locations of a multi-region submission, such as
+// gs://my-bucket-{region}/staging, so that each region stages to a bucket
+// in that region. Fallback regions likewise stage to their own bucket.
+const RegionPlaceholder = "{region}"
+
+// submitRegion submits the model pipeline in a single region of a
+// multi-region submission. Tests replace it.
+var submitRegion = submit
+
+// ExecuteMultiRegion builds the pipeline once and concurrently stages and
+// submits it as a separate job in each of the regions, such as for an
+// active-active deployment. The staging and temp locations may contain
+// RegionPlaceholder to stage the artifacts of each region to a bucket in
+// that region. If the job options are nil, they are populated from flags;
+// their region is ignored. With --describe, the pipeline is only described.
+//
+// It returns the results of the regions whose submission succeeded, which
+// are nil for dry runs, and an error listing the failures of all other
+// regions. Jobs already submitted in other regions are not cancelled on
+// failure. Region fallback, checksums files, --follow, --stage_only,
+// --skip_if_unchanged, --emit_gcloud_template, --dry_run_output and
+// --diff_against_job are not supported, as they assume a single job.
+func ExecuteMultiRegion(ctx context.Context, p *beam.Pipeline, opts *dataflowlib.JobOptions, regions []string) (map[string]*dataflowlib.Result, error) {
+	if err := checkRegions(regions); err != nil {
+		return nil, err
+	}
+	if *describeGraph {
+		model, err := buildModel(ctx, p, marshalOptions(ctx))
+		if err != nil {
+			return nil, err
+		}
+		return nil, describe(os.Stdout, model)
+	}
+	switch {
+	case *follow:
+		return nil, errors.New("--follow is not supported with multiple regions")
+	case *stageOnly != "":
+		return nil, errors.New("--stage_only is not supported with multiple regions")
+	case *skipUnchanged != "":
+		return nil, errors.New("--skip_if_unchanged is not supported with multiple regions")
+	case *gcloudTemplate != "":
+		return nil, errors.New("--emit_gcloud_template is not supported with multiple regions")
+	case *dryRunOutput != "":
+		return nil, errors.New("--dry_run_output is not supported with multiple regions")
+	case *diffAgainstJob != "":
+		return nil, errors.New("--diff_against_job is not supported with multiple regions")
+	}
+	if r, ok := dataflowlib.EndpointRegion(*endpoint); ok {
+		return nil, fmt.Errorf("invalid --dataflow_endpoint %v: regional endpoint of %v cannot submit to multiple regions. Use a global endpoint", *endpoint, r)
+	}
+	if opts == nil {
+		var err error
+		if opts, err = getJobOptions(ctx); err != nil {
+			return nil, err
+		}
+	} else if *stagingLocation == "" {
+		return nil, errors.New("no GCS staging location specified. Use --staging_location=gs://<bucket>/<path>")
+	}
+	if len(opts.FallbackRegions) > 0 {
+		return nil, errors.New("region fallback is not supported with multiple regions")
+	}
+	if opts.Zone != "" {
+		return nil, fmt.Errorf("invalid zone %v: a zone is in a single region", opts.Zone)
+	}
+	if opts.ChecksumsFile != "" {
+		return nil, errors.New("a checksums file is not supported with multiple regions")
+	}
+	if !strings.Contains(*stagingLocation, RegionPlaceholder) && (opts.ModelObjectName != "" || opts.WorkerObjectName != "") {
+		return nil, fmt.Errorf("fixed model or worker object names require %v in the staging location, so that the regions do not overwrite each other's artifacts", RegionPlaceholder)
+	}
+
+	model, err := buildModel(ctx, p, marshalOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the worker binary once for all regions. It must be built
+	// here, because the build finds the user main package from the call
+	// stack, which the submission goroutines lack.
+	base := *opts
+	opts = &base
+	if opts.Worker == "" {
+		if self, ok := runnerlib.IsWorkerCompatibleBinary(); ok {
+			opts.Worker = self
+		} else {
+			worker, err := runnerlib.BuildTempWorkerBinary(ctx)
+			if err != nil {
+				return nil, err
+			}
+			defer os.Remove(worker)
+			opts.Worker = worker
+		}
+	}
+
+	var mu sync.Mutex
+	results := make(map[string]*dataflowlib.Result)
+	errs := make(map[string]error)
+	var wg sync.WaitGroup
+	for _, region := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			ropts := regionOptions(opts, region)
+			res, err := submitRegion(ctx, proto.Clone(model).(*pb.Pipeline), ropts, regionLocation(*stagingLocation, region))
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[region] = err
+				return
+			}
+			results[region] = res
+		}(region)
+	}
+	wg.Wait()
+	return results, multiRegionError(regions, errs)
+}
+
+// checkRegions checks that the regions are non-empty and unique.
+func checkRegions(regions []string) error {
+	if len(regions) == 0 {
+		return errors.New("no regions to submit to")
+	}
+	seen := make(map[string]bool)
+	for _, r := range regions {
+		if r == "" {
+			return errors.New("empty region")
+		}
+		if seen[r] {
+			return fmt.Errorf("duplicate region %v", r)
+		}
+		seen[r] = true
+	}
+	return nil
+}
+
+// regionOptions returns a copy of the job options for the given region,
+// with RegionPlaceholder in the temp location replaced.
+func regionOptions(opts *dataflowlib.JobOptions, region string) *dataflowlib.JobOptions {
+	ret := *opts
+	ret.Region = region
+	ret.TempLocation = regionLocation(opts.TempLocation, region)
+	return &ret
+}
+
+// regionStaging returns the staging location of a single job with
+// RegionPlaceholder replaced by the job region, which is also replaced in
+// the temp location of the options. With fallback regions, the options then
+// restage the artifacts under the staging location of each fallback region.
+func regionStaging(staging string, opts *dataflowlib.JobOptions) string {
+	if !strings.Contains(staging, RegionPlaceholder) {
+		return staging
+	}
+	opts.TempLocation = regionLocation(opts.TempLocation, opts.Region)
+	if len(opts.FallbackRegions) > 0 {
+		opts.FallbackStagingURLs = func(region string) (string, string, error) {
+			return stagingURLs(regionLocation(staging, region), opts)
+		}
+	}
+	return regionLocation(staging, opts.Region)
+}
+
+// regionLocation returns the location with RegionPlaceholder replaced by the
+// region.
+func regionLocation(location, region string) string {
+	return strings.Replace(location, RegionPlaceholder, region, -1)
+}
+
+// multiRegionError returns an error listing the submission errors by region,
+// or nil if there are none.
+func multiRegionError(regions []string, errs map[string]error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	var failed []string
+	for r := range errs {
+		failed = append(failed, r)
+	}
+	sort.Strings(failed)
+	var msgs []string
+	for _, r := range failed {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", r, errs[r]))
+	}
+	return fmt.Errorf("submission failed in %v of %v regions: %v", len(failed), len(regions), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,124 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/pipeline_v1"
+	"github.com/apache/beam/sdks/go/pkg/beam/runners/dataflow/dataflowlib"
+)
+
+func TestExecuteMultiRegion(t *testing.T) {
+	defer func(old func(context.Context, *pb.Pipeline, *dataflowlib.JobOptions, string) (*dataflowlib.Result, error)) {
+		submitRegion = old
+	}(submitRegion)
+	defer func(old string) { *stagingLocation = old }(*stagingLocation)
+	*stagingLocation = "gs://staging-{region}/staging"
+
+	var mu sync.Mutex
+	staged := make(map[string]string)
+	temps := make(map[string]string)
+	workers := make(map[string]bool)
+	submitRegion = func(ctx context.Context, model *pb.Pipeline, opts *dataflowlib.JobOptions, staging string) (*dataflowlib.Result, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		staged[opts.Region] = staging
+		temps[opts.Region] = opts.TempLocation
+		workers[opts.Worker] = true
+		if opts.Region == "asia-east1" {
+			return nil, errors.New("out of capacity")
+		}
+		return &dataflowlib.Result{JobID: "job-" + opts.Region, Region: opts.Region}, nil
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	beam.AddFixedKey(s, beam.Impulse(s))
+	opts := &dataflowlib.JobOptions{Name: "job", Project: "project", Region: "us-central1", TempLocation: "gs://temp-{region}/tmp"}
+	regions := []string{"us-east1", "europe-west1", "asia-east1"}
+
+	results, err := ExecuteMultiRegion(context.Background(), p, opts, regions)
+	if err == nil || !strings.Contains(err.Error(), "submission failed in 1 of 3 regions: asia-east1: out of capacity") {
+		t.Errorf("ExecuteMultiRegion() = %v, want asia-east1 failure", err)
+	}
+	if len(results) != 2 || results["us-east1"].JobID != "job-us-east1" || results["europe-west1"].JobID != "job-europe-west1" {
+		t.Errorf("ExecuteMultiRegion() = %v, want results of us-east1 and europe-west1", results)
+	}
+	wantStaged := map[string]string{
+		"us-east1":     "gs://staging-us-east1/staging",
+		"europe-west1": "gs://staging-europe-west1/staging",
+		"asia-east1":   "gs://staging-asia-east1/staging",
+	}
+	if !reflect.DeepEqual(staged, wantStaged) {
+		t.Errorf("ExecuteMultiRegion() staged to %v, want %v", staged, wantStaged)
+	}
+	if got, want := temps["europe-west1"], "gs://temp-europe-west1/tmp"; got != want {
+		t.Errorf("ExecuteMultiRegion() temp location of europe-west1 = %v, want %v", got, want)
+	}
+	if len(workers) != 1 || workers[""] {
+		t.Errorf("ExecuteMultiRegion() submitted with worker binaries %v, want one resolved binary", workers)
+	}
+	if opts.Region != "us-central1" || opts.TempLocation != "gs://temp-{region}/tmp" || opts.Worker != "" {
+		t.Errorf("ExecuteMultiRegion() modified the given options: %v, %v, %v", opts.Region, opts.TempLocation, opts.Worker)
+	}
+
+	for _, f := range []*string{gcloudTemplate, dryRunOutput, diffAgainstJob} {
+		*f = "out"
+		_, err := ExecuteMultiRegion(context.Background(), p, opts, regions)
+		*f = ""
+		if err == nil || !strings.Contains(err.Error(), "not supported with multiple regions") {
+			t.Errorf("ExecuteMultiRegion() with single-output flag = %v, want error", err)
+		}
+	}
+
+	for _, bad := range [][]string{nil, {"us-east1", "us-east1"}, {""}} {
+		if _, err := ExecuteMultiRegion(context.Background(), p, opts, bad); err == nil {
+			t.Errorf("ExecuteMultiRegion(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestRegionStaging(t *testing.T) {
+	opts := &dataflowlib.JobOptions{Region: "us-central1", TempLocation: "gs://tmp-{region}/tmp"}
+	if actual := regionStaging("gs://staging/path", opts); actual != "gs://staging/path" || opts.TempLocation != "gs://tmp-{region}/tmp" {
+		t.Errorf("regionStaging(gs://staging/path) = (%v, %v), want unchanged", actual, opts.TempLocation)
+	}
+	if actual := regionStaging("gs://staging-{region}/path", opts); actual != "gs://staging-us-central1/path" || opts.TempLocation != "gs://tmp-us-central1/tmp" {
+		t.Errorf("regionStaging(gs://staging-{region}/path) = (%v, %v), want the job region", actual, opts.TempLocation)
+	}
+	if opts.FallbackStagingURLs != nil {
+		t.Error("regionStaging set fallback staging locations without fallback regions")
+	}
+
+	opts.FallbackRegions = []string{"europe-west1"}
+	regionStaging("gs://staging-{region}/path", opts)
+	if opts.FallbackStagingURLs == nil {
+		t.Fatal("regionStaging set no fallback staging locations")
+	}
+	modelURL, workerURL, err := opts.FallbackStagingURLs("europe-west1")
+	if err != nil {
+		t.Fatalf("FallbackStagingURLs failed: %v", err)
+	}
+	if !strings.HasPrefix(modelURL, "gs://staging-europe-west1/path/model-") || !strings.HasPrefix(workerURL, "gs://staging-europe-west1/path/worker-") {
+		t.Errorf("FallbackStagingURLs(europe-west1) = (%v, %v), want locations in the region", modelURL, workerURL)
+	}
+}
@@ -0,0 +1,52 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"sort"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/graphx"
+)
+
+// findDuplicateNames returns the fully-qualified transform names, such as
+// "beam.Create/main.fn", that are used by more than one transform or
+// composite in the same scope. The names are sorted.
+func findDuplicateNames(edges []*graph.MultiEdge) []string {
+	counts := make(map[string]int)
+
+	var walk func(prefix string, t *graphx.ScopeTree)
+	walk = func(prefix string, t *graphx.ScopeTree) {
+		for _, edge := range t.Edges {
+			counts[prefix+edge.Name]++
+		}
+		for _, child := range t.Children {
+			name := prefix + child.Scope.Name
+			counts[name]++
+			walk(name+"/", child)
+		}
+	}
+	walk("", graphx.NewScopeTree(edges))
+
+	var ret []string
+	for name, n := range counts {
+		if n > 1 {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,64 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/profiler"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/util/hooks"
+	"github.com/apache/beam/sdks/go/pkg/beam/log"
+)
+
+// cloudProfilerHook is the name of the hook that starts the Cloud Profiler
+// agent on workers. It takes the profiler service name and project as
+// arguments.
+const cloudProfilerHook = "cloud_profiler"
+
+func init() {
+	hooks.RegisterHook(cloudProfilerHook, newCloudProfilerHook)
+}
+
+// newCloudProfilerHook returns the Cloud Profiler hook for the service name
+// and project arguments.
+func newCloudProfilerHook(opts []string) hooks.Hook {
+	if len(opts) != 2 {
+		return hooks.Hook{
+			Init: func(ctx context.Context) (context.Context, error) {
+				return ctx, fmt.Errorf("invalid %v hook arguments %q: want service name and project", cloudProfilerHook, opts)
+			},
+		}
+	}
+	cfg := profiler.Config{Service: opts[0], ProjectID: opts[1]}
+	return hooks.Hook{
+		Init: func(ctx context.Context) (context.Context, error) {
+			// Profiling is best effort and must not fail the worker.
+			if err := profiler.Start(cfg); err != nil {
+				log.Warnf(ctx, "Failed to start Cloud Profiler agent for service %v: %v", cfg.Service, err)
+			}
+			return ctx, nil
+		},
+	}
+}
+
+// enableCloudProfiler enables the Cloud Profiler agent on workers, reporting
+// under the job name as service name. The Cloud Profiler API must be enabled
+// in the project and the worker service account must be allowed to write
+// profiles (roles/cloudprofiler.agent).
+func enableCloudProfiler(name, project string) error {
+	return hooks.EnableHook(cloudProfilerHook, name, project)
+}
@@ -0,0 +1,103 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/util/reflectx"
+)
+
+// findUnregistered returns the struct DoFn types and named element types of
+// the pipeline that are not registered with the runtime, such as
+// "type main.T". Workers fail to deserialize them. Functions are not
+// checked: they resolve through the symbol table, so registering them is
+// only a performance aid. Standard library types are skipped. The names are
+// sorted.
+func findUnregistered(edges []*graph.MultiEdge) []string {
+	missing := make(map[string]bool)
+
+	checkFn := func(fn *graph.Fn) {
+		if fn.Recv != nil {
+			checkType(missing, reflect.TypeOf(fn.Recv))
+		}
+	}
+
+	for _, edge := range edges {
+		if edge.DoFn != nil {
+			checkFn((*graph.Fn)(edge.DoFn))
+		}
+		if edge.CombineFn != nil {
+			checkFn((*graph.Fn)(edge.CombineFn))
+		}
+		for _, in := range edge.Input {
+			checkFullType(missing, in.From.Type())
+		}
+		for _, out := range edge.Output {
+			checkFullType(missing, out.To.Type())
+		}
+	}
+
+	var ret []string
+	for name := range missing {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func checkFullType(missing map[string]bool, t typex.FullType) {
+	if typex.ClassOf(t.Type()) == typex.Concrete {
+		checkType(missing, t.Type())
+	}
+	for _, c := range t.Components() {
+		checkFullType(missing, c)
+	}
+}
+
+// checkType records the named user types of the given type, including
+// element types, that are not registered.
+func checkType(missing map[string]bool, t reflect.Type) {
+	t = reflectx.SkipPtr(t)
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		checkType(missing, t.Elem())
+		return
+	case reflect.Map:
+		checkType(missing, t.Key())
+		checkType(missing, t.Elem())
+		return
+	}
+
+	k, ok := runtime.TypeKey(t)
+	if !ok || isStandardPackage(t.PkgPath()) {
+		return
+	}
+	if _, ok := runtime.LookupType(k); !ok {
+		missing["type "+k] = true
+	}
+}
+
+// isStandardPackage returns true iff the package is likely part of the
+// standard library, whose import paths have no domain.
+func isStandardPackage(pkg string) bool {
+	return pkg != "main" && !strings.Contains(strings.SplitN(pkg, "/", 2)[0], ".")
+}
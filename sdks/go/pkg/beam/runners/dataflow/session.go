@@ -0,0 +1,203 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/harness"
+	"github.com/apache/beam/sdks/go/pkg/beam/util/gcsx"
+	"google.golang.org/api/storage/v1"
+)
+
+// sessionCaptureHook is the name of the session capture hook that writes
+// session transcripts to GCS in chunks. It takes the GCS location, whether
+// to gzip the chunks and the chunk name template as arguments.
+const sessionCaptureHook = "gcs_session_writer"
+
+// DefaultSessionChunkTemplate is the default name template of session
+// transcript chunks.
+const DefaultSessionChunkTemplate = "transcript-%05d"
+
+// chunkTemplateRe matches chunk name templates with a single zero-padded
+// chunk number verb, such as "transcript-%05d.log".
+var chunkTemplateRe = regexp.MustCompile(`^([^%/]|%%)*%0[1-9][0-9]*d([^%/]|%%)*$`)
+
+// sessionChunkBytes is the approximate size of each transcript chunk. With
+// gzip, it applies to the compressed bytes.
+var sessionChunkBytes = 50 << 20
+
+func init() {
+	harness.RegisterCaptureHook(sessionCaptureHook, func(opts []string) harness.CaptureHook {
+		if err := checkSessionHookArgs(opts); err != nil {
+			panic(err.Error())
+		}
+		bucket, prefix, err := gcsx.ParseObject(opts[0])
+		if err != nil {
+			panic(fmt.Sprintf("Invalid hook configuration for %v: %s", sessionCaptureHook, opts))
+		}
+		gz, _ := strconv.ParseBool(opts[1])
+		template := DefaultSessionChunkTemplate
+		if len(opts) > 2 {
+			template = opts[2]
+		}
+		worker, err := os.Hostname()
+		if err != nil {
+			worker = fmt.Sprintf("pid%v", os.Getpid())
+		}
+		return newSessionWriter(path.Join(prefix, worker), template, gz, func(name, encoding string, data []byte) error {
+			client, err := gcsx.NewClient(context.Background(), storage.DevstorageReadWriteScope)
+			if err != nil {
+				return fmt.Errorf("couldn't establish GCS client: %v", err)
+			}
+			obj := &storage.Object{Bucket: bucket, Name: name, ContentEncoding: encoding}
+			_, err = client.Objects.Insert(bucket, obj).Media(bytes.NewReader(data)).Do()
+			return err
+		})
+	})
+}
+
+// checkSessionHookArgs checks the arguments of the session capture hook: the
+// GCS location, whether to gzip and, optionally, the chunk name template.
+func checkSessionHookArgs(opts []string) error {
+	if len(opts) < 2 || len(opts) > 3 {
+		return fmt.Errorf("invalid %v hook arguments %q: want GCS location, gzip and an optional chunk template", sessionCaptureHook, opts)
+	}
+	return nil
+}
+
+// enableSessionRecording enables session transcripts to be recorded on
+// workers. Each worker writes its transcript to the GCS location under
+// <worker>/ in chunks of about sessionChunkBytes, so that the whole
+// transcript is not held in memory. The chunks are named after the template,
+// such as transcript-NNNNN by default. See checkChunkTemplate.
+//
+// If gzipped, each chunk is a separate gzip stream with Content-Encoding
+// gzip. To read back the transcript, concatenate the chunks in name order
+// and decompress the result, which is a multi-member gzip stream that
+// gzip.NewReader and gunzip read in full. Note that tools that honor the
+// content encoding, such as gsutil cp, decompress each chunk on download
+// already.
+func enableSessionRecording(location, template string, gz bool) error {
+	if !strings.HasPrefix(location, "gs://") {
+		return fmt.Errorf("invalid --session_recording %v: not a gs:// location", location)
+	}
+	if err := checkChunkTemplate(template); err != nil {
+		return err
+	}
+	harness.EnableCaptureHook(sessionCaptureHook, []string{location, strconv.FormatBool(gz), template})
+	return nil
+}
+
+// checkChunkTemplate checks that the chunk name template has exactly one
+// zero-padded decimal verb for the chunk number, such as %05d, and no
+// slashes, so that the names are unique and sort lexically in chunk order.
+// Names sort in order up to the padded width only, such as 100000 chunks
+// for %05d.
+func checkChunkTemplate(template string) error {
+	if !chunkTemplateRe.MatchString(template) {
+		return fmt.Errorf("invalid session chunk name template %q: want a single zero-padded chunk number, such as transcript-%%05d.log", template)
+	}
+	return nil
+}
+
+// sessionWriter is a harness.CaptureHook that buffers the session
+// transcript and writes it out in numbered chunks.
+type sessionWriter struct {
+	prefix   string
+	template string
+	write    func(name, encoding string, data []byte) error
+
+	buf   bytes.Buffer
+	zw    *gzip.Writer
+	n     int // uncompressed bytes written to the current chunk
+	next  int // uncompressed bytes at which to check the compressed size
+	chunk int
+}
+
+func newSessionWriter(prefix, template string, gz bool, write func(name, encoding string, data []byte) error) *sessionWriter {
+	w := &sessionWriter{prefix: prefix, template: template, write: write}
+	if gz {
+		w.zw = gzip.NewWriter(&w.buf)
+	}
+	return w
+}
+
+func (w *sessionWriter) Write(p []byte) (int, error) {
+	var err error
+	if w.zw != nil {
+		_, err = w.zw.Write(p)
+	} else {
+		_, err = w.buf.Write(p)
+	}
+	if err != nil {
+		return 0, err
+	}
+	w.n += len(p)
+	if w.zw != nil && w.n >= w.next {
+		// The compressor buffers its output, so flush it to measure the
+		// compressed size. Compressed bytes do not outgrow uncompressed
+		// bytes much, so the next check is at least the remaining chunk
+		// size away.
+		if err := w.zw.Flush(); err != nil {
+			return 0, err
+		}
+		w.next = w.n + sessionChunkBytes - w.buf.Len()
+	}
+	if w.buf.Len() >= sessionChunkBytes {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes out the last chunk.
+func (w *sessionWriter) Close() error {
+	if w.n == 0 {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *sessionWriter) flush() error {
+	encoding := ""
+	if w.zw != nil {
+		if err := w.zw.Close(); err != nil {
+			return err
+		}
+		encoding = "gzip"
+	}
+	name := path.Join(w.prefix, fmt.Sprintf(w.template, w.chunk))
+	if err := w.write(name, encoding, w.buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write session chunk %v: %v", name, err)
+	}
+	w.buf.Reset()
+	if w.zw != nil {
+		w.zw.Reset(&w.buf)
+	}
+	w.n, w.next = 0, 0
+	w.chunk++
+	return nil
+}
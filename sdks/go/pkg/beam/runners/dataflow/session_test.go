@@ -0,0 +1,115 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSessionWriter(t *testing.T) {
+	defer func(n int) { sessionChunkBytes = n }(sessionChunkBytes)
+	sessionChunkBytes = 100
+
+	// Use incompressible data, so that gzipped chunks are split as well.
+	rnd := rand.New(rand.NewSource(1))
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		sb.WriteByte(byte('a' + rnd.Intn(26)))
+	}
+	transcript := sb.String()
+	for _, gz := range []bool{false, true} {
+		var names []string
+		var all bytes.Buffer
+		w := newSessionWriter("prefix/worker", DefaultSessionChunkTemplate, gz, func(name, encoding string, data []byte) error {
+			if (encoding == "gzip") != gz {
+				t.Errorf("chunk %v has encoding %q, want gzip: %v", name, encoding, gz)
+			}
+			names = append(names, name)
+			all.Write(data)
+			return nil
+		})
+		for i := 0; i < len(transcript); i += 10 {
+			if _, err := w.Write([]byte(transcript[i : i+10])); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		if len(names) < 2 || names[0] != "prefix/worker/transcript-00000" {
+			t.Errorf("gzip %v: wrote chunks %v, want several numbered chunks", gz, names)
+		}
+		data := all.Bytes()
+		if gz {
+			r, err := gzip.NewReader(&all)
+			if err != nil {
+				t.Fatalf("invalid gzip chunks: %v", err)
+			}
+			if data, err = ioutil.ReadAll(r); err != nil {
+				t.Fatalf("invalid gzip chunks: %v", err)
+			}
+		}
+		if string(data) != transcript {
+			t.Errorf("gzip %v: chunks = %q, want the transcript", gz, data)
+		}
+	}
+}
+
+func TestCheckChunkTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{DefaultSessionChunkTemplate, true},
+		{"transcript-%05d.log", true},
+		{"100%%-%08d", true},
+		{"transcript-%d", false},
+		{"transcript-%5d", false},
+		{"transcript", false},
+		{"%05d-%05d", false},
+		{"chunks/%05d", false},
+		{"transcript-%05s", false},
+	}
+	for _, test := range tests {
+		if err := checkChunkTemplate(test.template); (err == nil) != test.valid {
+			t.Errorf("checkChunkTemplate(%q) = %v, want valid: %v", test.template, err, test.valid)
+		}
+	}
+}
+
+func TestCheckSessionHookArgs(t *testing.T) {
+	tests := []struct {
+		opts    []string
+		wantErr bool
+	}{
+		{nil, true},
+		{[]string{"gs://foo/sessions"}, true},
+		{[]string{"gs://foo/sessions", "true"}, false},
+		{[]string{"gs://foo/sessions", "true", "chunk-%03d"}, false},
+		{[]string{"gs://foo/sessions", "true", "chunk-%03d", "extra"}, true},
+	}
+	for _, test := range tests {
+		if err := checkSessionHookArgs(test.opts); (err != nil) != test.wantErr {
+			t.Errorf("checkSessionHookArgs(%q) = %v, want error: %v", test.opts, err, test.wantErr)
+		}
+	}
+}
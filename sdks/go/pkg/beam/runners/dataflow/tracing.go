@@ -0,0 +1,119 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataflow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"runtime/trace"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/util/hooks"
+	"github.com/apache/beam/sdks/go/pkg/beam/log"
+)
+
+// executionTraceHook is the name of the hook that periodically records
+// runtime/trace execution traces on workers. It takes the GCS location, the
+// interval and the trace duration as arguments.
+const executionTraceHook = "execution_trace"
+
+func init() {
+	hooks.RegisterHook(executionTraceHook, newExecutionTraceHook)
+}
+
+// newExecutionTraceHook returns the execution trace hook for the location,
+// interval and duration arguments.
+func newExecutionTraceHook(opts []string) hooks.Hook {
+	return hooks.Hook{
+		Init: func(ctx context.Context) (context.Context, error) {
+			if len(opts) != 3 {
+				return ctx, fmt.Errorf("invalid %v hook arguments %q: want GCS location, interval and duration", executionTraceHook, opts)
+			}
+			interval, err := time.ParseDuration(opts[1])
+			if err != nil {
+				return ctx, fmt.Errorf("invalid execution trace interval %v: %v", opts[1], err)
+			}
+			duration, err := time.ParseDuration(opts[2])
+			if err != nil {
+				return ctx, fmt.Errorf("invalid execution trace duration %v: %v", opts[2], err)
+			}
+			go recordExecutionTraces(ctx, opts[0], interval, duration)
+			return ctx, nil
+		},
+	}
+}
+
+// enableExecutionTracing enables execution traces of the given duration to
+// be recorded on workers once per interval. Traces are written to the GCS
+// location under execution_trace/<worker>/, apart from CPU and heap
+// profiles.
+//
+// Execution tracing slows down the worker noticeably while a trace is
+// recorded and traces of busy workers are large, so the duration should be
+// a small fraction of the interval.
+func enableExecutionTracing(location string, interval, duration time.Duration) error {
+	if duration <= 0 || duration > interval {
+		return fmt.Errorf("invalid execution trace duration %v: must be positive and at most the interval %v", duration, interval)
+	}
+	return hooks.EnableHook(executionTraceHook, location, interval.String(), duration.String())
+}
+
+// recordExecutionTraces records an execution trace every interval until the
+// context is done. Tracing is best effort and never fails the worker.
+func recordExecutionTraces(ctx context.Context, location string, interval, duration time.Duration) {
+	worker, err := os.Hostname()
+	if err != nil {
+		worker = fmt.Sprintf("pid%v", os.Getpid())
+	}
+	write := gcsRecorderHook([]string{location})
+
+	for {
+		var buf bytes.Buffer
+		if err := trace.Start(&buf); err != nil {
+			// Another trace, such as from the trace hook, is in progress.
+			log.Warnf(ctx, "Failed to start execution trace: %v", err)
+		} else {
+			start := time.Now()
+			sleep(ctx, duration)
+			trace.Stop()
+
+			name := path.Join(executionTraceHook, worker, fmt.Sprintf("%v.trace", start.UnixNano()))
+			if err := write(ctx, name, &buf); err != nil {
+				log.Warnf(ctx, "Failed to write execution trace %v: %v", name, err)
+			}
+		}
+		if !sleep(ctx, interval-duration) {
+			return
+		}
+	}
+}
+
+// sleep waits for the duration. It returns false if the context is done
+// first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
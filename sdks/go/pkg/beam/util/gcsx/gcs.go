@@ -55,6 +55,12 @@ func NewUnauthenticatedClient(ctx context.Context) (*storage.Service, error) {
 // Upload writes the given content to GCS. If the specified bucket does not
 // exist, it is created first. Returns the full path of the object.
 func Upload(client *storage.Service, project, bucket, object string, r io.Reader) (string, error) {
+	return UploadWithContentType(client, project, bucket, object, "", r)
+}
+
+// UploadWithContentType is like Upload, but sets the content type of the
+// object. If the content type is empty, it is detected from the content.
+func UploadWithContentType(client *storage.Service, project, bucket, object, contentType string, r io.Reader) (string, error) {
 	exists, err := BucketExists(client, bucket)
 	if err != nil {
 		return "", err
@@ -65,7 +71,7 @@ func Upload(client *storage.Service, project, bucket, object string, r io.Reader
 		}
 	}
 
-	if err := WriteObject(client, bucket, object, r); err != nil {
+	if err := WriteObjectWithContentType(client, bucket, object, contentType, r); err != nil {
 		return "", err
 	}
 	return fmt.Sprintf("gs://%s/%s", bucket, object), nil
@@ -92,14 +98,43 @@ func BucketExists(client *storage.Service, bucket string) (bool, error) {
 // WriteObject writes the given content to the specified object. If the object
 // already exist, it is overwritten.
 func WriteObject(client *storage.Service, bucket, object string, r io.Reader) error {
-	obj := &storage.Object{
-		Name:   object,
-		Bucket: bucket,
+	return WriteObjectWithContentType(client, bucket, object, "", r)
+}
+
+// WriteObjectWithContentType is like WriteObject, but sets the content type
+// of the object. If the content type is empty, it is detected from the content.
+func WriteObjectWithContentType(client *storage.Service, bucket, object, contentType string, r io.Reader) error {
+	return WriteObjectWithAttrs(client, &storage.Object{
+		Name:        object,
+		Bucket:      bucket,
+		ContentType: contentType,
+	}, r)
+}
+
+// WriteObjectWithAttrs is like WriteObject, but writes the object with the
+// given metadata, such as the content type and storage class. The metadata
+// must name the bucket and object.
+func WriteObjectWithAttrs(client *storage.Service, obj *storage.Object, r io.Reader) error {
+	var opts []googleapi.MediaOption
+	if obj.ContentType != "" {
+		opts = append(opts, googleapi.ContentType(obj.ContentType))
 	}
-	_, err := client.Objects.Insert(bucket, obj).Media(r).Do()
+	_, err := client.Objects.Insert(obj.Bucket, obj).Media(r, opts...).Do()
 	return err
 }
 
+// DeleteObjects deletes all objects with the given prefix in the bucket.
+func DeleteObjects(ctx context.Context, client *storage.Service, bucket, prefix string) error {
+	return client.Objects.List(bucket).Prefix(prefix).Pages(ctx, func(list *storage.Objects) error {
+		for _, obj := range list.Items {
+			if err := client.Objects.Delete(bucket, obj.Name).Do(); err != nil {
+				return fmt.Errorf("failed to delete gs://%v/%v: %v", bucket, obj.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
 // ReadObject reads the content of the given object in full.
 func ReadObject(client *storage.Service, bucket, object string) ([]byte, error) {
 	resp, err := client.Objects.Get(bucket, object).Download()
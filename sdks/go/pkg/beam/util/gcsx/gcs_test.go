@@ -0,0 +1,83 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/storage/v1"
+)
+
+func TestWriteObjectWithContentType(t *testing.T) {
+	var meta storage.Object
+	var mediaType string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Errorf("bad request content type: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Errorf("missing metadata part: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(part).Decode(&meta); err != nil {
+			t.Errorf("bad metadata part: %v", err)
+		}
+		part, err = mr.NextPart()
+		if err != nil {
+			t.Errorf("missing media part: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mediaType = part.Header.Get("Content-Type")
+		ioutil.ReadAll(part)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	client, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.BasePath = srv.URL + "/"
+
+	const ct = "application/octet-stream"
+	if err := WriteObjectWithContentType(client, "bucket", "worker", ct, strings.NewReader("#!/bin/sh\n")); err != nil {
+		t.Fatalf("WriteObjectWithContentType failed: %v", err)
+	}
+	if meta.ContentType != ct {
+		t.Errorf("object metadata content type = %q, want %q", meta.ContentType, ct)
+	}
+	if mediaType != ct {
+		t.Errorf("media content type = %q, want %q", mediaType, ct)
+	}
+}
@@ -0,0 +1,243 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+// uploadBasePath is the GCS JSON API endpoint for media uploads.
+var uploadBasePath = "https://storage.googleapis.com/upload/storage/v1/"
+
+// chunkSize is the number of bytes sent per resumable upload request. The
+// service commits whole chunks only, so it must be a multiple of 256 KiB.
+var chunkSize int64 = 8 << 20
+
+// uploadSession is the persisted state of a resumable upload.
+type uploadSession struct {
+	Bucket string `json:"bucket"`
+	Object string `json:"object"`
+	URI    string `json:"uri"`
+}
+
+// ResumableUpload writes size bytes of content to the specified object using
+// the GCS resumable upload protocol. The bucket must exist. If the content
+// type is empty, it is detected from the content.
+//
+// The upload session URI is persisted in sessionFile, if non-empty, so that
+// a later call for the same object resumes an interrupted upload from the
+// last committed offset. If the session cannot be resumed, such as if it has
+// expired, the content is uploaded in full. The session file is removed once
+// the upload completes.
+func ResumableUpload(ctx context.Context, client *http.Client, bucket, object, contentType string, r io.ReaderAt, size int64, sessionFile string) error {
+	return ResumableUploadWithAttrs(ctx, client, &storage.Object{Name: object, Bucket: bucket, ContentType: contentType}, r, size, sessionFile)
+}
+
+// ResumableUploadWithAttrs is like ResumableUpload, but writes the object
+// with the given metadata, such as the content type and storage class. The
+// metadata must name the bucket and object.
+func ResumableUploadWithAttrs(ctx context.Context, client *http.Client, attrs *storage.Object, r io.ReaderAt, size int64, sessionFile string) error {
+	bucket, object := attrs.Bucket, attrs.Name
+
+	var offset int64
+	uri := loadSession(sessionFile, bucket, object)
+	if uri != "" {
+		off, done, err := querySession(ctx, client, uri, size)
+		switch {
+		case err != nil:
+			uri = "" // cannot resume: upload in full
+		case done:
+			os.Remove(sessionFile)
+			return nil
+		default:
+			offset = off
+		}
+	}
+	if uri == "" {
+		var err error
+		uri, err = startSession(ctx, client, attrs, size)
+		if err != nil {
+			return err
+		}
+		// Persisting the session is best effort. If it fails, a retry
+		// merely uploads the content in full.
+		saveSession(sessionFile, uploadSession{Bucket: bucket, Object: object, URI: uri})
+	}
+
+	for {
+		n := chunkSize
+		if size-offset < n {
+			n = size - offset
+		}
+		req, err := http.NewRequest(http.MethodPut, uri, io.NewSectionReader(r, offset, n))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = n
+		if n == 0 {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes */%v", size))
+		} else {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", offset, offset+n-1, size))
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		off, done, err := sessionStatus(resp)
+		if err != nil {
+			return err
+		}
+		if done {
+			os.Remove(sessionFile)
+			return nil
+		}
+		offset = off
+	}
+}
+
+// startSession initiates a resumable upload and returns the session URI.
+func startSession(ctx context.Context, client *http.Client, attrs *storage.Object, size int64) (string, error) {
+	bucket, object, contentType := attrs.Bucket, attrs.Name, attrs.ContentType
+	meta, err := json.Marshal(attrs)
+	if err != nil {
+		return "", err
+	}
+	u := fmt.Sprintf("%vb/%v/o?uploadType=resumable&name=%v", uploadBasePath, url.PathEscape(bucket), url.QueryEscape(object))
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(meta))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	if contentType != "" {
+		req.Header.Set("X-Upload-Content-Type", contentType)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer closeResponse(resp)
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", err
+	}
+	uri := resp.Header.Get("Location")
+	if uri == "" {
+		return "", fmt.Errorf("no session URI for resumable upload of gs://%v/%v", bucket, object)
+	}
+	return uri, nil
+}
+
+// querySession returns the committed offset of the upload session, or
+// whether the upload has already completed.
+func querySession(ctx context.Context, client *http.Client, uri string, size int64) (int64, bool, error) {
+	req, err := http.NewRequest(http.MethodPut, uri, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%v", size))
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, false, err
+	}
+	return sessionStatus(resp)
+}
+
+// sessionStatus interprets a response of an upload session. It returns the
+// committed offset if the upload is incomplete, or true if it is complete.
+// The response is closed.
+func sessionStatus(resp *http.Response) (int64, bool, error) {
+	defer closeResponse(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return 0, true, nil
+	case http.StatusPermanentRedirect:
+		// Range is "bytes=0-N" for the committed bytes, or absent if none.
+		rng := resp.Header.Get("Range")
+		if rng == "" {
+			return 0, false, nil
+		}
+		last, err := strconv.ParseInt(rng[strings.LastIndex(rng, "-")+1:], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid committed range %q", rng)
+		}
+		return last + 1, false, nil
+	default:
+		return 0, false, googleapi.CheckResponse(resp)
+	}
+}
+
+// loadSession returns the persisted session URI for the object, if any.
+func loadSession(file, bucket, object string) string {
+	if file == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	var s uploadSession
+	if err := json.Unmarshal(data, &s); err != nil || s.Bucket != bucket || s.Object != object {
+		return ""
+	}
+	return s.URI
+}
+
+// SessionObject returns the bucket and object of the upload session persisted
+// in the session file, if any, such as of an upload interrupted in an earlier
+// process.
+func SessionObject(file string) (bucket, object string, ok bool) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", "", false
+	}
+	var s uploadSession
+	if err := json.Unmarshal(data, &s); err != nil || s.URI == "" {
+		return "", "", false
+	}
+	return s.Bucket, s.Object, true
+}
+
+// saveSession persists the session, if a file is given.
+func saveSession(file string, s uploadSession) error {
+	if file == "" {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0600)
+}
+
+func closeResponse(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
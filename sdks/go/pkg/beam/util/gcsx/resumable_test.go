@@ -0,0 +1,165 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeUploadServer implements the GCS resumable upload protocol for a single
+// session.
+type fakeUploadServer struct {
+	t      *testing.T
+	data   []byte
+	starts int
+	fail   int // chunk request to fail, if positive
+	chunks int
+}
+
+func (f *fakeUploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/b/bucket/o"):
+		f.starts++
+		f.data = nil
+		w.Header().Set("Location", "http://"+r.Host+"/session")
+		return
+	case r.Method == http.MethodPut && r.URL.Path == "/session":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var start, end, size int64
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes */%d", &size); err == nil {
+		// Status query.
+	} else if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		if f.chunks++; f.chunks == f.fail {
+			http.Error(w, "backend error", http.StatusServiceUnavailable)
+			return
+		}
+		if start != int64(len(f.data)) || end-start+1 != int64(len(body)) {
+			f.t.Errorf("chunk %v-%v of %v bytes, want start %v", start, end, len(body), len(f.data))
+			http.Error(w, "bad range", http.StatusBadRequest)
+			return
+		}
+		f.data = append(f.data, body...)
+	} else {
+		http.Error(w, "bad content range", http.StatusBadRequest)
+		return
+	}
+
+	if int64(len(f.data)) == size {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if len(f.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%v", len(f.data)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func setupResumable(t *testing.T, f *fakeUploadServer) (*httptest.Server, string, func()) {
+	srv := httptest.NewServer(f)
+	dir, err := ioutil.TempDir("", "gcsx")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	oldBase, oldChunk := uploadBasePath, chunkSize
+	uploadBasePath, chunkSize = srv.URL+"/upload/", 4
+
+	return srv, filepath.Join(dir, "session.json"), func() {
+		uploadBasePath, chunkSize = oldBase, oldChunk
+		os.RemoveAll(dir)
+		srv.Close()
+	}
+}
+
+func TestResumableUploadResume(t *testing.T) {
+	f := &fakeUploadServer{t: t, fail: 2}
+	srv, session, cleanup := setupResumable(t, f)
+	defer cleanup()
+
+	ctx := context.Background()
+	content := []byte("0123456789")
+
+	// The second chunk fails, which leaves 4 bytes committed.
+	if err := ResumableUpload(ctx, srv.Client(), "bucket", "worker", "", bytes.NewReader(content), int64(len(content)), session); err == nil {
+		t.Fatalf("ResumableUpload succeeded, want failure of the second chunk")
+	}
+	if _, err := os.Stat(session); err != nil {
+		t.Fatalf("session file not persisted: %v", err)
+	}
+	if bucket, object, ok := SessionObject(session); !ok || bucket != "bucket" || object != "worker" {
+		t.Errorf("SessionObject() = (%v, %v, %v), want (bucket, worker, true)", bucket, object, ok)
+	}
+
+	if err := ResumableUpload(ctx, srv.Client(), "bucket", "worker", "", bytes.NewReader(content), int64(len(content)), session); err != nil {
+		t.Fatalf("ResumableUpload failed: %v", err)
+	}
+	if f.starts != 1 {
+		t.Errorf("started %v upload sessions, want 1", f.starts)
+	}
+	if f.chunks != 4 {
+		t.Errorf("sent %v chunks, want 4", f.chunks)
+	}
+	if !bytes.Equal(f.data, content) {
+		t.Errorf("uploaded %q, want %q", f.data, content)
+	}
+	if _, err := os.Stat(session); !os.IsNotExist(err) {
+		t.Errorf("session file not removed after upload: %v", err)
+	}
+	if _, _, ok := SessionObject(session); ok {
+		t.Error("SessionObject() found a session after the upload completed")
+	}
+}
+
+func TestResumableUploadRestart(t *testing.T) {
+	f := &fakeUploadServer{t: t}
+	srv, session, cleanup := setupResumable(t, f)
+	defer cleanup()
+
+	// A session for another object is not resumed, nor is an expired one.
+	for _, s := range []uploadSession{
+		{Bucket: "bucket", Object: "other", URI: srv.URL + "/session"},
+		{Bucket: "bucket", Object: "worker", URI: srv.URL + "/expired"},
+	} {
+		f.starts, f.data = 0, []byte("xxxx")
+		if err := saveSession(session, s); err != nil {
+			t.Fatalf("failed to save session: %v", err)
+		}
+
+		content := []byte("0123456789")
+		if err := ResumableUpload(context.Background(), srv.Client(), "bucket", "worker", "", bytes.NewReader(content), int64(len(content)), session); err != nil {
+			t.Fatalf("ResumableUpload(%v) failed: %v", s, err)
+		}
+		if f.starts != 1 {
+			t.Errorf("ResumableUpload(%v) started %v upload sessions, want 1", s, f.starts)
+		}
+		if !bytes.Equal(f.data, content) {
+			t.Errorf("ResumableUpload(%v) uploaded %q, want %q", s, f.data, content)
+		}
+	}
+}
@@ -33,6 +33,7 @@ import (
 // The type of trace can be determined by the prefix of the string.
 //
 // * prof: A profile compatible with traces produced by runtime/pprof
+// * heap_prof: A heap profile compatible with runtime/pprof
 // * trace: A trace compatible with traces produced by runtime/trace
 type CaptureHook func(context.Context, string, io.Reader) error
 
@@ -73,6 +74,31 @@ func init() {
 	}
 	hooks.RegisterHook("prof", hf)
 
+	hf = func(opts []string) hooks.Hook {
+		enabledHeapCaptureHooks = opts
+		enabled := len(enabledHeapCaptureHooks) > 0
+		var heapProfBuf bytes.Buffer
+		return hooks.Hook{
+			Resp: func(ctx context.Context, req *fnpb.InstructionRequest, _ *fnpb.InstructionResponse) error {
+				if !enabled || req.GetProcessBundle() == nil {
+					return nil
+				}
+				heapProfBuf.Reset()
+				if err := pprof.WriteHeapProfile(&heapProfBuf); err != nil {
+					return err
+				}
+				for _, h := range enabledHeapCaptureHooks {
+					name, opts := hooks.Decode(h)
+					if err := heapCaptureHookRegistry[name](opts)(ctx, fmt.Sprintf("heap_prof%s", req.InstructionId), bytes.NewReader(heapProfBuf.Bytes())); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}
+	}
+	hooks.RegisterHook("heap", hf)
+
 	hf = func(opts []string) hooks.Hook {
 		var traceProfBuf bytes.Buffer
 		enabledTraceCaptureHooks = opts
@@ -136,6 +162,39 @@ func EnableProfCaptureHook(name string, opts ...string) {
 	hooks.EnableHook("prof", enabledProfCaptureHooks...)
 }
 
+var heapCaptureHookRegistry = make(map[string]CaptureHookFactory)
+var enabledHeapCaptureHooks []string
+
+// RegisterHeapCaptureHook registers a CaptureHookFactory for the
+// supplied identifier. It panics if the same identifier is
+// registered twice.
+func RegisterHeapCaptureHook(name string, c CaptureHookFactory) {
+	if _, exists := heapCaptureHookRegistry[name]; exists {
+		panic(fmt.Sprintf("RegisterHeapCaptureHook: %s registered twice", name))
+	}
+	heapCaptureHookRegistry[name] = c
+}
+
+// EnableHeapCaptureHook actives a registered heap profile capture hook for a given pipeline.
+func EnableHeapCaptureHook(name string, opts ...string) {
+	if _, exists := heapCaptureHookRegistry[name]; !exists {
+		panic(fmt.Sprintf("EnableHeapCaptureHook: %s not registered", name))
+	}
+
+	enc := hooks.Encode(name, opts)
+	for i, h := range enabledHeapCaptureHooks {
+		n, _ := hooks.Decode(h)
+		if h == n {
+			// Rewrite the registration with the current arguments
+			enabledHeapCaptureHooks[i] = enc
+			hooks.EnableHook("heap", enabledHeapCaptureHooks...)
+			return
+		}
+	}
+	enabledHeapCaptureHooks = append(enabledHeapCaptureHooks, enc)
+	hooks.EnableHook("heap", enabledHeapCaptureHooks...)
+}
+
 var traceCaptureHookRegistry = make(map[string]CaptureHookFactory)
 var enabledTraceCaptureHooks []string
 
@@ -168,3 +227,14 @@ func EnableTraceCaptureHook(name string, opts ...string) {
 	enabledTraceCaptureHooks = append(enabledTraceCaptureHooks, enc)
 	hooks.EnableHook("trace", enabledTraceCaptureHooks...)
 }
+
+// DisableCaptureHooks disables all profile, heap profile and trace capture
+// hooks, so that no profiling hooks are serialized into the pipeline options.
+func DisableCaptureHooks() {
+	enabledProfCaptureHooks = nil
+	enabledHeapCaptureHooks = nil
+	enabledTraceCaptureHooks = nil
+	for _, name := range []string{"prof", "heap", "trace"} {
+		hooks.DisableHook(name)
+	}
+}